@@ -0,0 +1,122 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// blobKeyPattern - Keys are lowercase SHA-256 hex digests, which also keeps them safe as file names
+var blobKeyPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// BlobStore - Raw storage for content-addressed objects. Put replaces any existing object
+// atomically, so a reader sees either the old bytes or the new ones.
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error) // ErrBlobNotFound if the key was never stored
+}
+
+// NewBlobStoreFromEnv - Picks the backend from BLOB_STORE ("postgres", the default, or
+// "filesystem", rooted at BLOB_STORE_PATH)
+func NewBlobStoreFromEnv(db *sql.DB) (BlobStore, error) {
+	switch backend := os.Getenv("BLOB_STORE"); backend {
+	case "", "postgres":
+		return &PostgresBlobStore{DB: db}, nil
+	case "filesystem":
+		root := os.Getenv("BLOB_STORE_PATH")
+		if root == "" {
+			root = "blobs"
+		}
+		if err := os.MkdirAll(root, 0o755); err != nil {
+			return nil, err
+		}
+		return &FileBlobStore{Root: root}, nil
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q", backend)
+	}
+}
+
+// PostgresBlobStore - Keeps objects in the blob_data table
+type PostgresBlobStore struct {
+	DB *sql.DB
+}
+
+func (s *PostgresBlobStore) Put(key string, data []byte) error {
+	query := `
+		INSERT INTO blob_data (hash, data)
+		VALUES ($1, $2)
+		ON CONFLICT (hash) DO UPDATE SET data = EXCLUDED.data
+	`
+	_, err := s.DB.Exec(query, key, data)
+	return err
+}
+
+func (s *PostgresBlobStore) Get(key string) ([]byte, error) {
+	var data []byte
+	err := s.DB.QueryRow(`SELECT data FROM blob_data WHERE hash = $1`, key).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+// FileBlobStore - Keeps objects as files under Root, fanned out by the first two hex digits
+type FileBlobStore struct {
+	Root string
+}
+
+func (s *FileBlobStore) path(key string) (string, error) {
+	if !blobKeyPattern.MatchString(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.Root, key[:2], key[2:]), nil
+}
+
+func (s *FileBlobStore) Put(key string, data []byte) error {
+	target, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it into place so the replace is atomic
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), target)
+}
+
+func (s *FileBlobStore) Get(key string) ([]byte, error) {
+	target, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
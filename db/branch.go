@@ -0,0 +1,737 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultBranch - Every project has this branch; it has no row in the branches table
+const DefaultBranch = "main"
+
+// maxBranchDepth - Guards ref resolution against a corrupted parent chain
+const maxBranchDepth = 64
+
+// deletedRefSeparator - Deleted branches keep their history under "name~branch-id". Ref names
+// can't contain it, so no branch or tag can take an archived name.
+const deletedRefSeparator = "~"
+
+var (
+	ErrRefNotFound          = errors.New("branch or tag not found")
+	ErrRefExists            = errors.New("a branch or tag with this name already exists")
+	ErrDefaultBranch        = errors.New("the default branch cannot be changed")
+	ErrBranchHasChildren    = errors.New("branch has branches forked from it")
+	ErrBranchNotMerged      = errors.New("branch has versions that are not merged")
+	ErrBranchTagged         = errors.New("branch has versions that are tagged")
+	ErrNothingToFastForward = errors.New("branch has no new versions")
+)
+
+// BranchDivergedError - Files changed on both a branch and its parent since the branch was forked
+type BranchDivergedError struct {
+	Files []string
+}
+
+func (e *BranchDivergedError) Error() string {
+	return fmt.Sprintf("branch and parent both changed %d files: %s", len(e.Files), strings.Join(e.Files, ", "))
+}
+
+type Branch struct {
+	ID        uuid.UUID `json:"id"`
+	ProjectID uuid.UUID `json:"project_id"`
+	Name      string    `json:"name"`
+	Parent    string    `json:"parent"`
+	ForkedAt  time.Time `json:"forked_at"` // parent versions committed after this are not seen by the branch
+	CreatedBy uuid.UUID `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Tag struct {
+	ID        uuid.UUID `json:"id"`
+	ProjectID uuid.UUID `json:"project_id"`
+	Name      string    `json:"name"`
+	Branch    string    `json:"branch"` // branch the tag was taken from
+	Message   string    `json:"message"`
+	FileCount int       `json:"file_count"`
+	CreatedBy uuid.UUID `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Ref - A resolved branch or tag. A branch sees its own versions plus the versions each
+// ancestor had when the branch below it was forked. A tag pins one version per file.
+type Ref struct {
+	Name   string
+	Branch string     // the branch itself, or the branch a tag was taken from
+	TagID  *uuid.UUID // set for tags, which are read-only
+	chain  []refLevel
+}
+
+type refLevel struct {
+	branch string
+	cutoff *time.Time // nil for the branch itself
+}
+
+// DefaultRef - The default branch, which needs no lookup
+func DefaultRef() *Ref {
+	return &Ref{
+		Name:   DefaultBranch,
+		Branch: DefaultBranch,
+		chain:  []refLevel{{branch: DefaultBranch}},
+	}
+}
+
+// IsTag - Whether the ref is a tag rather than a branch
+func (r *Ref) IsTag() bool {
+	return r.TagID != nil
+}
+
+// condition - SQL filter for the file_versions rows visible through the ref, with its
+// placeholders numbered from next. A nil ref means the default branch.
+func (r *Ref) condition(next int) (string, []interface{}) {
+	if r == nil {
+		r = DefaultRef()
+	}
+
+	if r.TagID != nil {
+		return "id IN (SELECT version_id FROM tag_files WHERE tag_id = $" + strconv.Itoa(next) + ")", []interface{}{*r.TagID}
+	}
+
+	var parts []string
+	var args []interface{}
+	for _, level := range r.chain {
+		if level.cutoff == nil {
+			parts = append(parts, "branch = $"+strconv.Itoa(next))
+			args = append(args, level.branch)
+			next++
+			continue
+		}
+		parts = append(parts, "(branch = $"+strconv.Itoa(next)+" AND branch_since <= $"+strconv.Itoa(next+1)+")")
+		args = append(args, level.branch, *level.cutoff)
+		next += 2
+	}
+	return "(" + strings.Join(parts, " OR ") + ")", args
+}
+
+type BranchModel struct {
+	DB *sql.DB
+}
+
+// ResolveRef - Looks up a branch or tag by name; an empty name is the default branch
+func (m *BranchModel) ResolveRef(projectID uuid.UUID, name string) (*Ref, error) {
+	if name == "" || name == DefaultBranch {
+		return DefaultRef(), nil
+	}
+
+	branch, err := m.GetBranch(projectID, name)
+	if err == nil {
+		return m.branchRef(branch)
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	tag, err := m.GetTag(projectID, name)
+	if err == sql.ErrNoRows {
+		return nil, ErrRefNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ref{Name: tag.Name, Branch: tag.Branch, TagID: &tag.ID}, nil
+}
+
+// branchRef - Walks up the parents of a branch to the default branch
+func (m *BranchModel) branchRef(branch *Branch) (*Ref, error) {
+	ref := &Ref{
+		Name:   branch.Name,
+		Branch: branch.Name,
+		chain:  []refLevel{{branch: branch.Name}},
+	}
+
+	current := branch
+	for depth := 0; ; depth++ {
+		if depth >= maxBranchDepth {
+			return nil, fmt.Errorf("branch %s: parent chain is deeper than %d", branch.Name, maxBranchDepth)
+		}
+
+		cutoff := current.ForkedAt
+		ref.chain = append(ref.chain, refLevel{branch: current.Parent, cutoff: &cutoff})
+		if current.Parent == DefaultBranch {
+			return ref, nil
+		}
+
+		parent, err := m.GetBranch(branch.ProjectID, current.Parent)
+		if err != nil {
+			return nil, err
+		}
+		current = parent
+	}
+}
+
+// GetBranch - Gets a branch by name. The default branch has no row and is not found here.
+func (m *BranchModel) GetBranch(projectID uuid.UUID, name string) (*Branch, error) {
+	query := `
+		SELECT id, project_id, name, parent, forked_at, created_by, created_at
+		FROM branches
+		WHERE project_id = $1 AND name = $2 AND deleted_at IS NULL
+	`
+
+	var b Branch
+	err := m.DB.QueryRow(query, projectID, name).Scan(
+		&b.ID, &b.ProjectID, &b.Name, &b.Parent, &b.ForkedAt, &b.CreatedBy, &b.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &b, nil
+}
+
+// GetProjectBranches - Gets every branch of a project except the default branch
+func (m *BranchModel) GetProjectBranches(projectID uuid.UUID) ([]Branch, error) {
+	query := `
+		SELECT id, project_id, name, parent, forked_at, created_by, created_at
+		FROM branches
+		WHERE project_id = $1 AND deleted_at IS NULL
+		ORDER BY name
+	`
+
+	rows, err := m.DB.Query(query, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var branches []Branch
+	for rows.Next() {
+		var b Branch
+		err := rows.Scan(&b.ID, &b.ProjectID, &b.Name, &b.Parent, &b.ForkedAt, &b.CreatedBy, &b.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		branches = append(branches, b)
+	}
+
+	return branches, nil
+}
+
+// lockRefs - Serializes branch and tag changes within a project
+func lockRefs(tx *sql.Tx, projectID uuid.UUID) error {
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, "refs/"+projectID.String())
+	return err
+}
+
+// refNameTaken - Branches and tags share one namespace so a name always resolves to one ref
+func refNameTaken(tx *sql.Tx, projectID uuid.UUID, name string) (bool, error) {
+	if name == DefaultBranch {
+		return true, nil
+	}
+
+	var taken bool
+	err := tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM branches WHERE project_id = $1 AND name = $2)
+			OR EXISTS (SELECT 1 FROM tags WHERE project_id = $1 AND name = $2)
+	`, projectID, name).Scan(&taken)
+	return taken, err
+}
+
+// CreateBranch - Forks a new branch from a parent branch as it is now
+func (m *BranchModel) CreateBranch(projectID, userID uuid.UUID, name, parent string) (*Branch, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := lockRefs(tx, projectID); err != nil {
+		return nil, err
+	}
+
+	taken, err := refNameTaken(tx, projectID, name)
+	if err != nil {
+		return nil, err
+	}
+	if taken {
+		return nil, ErrRefExists
+	}
+
+	if parent != DefaultBranch {
+		var exists bool
+		err := tx.QueryRow(
+			`SELECT EXISTS (SELECT 1 FROM branches WHERE project_id = $1 AND name = $2)`,
+			projectID, parent,
+		).Scan(&exists)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrRefNotFound
+		}
+	}
+
+	query := `
+		INSERT INTO branches (id, project_id, name, parent, forked_at, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, project_id, name, parent, forked_at, created_by, created_at
+	`
+
+	now := time.Now()
+	var b Branch
+	err = tx.QueryRow(query, uuid.New(), projectID, name, parent, now, userID, now).Scan(
+		&b.ID, &b.ProjectID, &b.Name, &b.Parent, &b.ForkedAt, &b.CreatedBy, &b.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &b, nil
+}
+
+// DeleteBranch - Deletes a branch ref. Its versions, changesets and conflicts are kept under an
+// archived name, so version IDs, changesets and history stay valid. Unless forced, a branch with
+// unmerged versions is kept. Returns the archived name and the number of versions archived.
+func (m *BranchModel) DeleteBranch(projectID uuid.UUID, name string, force bool) (string, int64, error) {
+	if name == DefaultBranch {
+		return "", 0, ErrDefaultBranch
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+
+	if err := lockRefs(tx, projectID); err != nil {
+		return "", 0, err
+	}
+
+	branchID, err := checkBranchDeletable(tx, projectID, name, force)
+	if err != nil {
+		return "", 0, err
+	}
+
+	now := time.Now()
+	archived := name + deletedRefSeparator + branchID.String()
+
+	// Conflicts on the branch can no longer be resolved there
+	_, err = tx.Exec(`
+		UPDATE file_conflicts SET status = 'ignored', resolved_at = $1
+		WHERE project_id = $2 AND branch = $3 AND status = 'pending'
+	`, now, projectID, name)
+	if err != nil {
+		return "", 0, err
+	}
+
+	result, err := tx.Exec(`UPDATE file_versions SET branch = $1 WHERE project_id = $2 AND branch = $3`, archived, projectID, name)
+	if err != nil {
+		return "", 0, err
+	}
+	archivedVersions, err := result.RowsAffected()
+	if err != nil {
+		return "", 0, err
+	}
+
+	for _, table := range []string{"changesets", "file_conflicts"} {
+		if _, err := tx.Exec(`UPDATE `+table+` SET branch = $1 WHERE project_id = $2 AND branch = $3`, archived, projectID, name); err != nil {
+			return "", 0, err
+		}
+	}
+
+	// Commits that haven't reached GitHub yet would recreate the branch there
+	_, err = tx.Exec(`
+		DELETE FROM github_sync_jobs
+		WHERE project_id = $1 AND branch = $2 AND status IN ($3, $4)
+	`, projectID, name, SyncPending, SyncFailed)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if _, err := tx.Exec(`UPDATE branches SET name = $1, deleted_at = $2 WHERE id = $3`, archived, now, branchID); err != nil {
+		return "", 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", 0, err
+	}
+
+	return archived, archivedVersions, nil
+}
+
+// checkBranchDeletable - Returns the ID of a branch that can be deleted
+func checkBranchDeletable(tx *sql.Tx, projectID uuid.UUID, name string, force bool) (uuid.UUID, error) {
+	var branchID uuid.UUID
+	var hasChildren, hasVersions, tagged bool
+	err := tx.QueryRow(`
+		SELECT
+			b.id,
+			EXISTS (SELECT 1 FROM branches WHERE project_id = $1 AND parent = $2 AND deleted_at IS NULL),
+			EXISTS (SELECT 1 FROM file_versions WHERE project_id = $1 AND branch = $2),
+			EXISTS (
+				SELECT 1 FROM tag_files tf
+				JOIN file_versions fv ON fv.id = tf.version_id
+				WHERE fv.project_id = $1 AND fv.branch = $2
+			)
+		FROM branches b
+		WHERE b.project_id = $1 AND b.name = $2 AND b.deleted_at IS NULL
+	`, projectID, name).Scan(&branchID, &hasChildren, &hasVersions, &tagged)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, ErrRefNotFound
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	switch {
+	case hasChildren:
+		return uuid.Nil, ErrBranchHasChildren
+	case tagged:
+		return uuid.Nil, ErrBranchTagged
+	case hasVersions && !force:
+		return uuid.Nil, ErrBranchNotMerged
+	}
+	return branchID, nil
+}
+
+// FastForward - Moves a branch's versions and changesets onto its parent. Only allowed when the
+// parent has not changed any of the branch's files since the fork, so the parent ends up with
+// exactly the branch's content for them. The branch stays, forked again from the updated parent.
+// The parent's new content is queued for GitHub as one commit. Returns the paths that moved.
+func (m *BranchModel) FastForward(projectID, userID uuid.UUID, name string) (*Branch, []string, error) {
+	if name == DefaultBranch {
+		return nil, nil, ErrDefaultBranch
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	if err := lockRefs(tx, projectID); err != nil {
+		return nil, nil, err
+	}
+
+	var b Branch
+	err = tx.QueryRow(`
+		SELECT id, project_id, name, parent, forked_at, created_by, created_at
+		FROM branches
+		WHERE project_id = $1 AND name = $2 AND deleted_at IS NULL
+		FOR UPDATE
+	`, projectID, name).Scan(&b.ID, &b.ProjectID, &b.Name, &b.Parent, &b.ForkedAt, &b.CreatedBy, &b.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrRefNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Branches forked from this one would start seeing the moved versions as their parent's
+	var hasChildren bool
+	err = tx.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM branches WHERE project_id = $1 AND parent = $2 AND deleted_at IS NULL)`,
+		projectID, name,
+	).Scan(&hasChildren)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hasChildren {
+		return nil, nil, ErrBranchHasChildren
+	}
+
+	paths, err := queryStrings(tx, `
+		SELECT DISTINCT file_path FROM file_versions
+		WHERE project_id = $1 AND branch = $2
+		ORDER BY file_path
+	`, projectID, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(paths) == 0 {
+		return nil, nil, ErrNothingToFastForward
+	}
+
+	diverged, err := queryStrings(tx, `
+		SELECT DISTINCT p.file_path FROM file_versions p
+		WHERE p.project_id = $1 AND p.branch = $2 AND p.branch_since > $3
+			AND EXISTS (
+				SELECT 1 FROM file_versions c
+				WHERE c.project_id = $1 AND c.branch = $4 AND c.file_path = p.file_path
+			)
+		ORDER BY p.file_path
+	`, projectID, b.Parent, b.ForkedAt, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(diverged) > 0 {
+		return nil, nil, &BranchDivergedError{Files: diverged}
+	}
+
+	// The moved versions join the parent now, so branches already forked from it don't see them
+	now := time.Now()
+	_, err = tx.Exec(`
+		UPDATE file_versions SET branch = $1, branch_since = $2
+		WHERE project_id = $3 AND branch = $4
+	`, b.Parent, now, projectID, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = tx.Exec(`UPDATE changesets SET branch = $1 WHERE project_id = $2 AND branch = $3`, b.Parent, projectID, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := enqueueMergeSync(tx, projectID, userID, b.Parent, name, now); err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := tx.Exec(`UPDATE branches SET forked_at = $1 WHERE id = $2`, now, b.ID); err != nil {
+		return nil, nil, err
+	}
+	b.ForkedAt = now
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	return &b, paths, nil
+}
+
+// GetFastForwardedVersions - The newest version of each file a fast-forward moved onto a branch at
+// the given time, without content
+func (m *VersionModel) GetFastForwardedVersions(projectID uuid.UUID, branch string, at time.Time) ([]FileVersion, error) {
+	rows, err := m.DB.Query(`
+		SELECT DISTINCT ON (file_path) id, project_id, user_id, file_path, file_name, file_type, version,
+			file_hash, file_size, commit_message, is_deleted, is_binary, changeset_id, branch, created_at
+		FROM file_versions
+		WHERE project_id = $1 AND branch = $2 AND branch_since = $3
+		ORDER BY file_path, version DESC
+	`, projectID, branch, at)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []FileVersion
+	for rows.Next() {
+		var fv FileVersion
+		err := rows.Scan(
+			&fv.ID, &fv.ProjectID, &fv.UserID, &fv.FilePath, &fv.FileName,
+			&fv.FileType, &fv.Version, &fv.FileHash, &fv.FileSize,
+			&fv.CommitMsg, &fv.IsDeleted, &fv.IsBinary, &fv.ChangesetID, &fv.Branch, &fv.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, fv)
+	}
+
+	return versions, rows.Err()
+}
+
+func queryStrings(q querier, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// Tag Methods
+
+// CreateTag - Pins the latest version of every file visible through a branch under a name
+func (m *BranchModel) CreateTag(projectID, userID uuid.UUID, name string, ref *Ref, message string) (*Tag, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := lockRefs(tx, projectID); err != nil {
+		return nil, err
+	}
+
+	taken, err := refNameTaken(tx, projectID, name)
+	if err != nil {
+		return nil, err
+	}
+	if taken {
+		return nil, ErrRefExists
+	}
+
+	query := `
+		INSERT INTO tags (id, project_id, name, branch, message, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, project_id, name, branch, message, created_by, created_at
+	`
+
+	var t Tag
+	err = tx.QueryRow(query, uuid.New(), projectID, name, ref.Branch, message, userID, time.Now()).Scan(
+		&t.ID, &t.ProjectID, &t.Name, &t.Branch, &t.Message, &t.CreatedBy, &t.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	cond, args := ref.condition(3)
+	result, err := tx.Exec(`
+		INSERT INTO tag_files (tag_id, file_path, version_id)
+		SELECT $1, file_path, id FROM (
+			SELECT DISTINCT ON (file_path) file_path, id, is_deleted
+			FROM file_versions
+			WHERE project_id = $2 AND `+cond+`
+			ORDER BY file_path, version DESC
+		) latest
+		WHERE NOT is_deleted
+	`, append([]interface{}{t.ID, projectID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	files, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	t.FileCount = int(files)
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// GetTag - Gets a tag by name
+func (m *BranchModel) GetTag(projectID uuid.UUID, name string) (*Tag, error) {
+	query := `
+		SELECT t.id, t.project_id, t.name, t.branch, COALESCE(t.message, ''), t.created_by, t.created_at,
+			(SELECT COUNT(*) FROM tag_files tf WHERE tf.tag_id = t.id)
+		FROM tags t
+		WHERE t.project_id = $1 AND t.name = $2
+	`
+
+	var t Tag
+	err := m.DB.QueryRow(query, projectID, name).Scan(
+		&t.ID, &t.ProjectID, &t.Name, &t.Branch, &t.Message, &t.CreatedBy, &t.CreatedAt, &t.FileCount,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// GetProjectTags - Gets every tag of a project, newest first
+func (m *BranchModel) GetProjectTags(projectID uuid.UUID) ([]Tag, error) {
+	query := `
+		SELECT t.id, t.project_id, t.name, t.branch, COALESCE(t.message, ''), t.created_by, t.created_at,
+			(SELECT COUNT(*) FROM tag_files tf WHERE tf.tag_id = t.id)
+		FROM tags t
+		WHERE t.project_id = $1
+		ORDER BY t.created_at DESC
+	`
+
+	rows, err := m.DB.Query(query, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []Tag
+	for rows.Next() {
+		var t Tag
+		err := rows.Scan(&t.ID, &t.ProjectID, &t.Name, &t.Branch, &t.Message, &t.CreatedBy, &t.CreatedAt, &t.FileCount)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+
+	return tags, nil
+}
+
+// DeleteTag - Deletes a tag; the versions it pinned are kept
+func (m *BranchModel) DeleteTag(projectID uuid.UUID, name string) error {
+	result, err := m.DB.Exec(`DELETE FROM tags WHERE project_id = $1 AND name = $2`, projectID, name)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRefNotFound
+	}
+
+	return nil
+}
+
+// InitBranchTables - Creates the branch and tag tables and puts existing versions on the default branch
+func InitBranchTables() error {
+	query := `
+	ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS branch TEXT NOT NULL DEFAULT 'main';
+	ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS branch_since TIMESTAMP;
+	UPDATE file_versions SET branch_since = created_at WHERE branch_since IS NULL;
+	CREATE INDEX IF NOT EXISTS idx_file_versions_branch ON file_versions(project_id, branch, file_path, version DESC);
+
+	ALTER TABLE file_conflicts ADD COLUMN IF NOT EXISTS branch TEXT NOT NULL DEFAULT 'main';
+	ALTER TABLE changesets ADD COLUMN IF NOT EXISTS branch TEXT NOT NULL DEFAULT 'main';
+
+	CREATE TABLE IF NOT EXISTS branches (
+		id UUID PRIMARY KEY,
+		project_id UUID REFERENCES projects(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		parent TEXT NOT NULL,
+		forked_at TIMESTAMP NOT NULL,
+		created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(project_id, name)
+	);
+
+	ALTER TABLE branches ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+	CREATE TABLE IF NOT EXISTS tags (
+		id UUID PRIMARY KEY,
+		project_id UUID REFERENCES projects(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		branch TEXT NOT NULL,
+		message TEXT,
+		created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(project_id, name)
+	);
+
+	CREATE TABLE IF NOT EXISTS tag_files (
+		tag_id UUID REFERENCES tags(id) ON DELETE CASCADE,
+		file_path TEXT NOT NULL,
+		version_id UUID NOT NULL REFERENCES file_versions(id),
+		PRIMARY KEY (tag_id, file_path)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_tag_files_version ON tag_files(version_id);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
@@ -0,0 +1,310 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Changeset file actions
+const (
+	ChangeAdd     = "add"
+	ChangeEdit    = "edit"
+	ChangeDelete  = "delete"
+	ChangeRestore = "restore" // brings back Source's content, whether or not the file currently exists
+)
+
+type Changeset struct {
+	ID        uuid.UUID     `json:"id"`
+	ProjectID uuid.UUID     `json:"project_id"`
+	UserID    uuid.UUID     `json:"user_id"`
+	Message   string        `json:"message"`
+	Branch    string        `json:"branch"`
+	CreatedAt time.Time     `json:"created_at"`
+	Files     []FileVersion `json:"files"`
+}
+
+// ChangesetFile - One file change within a changeset
+type ChangesetFile struct {
+	Action      string
+	FilePath    string
+	FileName    string
+	FileType    string
+	FileHash    string // expected SHA-256 of Content, checked when set
+	Content     string
+	BaseVersion int
+	Source      *FileVersion // for ChangeRestore, the version whose content is committed again
+}
+
+// ChangesetFileError - A file whose current state does not match what the changeset expects
+type ChangesetFileError struct {
+	FilePath      string
+	Action        string
+	BaseVersion   int
+	LatestVersion int    // 0 if the file has no versions
+	LatestHash    string // hash of the latest version, empty for a deletion
+	Exists        bool   // whether the file currently exists (its latest version is not a deletion)
+}
+
+func (e *ChangesetFileError) Error() string {
+	return fmt.Sprintf("%s %s: base version %d, latest version %d", e.Action, e.FilePath, e.BaseVersion, e.LatestVersion)
+}
+
+type ChangesetModel struct {
+	DB *sql.DB
+}
+
+// CreateChangeset - Commits every file change to a branch in one transaction. Each file is checked
+// against its base version under a lock, so the whole changeset fails if any file moved on.
+func (m *ChangesetModel) CreateChangeset(projectID, userID uuid.UUID, ref *Ref, message string, files []ChangesetFile) (*Changeset, error) {
+	if ref == nil {
+		ref = DefaultRef()
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	cs := Changeset{
+		ID:        uuid.New(),
+		ProjectID: projectID,
+		UserID:    userID,
+		Message:   message,
+		Branch:    ref.Branch,
+		CreatedAt: time.Now(),
+	}
+
+	query := `
+		INSERT INTO changesets (id, project_id, user_id, message, branch, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	if _, err := tx.Exec(query, cs.ID, cs.ProjectID, cs.UserID, cs.Message, cs.Branch, cs.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		fv, err := applyChange(tx, projectID, userID, &cs.ID, ref, file, message)
+		if err != nil {
+			return nil, err
+		}
+		cs.Files = append(cs.Files, *fv)
+	}
+
+	if err := enqueueSync(tx, projectID, &cs.ID, nil, cs.Branch); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &cs, nil
+}
+
+// fileHead - The latest version of a file on a branch, deletions included
+type fileHead struct {
+	version   int
+	hash      string
+	isDeleted bool
+}
+
+// lockFile - Takes the lock that serializes writers of a file, including ones creating it, and
+// reads the file's latest version visible through ref under it. The head is zero if the file
+// has no versions.
+func lockFile(tx *sql.Tx, projectID uuid.UUID, filePath string, ref *Ref) (fileHead, error) {
+	var head fileHead
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, projectID.String()+"/"+filePath); err != nil {
+		return head, err
+	}
+
+	cond, condArgs := ref.condition(3)
+	err := tx.QueryRow(`
+		SELECT version, file_hash, is_deleted
+		FROM file_versions
+		WHERE project_id = $1 AND file_path = $2 AND `+cond+`
+		ORDER BY version DESC
+		LIMIT 1
+	`, append([]interface{}{projectID, filePath}, condArgs...)...).Scan(&head.version, &head.hash, &head.isDeleted)
+	if err == sql.ErrNoRows {
+		return fileHead{}, nil
+	}
+	return head, err
+}
+
+// staleFile - The error for a change whose expectations the file's head doesn't meet
+func staleFile(file ChangesetFile, head fileHead) *ChangesetFileError {
+	exists := head.version > 0 && !head.isDeleted
+	fileErr := &ChangesetFileError{
+		FilePath:      file.FilePath,
+		Action:        file.Action,
+		BaseVersion:   file.BaseVersion,
+		LatestVersion: head.version,
+		Exists:        exists,
+	}
+	if exists {
+		fileErr.LatestHash = head.hash
+	}
+	return fileErr
+}
+
+// applyChange - Checks one file change against the file's latest version on the branch, under a
+// lock, and commits it
+func applyChange(tx *sql.Tx, projectID, userID uuid.UUID, changesetID *uuid.UUID, ref *Ref, file ChangesetFile, message string) (*FileVersion, error) {
+	head, err := lockFile(tx, projectID, file.FilePath, ref)
+	if err != nil {
+		return nil, err
+	}
+	latestVersion := head.version
+	exists := latestVersion > 0 && !head.isDeleted
+
+	expected := exists && latestVersion == file.BaseVersion
+	switch file.Action {
+	case ChangeAdd:
+		expected = !exists
+	case ChangeRestore:
+		expected = latestVersion == file.BaseVersion
+	}
+	if !expected {
+		return nil, staleFile(file, head)
+	}
+
+	// Binary content is already in the blob store and is committed again by hash
+	if source := file.Source; file.Action == ChangeRestore && source.IsBinary {
+		return insertVersion(
+			tx, projectID, userID, changesetID, ref.Branch, file.FilePath, file.FileName, file.FileType,
+			source.FileHash, source.FileSize, true, message, false,
+		)
+	}
+	if file.Action == ChangeRestore {
+		file.Content = file.Source.Content
+	}
+
+	return createVersion(
+		tx, projectID, userID, changesetID, ref.Branch, file.FilePath, file.FileName, file.FileType,
+		file.FileHash, file.Content, message, file.Action == ChangeDelete,
+	)
+}
+
+// GetChangeset - Gets a changeset with the versions it created (without content)
+func (m *ChangesetModel) GetChangeset(changesetID uuid.UUID) (*Changeset, error) {
+	query := `
+		SELECT id, project_id, user_id, message, branch, created_at
+		FROM changesets
+		WHERE id = $1
+	`
+
+	var cs Changeset
+	err := m.DB.QueryRow(query, changesetID).Scan(&cs.ID, &cs.ProjectID, &cs.UserID, &cs.Message, &cs.Branch, &cs.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := m.getChangesetFiles(`WHERE fv.changeset_id = $1`, changesetID)
+	if err != nil {
+		return nil, err
+	}
+	cs.Files = files[cs.ID]
+
+	return &cs, nil
+}
+
+// GetProjectChangesets - Gets the most recent changesets of a project, newest first
+func (m *ChangesetModel) GetProjectChangesets(projectID uuid.UUID, limit int) ([]Changeset, error) {
+	query := `
+		SELECT id, project_id, user_id, message, branch, created_at
+		FROM changesets
+		WHERE project_id = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`
+
+	rows, err := m.DB.Query(query, projectID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changesets []Changeset
+	for rows.Next() {
+		var cs Changeset
+		if err := rows.Scan(&cs.ID, &cs.ProjectID, &cs.UserID, &cs.Message, &cs.Branch, &cs.CreatedAt); err != nil {
+			return nil, err
+		}
+		changesets = append(changesets, cs)
+	}
+	if len(changesets) == 0 {
+		return changesets, nil
+	}
+
+	oldest := changesets[len(changesets)-1].CreatedAt
+	files, err := m.getChangesetFiles(`
+		JOIN changesets c ON c.id = fv.changeset_id
+		WHERE c.project_id = $1 AND c.created_at >= $2
+	`, projectID, oldest)
+	if err != nil {
+		return nil, err
+	}
+	for i := range changesets {
+		changesets[i].Files = files[changesets[i].ID]
+	}
+
+	return changesets, nil
+}
+
+// getChangesetFiles - Loads file versions belonging to changesets, grouped by changeset ID
+func (m *ChangesetModel) getChangesetFiles(where string, args ...interface{}) (map[uuid.UUID][]FileVersion, error) {
+	query := `
+		SELECT fv.id, fv.project_id, fv.user_id, fv.file_path, fv.file_name, fv.file_type, fv.version,
+			fv.file_hash, fv.file_size, fv.commit_message, fv.is_deleted, fv.is_binary, fv.changeset_id, fv.branch, fv.created_at
+		FROM file_versions fv
+	` + where + `
+		ORDER BY fv.file_path
+	`
+
+	rows, err := m.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make(map[uuid.UUID][]FileVersion)
+	for rows.Next() {
+		var fv FileVersion
+		err := rows.Scan(
+			&fv.ID, &fv.ProjectID, &fv.UserID, &fv.FilePath, &fv.FileName,
+			&fv.FileType, &fv.Version, &fv.FileHash, &fv.FileSize,
+			&fv.CommitMsg, &fv.IsDeleted, &fv.IsBinary, &fv.ChangesetID, &fv.Branch, &fv.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		files[*fv.ChangesetID] = append(files[*fv.ChangesetID], fv)
+	}
+
+	return files, nil
+}
+
+// InitChangesetTable - Creates the changesets table and links file versions to it
+func InitChangesetTable() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS changesets (
+		id UUID PRIMARY KEY,
+		project_id UUID REFERENCES projects(id) ON DELETE CASCADE,
+		user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+		message TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_changesets_project ON changesets(project_id, created_at DESC);
+
+	ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS changeset_id UUID REFERENCES changesets(id) ON DELETE SET NULL;
+	CREATE INDEX IF NOT EXISTS idx_file_versions_changeset ON file_versions(changeset_id);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
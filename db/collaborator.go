@@ -7,11 +7,21 @@ import (
 	"github.com/google/uuid"
 )
 
+// Project roles, from least to most privileged. The owner is the project's
+// owner_id and never has a collaborators row.
+const (
+	RoleViewer     = "viewer"
+	RoleEditor     = "editor"
+	RoleMaintainer = "maintainer"
+	RoleOwner      = "owner"
+)
+
 type Collaborator struct {
 	ID        uuid.UUID `json:"id"`
 	UserID    uuid.UUID `json:"user_id"`
 	ProjectID uuid.UUID `json:"project_id"`
 	Status    string    `json:"status"` // "pending", "approved", "rejected"
+	Role      string    `json:"role"`   // "viewer", "editor", "maintainer"
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
@@ -21,19 +31,19 @@ type CollaboratorModel struct {
 }
 
 // CreateCollaboration - Creates a new collaboration request
-func (m *CollaboratorModel) CreateCollaboration(userID, projectID uuid.UUID, status string) (*Collaborator, error) {
+func (m *CollaboratorModel) CreateCollaboration(userID, projectID uuid.UUID, status, role string) (*Collaborator, error) {
 	query := `
-		INSERT INTO collaborators (id, user_id, project_id, status, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING id, user_id, project_id, status, created_at, updated_at
+		INSERT INTO collaborators (id, user_id, project_id, status, role, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, user_id, project_id, status, role, created_at, updated_at
 	`
 
 	id := uuid.New()
 	now := time.Now()
 
 	var collab Collaborator
-	err := m.DB.QueryRow(query, id, userID, projectID, status, now, now).Scan(
-		&collab.ID, &collab.UserID, &collab.ProjectID, &collab.Status, &collab.CreatedAt, &collab.UpdatedAt,
+	err := m.DB.QueryRow(query, id, userID, projectID, status, role, now, now).Scan(
+		&collab.ID, &collab.UserID, &collab.ProjectID, &collab.Status, &collab.Role, &collab.CreatedAt, &collab.UpdatedAt,
 	)
 
 	if err != nil {
@@ -46,14 +56,14 @@ func (m *CollaboratorModel) CreateCollaboration(userID, projectID uuid.UUID, sta
 // GetCollaborationByID - Gets a collaboration by ID
 func (m *CollaboratorModel) GetCollaborationByID(collabID uuid.UUID) (*Collaborator, error) {
 	query := `
-		SELECT id, user_id, project_id, status, created_at, updated_at
+		SELECT id, user_id, project_id, status, role, created_at, updated_at
 		FROM collaborators
 		WHERE id = $1
 	`
 
 	var collab Collaborator
 	err := m.DB.QueryRow(query, collabID).Scan(
-		&collab.ID, &collab.UserID, &collab.ProjectID, &collab.Status, &collab.CreatedAt, &collab.UpdatedAt,
+		&collab.ID, &collab.UserID, &collab.ProjectID, &collab.Status, &collab.Role, &collab.CreatedAt, &collab.UpdatedAt,
 	)
 
 	if err != nil {
@@ -66,14 +76,14 @@ func (m *CollaboratorModel) GetCollaborationByID(collabID uuid.UUID) (*Collabora
 // GetCollaborationByUserAndProject - Gets collaboration by user and project
 func (m *CollaboratorModel) GetCollaborationByUserAndProject(userID, projectID uuid.UUID) (*Collaborator, error) {
 	query := `
-		SELECT id, user_id, project_id, status, created_at, updated_at
+		SELECT id, user_id, project_id, status, role, created_at, updated_at
 		FROM collaborators
 		WHERE user_id = $1 AND project_id = $2
 	`
 
 	var collab Collaborator
 	err := m.DB.QueryRow(query, userID, projectID).Scan(
-		&collab.ID, &collab.UserID, &collab.ProjectID, &collab.Status, &collab.CreatedAt, &collab.UpdatedAt,
+		&collab.ID, &collab.UserID, &collab.ProjectID, &collab.Status, &collab.Role, &collab.CreatedAt, &collab.UpdatedAt,
 	)
 
 	if err != nil {
@@ -86,7 +96,7 @@ func (m *CollaboratorModel) GetCollaborationByUserAndProject(userID, projectID u
 // GetProjectCollaborators - Gets all collaborators for a project
 func (m *CollaboratorModel) GetProjectCollaborators(projectID uuid.UUID) ([]Collaborator, error) {
 	query := `
-		SELECT id, user_id, project_id, status, created_at, updated_at
+		SELECT id, user_id, project_id, status, role, created_at, updated_at
 		FROM collaborators
 		WHERE project_id = $1
 		ORDER BY created_at DESC
@@ -102,7 +112,7 @@ func (m *CollaboratorModel) GetProjectCollaborators(projectID uuid.UUID) ([]Coll
 	for rows.Next() {
 		var collab Collaborator
 		err := rows.Scan(
-			&collab.ID, &collab.UserID, &collab.ProjectID, &collab.Status, &collab.CreatedAt, &collab.UpdatedAt,
+			&collab.ID, &collab.UserID, &collab.ProjectID, &collab.Status, &collab.Role, &collab.CreatedAt, &collab.UpdatedAt,
 		)
 		if err != nil {
 			return nil, err
@@ -116,7 +126,7 @@ func (m *CollaboratorModel) GetProjectCollaborators(projectID uuid.UUID) ([]Coll
 // GetUserPendingRequests - Gets pending collaboration requests for a user
 func (m *CollaboratorModel) GetUserPendingRequests(userID uuid.UUID) ([]Collaborator, error) {
 	query := `
-		SELECT id, user_id, project_id, status, created_at, updated_at
+		SELECT id, user_id, project_id, status, role, created_at, updated_at
 		FROM collaborators
 		WHERE user_id = $1 AND status = 'pending'
 		ORDER BY created_at DESC
@@ -132,7 +142,7 @@ func (m *CollaboratorModel) GetUserPendingRequests(userID uuid.UUID) ([]Collabor
 	for rows.Next() {
 		var collab Collaborator
 		err := rows.Scan(
-			&collab.ID, &collab.UserID, &collab.ProjectID, &collab.Status, &collab.CreatedAt, &collab.UpdatedAt,
+			&collab.ID, &collab.UserID, &collab.ProjectID, &collab.Status, &collab.Role, &collab.CreatedAt, &collab.UpdatedAt,
 		)
 		if err != nil {
 			return nil, err
@@ -146,7 +156,7 @@ func (m *CollaboratorModel) GetUserPendingRequests(userID uuid.UUID) ([]Collabor
 // GetUserCollaborations - Gets all collaborations for a user (any status)
 func (m *CollaboratorModel) GetUserCollaborations(userID uuid.UUID) ([]Collaborator, error) {
 	query := `
-		SELECT id, user_id, project_id, status, created_at, updated_at
+		SELECT id, user_id, project_id, status, role, created_at, updated_at
 		FROM collaborators
 		WHERE user_id = $1
 		ORDER BY created_at DESC
@@ -162,7 +172,7 @@ func (m *CollaboratorModel) GetUserCollaborations(userID uuid.UUID) ([]Collabora
 	for rows.Next() {
 		var collab Collaborator
 		err := rows.Scan(
-			&collab.ID, &collab.UserID, &collab.ProjectID, &collab.Status, &collab.CreatedAt, &collab.UpdatedAt,
+			&collab.ID, &collab.UserID, &collab.ProjectID, &collab.Status, &collab.Role, &collab.CreatedAt, &collab.UpdatedAt,
 		)
 		if err != nil {
 			return nil, err
@@ -199,6 +209,32 @@ func (m *CollaboratorModel) UpdateCollaborationStatus(collabID uuid.UUID, status
 	return nil
 }
 
+// UpdateCollaborationRole - Updates the role of a collaboration
+func (m *CollaboratorModel) UpdateCollaborationRole(collabID uuid.UUID, role string) error {
+	query := `
+		UPDATE collaborators
+		SET role = $1, updated_at = $2
+		WHERE id = $3
+	`
+
+	now := time.Now()
+	result, err := m.DB.Exec(query, role, now, collabID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
 // DeleteCollaboration - Deletes a collaboration
 func (m *CollaboratorModel) DeleteCollaboration(collabID uuid.UUID) error {
 	query := `DELETE FROM collaborators WHERE id = $1`
@@ -236,3 +272,109 @@ func (m *CollaboratorModel) IsUserCollaborator(userID, projectID uuid.UUID) (boo
 
 	return exists, nil
 }
+
+// GetUserRole - Gets a user's role on a project: "owner" for the project owner, the collaboration
+// role for approved collaborators, or "" when the user has no access. Returns sql.ErrNoRows if
+// the project does not exist.
+func (m *CollaboratorModel) GetUserRole(userID, projectID uuid.UUID) (string, error) {
+	query := `
+		SELECT CASE WHEN p.owner_id = $1 THEN 'owner' ELSE c.role END
+		FROM projects p
+		LEFT JOIN collaborators c
+			ON c.project_id = p.id AND c.user_id = $1 AND c.status = 'approved'
+		WHERE p.id = $2
+	`
+
+	var role sql.NullString
+	err := m.DB.QueryRow(query, userID, projectID).Scan(&role)
+	if err != nil {
+		return "", err
+	}
+
+	return role.String, nil
+}
+
+// SharesProject - Checks whether two users are both members, as owner or approved collaborator,
+// of at least one project
+func (m *CollaboratorModel) SharesProject(userID, otherID uuid.UUID) (bool, error) {
+	query := `
+		WITH memberships AS (
+			SELECT id AS project_id, owner_id AS user_id FROM projects WHERE owner_id IN ($1, $2)
+			UNION
+			SELECT project_id, user_id FROM collaborators WHERE user_id IN ($1, $2) AND status = 'approved'
+		)
+		SELECT EXISTS(
+			SELECT 1 FROM memberships a
+			JOIN memberships b ON b.project_id = a.project_id
+			WHERE a.user_id = $1 AND b.user_id = $2
+		)
+	`
+
+	var shares bool
+	err := m.DB.QueryRow(query, userID, otherID).Scan(&shares)
+	if err != nil {
+		return false, err
+	}
+
+	return shares, nil
+}
+
+// GetProjectMemberIDs - Gets the owner and every approved collaborator of a project
+func (m *CollaboratorModel) GetProjectMemberIDs(projectID uuid.UUID) ([]uuid.UUID, error) {
+	query := `
+		SELECT owner_id FROM projects WHERE id = $1 AND owner_id IS NOT NULL
+		UNION
+		SELECT user_id FROM collaborators WHERE project_id = $1 AND status = 'approved'
+	`
+
+	rows, err := m.DB.Query(query, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []uuid.UUID
+	for rows.Next() {
+		var userID uuid.UUID
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		members = append(members, userID)
+	}
+
+	return members, nil
+}
+
+// CollaboratorAccount - An approved collaborator with the GitHub login they signed in with
+type CollaboratorAccount struct {
+	UserID   uuid.UUID `json:"user_id"`
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+}
+
+// GetApprovedAccounts - Gets the approved collaborators of a project with their GitHub logins
+func (m *CollaboratorModel) GetApprovedAccounts(projectID uuid.UUID) ([]CollaboratorAccount, error) {
+	query := `
+		SELECT c.user_id, u.username, c.role
+		FROM collaborators c
+		JOIN users u ON u.id = c.user_id
+		WHERE c.project_id = $1 AND c.status = 'approved'
+	`
+
+	rows, err := m.DB.Query(query, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []CollaboratorAccount
+	for rows.Next() {
+		var account CollaboratorAccount
+		if err := rows.Scan(&account.UserID, &account.Username, &account.Role); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+
+	return accounts, rows.Err()
+}
@@ -0,0 +1,450 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/google/uuid"
+)
+
+// Objects in the blob store start with a kind byte. A delta object then names the blob it is
+// a delta against, followed by the delta itself. A manifest lists the hashes of the chunks a
+// large upload was stored as, in order.
+const (
+	blobFull     byte = 'F'
+	blobDelta    byte = 'D'
+	blobManifest byte = 'M'
+)
+
+const (
+	// maxDeltaChain - Deltas a read may have to apply; after this many a full copy is kept
+	maxDeltaChain = 32
+
+	// deltaWorthwhile - A delta replaces the full copy only if it is at most this share of its size
+	deltaWorthwhile = 0.75
+
+	deltaQueueSize = 256
+)
+
+var (
+	ErrHashMismatch = errors.New("content does not match file_hash")
+	ErrBlobCorrupt  = errors.New("blob content does not match its hash")
+)
+
+// ContentStore - Deduplicated file contents keyed by SHA-256. Older contents of a file are
+// rewritten as deltas against newer ones in the background (reverse deltas), so the latest
+// version of a file is always a plain read.
+type ContentStore struct {
+	DB     *sql.DB // blob metadata; the bytes live in Store
+	Store  BlobStore
+	deltas chan deltaJob
+}
+
+type deltaJob struct {
+	older, newer string
+}
+
+// Blobs - The content store used by file versions, set up by InitDB
+var Blobs *ContentStore
+
+// HashContent - SHA-256 of file content, hex encoded; the key content is stored under
+func HashContent(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// NewContentStore - Wraps a blob backend and starts the worker that writes deltas
+func NewContentStore(db *sql.DB, store BlobStore) *ContentStore {
+	s := &ContentStore{
+		DB:     db,
+		Store:  store,
+		deltas: make(chan deltaJob, deltaQueueSize),
+	}
+	go s.deltaWorker()
+	return s
+}
+
+// Put - Stores content once and returns its hash
+func (s *ContentStore) Put(content []byte) (string, error) {
+	hash := HashContent(content)
+
+	var exists bool
+	if err := s.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM blobs WHERE hash = $1)`, hash).Scan(&exists); err != nil {
+		return "", err
+	}
+	if exists {
+		return hash, nil
+	}
+
+	object := append([]byte{blobFull}, content...)
+	if err := s.Store.Put(hash, object); err != nil {
+		return "", err
+	}
+
+	_, err := s.DB.Exec(`
+		INSERT INTO blobs (hash, size, stored_size)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (hash) DO NOTHING
+	`, hash, len(content), len(object))
+	if err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// Get - Reads content by hash, applying any deltas, and checks it against the hash
+func (s *ContentStore) Get(hash string) ([]byte, error) {
+	return s.get(hash, 0)
+}
+
+func (s *ContentStore) get(hash string, depth int) ([]byte, error) {
+	if depth > 2*maxDeltaChain {
+		return nil, fmt.Errorf("blob %s: delta chain too long", hash)
+	}
+
+	object, err := s.Store.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(object) == 0 {
+		return nil, ErrBlobCorrupt
+	}
+
+	var content []byte
+	switch object[0] {
+	case blobFull:
+		content = object[1:]
+
+	case blobManifest:
+		var buf bytes.Buffer
+		if _, err := s.writeManifest(&buf, object[1:]); err != nil {
+			return nil, err
+		}
+		content = buf.Bytes()
+
+	case blobDelta:
+		if len(object) < 1+64 {
+			return nil, ErrBlobCorrupt
+		}
+		base, err := s.get(string(object[1:65]), depth+1)
+		if err != nil {
+			return nil, err
+		}
+		content, err = applyDelta(base, object[65:])
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, ErrBlobCorrupt
+	}
+
+	if HashContent(content) != hash {
+		return nil, ErrBlobCorrupt
+	}
+	return content, nil
+}
+
+// WriteTo - Streams content by hash. Chunked uploads are written one chunk at a time instead
+// of being assembled in memory.
+func (s *ContentStore) WriteTo(hash string, w io.Writer) (int64, error) {
+	object, err := s.Store.Get(hash)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(object) > 0 && object[0] == blobManifest {
+		return s.writeManifest(w, object[1:])
+	}
+
+	content, err := s.Get(hash)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(content)
+	return int64(n), err
+}
+
+func (s *ContentStore) writeManifest(w io.Writer, manifest []byte) (int64, error) {
+	if len(manifest)%64 != 0 {
+		return 0, ErrBlobCorrupt
+	}
+
+	var written int64
+	for i := 0; i < len(manifest); i += 64 {
+		chunk, err := s.Get(string(manifest[i : i+64]))
+		if err != nil {
+			return written, err
+		}
+		n, err := w.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// PutChunked - Stores a file uploaded in chunks, each already in the store, as a manifest
+// under the hash of the whole file. Returns that hash and the file size.
+func (s *ContentStore) PutChunked(chunkHashes []string) (string, int64, error) {
+	whole := sha256.New()
+	var size int64
+	manifest := make([]byte, 0, 1+64*len(chunkHashes))
+	manifest = append(manifest, blobManifest)
+
+	for _, chunkHash := range chunkHashes {
+		chunk, err := s.Get(chunkHash)
+		if err != nil {
+			return "", 0, err
+		}
+		whole.Write(chunk)
+		size += int64(len(chunk))
+		manifest = append(manifest, chunkHash...)
+	}
+	hash := hex.EncodeToString(whole.Sum(nil))
+
+	var exists bool
+	if err := s.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM blobs WHERE hash = $1)`, hash).Scan(&exists); err != nil {
+		return "", 0, err
+	}
+	if exists {
+		return hash, size, nil
+	}
+
+	if err := s.Store.Put(hash, manifest); err != nil {
+		return "", 0, err
+	}
+
+	_, err := s.DB.Exec(`
+		INSERT INTO blobs (hash, size, stored_size, chunked)
+		VALUES ($1, $2, $3, TRUE)
+		ON CONFLICT (hash) DO NOTHING
+	`, hash, size, len(manifest))
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hash, size, nil
+}
+
+// QueueDelta - Asks the background worker to store older as a delta against newer. Dropped if
+// the worker is behind; older then simply stays a full copy.
+func (s *ContentStore) QueueDelta(older, newer string) {
+	if older == "" || newer == "" || older == newer {
+		return
+	}
+
+	select {
+	case s.deltas <- deltaJob{older: older, newer: newer}:
+	default:
+	}
+}
+
+func (s *ContentStore) deltaWorker() {
+	for job := range s.deltas {
+		if err := s.Deltify(job.older, job.newer); err != nil {
+			log.Printf("Failed to delta-compress blob %s: %v", job.older, err)
+		}
+	}
+}
+
+// Deltify - Replaces the full copy of older with a delta against newer when that saves enough
+// space. Both must be full copies, which rules out cycles, and the longest chain of deltas
+// that would end up leading through older must stay within maxDeltaChain. Chunked uploads
+// are left alone.
+func (s *ContentStore) Deltify(older, newer string) error {
+	// Decide under a lock shared by every server, and record the change before making it, so
+	// the metadata never shows a full copy where there is a delta
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('blobs'))`); err != nil {
+		return err
+	}
+
+	var fullCount int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM blobs WHERE hash IN ($1, $2) AND delta_base IS NULL AND NOT chunked
+	`, older, newer).Scan(&fullCount)
+	if err != nil {
+		return err
+	}
+	if fullCount != 2 {
+		return nil
+	}
+
+	var dependents int
+	err = tx.QueryRow(`
+		WITH RECURSIVE deps AS (
+			SELECT hash, 1 AS depth FROM blobs WHERE delta_base = $1
+			UNION ALL
+			SELECT b.hash, d.depth + 1 FROM blobs b JOIN deps d ON b.delta_base = d.hash
+			WHERE d.depth < $2
+		)
+		SELECT COALESCE(MAX(depth), 0) FROM deps
+	`, older, maxDeltaChain+1).Scan(&dependents)
+	if err != nil {
+		return err
+	}
+	if dependents+1 > maxDeltaChain {
+		return nil
+	}
+
+	olderContent, err := s.Get(older)
+	if err != nil {
+		return err
+	}
+	newerContent, err := s.Get(newer)
+	if err != nil {
+		return err
+	}
+
+	delta := encodeDelta(newerContent, olderContent)
+	object := make([]byte, 0, 1+64+len(delta))
+	object = append(object, blobDelta)
+	object = append(object, newer...)
+	object = append(object, delta...)
+	if float64(len(object)) > deltaWorthwhile*float64(len(olderContent)+1) {
+		return nil
+	}
+
+	// Make sure the delta decodes before giving up the full copy
+	if rebuilt, err := applyDelta(newerContent, delta); err != nil || !bytes.Equal(rebuilt, olderContent) {
+		return fmt.Errorf("delta against %s does not rebuild the blob", newer)
+	}
+
+	_, err = tx.Exec(`UPDATE blobs SET delta_base = $1, stored_size = $2 WHERE hash = $3`, newer, len(object), older)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if err := s.Store.Put(older, object); err != nil {
+		// The full copy is still in place; put the metadata back
+		s.DB.Exec(`UPDATE blobs SET delta_base = NULL, stored_size = $1 WHERE hash = $2`, len(olderContent)+1, older)
+		return err
+	}
+
+	return nil
+}
+
+// MigrateInlineContent - Moves content stored in file_versions rows into the blob store,
+// newest version of each file first so older ones can become deltas against it
+func (s *ContentStore) MigrateInlineContent() error {
+	var previousFile, previousHash string
+	migrated := 0
+
+	for {
+		rows, err := s.DB.Query(`
+			SELECT id, project_id, file_path, is_deleted, content
+			FROM file_versions
+			WHERE content IS NOT NULL
+			ORDER BY project_id, file_path, version DESC
+			LIMIT 200
+		`)
+		if err != nil {
+			return err
+		}
+
+		type inlineVersion struct {
+			id        uuid.UUID
+			file      string
+			isDeleted bool
+			content   string
+		}
+		var batch []inlineVersion
+		for rows.Next() {
+			var v inlineVersion
+			var projectID uuid.UUID
+			var filePath string
+			if err := rows.Scan(&v.id, &projectID, &filePath, &v.isDeleted, &v.content); err != nil {
+				rows.Close()
+				return err
+			}
+			v.file = projectID.String() + "/" + filePath
+			batch = append(batch, v)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, v := range batch {
+			if v.isDeleted {
+				if _, err := s.DB.Exec(`UPDATE file_versions SET content = NULL WHERE id = $1`, v.id); err != nil {
+					return err
+				}
+				continue
+			}
+
+			hash, err := s.Put([]byte(v.content))
+			if err != nil {
+				return err
+			}
+
+			// The stored hash is now always the server's own
+			_, err = s.DB.Exec(`
+				UPDATE file_versions SET file_hash = $1, file_size = $2, content = NULL WHERE id = $3
+			`, hash, len(v.content), v.id)
+			if err != nil {
+				return err
+			}
+
+			if v.file == previousFile {
+				if err := s.Deltify(hash, previousHash); err != nil {
+					log.Printf("Failed to delta-compress blob %s: %v", hash, err)
+				}
+			}
+			previousFile, previousHash = v.file, hash
+			migrated++
+		}
+	}
+
+	if migrated > 0 {
+		log.Printf("Moved %d file versions into the blob store", migrated)
+	}
+	return nil
+}
+
+// InitBlobTables - Creates the blob metadata table, and the table objects are kept in when
+// Postgres is the blob backend
+func InitBlobTables() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS blobs (
+		hash TEXT PRIMARY KEY,
+		size BIGINT NOT NULL,
+		stored_size BIGINT NOT NULL,
+		delta_base TEXT,
+		chunked BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	ALTER TABLE blobs ADD COLUMN IF NOT EXISTS chunked BOOLEAN NOT NULL DEFAULT FALSE;
+
+	CREATE INDEX IF NOT EXISTS idx_blobs_delta_base ON blobs(delta_base);
+
+	CREATE TABLE IF NOT EXISTS blob_data (
+		hash TEXT PRIMARY KEY,
+		data BYTEA NOT NULL
+	);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
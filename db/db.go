@@ -33,6 +33,20 @@ func InitDB() {
 	InitTokenTable()
 	log.Println("Initialized Token Table Successfully")
 
+	log.Println("Initializing Session Table")
+	err = InitSessionTable()
+	if err != nil {
+		log.Fatal("Failed to initialize Session Table: ", err)
+	}
+	log.Println("Initialized Session Table Successfully")
+
+	log.Println("Initializing OAuth State Table")
+	err = InitOAuthStateTable()
+	if err != nil {
+		log.Fatal("Failed to initialize OAuth State Table: ", err)
+	}
+	log.Println("Initialized OAuth State Table Successfully")
+
 	log.Println("Initializing Collaborator Table")
 	InitCollaboratorTable()
 	log.Println("Initialized Collaborator Table Successfully")
@@ -50,6 +64,67 @@ func InitDB() {
 		log.Fatal("Failed to initialize Version Control Tables: ", err)
 	}
 	log.Println("Initialized Version Control Tables Successfully")
+
+	log.Println("Initializing Changeset Table")
+	err = InitChangesetTable()
+	if err != nil {
+		log.Fatal("Failed to initialize Changeset Table: ", err)
+	}
+	log.Println("Initialized Changeset Table Successfully")
+
+	log.Println("Initializing Branch Tables")
+	err = InitBranchTables()
+	if err != nil {
+		log.Fatal("Failed to initialize Branch Tables: ", err)
+	}
+	log.Println("Initialized Branch Tables Successfully")
+
+	log.Println("Initializing Upload Tables")
+	err = InitUploadTables()
+	if err != nil {
+		log.Fatal("Failed to initialize Upload Tables: ", err)
+	}
+	log.Println("Initialized Upload Tables Successfully")
+
+	log.Println("Initializing GitHub Sync Table")
+	err = InitGitHubSyncTable()
+	if err != nil {
+		log.Fatal("Failed to initialize GitHub Sync Table: ", err)
+	}
+	log.Println("Initialized GitHub Sync Table Successfully")
+
+	log.Println("Initializing GitHub Access Table")
+	err = InitGitHubAccessTable()
+	if err != nil {
+		log.Fatal("Failed to initialize GitHub Access Table: ", err)
+	}
+	log.Println("Initialized GitHub Access Table Successfully")
+
+	log.Println("Initializing Blob Store")
+	err = InitBlobTables()
+	if err != nil {
+		log.Fatal("Failed to initialize Blob Tables: ", err)
+	}
+	store, err := NewBlobStoreFromEnv(DB)
+	if err != nil {
+		log.Fatal("Failed to open Blob Store: ", err)
+	}
+	Blobs = NewContentStore(DB, store)
+	log.Println("Initialized Blob Store Successfully")
+
+	// Versions saved before the blob store existed are moved into it in the background
+	go func() {
+		if err := Blobs.MigrateInlineContent(); err != nil {
+			log.Println("Failed to move file contents into the Blob Store: ", err)
+		}
+	}()
+
+	log.Println("Initializing Message Queue Table")
+	err = InitMessageQueueTable()
+	if err != nil {
+		log.Fatal("Failed to initialize Message Queue Table: ", err)
+	}
+	log.Println("Initialized Message Queue Table Successfully")
 }
 
 func InitUserTable() {
@@ -75,7 +150,31 @@ func InitProjectTable() {
 		name TEXT NOT NULL,
 		description TEXT,
 		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
-	)`
+	);
+
+	ALTER TABLE projects ADD COLUMN IF NOT EXISTS max_file_size BIGINT;
+	ALTER TABLE projects ADD COLUMN IF NOT EXISTS repo_owner TEXT;
+	ALTER TABLE projects ADD COLUMN IF NOT EXISTS repo_name TEXT;
+	ALTER TABLE projects ADD COLUMN IF NOT EXISTS default_branch TEXT;
+	ALTER TABLE projects ADD COLUMN IF NOT EXISTS repo_id BIGINT;
+	ALTER TABLE projects ADD COLUMN IF NOT EXISTS repo_visibility TEXT;
+	ALTER TABLE projects ADD COLUMN IF NOT EXISTS repo_html_url TEXT;
+	ALTER TABLE projects ADD COLUMN IF NOT EXISTS repo_clone_url TEXT;
+	ALTER TABLE projects ADD COLUMN IF NOT EXISTS repo_ssh_url TEXT;
+	ALTER TABLE projects ADD COLUMN IF NOT EXISTS webhook_secret TEXT;
+
+	CREATE INDEX IF NOT EXISTS idx_projects_repo_id ON projects(repo_id);
+
+	CREATE TABLE IF NOT EXISTS pushed_repos (
+		repo_id BIGINT PRIMARY KEY,
+		owner_id UUID REFERENCES users(id) ON DELETE CASCADE,
+		private BOOLEAN NOT NULL,
+		template TEXT,
+		gitignore_template TEXT,
+		auto_init BOOLEAN NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	`
 
 	_, err := DB.Exec(query)
 	if err != nil {
@@ -106,10 +205,15 @@ func InitCollaboratorTable() {
 		user_id UUID REFERENCES users(id),
 		project_id UUID REFERENCES projects(id),
 		status TEXT NOT NULL CHECK (status IN ('pending', 'approved', 'rejected')),
+		role TEXT NOT NULL DEFAULT 'editor' CHECK (role IN ('viewer', 'editor', 'maintainer')),
 		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
 		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
 		UNIQUE(user_id, project_id)
-	)`
+	);
+
+	ALTER TABLE collaborators ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'editor'
+		CHECK (role IN ('viewer', 'editor', 'maintainer'));
+	`
 
 	_, err := DB.Exec(query)
 	if err != nil {
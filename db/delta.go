@@ -0,0 +1,157 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Delta instructions: copy a byte range of the base, or insert literal bytes
+const (
+	deltaCopy   byte = 1
+	deltaInsert byte = 2
+)
+
+const (
+	// deltaMaxCandidates - Base positions remembered per distinct line, so files full of
+	// repeated lines (YAML scenes, braces) stay linear
+	deltaMaxCandidates = 16
+
+	// deltaMinCopy - Shorter matches cost more to encode as a copy than to insert
+	deltaMinCopy = 8
+)
+
+var errBadDelta = errors.New("malformed delta")
+
+// encodeDelta - Instructions that rebuild target from base, found by matching whole lines.
+// The delta starts with the target length so decoding can check the result.
+func encodeDelta(base, target []byte) []byte {
+	baseLines := splitLines(base)
+	targetLines := splitLines(target)
+
+	// Byte offset of every base line, plus the end
+	offsets := make([]int, len(baseLines)+1)
+	for i, line := range baseLines {
+		offsets[i+1] = offsets[i] + len(line)
+	}
+
+	index := make(map[string][]int)
+	for i, line := range baseLines {
+		if positions := index[string(line)]; len(positions) < deltaMaxCandidates {
+			index[string(line)] = append(positions, i)
+		}
+	}
+
+	out := binary.AppendUvarint(nil, uint64(len(target)))
+	var pending []byte
+	lastCopyEnd := -1
+
+	flushInsert := func() {
+		if len(pending) == 0 {
+			return
+		}
+		out = append(out, deltaInsert)
+		out = binary.AppendUvarint(out, uint64(len(pending)))
+		out = append(out, pending...)
+		pending = pending[:0]
+	}
+
+	for i := 0; i < len(targetLines); {
+		bestStart, bestRun, bestBytes := -1, 0, 0
+		for _, j := range index[string(targetLines[i])] {
+			run, size := 0, 0
+			for j+run < len(baseLines) && i+run < len(targetLines) && bytes.Equal(baseLines[j+run], targetLines[i+run]) {
+				size += len(baseLines[j+run])
+				run++
+			}
+			// Prefer continuing where the last copy ended, which keeps copies merged
+			if size > bestBytes || (size == bestBytes && offsets[j] == lastCopyEnd) {
+				bestStart, bestRun, bestBytes = j, run, size
+			}
+		}
+
+		if bestStart < 0 || bestBytes < deltaMinCopy {
+			pending = append(pending, targetLines[i]...)
+			i++
+			continue
+		}
+
+		flushInsert()
+		out = append(out, deltaCopy)
+		out = binary.AppendUvarint(out, uint64(offsets[bestStart]))
+		out = binary.AppendUvarint(out, uint64(bestBytes))
+		lastCopyEnd = offsets[bestStart] + bestBytes
+		i += bestRun
+	}
+	flushInsert()
+
+	return out
+}
+
+// applyDelta - Rebuilds the target from its base and a delta made by encodeDelta
+func applyDelta(base, delta []byte) ([]byte, error) {
+	size, n := binary.Uvarint(delta)
+	if n <= 0 {
+		return nil, errBadDelta
+	}
+	delta = delta[n:]
+
+	out := make([]byte, 0, size)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		switch op {
+		case deltaCopy:
+			offset, n := binary.Uvarint(delta)
+			if n <= 0 {
+				return nil, errBadDelta
+			}
+			delta = delta[n:]
+			length, n := binary.Uvarint(delta)
+			if n <= 0 {
+				return nil, errBadDelta
+			}
+			delta = delta[n:]
+			if offset > uint64(len(base)) || length > uint64(len(base))-offset {
+				return nil, errBadDelta
+			}
+			out = append(out, base[offset:offset+length]...)
+
+		case deltaInsert:
+			length, n := binary.Uvarint(delta)
+			if n <= 0 {
+				return nil, errBadDelta
+			}
+			delta = delta[n:]
+			if length > uint64(len(delta)) {
+				return nil, errBadDelta
+			}
+			out = append(out, delta[:length]...)
+			delta = delta[length:]
+
+		default:
+			return nil, errBadDelta
+		}
+	}
+
+	if uint64(len(out)) != size {
+		return nil, errBadDelta
+	}
+	return out, nil
+}
+
+// splitLines - Splits after every newline, keeping it; the last line may have none
+func splitLines(data []byte) [][]byte {
+	var lines [][]byte
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			lines = append(lines, data)
+			break
+		}
+		lines = append(lines, data[:i+1])
+		data = data[i+1:]
+	}
+	return lines
+}
@@ -0,0 +1,197 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Repository access changes
+const (
+	AccessGrant  = "grant"  // invite the user, or update their permission, to match their role
+	AccessRevoke = "revoke" // remove the user and cancel any pending invitation
+)
+
+// Repository access change states
+const (
+	AccessPending = "pending" // waiting for its first attempt or a retry
+	AccessApplied = "applied"
+	AccessFailed  = "failed" // gave up until retried or reconciled
+)
+
+// AccessChange - The latest access a user should have on a project's GitHub repository. A
+// newer change for the same login replaces an older one that hasn't been applied.
+type AccessChange struct {
+	ID            uuid.UUID  `json:"id"`
+	ProjectID     uuid.UUID  `json:"project_id"`
+	UserID        *uuid.UUID `json:"user_id,omitempty"`
+	GitHubLogin   string     `json:"github_login"`
+	Action        string     `json:"action"`
+	Role          string     `json:"role,omitempty"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	Note          string     `json:"note,omitempty"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	AppliedAt     *time.Time `json:"applied_at,omitempty"`
+	Revision      int64      `json:"-"` // bumped whenever the change is replaced
+}
+
+type AccessModel struct {
+	DB *sql.DB
+}
+
+const accessChangeColumns = `id, project_id, user_id, github_login, action, COALESCE(role, ''), status, attempts,
+	COALESCE(last_error, ''), COALESCE(note, ''), next_attempt_at, created_at, updated_at, applied_at, revision`
+
+func scanAccessChange(row interface{ Scan(...interface{}) error }) (*AccessChange, error) {
+	var change AccessChange
+	err := row.Scan(
+		&change.ID, &change.ProjectID, &change.UserID, &change.GitHubLogin, &change.Action, &change.Role, &change.Status,
+		&change.Attempts, &change.LastError, &change.Note, &change.NextAttemptAt, &change.CreatedAt, &change.UpdatedAt,
+		&change.AppliedAt, &change.Revision,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+func (m *AccessModel) queryChanges(query string, args ...interface{}) ([]AccessChange, error) {
+	rows, err := m.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []AccessChange
+	for rows.Next() {
+		change, err := scanAccessChange(rows)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, *change)
+	}
+
+	return changes, rows.Err()
+}
+
+// QueueAccessChange - Records the access a login should have, replacing any earlier change for
+// it. Projects that aren't linked to a repository get nothing; the result says whether a change
+// was queued.
+func (m *AccessModel) QueueAccessChange(projectID uuid.UUID, userID *uuid.UUID, login, action, role string) (bool, error) {
+	now := time.Now()
+	result, err := m.DB.Exec(`
+		INSERT INTO github_access (id, project_id, user_id, github_login, action, role, status, next_attempt_at, created_at, updated_at)
+		SELECT $1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $8, $8
+		WHERE EXISTS (SELECT 1 FROM projects WHERE id = $2 AND repo_owner IS NOT NULL AND repo_name IS NOT NULL)
+		ON CONFLICT (project_id, github_login) DO UPDATE
+		SET user_id = EXCLUDED.user_id, action = EXCLUDED.action, role = EXCLUDED.role, status = EXCLUDED.status,
+			attempts = 0, last_error = NULL, note = NULL, next_attempt_at = EXCLUDED.next_attempt_at,
+			updated_at = EXCLUDED.updated_at, applied_at = NULL, revision = github_access.revision + 1
+	`, uuid.New(), projectID, userID, login, action, role, AccessPending, now)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected > 0, nil
+}
+
+// GetDueAccessChanges - Gets pending changes whose next attempt is due, oldest first
+func (m *AccessModel) GetDueAccessChanges(now time.Time, limit int) ([]AccessChange, error) {
+	return m.queryChanges(`
+		SELECT `+accessChangeColumns+`
+		FROM github_access
+		WHERE status = $1 AND next_attempt_at <= $2
+		ORDER BY updated_at
+		LIMIT $3
+	`, AccessPending, now, limit)
+}
+
+// GetProjectAccessChanges - Gets the latest change for every login of a project
+func (m *AccessModel) GetProjectAccessChanges(projectID uuid.UUID) ([]AccessChange, error) {
+	return m.queryChanges(`
+		SELECT `+accessChangeColumns+`
+		FROM github_access
+		WHERE project_id = $1
+		ORDER BY updated_at DESC
+	`, projectID)
+}
+
+// MarkAccessApplied - Records that a change is in place on GitHub, unless it was replaced meanwhile
+func (m *AccessModel) MarkAccessApplied(change *AccessChange, note string) error {
+	now := time.Now()
+	_, err := m.DB.Exec(`
+		UPDATE github_access
+		SET status = $1, note = NULLIF($2, ''), last_error = NULL, updated_at = $3, applied_at = $3
+		WHERE id = $4 AND revision = $5
+	`, AccessApplied, note, now, change.ID, change.Revision)
+	return err
+}
+
+// MarkAccessAttemptFailed - Records a failed attempt, unless the change was replaced meanwhile.
+// With a retry time the change stays pending; without one it is marked failed.
+func (m *AccessModel) MarkAccessAttemptFailed(change *AccessChange, errMsg string, retryAt *time.Time) error {
+	status := AccessFailed
+	nextAttempt := time.Now()
+	if retryAt != nil {
+		status, nextAttempt = AccessPending, *retryAt
+	}
+
+	_, err := m.DB.Exec(`
+		UPDATE github_access
+		SET status = $1, attempts = attempts + 1, last_error = $2, next_attempt_at = $3, updated_at = $4
+		WHERE id = $5 AND revision = $6
+	`, status, errMsg, nextAttempt, time.Now(), change.ID, change.Revision)
+	return err
+}
+
+// RetryFailedAccessChanges - Puts a project's failed changes back in the queue with a fresh set of attempts
+func (m *AccessModel) RetryFailedAccessChanges(projectID uuid.UUID) (int64, error) {
+	now := time.Now()
+	result, err := m.DB.Exec(`
+		UPDATE github_access
+		SET status = $1, attempts = 0, next_attempt_at = $2, updated_at = $2, revision = revision + 1
+		WHERE project_id = $3 AND status = $4
+	`, AccessPending, now, projectID, AccessFailed)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// InitGitHubAccessTable - Creates the queue of repository access changes
+func InitGitHubAccessTable() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS github_access (
+		id UUID PRIMARY KEY,
+		project_id UUID REFERENCES projects(id) ON DELETE CASCADE,
+		user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+		github_login TEXT NOT NULL,
+		action TEXT NOT NULL CHECK (action IN ('grant', 'revoke')),
+		role TEXT,
+		status TEXT NOT NULL CHECK (status IN ('pending', 'applied', 'failed')),
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		note TEXT,
+		next_attempt_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		applied_at TIMESTAMP,
+		revision BIGINT NOT NULL DEFAULT 0,
+		UNIQUE (project_id, github_login)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_github_access_status ON github_access(status, next_attempt_at) WHERE status = 'pending';
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
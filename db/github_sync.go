@@ -0,0 +1,259 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// GitHub sync job states
+const (
+	SyncPending = "pending" // waiting for its first attempt or a retry
+	SyncRunning = "running" // claimed by a worker until next_attempt_at
+	SyncSynced  = "synced"
+	SyncFailed  = "failed" // gave up; blocks later jobs of the branch until retried
+)
+
+// SyncJob - A changeset, a version committed on its own or a branch fast-forwarded into this one,
+// to be mirrored to the project's GitHub repository as one git commit. Jobs of a branch are synced
+// strictly in order.
+type SyncJob struct {
+	ID            uuid.UUID  `json:"id"`
+	ProjectID     uuid.UUID  `json:"project_id"`
+	ChangesetID   *uuid.UUID `json:"changeset_id,omitempty"`
+	VersionID     *uuid.UUID `json:"version_id,omitempty"`
+	MergedFrom    string     `json:"merged_from,omitempty"` // the fast-forwarded branch
+	MergedAt      *time.Time `json:"merged_at,omitempty"`
+	UserID        *uuid.UUID `json:"user_id,omitempty"` // who fast-forwarded; changesets and versions have their own
+	Branch        string     `json:"branch"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	Note          string     `json:"note,omitempty"`
+	CommitSHA     string     `json:"commit_sha,omitempty"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	SyncedAt      *time.Time `json:"synced_at,omitempty"`
+}
+
+type SyncModel struct {
+	DB *sql.DB
+}
+
+const syncJobColumns = `id, project_id, changeset_id, version_id, COALESCE(merged_from, ''), merged_at, user_id, branch, status,
+	attempts, COALESCE(last_error, ''), COALESCE(note, ''), COALESCE(commit_sha, ''), next_attempt_at, created_at, updated_at, synced_at`
+
+func scanSyncJob(row interface{ Scan(...interface{}) error }) (*SyncJob, error) {
+	var job SyncJob
+	err := row.Scan(
+		&job.ID, &job.ProjectID, &job.ChangesetID, &job.VersionID, &job.MergedFrom, &job.MergedAt, &job.UserID,
+		&job.Branch, &job.Status, &job.Attempts, &job.LastError, &job.Note, &job.CommitSHA, &job.NextAttemptAt, &job.CreatedAt, &job.UpdatedAt, &job.SyncedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (m *SyncModel) queryJobs(query string, args ...interface{}) ([]SyncJob, error) {
+	rows, err := m.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []SyncJob
+	for rows.Next() {
+		job, err := scanSyncJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// enqueueSync - Queues a commit for GitHub within the transaction that made it. Projects that
+// aren't linked to a repository get no job.
+func enqueueSync(q querier, projectID uuid.UUID, changesetID, versionID *uuid.UUID, branch string) error {
+	now := time.Now()
+	_, err := q.Exec(`
+		INSERT INTO github_sync_jobs (id, project_id, changeset_id, version_id, branch, status, next_attempt_at, created_at, updated_at)
+		SELECT $1, $2, $3, $4, $5, $6, $7, $7, $7
+		WHERE EXISTS (SELECT 1 FROM projects WHERE id = $2 AND repo_owner IS NOT NULL AND repo_name IS NOT NULL)
+	`, uuid.New(), projectID, changesetID, versionID, branch, SyncPending, now)
+	return err
+}
+
+// enqueueMergeSync - Queues the versions a fast-forward moved onto a branch at mergedAt as one commit
+// on that branch, within the fast-forward's transaction
+func enqueueMergeSync(q querier, projectID, userID uuid.UUID, branch, mergedFrom string, mergedAt time.Time) error {
+	now := time.Now()
+	_, err := q.Exec(`
+		INSERT INTO github_sync_jobs (id, project_id, merged_from, merged_at, user_id, branch, status, next_attempt_at, created_at, updated_at)
+		SELECT $1, $2, $3, $4, $5, $6, $7, $8, $8, $8
+		WHERE EXISTS (SELECT 1 FROM projects WHERE id = $2 AND repo_owner IS NOT NULL AND repo_name IS NOT NULL)
+	`, uuid.New(), projectID, mergedFrom, mergedAt, userID, branch, SyncPending, now)
+	return err
+}
+
+// ClaimSyncJob - Claims the oldest due job whose branch has no earlier unsynced job, so no other
+// worker or server takes it, until lease runs out. Jobs still running after that, because their
+// worker died, can be claimed again. A failed job holds back the rest of its branch. Returns
+// sql.ErrNoRows when nothing is due.
+func (m *SyncModel) ClaimSyncJob(now time.Time, lease time.Duration) (*SyncJob, error) {
+	return scanSyncJob(m.DB.QueryRow(`
+		UPDATE github_sync_jobs
+		SET status = $1, next_attempt_at = $2, updated_at = $3
+		WHERE id = (
+			SELECT j.id FROM github_sync_jobs j
+			WHERE j.id IN (
+				SELECT DISTINCT ON (project_id, branch) id
+				FROM github_sync_jobs
+				WHERE status <> $4
+				ORDER BY project_id, branch, seq
+			)
+				AND j.status IN ($5, $1) AND j.next_attempt_at <= $3
+			ORDER BY j.seq
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+syncJobColumns+`
+	`, SyncRunning, now.Add(lease), now, SyncSynced, SyncPending))
+}
+
+// GetSyncJob - Gets a sync job by ID
+func (m *SyncModel) GetSyncJob(jobID uuid.UUID) (*SyncJob, error) {
+	return scanSyncJob(m.DB.QueryRow(`SELECT `+syncJobColumns+` FROM github_sync_jobs WHERE id = $1`, jobID))
+}
+
+// GetChangesetSyncJob - Gets the sync job of a changeset
+func (m *SyncModel) GetChangesetSyncJob(changesetID uuid.UUID) (*SyncJob, error) {
+	return scanSyncJob(m.DB.QueryRow(`SELECT `+syncJobColumns+` FROM github_sync_jobs WHERE changeset_id = $1`, changesetID))
+}
+
+// GetVersionSyncJob - Gets the sync job of a version committed outside a changeset
+func (m *SyncModel) GetVersionSyncJob(versionID uuid.UUID) (*SyncJob, error) {
+	return scanSyncJob(m.DB.QueryRow(`SELECT `+syncJobColumns+` FROM github_sync_jobs WHERE version_id = $1`, versionID))
+}
+
+// GetProjectSyncJobs - Gets a project's most recent sync jobs, newest first
+func (m *SyncModel) GetProjectSyncJobs(projectID uuid.UUID, limit int) ([]SyncJob, error) {
+	return m.queryJobs(`
+		SELECT `+syncJobColumns+`
+		FROM github_sync_jobs
+		WHERE project_id = $1
+		ORDER BY seq DESC
+		LIMIT $2
+	`, projectID, limit)
+}
+
+// IsSyncCommit - Whether a git commit was made by syncing one of the project's jobs
+func (m *SyncModel) IsSyncCommit(projectID uuid.UUID, commitSHA string) (bool, error) {
+	var exists bool
+	err := m.DB.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM github_sync_jobs WHERE project_id = $1 AND commit_sha = $2)
+	`, projectID, commitSHA).Scan(&exists)
+	return exists, err
+}
+
+// SetSyncCommit - Remembers the git commit built for a job before the branch is moved to it,
+// so a retry after a crash can reuse it instead of committing twice
+func (m *SyncModel) SetSyncCommit(jobID uuid.UUID, commitSHA string) error {
+	_, err := m.DB.Exec(`
+		UPDATE github_sync_jobs SET commit_sha = NULLIF($1, ''), updated_at = $2
+		WHERE id = $3
+	`, commitSHA, time.Now(), jobID)
+	return err
+}
+
+// MarkSynced - Records that a job's commit is on GitHub
+func (m *SyncModel) MarkSynced(jobID uuid.UUID, commitSHA, note string) error {
+	now := time.Now()
+	_, err := m.DB.Exec(`
+		UPDATE github_sync_jobs
+		SET status = $1, commit_sha = NULLIF($2, ''), note = NULLIF($3, ''), last_error = NULL, updated_at = $4, synced_at = $4
+		WHERE id = $5
+	`, SyncSynced, commitSHA, note, now, jobID)
+	return err
+}
+
+// MarkSyncAttemptFailed - Records a failed attempt. With a retry time the job stays pending;
+// without one it is marked failed.
+func (m *SyncModel) MarkSyncAttemptFailed(jobID uuid.UUID, errMsg string, retryAt *time.Time) error {
+	status := SyncFailed
+	nextAttempt := time.Now()
+	if retryAt != nil {
+		status, nextAttempt = SyncPending, *retryAt
+	}
+
+	_, err := m.DB.Exec(`
+		UPDATE github_sync_jobs
+		SET status = $1, attempts = attempts + 1, last_error = $2, next_attempt_at = $3, updated_at = $4
+		WHERE id = $5
+	`, status, errMsg, nextAttempt, time.Now(), jobID)
+	return err
+}
+
+// RetryFailedSyncJobs - Puts a project's failed jobs back in the queue with a fresh set of attempts
+func (m *SyncModel) RetryFailedSyncJobs(projectID uuid.UUID) (int64, error) {
+	now := time.Now()
+	result, err := m.DB.Exec(`
+		UPDATE github_sync_jobs
+		SET status = $1, attempts = 0, next_attempt_at = $2, updated_at = $2
+		WHERE project_id = $3 AND status = $4
+	`, SyncPending, now, projectID, SyncFailed)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// InitGitHubSyncTable - Creates the queue of commits to mirror to GitHub
+func InitGitHubSyncTable() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS github_sync_jobs (
+		id UUID PRIMARY KEY,
+		seq BIGSERIAL,
+		project_id UUID REFERENCES projects(id) ON DELETE CASCADE,
+		changeset_id UUID UNIQUE REFERENCES changesets(id) ON DELETE CASCADE,
+		version_id UUID UNIQUE REFERENCES file_versions(id) ON DELETE CASCADE,
+		merged_from TEXT,
+		merged_at TIMESTAMP,
+		user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+		branch TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		note TEXT,
+		commit_sha TEXT,
+		next_attempt_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		synced_at TIMESTAMP
+	);
+
+	ALTER TABLE github_sync_jobs ADD COLUMN IF NOT EXISTS merged_from TEXT;
+	ALTER TABLE github_sync_jobs ADD COLUMN IF NOT EXISTS merged_at TIMESTAMP;
+	ALTER TABLE github_sync_jobs ADD COLUMN IF NOT EXISTS user_id UUID REFERENCES users(id) ON DELETE SET NULL;
+
+	ALTER TABLE github_sync_jobs
+		DROP CONSTRAINT IF EXISTS github_sync_jobs_status_check,
+		ADD CONSTRAINT github_sync_jobs_status_check CHECK (status IN ('pending', 'running', 'synced', 'failed'));
+
+	-- Every job is exactly one changeset, version or fast-forward
+	ALTER TABLE github_sync_jobs
+		DROP CONSTRAINT IF EXISTS github_sync_jobs_check,
+		DROP CONSTRAINT IF EXISTS github_sync_jobs_source_check,
+		ADD CONSTRAINT github_sync_jobs_source_check CHECK (num_nonnulls(changeset_id, version_id, merged_from) = 1);
+
+	CREATE INDEX IF NOT EXISTS idx_github_sync_jobs_project ON github_sync_jobs(project_id, branch, seq);
+	CREATE INDEX IF NOT EXISTS idx_github_sync_jobs_status ON github_sync_jobs(status) WHERE status <> 'synced';
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
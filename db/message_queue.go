@@ -0,0 +1,162 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type QueuedMessage struct {
+	ID          uuid.UUID  `json:"id"`
+	Seq         int64      `json:"seq"`
+	RecipientID uuid.UUID  `json:"recipient_id"`
+	MessageType string     `json:"message_type"`
+	Payload     []byte     `json:"payload"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	AckedAt     *time.Time `json:"acked_at,omitempty"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+}
+
+type MessageQueueModel struct {
+	DB *sql.DB
+}
+
+// ErrQueueFull - The recipient already has as many pending messages, or bytes of them, as allowed
+var ErrQueueFull = errors.New("message queue is full")
+
+// EnqueueMessage - Stores a WebSocket message until the recipient acknowledges it. Returns
+// ErrQueueFull instead if the recipient has maxPending pending messages, or if the message would
+// take their pending messages over maxBytes.
+func (m *MessageQueueModel) EnqueueMessage(recipientID uuid.UUID, messageType string, payload []byte, expiresAt time.Time, maxPending int, maxBytes int64) (*QueuedMessage, error) {
+	query := `
+		INSERT INTO message_queue (id, recipient_id, message_type, payload, created_at, expires_at)
+		SELECT $1::uuid, $2::uuid, $3::text, $4::jsonb, $5::timestamp, $6::timestamp
+		FROM (
+			SELECT COUNT(*) AS pending, COALESCE(SUM(octet_length(payload::text)), 0) AS bytes
+			FROM message_queue
+			WHERE recipient_id = $2 AND acked_at IS NULL AND expires_at > $5
+		) queued
+		WHERE queued.pending < $7 AND queued.bytes + $8 <= $9
+		RETURNING id, seq, recipient_id, message_type, payload, created_at, expires_at
+	`
+
+	id := uuid.New()
+	now := time.Now()
+
+	var qm QueuedMessage
+	err := m.DB.QueryRow(query, id, recipientID, messageType, payload, now, expiresAt, maxPending, len(payload), maxBytes).Scan(
+		&qm.ID, &qm.Seq, &qm.RecipientID, &qm.MessageType, &qm.Payload, &qm.CreatedAt, &qm.ExpiresAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrQueueFull
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &qm, nil
+}
+
+// GetPendingMessages - Gets unacknowledged, unexpired messages for a user in the order they were queued
+func (m *MessageQueueModel) GetPendingMessages(recipientID uuid.UUID, limit int) ([]QueuedMessage, error) {
+	query := `
+		SELECT id, seq, recipient_id, message_type, payload, created_at, delivered_at, acked_at, expires_at
+		FROM message_queue
+		WHERE recipient_id = $1 AND acked_at IS NULL AND expires_at > $2
+		ORDER BY seq ASC
+		LIMIT $3
+	`
+
+	rows, err := m.DB.Query(query, recipientID, time.Now(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []QueuedMessage
+	for rows.Next() {
+		var qm QueuedMessage
+		err := rows.Scan(
+			&qm.ID, &qm.Seq, &qm.RecipientID, &qm.MessageType, &qm.Payload,
+			&qm.CreatedAt, &qm.DeliveredAt, &qm.AckedAt, &qm.ExpiresAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, qm)
+	}
+
+	return messages, nil
+}
+
+// MarkDelivered - Records that a message was written to at least one of the recipient's connections
+func (m *MessageQueueModel) MarkDelivered(messageID uuid.UUID) error {
+	query := `
+		UPDATE message_queue
+		SET delivered_at = $1
+		WHERE id = $2 AND delivered_at IS NULL
+	`
+	_, err := m.DB.Exec(query, time.Now(), messageID)
+	return err
+}
+
+// AcknowledgeMessage - Marks a message as acknowledged by its recipient
+func (m *MessageQueueModel) AcknowledgeMessage(messageID, recipientID uuid.UUID) error {
+	query := `
+		UPDATE message_queue
+		SET acked_at = $1
+		WHERE id = $2 AND recipient_id = $3 AND acked_at IS NULL
+	`
+
+	result, err := m.DB.Exec(query, time.Now(), messageID, recipientID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// DeleteExpiredMessages - Removes acknowledged messages and messages past their retention window
+func (m *MessageQueueModel) DeleteExpiredMessages(now time.Time) (int64, error) {
+	query := `DELETE FROM message_queue WHERE expires_at < $1 OR acked_at IS NOT NULL`
+	result, err := m.DB.Exec(query, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// InitMessageQueueTable - Creates the message_queue table
+func InitMessageQueueTable() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS message_queue (
+		id UUID PRIMARY KEY,
+		seq BIGSERIAL UNIQUE,
+		recipient_id UUID REFERENCES users(id) ON DELETE CASCADE,
+		message_type TEXT NOT NULL,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		delivered_at TIMESTAMP,
+		acked_at TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_message_queue_recipient ON message_queue(recipient_id, seq);
+	CREATE INDEX IF NOT EXISTS idx_message_queue_expires_at ON message_queue(expires_at);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
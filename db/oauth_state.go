@@ -0,0 +1,105 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OAuthState - One GitHub login in progress. The state is only stored as its hash; the PKCE
+// verifier is kept as is, since it has to be sent to GitHub with the code.
+type OAuthState struct {
+	ID          uuid.UUID `json:"id"`
+	StateHash   string    `json:"-"`
+	Verifier    string    `json:"-"`
+	RedirectURI string    `json:"redirect_uri,omitempty"`
+	ClientState string    `json:"client_state,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+type OAuthStateModel struct {
+	DB *sql.DB
+}
+
+// CreateOAuthState - Stores a login that is about to be sent to GitHub
+func (m *OAuthStateModel) CreateOAuthState(stateHash, verifier, redirectURI, clientState string, expiresAt time.Time) (*OAuthState, error) {
+	query := `
+		INSERT INTO oauth_states (id, state_hash, verifier, redirect_uri, client_state, created_at, expires_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7)
+	`
+
+	state := OAuthState{
+		ID:          uuid.New(),
+		StateHash:   stateHash,
+		Verifier:    verifier,
+		RedirectURI: redirectURI,
+		ClientState: clientState,
+		CreatedAt:   time.Now(),
+		ExpiresAt:   expiresAt,
+	}
+
+	_, err := m.DB.Exec(query, state.ID, state.StateHash, state.Verifier, state.RedirectURI,
+		state.ClientState, state.CreatedAt, state.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// ConsumeOAuthState - Deletes and returns the login behind a state hash, so each state is
+// accepted at most once. Returns sql.ErrNoRows if it is unknown, used or expired.
+func (m *OAuthStateModel) ConsumeOAuthState(stateHash string) (*OAuthState, error) {
+	query := `
+		DELETE FROM oauth_states
+		WHERE state_hash = $1
+		RETURNING id, state_hash, verifier, COALESCE(redirect_uri, ''), COALESCE(client_state, ''), created_at, expires_at
+	`
+
+	var state OAuthState
+	err := m.DB.QueryRow(query, stateHash).Scan(
+		&state.ID, &state.StateHash, &state.Verifier, &state.RedirectURI,
+		&state.ClientState, &state.CreatedAt, &state.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(state.ExpiresAt) {
+		return nil, sql.ErrNoRows
+	}
+
+	return &state, nil
+}
+
+// DeleteExpiredOAuthStates - Removes logins that were never completed
+func (m *OAuthStateModel) DeleteExpiredOAuthStates(cutoff time.Time) (int64, error) {
+	query := `DELETE FROM oauth_states WHERE expires_at < $1`
+	result, err := m.DB.Exec(query, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// InitOAuthStateTable - Creates the oauth_states table
+func InitOAuthStateTable() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS oauth_states (
+		id UUID PRIMARY KEY,
+		state_hash TEXT UNIQUE NOT NULL,
+		verifier TEXT NOT NULL,
+		redirect_uri TEXT,
+		client_state TEXT,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_oauth_states_expires_at ON oauth_states(expires_at);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
@@ -2,90 +2,128 @@ package db
 
 import (
 	"database/sql"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type Project struct {
-	ID          uuid.UUID `json:"id"`
-	OwnerID     uuid.UUID `json:"owner_id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID          uuid.UUID   `json:"id"`
+	OwnerID     uuid.UUID   `json:"owner_id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Repo        *GitHubRepo `json:"repo"` // nil when the project isn't linked to a repository
+
+	WebhookSecret string `json:"-"` // signs the deliveries of the repository's webhook; empty until linked
 }
 
 type ProjectModel struct {
 	DB *sql.DB
 }
 
+const projectColumns = `id, owner_id, name, description, created_at, repo_owner, repo_name, default_branch,
+	repo_id, repo_visibility, repo_html_url, repo_clone_url, repo_ssh_url, webhook_secret`
+
+func scanProject(row interface{ Scan(...interface{}) error }) (*Project, error) {
+	var project Project
+	var owner, name, branch, visibility, htmlURL, cloneURL, sshURL, secret sql.NullString
+	var repoID sql.NullInt64
+	err := row.Scan(
+		&project.ID, &project.OwnerID, &project.Name, &project.Description, &project.CreatedAt,
+		&owner, &name, &branch, &repoID, &visibility, &htmlURL, &cloneURL, &sshURL, &secret,
+	)
+	if err != nil {
+		return nil, err
+	}
+	project.WebhookSecret = secret.String
+
+	if owner.Valid && name.Valid {
+		project.Repo = &GitHubRepo{
+			ID:            repoID.Int64,
+			Owner:         owner.String,
+			Name:          name.String,
+			DefaultBranch: branch.String,
+			Visibility:    visibility.String,
+			HTMLURL:       htmlURL.String,
+			CloneURL:      cloneURL.String,
+			SSHURL:        sshURL.String,
+		}
+		if project.Repo.DefaultBranch == "" {
+			project.Repo.DefaultBranch = DefaultBranch
+		}
+	}
+	return &project, nil
+}
+
+func scanProjects(rows *sql.Rows) ([]Project, error) {
+	defer rows.Close()
+
+	var projects []Project
+	for rows.Next() {
+		project, err := scanProject(rows)
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, *project)
+	}
+
+	return projects, rows.Err()
+}
+
+// defaultMaxFileSizeMB - Largest file a project accepts unless MAX_FILE_SIZE_MB or the project says otherwise
+const defaultMaxFileSizeMB = 512
+
+// DefaultMaxFileSize - The file size limit, in bytes, for projects that don't set their own
+func DefaultMaxFileSize() int64 {
+	if mb, err := strconv.ParseInt(os.Getenv("MAX_FILE_SIZE_MB"), 10, 64); err == nil && mb > 0 {
+		return mb << 20
+	}
+	return defaultMaxFileSizeMB << 20
+}
+
 // CreateProject - Creates a new project
 func (m *ProjectModel) CreateProject(ownerID uuid.UUID, name, description string) (*Project, error) {
 	query := `
 		INSERT INTO projects (id, owner_id, name, description, created_at)
 		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id, owner_id, name, description, created_at
+		RETURNING ` + projectColumns + `
 	`
 
 	id := uuid.New()
 	now := time.Now()
 
-	var project Project
-	err := m.DB.QueryRow(query, id, ownerID, name, description, now).Scan(
-		&project.ID, &project.OwnerID, &project.Name, &project.Description, &project.CreatedAt,
-	)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return &project, nil
+	return scanProject(m.DB.QueryRow(query, id, ownerID, name, description, now))
 }
 
 // GetProjectByID - Gets project by ID
 func (m *ProjectModel) GetProjectByID(projectID uuid.UUID) (*Project, error) {
 	query := `
-		SELECT id, owner_id, name, description, created_at
+		SELECT ` + projectColumns + `
 		FROM projects
 		WHERE id = $1
 	`
 
-	var project Project
-	err := m.DB.QueryRow(query, projectID).Scan(
-		&project.ID, &project.OwnerID, &project.Name, &project.Description, &project.CreatedAt,
-	)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return &project, nil
+	return scanProject(m.DB.QueryRow(query, projectID))
 }
 
 // GetProjectByName - Gets project by owner ID and name
 func (m *ProjectModel) GetProjectByName(ownerID uuid.UUID, name string) (*Project, error) {
 	query := `
-		SELECT id, owner_id, name, description, created_at
+		SELECT ` + projectColumns + `
 		FROM projects
 		WHERE owner_id = $1 AND name = $2
 	`
 
-	var project Project
-	err := m.DB.QueryRow(query, ownerID, name).Scan(
-		&project.ID, &project.OwnerID, &project.Name, &project.Description, &project.CreatedAt,
-	)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return &project, nil
+	return scanProject(m.DB.QueryRow(query, ownerID, name))
 }
 
 // GetProjectsByUser - Gets all projects for a user
 func (m *ProjectModel) GetProjectsByUser(ownerID uuid.UUID) ([]Project, error) {
 	query := `
-		SELECT id, owner_id, name, description, created_at
+		SELECT ` + projectColumns + `
 		FROM projects
 		WHERE owner_id = $1
 		ORDER BY created_at DESC
@@ -95,27 +133,25 @@ func (m *ProjectModel) GetProjectsByUser(ownerID uuid.UUID) ([]Project, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return scanProjects(rows)
+}
 
-	var projects []Project
-	for rows.Next() {
-		var project Project
-		err := rows.Scan(
-			&project.ID, &project.OwnerID, &project.Name, &project.Description, &project.CreatedAt,
-		)
-		if err != nil {
-			return nil, err
-		}
-		projects = append(projects, project)
+// DeleteProject - Deletes a project along with its collaborations
+func (m *ProjectModel) DeleteProject(ownerID, projectID uuid.UUID) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	return projects, nil
-}
+	// collaborators.project_id has no ON DELETE CASCADE
+	_, err = tx.Exec(`DELETE FROM collaborators WHERE project_id = $1`, projectID)
+	if err != nil {
+		return err
+	}
 
-// DeleteProject - Deletes a project
-func (m *ProjectModel) DeleteProject(ownerID, projectID uuid.UUID) error {
 	query := `DELETE FROM projects WHERE id = $1 AND owner_id = $2`
-	result, err := m.DB.Exec(query, projectID, ownerID)
+	result, err := tx.Exec(query, projectID, ownerID)
 	if err != nil {
 		return err
 	}
@@ -129,7 +165,7 @@ func (m *ProjectModel) DeleteProject(ownerID, projectID uuid.UUID) error {
 		return sql.ErrNoRows
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 // UpdateProject - Updates project information
@@ -143,31 +179,307 @@ func (m *ProjectModel) UpdateProject(projectID uuid.UUID, name, description stri
 	return err
 }
 
-// GetAllProjects - Gets all projects (admin function)
-func (m *ProjectModel) GetAllProjects() ([]Project, error) {
-	query := `
-		SELECT id, owner_id, name, description, created_at
-		FROM projects
-		ORDER BY created_at DESC
-	`
+// GetMaxFileSize - Gets the largest file, in bytes, a project accepts, and whether that is the
+// project's own limit rather than the server default
+func (m *ProjectModel) GetMaxFileSize(projectID uuid.UUID) (int64, bool, error) {
+	var limit sql.NullInt64
+	err := m.DB.QueryRow(`SELECT max_file_size FROM projects WHERE id = $1`, projectID).Scan(&limit)
+	if err != nil {
+		return 0, false, err
+	}
+	if !limit.Valid {
+		return DefaultMaxFileSize(), false, nil
+	}
+	return limit.Int64, true, nil
+}
 
-	rows, err := m.DB.Query(query)
+// SetMaxFileSize - Sets a project's file size limit in bytes; nil goes back to the server default
+func (m *ProjectModel) SetMaxFileSize(projectID uuid.UUID, limit *int64) error {
+	result, err := m.DB.Exec(`UPDATE projects SET max_file_size = $1 WHERE id = $2`, limit, projectID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// GitHubRepo - The GitHub repository a project is mirrored to. The ID stays the same when the
+// repository is renamed or transferred, so the rest is refreshed from it.
+type GitHubRepo struct {
+	ID            int64  `json:"id,omitempty"`
+	Owner         string `json:"owner"`
+	Name          string `json:"name"`
+	DefaultBranch string `json:"default_branch"`       // the branch the project's main branch syncs to
+	Visibility    string `json:"visibility,omitempty"` // "public", "private" or "internal"
+	HTMLURL       string `json:"html_url,omitempty"`
+	CloneURL      string `json:"clone_url,omitempty"`
+	SSHURL        string `json:"ssh_url,omitempty"`
+}
+
+// GetGitHubRepo - Gets the repository linked to a project; sql.ErrNoRows if there is none
+func (m *ProjectModel) GetGitHubRepo(projectID uuid.UUID) (*GitHubRepo, error) {
+	project, err := m.GetProjectByID(projectID)
+	if err != nil {
+		return nil, err
+	}
+	if project.Repo == nil {
+		return nil, sql.ErrNoRows
+	}
+	return project.Repo, nil
+}
+
+// SetGitHubRepo - Links a project to a GitHub repository, or updates what is stored about it
+func (m *ProjectModel) SetGitHubRepo(projectID uuid.UUID, repo GitHubRepo) error {
+	result, err := m.DB.Exec(`
+		UPDATE projects
+		SET repo_owner = $1, repo_name = $2, default_branch = NULLIF($3, ''), repo_id = NULLIF($4, 0),
+			repo_visibility = NULLIF($5, ''), repo_html_url = NULLIF($6, ''), repo_clone_url = NULLIF($7, ''),
+			repo_ssh_url = NULLIF($8, '')
+		WHERE id = $9
+	`, repo.Owner, repo.Name, repo.DefaultBranch, repo.ID, repo.Visibility, repo.HTMLURL, repo.CloneURL, repo.SSHURL, projectID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// EnsureWebhookSecret - Gives a linked project the webhook secret unless it already has one, and
+// returns the secret it ends up with
+func (m *ProjectModel) EnsureWebhookSecret(projectID uuid.UUID, secret string) (string, error) {
+	err := m.DB.QueryRow(`
+		UPDATE projects
+		SET webhook_secret = COALESCE(webhook_secret, $1)
+		WHERE id = $2 AND repo_owner IS NOT NULL AND repo_name IS NOT NULL
+		RETURNING webhook_secret
+	`, secret, projectID).Scan(&secret)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// SetWebhookSecret - Replaces a linked project's webhook secret. Deliveries signed with the old
+// one are rejected from then on.
+func (m *ProjectModel) SetWebhookSecret(projectID uuid.UUID, secret string) error {
+	result, err := m.DB.Exec(`
+		UPDATE projects
+		SET webhook_secret = $1
+		WHERE id = $2 AND repo_owner IS NOT NULL AND repo_name IS NOT NULL
+	`, secret, projectID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// GetLinkedProjectIDs - Gets every project linked to a GitHub repository
+func (m *ProjectModel) GetLinkedProjectIDs() ([]uuid.UUID, error) {
+	rows, err := m.DB.Query(`
+		SELECT id FROM projects
+		WHERE repo_owner IS NOT NULL AND repo_name IS NOT NULL
+		ORDER BY created_at
+	`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var projects []Project
+	var projectIDs []uuid.UUID
 	for rows.Next() {
-		var project Project
-		err := rows.Scan(
-			&project.ID, &project.OwnerID, &project.Name, &project.Description, &project.CreatedAt,
-		)
-		if err != nil {
+		var projectID uuid.UUID
+		if err := rows.Scan(&projectID); err != nil {
 			return nil, err
 		}
-		projects = append(projects, project)
+		projectIDs = append(projectIDs, projectID)
+	}
+
+	return projectIDs, rows.Err()
+}
+
+// GetProjectsByRepoID - Gets the projects linked to a repository, whatever it is called now
+func (m *ProjectModel) GetProjectsByRepoID(repoID int64) ([]Project, error) {
+	rows, err := m.DB.Query(`
+		SELECT `+projectColumns+`
+		FROM projects
+		WHERE repo_id = $1
+	`, repoID)
+	if err != nil {
+		return nil, err
+	}
+	return scanProjects(rows)
+}
+
+// GetProjectsByRepo - Gets the projects linked to a repository. GitHub names are case-insensitive.
+func (m *ProjectModel) GetProjectsByRepo(owner, name string) ([]Project, error) {
+	rows, err := m.DB.Query(`
+		SELECT `+projectColumns+`
+		FROM projects
+		WHERE LOWER(repo_owner) = LOWER($1) AND LOWER(repo_name) = LOWER($2)
+	`, owner, name)
+	if err != nil {
+		return nil, err
+	}
+	return scanProjects(rows)
+}
+
+// insertLinkedProject - Inserts a project that is linked to repo from the start
+func insertLinkedProject(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, ownerID uuid.UUID, name, description string, repo GitHubRepo, webhookSecret string, now time.Time) (*Project, error) {
+	return scanProject(q.QueryRow(`
+		INSERT INTO projects (id, owner_id, name, description, created_at, repo_owner, repo_name, default_branch,
+			repo_id, repo_visibility, repo_html_url, repo_clone_url, repo_ssh_url, webhook_secret)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, 0), NULLIF($10, ''), NULLIF($11, ''), NULLIF($12, ''), NULLIF($13, ''), $14)
+		RETURNING `+projectColumns+`
+	`, uuid.New(), ownerID, name, description, now, repo.Owner, repo.Name, repo.DefaultBranch,
+		repo.ID, repo.Visibility, repo.HTMLURL, repo.CloneURL, repo.SSHURL, webhookSecret))
+}
+
+// CreateLinkedProject - Creates a project already linked to repo, with webhookSecret for its
+// webhook. There is no moment at which the project exists without its link.
+func (m *ProjectModel) CreateLinkedProject(ownerID uuid.UUID, name, description string, repo GitHubRepo, webhookSecret string) (*Project, error) {
+	return insertLinkedProject(m.DB, ownerID, name, description, repo, webhookSecret, time.Now())
+}
+
+// PushedRepo - A repository the server created for a push, with the settings it was created with
+type PushedRepo struct {
+	RepoID            int64
+	OwnerID           uuid.UUID
+	Private           bool
+	Template          string
+	GitignoreTemplate string
+	AutoInit          bool
+	CreatedAt         time.Time
+}
+
+// RecordPushedRepo - Remembers a repository created for a push before its project is created, so
+// a push retried after a failure can tell the repository is its own
+func (m *ProjectModel) RecordPushedRepo(repo PushedRepo) error {
+	_, err := m.DB.Exec(`
+		INSERT INTO pushed_repos (repo_id, owner_id, private, template, gitignore_template, auto_init, created_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7)
+		ON CONFLICT (repo_id) DO NOTHING
+	`, repo.RepoID, repo.OwnerID, repo.Private, repo.Template, repo.GitignoreTemplate, repo.AutoInit, time.Now())
+	return err
+}
+
+// GetPushedRepo - Gets a repository created for a push; sql.ErrNoRows if the server didn't create it
+func (m *ProjectModel) GetPushedRepo(repoID int64) (*PushedRepo, error) {
+	var repo PushedRepo
+	err := m.DB.QueryRow(`
+		SELECT repo_id, owner_id, private, COALESCE(template, ''), COALESCE(gitignore_template, ''), auto_init, created_at
+		FROM pushed_repos
+		WHERE repo_id = $1
+	`, repoID).Scan(&repo.RepoID, &repo.OwnerID, &repo.Private, &repo.Template, &repo.GitignoreTemplate, &repo.AutoInit, &repo.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &repo, nil
+}
+
+// ImportedFile - A file brought in from a repository, its content already in the blob store
+type ImportedFile struct {
+	FilePath string
+	FileName string
+	FileType string
+	Hash     string
+	Size     int64
+	IsBinary bool
+}
+
+// ImportProject - In one transaction, creates a project linked to repo, with webhookSecret for
+// its webhook, whose default branch starts with files, committed as one changeset by the owner.
+// Nothing is queued for GitHub sync: the repository already has these contents.
+func (m *ProjectModel) ImportProject(ownerID uuid.UUID, name, description string, repo GitHubRepo, webhookSecret, message string, files []ImportedFile) (*Project, *Changeset, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	project, err := insertLinkedProject(tx, ownerID, name, description, repo, webhookSecret, now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cs *Changeset
+	if len(files) > 0 {
+		cs = &Changeset{
+			ID:        uuid.New(),
+			ProjectID: project.ID,
+			UserID:    ownerID,
+			Message:   message,
+			Branch:    DefaultBranch,
+			CreatedAt: now,
+		}
+		_, err := tx.Exec(`
+			INSERT INTO changesets (id, project_id, user_id, message, branch, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, cs.ID, cs.ProjectID, cs.UserID, cs.Message, cs.Branch, cs.CreatedAt)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, file := range files {
+			fv, err := insertVersion(
+				tx, project.ID, ownerID, &cs.ID, DefaultBranch, file.FilePath, file.FileName, file.FileType,
+				file.Hash, file.Size, file.IsBinary, message, false,
+			)
+			if err != nil {
+				return nil, nil, err
+			}
+			cs.Files = append(cs.Files, *fv)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
 	}
 
-	return projects, nil
+	return project, cs, nil
+}
+
+// GetAllProjects - Gets all projects (admin function)
+func (m *ProjectModel) GetAllProjects() ([]Project, error) {
+	query := `
+		SELECT ` + projectColumns + `
+		FROM projects
+		ORDER BY created_at DESC
+	`
+
+	rows, err := m.DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	return scanProjects(rows)
 }
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Session struct {
+	ID        uuid.UUID  `json:"id"`
+	UserID    uuid.UUID  `json:"user_id"`
+	TokenHash string     `json:"-"`
+	IPAddress string     `json:"ip_address,omitempty"`
+	UserAgent string     `json:"user_agent,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type SessionModel struct {
+	DB *sql.DB
+}
+
+// CreateSession - Stores a new session for a user, keyed by the hash of its token
+func (m *SessionModel) CreateSession(userID uuid.UUID, tokenHash, ipAddress, userAgent string, expiresAt time.Time) (*Session, error) {
+	query := `
+		INSERT INTO sessions (id, user_id, token_hash, ip_address, user_agent, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, user_id, token_hash, ip_address, user_agent, created_at, expires_at
+	`
+
+	id := uuid.New()
+	now := time.Now()
+
+	var session Session
+	err := m.DB.QueryRow(query, id, userID, tokenHash, ipAddress, userAgent, now, expiresAt).Scan(
+		&session.ID, &session.UserID, &session.TokenHash, &session.IPAddress,
+		&session.UserAgent, &session.CreatedAt, &session.ExpiresAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// GetActiveSession - Gets a session by token hash if it is neither expired nor revoked
+func (m *SessionModel) GetActiveSession(tokenHash string) (*Session, error) {
+	query := `
+		SELECT id, user_id, token_hash, ip_address, user_agent, created_at, expires_at
+		FROM sessions
+		WHERE token_hash = $1 AND revoked_at IS NULL AND expires_at > $2
+	`
+
+	var session Session
+	err := m.DB.QueryRow(query, tokenHash, time.Now()).Scan(
+		&session.ID, &session.UserID, &session.TokenHash, &session.IPAddress,
+		&session.UserAgent, &session.CreatedAt, &session.ExpiresAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// IsSessionActive - Checks whether a session is still neither expired nor revoked
+func (m *SessionModel) IsSessionActive(sessionID uuid.UUID) (bool, error) {
+	query := `
+		SELECT EXISTS(
+			SELECT 1 FROM sessions
+			WHERE id = $1 AND revoked_at IS NULL AND expires_at > $2
+		)
+	`
+
+	var active bool
+	err := m.DB.QueryRow(query, sessionID, time.Now()).Scan(&active)
+	if err != nil {
+		return false, err
+	}
+
+	return active, nil
+}
+
+// RevokeSession - Revokes a single session
+func (m *SessionModel) RevokeSession(sessionID uuid.UUID) error {
+	query := `
+		UPDATE sessions
+		SET revoked_at = $1
+		WHERE id = $2 AND revoked_at IS NULL
+	`
+
+	result, err := m.DB.Exec(query, time.Now(), sessionID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// RevokeUserSessions - Revokes every active session belonging to a user and returns their IDs
+func (m *SessionModel) RevokeUserSessions(userID uuid.UUID) ([]uuid.UUID, error) {
+	query := `
+		UPDATE sessions
+		SET revoked_at = $1
+		WHERE user_id = $2 AND revoked_at IS NULL
+		RETURNING id
+	`
+
+	rows, err := m.DB.Query(query, time.Now(), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessionIDs []uuid.UUID
+	for rows.Next() {
+		var sessionID uuid.UUID
+		if err := rows.Scan(&sessionID); err != nil {
+			return nil, err
+		}
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+
+	return sessionIDs, rows.Err()
+}
+
+// DeleteExpiredSessions - Removes sessions that expired or were revoked before the cutoff
+func (m *SessionModel) DeleteExpiredSessions(cutoff time.Time) (int64, error) {
+	query := `DELETE FROM sessions WHERE expires_at < $1 OR revoked_at < $1`
+	result, err := m.DB.Exec(query, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// InitSessionTable - Creates the sessions table
+func InitSessionTable() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id UUID PRIMARY KEY,
+		user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+		token_hash TEXT UNIQUE NOT NULL,
+		ip_address TEXT,
+		user_agent TEXT,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+	CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"database/sql"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type SnapshotModel struct {
+	DB *sql.DB
+}
+
+// GetSnapshot - Gets the latest non-deleted version of every file as seen through a branch or
+// tag, optionally as it was at a point in time, ordered by path. Contents are not loaded; stream
+// them with WriteVersionContent.
+func (m *SnapshotModel) GetSnapshot(projectID uuid.UUID, ref *Ref, at *time.Time) ([]FileVersion, error) {
+	cond, args := ref.condition(2)
+	args = append([]interface{}{projectID}, args...)
+
+	// A version joins a branch at branch_since: when it was committed, or when it was fast-forwarded in
+	if at != nil {
+		args = append(args, *at)
+		cond += " AND branch_since <= $" + strconv.Itoa(len(args))
+	}
+
+	query := `
+		SELECT id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, content, commit_message, is_deleted, is_binary, changeset_id, branch, created_at
+		FROM (
+			SELECT DISTINCT ON (file_path) *
+			FROM file_versions
+			WHERE project_id = $1 AND ` + cond + `
+			ORDER BY file_path, version DESC
+		) latest
+		WHERE NOT is_deleted
+		ORDER BY file_path
+	`
+
+	rows, err := m.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []FileVersion
+	for rows.Next() {
+		var fv FileVersion
+		var content sql.NullString
+		err := rows.Scan(
+			&fv.ID, &fv.ProjectID, &fv.UserID, &fv.FilePath, &fv.FileName,
+			&fv.FileType, &fv.Version, &fv.FileHash, &fv.FileSize, &content,
+			&fv.CommitMsg, &fv.IsDeleted, &fv.IsBinary, &fv.ChangesetID, &fv.Branch, &fv.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		// Only versions the blob store migration hasn't reached yet carry their content inline
+		fv.Content = content.String
+		files = append(files, fv)
+	}
+
+	return files, rows.Err()
+}
+
+// GetChangesetPoint - The branch a changeset's versions are on now and the moment the last of
+// them joined it; a snapshot there includes the changeset and everything before it
+func (m *SnapshotModel) GetChangesetPoint(changesetID uuid.UUID) (string, time.Time, error) {
+	var branch string
+	var at time.Time
+	err := m.DB.QueryRow(`
+		SELECT branch, MAX(branch_since)
+		FROM file_versions
+		WHERE changeset_id = $1
+		GROUP BY branch
+		ORDER BY MAX(branch_since) DESC
+		LIMIT 1
+	`, changesetID).Scan(&branch, &at)
+	return branch, at, err
+}
+
+// WriteVersionContent - Streams the content of a version returned by GetSnapshot
+func WriteVersionContent(fv *FileVersion, w io.Writer) (int64, error) {
+	if fv.Content != "" || fv.FileSize == 0 {
+		n, err := io.Copy(w, strings.NewReader(fv.Content))
+		return n, err
+	}
+	return Blobs.WriteTo(fv.FileHash, w)
+}
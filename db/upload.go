@@ -0,0 +1,285 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Upload session states
+const (
+	UploadOpen      = "open"
+	UploadCommitted = "committed"
+	UploadAborted   = "aborted"
+)
+
+// ErrUploadNotOpen - The upload was already committed or aborted
+var ErrUploadNotOpen = errors.New("upload is not open")
+
+// Upload - A file being sent in chunks. Once every chunk is in, committing it creates a binary
+// version of FilePath on Branch.
+type Upload struct {
+	ID          uuid.UUID  `json:"upload_id"`
+	ProjectID   uuid.UUID  `json:"project_id"`
+	UserID      uuid.UUID  `json:"user_id"`
+	Branch      string     `json:"branch"`
+	FilePath    string     `json:"file_path"`
+	FileName    string     `json:"file_name"`
+	FileType    string     `json:"file_type"`
+	TotalSize   int64      `json:"total_size"`
+	ChunkSize   int64      `json:"chunk_size"`
+	FileHash    string     `json:"file_hash,omitempty"` // expected SHA-256 of the whole file, if the client sent one
+	BaseVersion int        `json:"base_version,omitempty"`
+	Status      string     `json:"status"`
+	VersionID   *uuid.UUID `json:"version_id,omitempty"` // set once committed
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+}
+
+// UploadChunk - A received chunk; the bytes are in the blob store under Hash
+type UploadChunk struct {
+	Index int    `json:"index"`
+	Hash  string `json:"hash"`
+	Size  int64  `json:"size"`
+}
+
+// ChunkCount - Chunks the whole file is split into
+func (u *Upload) ChunkCount() int {
+	return int((u.TotalSize + u.ChunkSize - 1) / u.ChunkSize)
+}
+
+// ChunkLength - Size chunk index must have; only the last one may be short
+func (u *Upload) ChunkLength(index int) int64 {
+	if index == u.ChunkCount()-1 {
+		return u.TotalSize - int64(index)*u.ChunkSize
+	}
+	return u.ChunkSize
+}
+
+type UploadModel struct {
+	DB *sql.DB
+}
+
+const uploadColumns = `id, project_id, user_id, branch, file_path, file_name, file_type, total_size, chunk_size,
+	COALESCE(file_hash, ''), base_version, status, version_id, created_at, updated_at, expires_at`
+
+func scanUpload(row interface{ Scan(...interface{}) error }) (*Upload, error) {
+	var u Upload
+	err := row.Scan(
+		&u.ID, &u.ProjectID, &u.UserID, &u.Branch, &u.FilePath, &u.FileName, &u.FileType,
+		&u.TotalSize, &u.ChunkSize, &u.FileHash, &u.BaseVersion, &u.Status, &u.VersionID,
+		&u.CreatedAt, &u.UpdatedAt, &u.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// CreateUpload - Opens an upload session
+func (m *UploadModel) CreateUpload(projectID, userID uuid.UUID, branch, filePath, fileName, fileType string, totalSize, chunkSize int64, fileHash string, baseVersion int, expiresAt time.Time) (*Upload, error) {
+	query := `
+		INSERT INTO upload_sessions (id, project_id, user_id, branch, file_path, file_name, file_type, total_size, chunk_size, file_hash, base_version, status, created_at, updated_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), $11, $12, $13, $13, $14)
+		RETURNING ` + uploadColumns
+
+	return scanUpload(m.DB.QueryRow(
+		query,
+		uuid.New(), projectID, userID, branch, filePath, fileName, fileType,
+		totalSize, chunkSize, fileHash, baseVersion, UploadOpen, time.Now(), expiresAt,
+	))
+}
+
+// GetUpload - Gets an upload session by ID
+func (m *UploadModel) GetUpload(uploadID uuid.UUID) (*Upload, error) {
+	return scanUpload(m.DB.QueryRow(`SELECT `+uploadColumns+` FROM upload_sessions WHERE id = $1`, uploadID))
+}
+
+// SaveChunk - Records a chunk already written to the blob store, replacing an earlier copy of
+// the same index, and keeps the session alive until expiresAt
+func (m *UploadModel) SaveChunk(uploadID uuid.UUID, chunk UploadChunk, expiresAt time.Time) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Taking the row lock here orders chunk writes against a commit of the same upload
+	result, err := tx.Exec(`
+		UPDATE upload_sessions SET updated_at = $1, expires_at = $2
+		WHERE id = $3 AND status = $4
+	`, time.Now(), expiresAt, uploadID, UploadOpen)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrUploadNotOpen
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO upload_chunks (upload_id, chunk_index, hash, size)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (upload_id, chunk_index) DO UPDATE SET hash = EXCLUDED.hash, size = EXCLUDED.size
+	`, uploadID, chunk.Index, chunk.Hash, chunk.Size)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetChunks - Gets the chunks received so far, in order
+func (m *UploadModel) GetChunks(uploadID uuid.UUID) ([]UploadChunk, error) {
+	rows, err := m.DB.Query(`
+		SELECT chunk_index, hash, size
+		FROM upload_chunks
+		WHERE upload_id = $1
+		ORDER BY chunk_index
+	`, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chunks []UploadChunk
+	for rows.Next() {
+		var chunk UploadChunk
+		if err := rows.Scan(&chunk.Index, &chunk.Hash, &chunk.Size); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, rows.Err()
+}
+
+// CommitUpload - In one transaction, creates the binary version for an upload whose assembled
+// content is stored under hash and closes the session. With a base version, the file's latest
+// version on ref is checked against it under the file lock and a *ChangesetFileError is returned
+// if it moved on. Returns ErrUploadNotOpen if the upload was already committed or aborted.
+func (m *UploadModel) CommitUpload(uploadID uuid.UUID, ref *Ref, baseVersion int, hash string, size int64, commitMsg string) (*FileVersion, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	upload, err := scanUpload(tx.QueryRow(`SELECT `+uploadColumns+` FROM upload_sessions WHERE id = $1 FOR UPDATE`, uploadID))
+	if err != nil {
+		return nil, err
+	}
+	if upload.Status != UploadOpen {
+		return nil, ErrUploadNotOpen
+	}
+
+	// Serializes with other writers of the file, as changesets do. Binary files can't be
+	// merged, so a commit over a version other than the base is refused.
+	head, err := lockFile(tx, upload.ProjectID, upload.FilePath, ref)
+	if err != nil {
+		return nil, err
+	}
+	if baseVersion > 0 && head.version != baseVersion {
+		return nil, staleFile(ChangesetFile{Action: ChangeEdit, FilePath: upload.FilePath, BaseVersion: baseVersion}, head)
+	}
+
+	fv, err := insertVersion(
+		tx, upload.ProjectID, upload.UserID, nil, ref.Branch, upload.FilePath, upload.FileName, upload.FileType,
+		hash, size, true, commitMsg, false,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE upload_sessions SET status = $1, version_id = $2, updated_at = $3
+		WHERE id = $4
+	`, UploadCommitted, fv.ID, time.Now(), uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return fv, nil
+}
+
+// AbortUpload - Closes an open upload without committing it
+func (m *UploadModel) AbortUpload(uploadID uuid.UUID) error {
+	result, err := m.DB.Exec(`
+		UPDATE upload_sessions SET status = $1, updated_at = $2
+		WHERE id = $3 AND status = $4
+	`, UploadAborted, time.Now(), uploadID, UploadOpen)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrUploadNotOpen
+	}
+
+	return nil
+}
+
+// DeleteExpiredUploads - Removes upload sessions, whatever their state, that saw no activity
+// before the cutoff. Chunks already in the blob store stay there.
+func (m *UploadModel) DeleteExpiredUploads(cutoff time.Time) (int64, error) {
+	result, err := m.DB.Exec(`DELETE FROM upload_sessions WHERE expires_at < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// InitUploadTables - Creates the upload session tables and marks which versions are binary
+func InitUploadTables() error {
+	query := `
+	ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS is_binary BOOLEAN NOT NULL DEFAULT FALSE;
+
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		id UUID PRIMARY KEY,
+		project_id UUID REFERENCES projects(id) ON DELETE CASCADE,
+		user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+		branch TEXT NOT NULL DEFAULT 'main',
+		file_path TEXT NOT NULL,
+		file_name TEXT NOT NULL,
+		file_type TEXT NOT NULL,
+		total_size BIGINT NOT NULL,
+		chunk_size BIGINT NOT NULL,
+		file_hash TEXT,
+		base_version INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL CHECK (status IN ('open', 'committed', 'aborted')),
+		version_id UUID REFERENCES file_versions(id) ON DELETE SET NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_upload_sessions_expires_at ON upload_sessions(expires_at);
+
+	CREATE TABLE IF NOT EXISTS upload_chunks (
+		upload_id UUID REFERENCES upload_sessions(id) ON DELETE CASCADE,
+		chunk_index INTEGER NOT NULL,
+		hash TEXT NOT NULL,
+		size BIGINT NOT NULL,
+		PRIMARY KEY (upload_id, chunk_index)
+	);
+	`
+
+	_, err := DB.Exec(query)
+	return err
+}
@@ -2,40 +2,62 @@ package db
 
 import (
 	"database/sql"
+	"errors"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type FileVersion struct {
-	ID        uuid.UUID
-	ProjectID uuid.UUID
-	UserID    uuid.UUID
-	FilePath  string
-	FileName  string
-	FileType  string
-	Version   int
-	FileHash  string
-	FileSize  int64
-	Content   string
-	CommitMsg string
-	IsDeleted bool
-	CreatedAt time.Time
+	ID          uuid.UUID
+	ProjectID   uuid.UUID
+	UserID      uuid.UUID
+	FilePath    string
+	FileName    string
+	FileType    string
+	Version     int
+	FileHash    string
+	FileSize    int64
+	Content     string
+	CommitMsg   string
+	IsDeleted   bool
+	IsBinary    bool // content is an uploaded asset, not text; see UploadModel
+	ChangesetID *uuid.UUID
+	Branch      string
+	CreatedAt   time.Time
 }
 
 type FileConflict struct {
-	ID            uuid.UUID
-	ProjectID     uuid.UUID
-	FilePath      string
-	BaseVersion   int
-	LocalUserID   uuid.UUID
-	RemoteUserID  uuid.UUID
-	LocalContent  string
-	RemoteContent string
-	Status        string
-	ResolvedBy    uuid.UUID
-	CreatedAt     time.Time
-	ResolvedAt    time.Time
+	ID                uuid.UUID
+	ProjectID         uuid.UUID
+	FilePath          string
+	Branch            string
+	BaseVersion       int
+	LatestVersion     int // the version the local edits were merged with; 0 if unknown
+	LocalUserID       uuid.UUID
+	RemoteUserID      uuid.UUID
+	LocalContent      string
+	RemoteContent     string
+	BaseContent       string
+	MergedContent     string // merge result with conflict markers around overlapping edits
+	Hunks             []byte // JSON description of the conflicting regions
+	Status            string
+	ResolvedBy        uuid.UUID
+	ResolvedVersionID *uuid.UUID // version created from the resolved content
+	CreatedAt         time.Time
+	ResolvedAt        time.Time
+}
+
+// ErrConflictNotPending - The conflict was already resolved or ignored
+var ErrConflictNotPending = errors.New("conflict is not pending")
+
+// querier - Satisfied by both *sql.DB and *sql.Tx so writes can join a transaction
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
 type VersionModel struct {
@@ -46,82 +68,256 @@ type ConflictModel struct {
 	DB *sql.DB
 }
 
-// CreateVersion - Creates a new file version
-func (m *VersionModel) CreateVersion(projectID, userID uuid.UUID, filePath, fileName, fileType, fileHash string, fileSize int64, content, commitMsg string) (*FileVersion, error) {
-	// Get next version number
+// CreateVersion - Creates a new file version on a branch. fileHash, if set, must be the SHA-256 of content.
+func (m *VersionModel) CreateVersion(projectID, userID uuid.UUID, branch, filePath, fileName, fileType, fileHash, content, commitMsg string) (*FileVersion, error) {
+	return createVersion(m.DB, projectID, userID, nil, branch, filePath, fileName, fileType, fileHash, content, commitMsg, false)
+}
+
+// createVersion - Inserts the next version of a file; deleted files get a tombstone version.
+// The content goes to the blob store and the row keeps its hash, computed here; an expected
+// fileHash from the client is only compared against it.
+func createVersion(q querier, projectID, userID uuid.UUID, changesetID *uuid.UUID, branch, filePath, fileName, fileType, fileHash, content, commitMsg string, isDeleted bool) (*FileVersion, error) {
+	hash, size := "", int64(0)
+	if !isDeleted {
+		hash, size = HashContent([]byte(content)), int64(len(content))
+		if fileHash != "" && !strings.EqualFold(fileHash, hash) {
+			return nil, ErrHashMismatch
+		}
+		if _, err := Blobs.Put([]byte(content)); err != nil {
+			return nil, err
+		}
+	}
+
+	fv, err := insertVersion(q, projectID, userID, changesetID, branch, filePath, fileName, fileType, hash, size, false, commitMsg, isDeleted)
+	if err != nil {
+		return nil, err
+	}
+	if !isDeleted {
+		fv.Content = content
+	}
+	return fv, nil
+}
+
+// insertVersion - Adds the row for the next version of a file whose content is already in the
+// blob store under hash. Version numbers count across all branches so a number names one
+// version of a file.
+func insertVersion(q querier, projectID, userID uuid.UUID, changesetID *uuid.UUID, branch, filePath, fileName, fileType, hash string, size int64, isBinary bool, commitMsg string, isDeleted bool) (*FileVersion, error) {
+	// Get next version number and the content it follows
 	var version int
+	var previousHash string
+	var previousDeleted, previousBinary bool
 	versionQuery := `
-		SELECT COALESCE(MAX(version), 0) + 1
+		SELECT version, file_hash, is_deleted, is_binary
 		FROM file_versions
 		WHERE project_id = $1 AND file_path = $2
+		ORDER BY version DESC
+		LIMIT 1
 	`
-	err := m.DB.QueryRow(versionQuery, projectID, filePath).Scan(&version)
+	err := q.QueryRow(versionQuery, projectID, filePath).Scan(&version, &previousHash, &previousDeleted, &previousBinary)
 	if err != nil {
-		version = 1
+		version, previousHash = 0, ""
 	}
+	version++
 
 	query := `
-		INSERT INTO file_versions (id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, content, commit_message, is_deleted, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
-		RETURNING id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, content, commit_message, is_deleted, created_at
+		INSERT INTO file_versions (id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, content, commit_message, is_deleted, is_binary, changeset_id, branch, branch_since, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $16)
+		RETURNING id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, commit_message, is_deleted, is_binary, changeset_id, branch, created_at
 	`
 
 	id := uuid.New()
 	now := time.Now()
 
 	var fv FileVersion
-	err = m.DB.QueryRow(
+	err = q.QueryRow(
 		query,
 		id, projectID, userID, filePath, fileName, fileType, version,
-		fileHash, fileSize, content, commitMsg, false, now,
+		hash, size, nil, commitMsg, isDeleted, isBinary, changesetID, branch, now,
 	).Scan(
 		&fv.ID, &fv.ProjectID, &fv.UserID, &fv.FilePath, &fv.FileName,
-		&fv.FileType, &fv.Version, &fv.FileHash, &fv.FileSize, &fv.Content,
-		&fv.CommitMsg, &fv.IsDeleted, &fv.CreatedAt,
+		&fv.FileType, &fv.Version, &fv.FileHash, &fv.FileSize,
+		&fv.CommitMsg, &fv.IsDeleted, &fv.IsBinary, &fv.ChangesetID, &fv.Branch, &fv.CreatedAt,
 	)
 
 	if err != nil {
 		return nil, err
 	}
 
+	// A changeset is mirrored to GitHub as a whole; a version committed on its own gets its own commit
+	if changesetID == nil {
+		if err := enqueueSync(q, projectID, nil, &fv.ID, branch); err != nil {
+			return nil, err
+		}
+	}
+
+	// The version this one replaces becomes a delta against it; binary assets don't delta well
+	if !previousDeleted && !previousBinary && !isBinary {
+		Blobs.QueueDelta(previousHash, hash)
+	}
+
 	return &fv, nil
 }
 
-// GetLatestVersion - Gets the latest version of a file
-func (m *VersionModel) GetLatestVersion(projectID uuid.UUID, filePath string) (*FileVersion, error) {
+// CommitChange - Commits a single file change, checked against the branch the same way as a
+// changeset file but without recording a changeset. Returns a *ChangesetFileError if the file
+// moved on from file.BaseVersion.
+func (m *VersionModel) CommitChange(projectID, userID uuid.UUID, ref *Ref, file ChangesetFile, commitMsg string) (*FileVersion, error) {
+	if ref == nil {
+		ref = DefaultRef()
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	fv, err := applyChange(tx, projectID, userID, nil, ref, file, commitMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return fv, nil
+}
+
+// resolveContent - Fills in a version's content, kept in the row for versions from before the
+// blob store and in the blob store otherwise. Binary versions are left empty; their bytes are
+// read with Blobs.WriteTo.
+func resolveContent(fv *FileVersion, inline sql.NullString) error {
+	switch {
+	case inline.Valid:
+		fv.Content = inline.String
+	case fv.IsDeleted || fv.IsBinary || fv.FileHash == "":
+		fv.Content = ""
+	default:
+		content, err := Blobs.Get(fv.FileHash)
+		if err != nil {
+			return err
+		}
+		fv.Content = string(content)
+	}
+	return nil
+}
+
+// GetLatestVersion - Gets the latest version of a file as seen through a branch or tag (nil for
+// the default branch); a file whose latest version deletes it is not found
+func (m *VersionModel) GetLatestVersion(projectID uuid.UUID, filePath string, ref *Ref) (*FileVersion, error) {
+	cond, args := ref.condition(3)
 	query := `
-		SELECT id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, content, commit_message, is_deleted, created_at
+		SELECT id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, content, commit_message, is_deleted, is_binary, changeset_id, branch, created_at
 		FROM file_versions
-		WHERE project_id = $1 AND file_path = $2 AND is_deleted = false
+		WHERE project_id = $1 AND file_path = $2 AND ` + cond + `
 		ORDER BY version DESC
 		LIMIT 1
 	`
 
 	var fv FileVersion
-	err := m.DB.QueryRow(query, projectID, filePath).Scan(
+	var content sql.NullString
+	err := m.DB.QueryRow(query, append([]interface{}{projectID, filePath}, args...)...).Scan(
 		&fv.ID, &fv.ProjectID, &fv.UserID, &fv.FilePath, &fv.FileName,
-		&fv.FileType, &fv.Version, &fv.FileHash, &fv.FileSize, &fv.Content,
-		&fv.CommitMsg, &fv.IsDeleted, &fv.CreatedAt,
+		&fv.FileType, &fv.Version, &fv.FileHash, &fv.FileSize, &content,
+		&fv.CommitMsg, &fv.IsDeleted, &fv.IsBinary, &fv.ChangesetID, &fv.Branch, &fv.CreatedAt,
 	)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if err := resolveContent(&fv, content); err != nil {
+		return nil, err
+	}
+
+	if fv.IsDeleted {
+		return nil, sql.ErrNoRows
+	}
+
 	return &fv, nil
 }
 
-// GetFileHistory - Gets version history for a file
-func (m *VersionModel) GetFileHistory(projectID uuid.UUID, filePath string, limit int) ([]FileVersion, error) {
+// GetPreviousVersion - Gets the newest version of a file before the given version number, as seen
+// through a branch or tag. Unlike GetLatestVersion, a deletion is returned rather than hidden.
+func (m *VersionModel) GetPreviousVersion(projectID uuid.UUID, filePath string, ref *Ref, before int) (*FileVersion, error) {
+	cond, args := ref.condition(4)
 	query := `
-		SELECT id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, commit_message, is_deleted, created_at
+		SELECT id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, content, commit_message, is_deleted, is_binary, changeset_id, branch, created_at
 		FROM file_versions
-		WHERE project_id = $1 AND file_path = $2
+		WHERE project_id = $1 AND file_path = $2 AND version < $3 AND ` + cond + `
+		ORDER BY version DESC
+		LIMIT 1
+	`
+
+	var fv FileVersion
+	var content sql.NullString
+	err := m.DB.QueryRow(query, append([]interface{}{projectID, filePath, before}, args...)...).Scan(
+		&fv.ID, &fv.ProjectID, &fv.UserID, &fv.FilePath, &fv.FileName,
+		&fv.FileType, &fv.Version, &fv.FileHash, &fv.FileSize, &content,
+		&fv.CommitMsg, &fv.IsDeleted, &fv.IsBinary, &fv.ChangesetID, &fv.Branch, &fv.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resolveContent(&fv, content); err != nil {
+		return nil, err
+	}
+
+	return &fv, nil
+}
+
+// GetHeadVersion - Gets the newest version of a file as seen through a branch or tag, including a
+// deletion, which GetLatestVersion hides
+func (m *VersionModel) GetHeadVersion(projectID uuid.UUID, filePath string, ref *Ref) (*FileVersion, error) {
+	return m.GetPreviousVersion(projectID, filePath, ref, math.MaxInt32)
+}
+
+// GetLastLiveVersion - Gets the newest version of a file that is not a deletion, as seen through
+// a branch or tag; what undeleting the file brings back
+func (m *VersionModel) GetLastLiveVersion(projectID uuid.UUID, filePath string, ref *Ref) (*FileVersion, error) {
+	cond, args := ref.condition(3)
+	query := `
+		SELECT id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, content, commit_message, is_deleted, is_binary, changeset_id, branch, created_at
+		FROM file_versions
+		WHERE project_id = $1 AND file_path = $2 AND NOT is_deleted AND ` + cond + `
+		ORDER BY version DESC
+		LIMIT 1
+	`
+
+	var fv FileVersion
+	var content sql.NullString
+	err := m.DB.QueryRow(query, append([]interface{}{projectID, filePath}, args...)...).Scan(
+		&fv.ID, &fv.ProjectID, &fv.UserID, &fv.FilePath, &fv.FileName,
+		&fv.FileType, &fv.Version, &fv.FileHash, &fv.FileSize, &content,
+		&fv.CommitMsg, &fv.IsDeleted, &fv.IsBinary, &fv.ChangesetID, &fv.Branch, &fv.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resolveContent(&fv, content); err != nil {
+		return nil, err
+	}
+
+	return &fv, nil
+}
+
+// GetFileHistory - Gets version history for a file as seen through a branch or tag (nil for the default branch)
+func (m *VersionModel) GetFileHistory(projectID uuid.UUID, filePath string, ref *Ref, limit int) ([]FileVersion, error) {
+	cond, args := ref.condition(4)
+	query := `
+		SELECT id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, commit_message, is_deleted, is_binary, changeset_id, branch, created_at
+		FROM file_versions
+		WHERE project_id = $1 AND file_path = $2 AND ` + cond + `
 		ORDER BY version DESC
 		LIMIT $3
 	`
 
-	rows, err := m.DB.Query(query, projectID, filePath, limit)
+	rows, err := m.DB.Query(query, append([]interface{}{projectID, filePath, limit}, args...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -133,7 +329,7 @@ func (m *VersionModel) GetFileHistory(projectID uuid.UUID, filePath string, limi
 		err := rows.Scan(
 			&fv.ID, &fv.ProjectID, &fv.UserID, &fv.FilePath, &fv.FileName,
 			&fv.FileType, &fv.Version, &fv.FileHash, &fv.FileSize,
-			&fv.CommitMsg, &fv.IsDeleted, &fv.CreatedAt,
+			&fv.CommitMsg, &fv.IsDeleted, &fv.IsBinary, &fv.ChangesetID, &fv.Branch, &fv.CreatedAt,
 		)
 		if err != nil {
 			return nil, err
@@ -144,10 +340,44 @@ func (m *VersionModel) GetFileHistory(projectID uuid.UUID, filePath string, limi
 	return versions, nil
 }
 
+// GetFileChain - Gets every version of a file up to and including upTo as seen through a branch
+// or tag, oldest first and without content
+func (m *VersionModel) GetFileChain(projectID uuid.UUID, filePath string, ref *Ref, upTo int) ([]FileVersion, error) {
+	cond, args := ref.condition(4)
+	query := `
+		SELECT id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, commit_message, is_deleted, is_binary, changeset_id, branch, created_at
+		FROM file_versions
+		WHERE project_id = $1 AND file_path = $2 AND version <= $3 AND ` + cond + `
+		ORDER BY version ASC
+	`
+
+	rows, err := m.DB.Query(query, append([]interface{}{projectID, filePath, upTo}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []FileVersion
+	for rows.Next() {
+		var fv FileVersion
+		err := rows.Scan(
+			&fv.ID, &fv.ProjectID, &fv.UserID, &fv.FilePath, &fv.FileName,
+			&fv.FileType, &fv.Version, &fv.FileHash, &fv.FileSize,
+			&fv.CommitMsg, &fv.IsDeleted, &fv.IsBinary, &fv.ChangesetID, &fv.Branch, &fv.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, fv)
+	}
+
+	return versions, rows.Err()
+}
+
 // GetProjectVersions - Gets all recent versions in a project
 func (m *VersionModel) GetProjectVersions(projectID uuid.UUID, limit int) ([]FileVersion, error) {
 	query := `
-		SELECT id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, commit_message, is_deleted, created_at
+		SELECT id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, commit_message, is_deleted, is_binary, changeset_id, branch, created_at
 		FROM file_versions
 		WHERE project_id = $1
 		ORDER BY created_at DESC
@@ -166,7 +396,7 @@ func (m *VersionModel) GetProjectVersions(projectID uuid.UUID, limit int) ([]Fil
 		err := rows.Scan(
 			&fv.ID, &fv.ProjectID, &fv.UserID, &fv.FilePath, &fv.FileName,
 			&fv.FileType, &fv.Version, &fv.FileHash, &fv.FileSize,
-			&fv.CommitMsg, &fv.IsDeleted, &fv.CreatedAt,
+			&fv.CommitMsg, &fv.IsDeleted, &fv.IsBinary, &fv.ChangesetID, &fv.Branch, &fv.CreatedAt,
 		)
 		if err != nil {
 			return nil, err
@@ -177,36 +407,68 @@ func (m *VersionModel) GetProjectVersions(projectID uuid.UUID, limit int) ([]Fil
 	return versions, nil
 }
 
+// GetVersion - Gets a file at a specific version number
+func (m *VersionModel) GetVersion(projectID uuid.UUID, filePath string, version int) (*FileVersion, error) {
+	query := `
+		SELECT id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, content, commit_message, is_deleted, is_binary, changeset_id, branch, created_at
+		FROM file_versions
+		WHERE project_id = $1 AND file_path = $2 AND version = $3
+	`
+
+	var fv FileVersion
+	var content sql.NullString
+	err := m.DB.QueryRow(query, projectID, filePath, version).Scan(
+		&fv.ID, &fv.ProjectID, &fv.UserID, &fv.FilePath, &fv.FileName,
+		&fv.FileType, &fv.Version, &fv.FileHash, &fv.FileSize, &content,
+		&fv.CommitMsg, &fv.IsDeleted, &fv.IsBinary, &fv.ChangesetID, &fv.Branch, &fv.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resolveContent(&fv, content); err != nil {
+		return nil, err
+	}
+
+	return &fv, nil
+}
+
 // GetVersionByID - Gets a specific version by ID
 func (m *VersionModel) GetVersionByID(versionID uuid.UUID) (*FileVersion, error) {
 	query := `
-		SELECT id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, content, commit_message, is_deleted, created_at
+		SELECT id, project_id, user_id, file_path, file_name, file_type, version, file_hash, file_size, content, commit_message, is_deleted, is_binary, changeset_id, branch, created_at
 		FROM file_versions
 		WHERE id = $1
 	`
 
 	var fv FileVersion
+	var content sql.NullString
 	err := m.DB.QueryRow(query, versionID).Scan(
 		&fv.ID, &fv.ProjectID, &fv.UserID, &fv.FilePath, &fv.FileName,
-		&fv.FileType, &fv.Version, &fv.FileHash, &fv.FileSize, &fv.Content,
-		&fv.CommitMsg, &fv.IsDeleted, &fv.CreatedAt,
+		&fv.FileType, &fv.Version, &fv.FileHash, &fv.FileSize, &content,
+		&fv.CommitMsg, &fv.IsDeleted, &fv.IsBinary, &fv.ChangesetID, &fv.Branch, &fv.CreatedAt,
 	)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if err := resolveContent(&fv, content); err != nil {
+		return nil, err
+	}
+
 	return &fv, nil
 }
 
 // Conflict Model Methods
 
-// CreateConflict - Creates a new conflict record
-func (m *ConflictModel) CreateConflict(projectID uuid.UUID, filePath string, baseVersion int, localUserID, remoteUserID uuid.UUID, localContent, remoteContent string) (*FileConflict, error) {
+// CreateConflict - Creates a new conflict record with the three merge inputs and the attempted merge
+func (m *ConflictModel) CreateConflict(projectID uuid.UUID, branch, filePath string, baseVersion, latestVersion int, localUserID, remoteUserID uuid.UUID, localContent, remoteContent, baseContent, mergedContent string, hunks []byte) (*FileConflict, error) {
 	query := `
-		INSERT INTO file_conflicts (id, project_id, file_path, base_version, local_user_id, remote_user_id, local_content, remote_content, status, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-		RETURNING id, project_id, file_path, base_version, local_user_id, remote_user_id, status, created_at
+		INSERT INTO file_conflicts (id, project_id, file_path, base_version, latest_version, local_user_id, remote_user_id, local_content, remote_content, base_content, merged_content, hunks, status, branch, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		RETURNING id, project_id, file_path, branch, base_version, latest_version, local_user_id, remote_user_id, status, created_at
 	`
 
 	id := uuid.New()
@@ -215,10 +477,10 @@ func (m *ConflictModel) CreateConflict(projectID uuid.UUID, filePath string, bas
 	var fc FileConflict
 	err := m.DB.QueryRow(
 		query,
-		id, projectID, filePath, baseVersion, localUserID, remoteUserID,
-		localContent, remoteContent, "pending", now,
+		id, projectID, filePath, baseVersion, latestVersion, localUserID, remoteUserID,
+		localContent, remoteContent, baseContent, mergedContent, hunks, "pending", branch, now,
 	).Scan(
-		&fc.ID, &fc.ProjectID, &fc.FilePath, &fc.BaseVersion,
+		&fc.ID, &fc.ProjectID, &fc.FilePath, &fc.Branch, &fc.BaseVersion, &fc.LatestVersion,
 		&fc.LocalUserID, &fc.RemoteUserID, &fc.Status, &fc.CreatedAt,
 	)
 
@@ -229,10 +491,40 @@ func (m *ConflictModel) CreateConflict(projectID uuid.UUID, filePath string, bas
 	return &fc, nil
 }
 
+// GetConflictByID - Gets a conflict by ID
+func (m *ConflictModel) GetConflictByID(conflictID uuid.UUID) (*FileConflict, error) {
+	query := `
+		SELECT id, project_id, file_path, branch, base_version, COALESCE(latest_version, 0), local_user_id, remote_user_id, local_content, remote_content,
+			COALESCE(base_content, ''), COALESCE(merged_content, ''), COALESCE(hunks, '[]'::jsonb), status,
+			resolved_by, resolved_version_id, created_at, resolved_at
+		FROM file_conflicts
+		WHERE id = $1
+	`
+
+	var fc FileConflict
+	var resolvedBy uuid.NullUUID
+	var resolvedAt sql.NullTime
+	err := m.DB.QueryRow(query, conflictID).Scan(
+		&fc.ID, &fc.ProjectID, &fc.FilePath, &fc.Branch, &fc.BaseVersion, &fc.LatestVersion,
+		&fc.LocalUserID, &fc.RemoteUserID, &fc.LocalContent, &fc.RemoteContent,
+		&fc.BaseContent, &fc.MergedContent, &fc.Hunks, &fc.Status,
+		&resolvedBy, &fc.ResolvedVersionID, &fc.CreatedAt, &resolvedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fc.ResolvedBy = resolvedBy.UUID
+	fc.ResolvedAt = resolvedAt.Time
+
+	return &fc, nil
+}
+
 // GetProjectConflicts - Gets all conflicts for a project
 func (m *ConflictModel) GetProjectConflicts(projectID uuid.UUID, status string) ([]FileConflict, error) {
 	query := `
-		SELECT id, project_id, file_path, base_version, local_user_id, remote_user_id, status, created_at
+		SELECT id, project_id, file_path, branch, base_version, COALESCE(latest_version, 0), local_user_id, remote_user_id, status, created_at
 		FROM file_conflicts
 		WHERE project_id = $1 AND status = $2
 		ORDER BY created_at DESC
@@ -248,7 +540,7 @@ func (m *ConflictModel) GetProjectConflicts(projectID uuid.UUID, status string)
 	for rows.Next() {
 		var fc FileConflict
 		err := rows.Scan(
-			&fc.ID, &fc.ProjectID, &fc.FilePath, &fc.BaseVersion,
+			&fc.ID, &fc.ProjectID, &fc.FilePath, &fc.Branch, &fc.BaseVersion, &fc.LatestVersion,
 			&fc.LocalUserID, &fc.RemoteUserID, &fc.Status, &fc.CreatedAt,
 		)
 		if err != nil {
@@ -260,17 +552,102 @@ func (m *ConflictModel) GetProjectConflicts(projectID uuid.UUID, status string)
 	return conflicts, nil
 }
 
-// ResolveConflict - Marks a conflict as resolved
-func (m *ConflictModel) ResolveConflict(conflictID, resolvedBy uuid.UUID) error {
+// ResolveConflict - In one transaction, commits the resolved content as a new version of the
+// file on ref and marks the conflict resolved with a link to that version. The resolution is
+// made against baseVersion, or against the version the conflict was merged with when it is 0;
+// if the file moved on since, a *ChangesetFileError is returned and nothing is committed.
+// Returns ErrConflictNotPending if the conflict was already resolved or ignored.
+func (m *ConflictModel) ResolveConflict(conflictID, resolvedBy uuid.UUID, ref *Ref, baseVersion int, fileName, fileType, content, commitMsg string) (*FileVersion, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the conflict so two people resolving at once cannot both commit
+	var projectID uuid.UUID
+	var filePath, status string
+	var latestVersion int
+	err = tx.QueryRow(
+		`SELECT project_id, file_path, COALESCE(latest_version, 0), status FROM file_conflicts WHERE id = $1 FOR UPDATE`,
+		conflictID,
+	).Scan(&projectID, &filePath, &latestVersion, &status)
+	if err != nil {
+		return nil, err
+	}
+	if status != "pending" {
+		return nil, ErrConflictNotPending
+	}
+	if baseVersion == 0 {
+		baseVersion = latestVersion
+	}
+
+	// Goes through the same lock and head check as any other commit, so a version committed
+	// since the conflict is never overwritten
+	file := ChangesetFile{
+		Action:      ChangeEdit,
+		FilePath:    filePath,
+		FileName:    fileName,
+		FileType:    fileType,
+		Content:     content,
+		BaseVersion: baseVersion,
+	}
+	head, err := lockFile(tx, projectID, filePath, ref)
+	if err != nil {
+		return nil, err
+	}
+	if head.version != baseVersion {
+		return nil, staleFile(file, head)
+	}
+	if head.isDeleted {
+		// The file was deleted in the meantime; the resolution brings it back
+		file.Action = ChangeAdd
+	}
+
+	fv, err := applyChange(tx, projectID, resolvedBy, nil, ref, file, commitMsg)
+	if err != nil {
+		return nil, err
+	}
+
 	query := `
 		UPDATE file_conflicts
-		SET status = 'resolved', resolved_by = $1, resolved_at = $2
-		WHERE id = $3
+		SET status = 'resolved', resolved_by = $1, resolved_at = $2, resolved_version_id = $3
+		WHERE id = $4
 	`
+	if _, err := tx.Exec(query, resolvedBy, time.Now(), fv.ID, conflictID); err != nil {
+		return nil, err
+	}
 
-	now := time.Now()
-	_, err := m.DB.Exec(query, resolvedBy, now, conflictID)
-	return err
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return fv, nil
+}
+
+// IgnoreConflict - Closes a pending conflict without committing anything
+func (m *ConflictModel) IgnoreConflict(conflictID, resolvedBy uuid.UUID) error {
+	query := `
+		UPDATE file_conflicts
+		SET status = 'ignored', resolved_by = $1, resolved_at = $2
+		WHERE id = $3 AND status = 'pending'
+	`
+
+	result, err := m.DB.Exec(query, resolvedBy, time.Now(), conflictID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrConflictNotPending
+	}
+
+	return nil
 }
 
 // Initialize tables
@@ -315,6 +692,12 @@ func InitVersionControlTables() error {
 		resolved_at TIMESTAMP
 	);
 
+	ALTER TABLE file_conflicts ADD COLUMN IF NOT EXISTS base_content TEXT;
+	ALTER TABLE file_conflicts ADD COLUMN IF NOT EXISTS merged_content TEXT;
+	ALTER TABLE file_conflicts ADD COLUMN IF NOT EXISTS hunks JSONB;
+	ALTER TABLE file_conflicts ADD COLUMN IF NOT EXISTS resolved_version_id UUID REFERENCES file_versions(id) ON DELETE SET NULL;
+	ALTER TABLE file_conflicts ADD COLUMN IF NOT EXISTS latest_version INTEGER;
+
 	CREATE INDEX IF NOT EXISTS idx_file_conflicts_project ON file_conflicts(project_id);
 	CREATE INDEX IF NOT EXISTS idx_file_conflicts_status ON file_conflicts(status);
 	`
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/joho/godotenv"
@@ -29,6 +30,16 @@ func main() {
 	db.InitDB()
 	log.Println("Database initialized successfully")
 
+	// Purge expired sessions, logins, queued messages and stale uploads in the background
+	services.StartSessionCleanup(time.Hour)
+	services.StartOAuthStateCleanup(10 * time.Minute)
+	services.StartMessageQueueCleanup(time.Hour)
+	services.StartUploadCleanup(time.Hour)
+	services.StartDocumentSnapshots(time.Minute)
+	services.StartGitHubSync(15 * time.Second)
+	services.StartGitHubAccessSync(15 * time.Second)
+	services.StartGitHubAccessReconciliation(time.Hour)
+
 	// Setup routes
 	log.Println("Setting up routes...")
 	router := routers.SetupRoutes()
@@ -42,9 +53,11 @@ func main() {
 			services.SecurityHeaders(
 				services.CORS(
 					rateLimiter.Limit(
-						services.UserContext(
-							services.ProjectContext(
-								router,
+						services.BodySizeLimit(
+							services.UserContext(
+								services.ProjectContext(
+									router,
+								),
 							),
 						),
 					),
@@ -62,7 +75,7 @@ func main() {
 	corsHandler := handlers.CORS(
 		handlers.AllowedOrigins(allowedOrigins),
 		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
-		handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "X-User-ID", "X-Project-ID"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "X-User-ID", "X-Project-ID", "X-Chunk-SHA256"}),
 		handlers.AllowCredentials(),
 	)(handler)
 
@@ -7,11 +7,17 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// protected - Wraps a handler so it only runs for requests with a valid session token
+func protected(h http.HandlerFunc) http.Handler {
+	return services.AuthRequired(h)
+}
+
 func SetupRoutes() *mux.Router {
 	r := mux.NewRouter()
 
 	// Push Project
-	r.HandleFunc("/push/manual", services.PushProject).Methods("POST")
+	r.Handle("/push/manual", protected(services.PushProject)).Methods("POST")
+	r.Handle("/github/import", protected(services.ImportRepository)).Methods("POST")
 
 	// Github Token Access
 	r.HandleFunc("/db/token/{super_user_key}/{user}", services.GetToken).Methods("GET")
@@ -20,7 +26,7 @@ func SetupRoutes() *mux.Router {
 	r.HandleFunc("/db/projects-count/{owner}", services.NProjects).Methods("GET")
 	r.HandleFunc("/db/projects/{owner}", services.GetProjects).Methods("GET")
 	r.HandleFunc("/db/projects/{owner}/{name}", services.GetProject).Methods("GET")
-	r.HandleFunc("/db/projects/{owner}/{name}", services.DeleteProject).Methods("DELETE")
+	r.Handle("/db/projects/{owner}/{name}", protected(services.DeleteProject)).Methods("DELETE")
 
 	// User Functions
 	r.HandleFunc("/db/users-count", services.GetUsersLen).Methods("GET")
@@ -32,37 +38,85 @@ func SetupRoutes() *mux.Router {
 	// GitHub OAuth
 	r.HandleFunc("/github/login", services.GitHubLoginHandler)
 	r.HandleFunc("/github/callback", services.GitHubCallbackHandler)
+	r.HandleFunc("/github/webhook", services.GitHubWebhook).Methods("POST")
+	r.Handle("/github/webhook/secret", protected(services.GetWebhookSecret)).Methods("GET")
+	r.Handle("/github/webhook/secret", protected(services.RotateWebhookSecret)).Methods("POST")
+
+	// Session Routes
+	r.Handle("/auth/session", protected(services.GetSession)).Methods("GET")
+	r.Handle("/auth/logout", protected(services.Logout)).Methods("POST")
+	r.Handle("/auth/logout-all", protected(services.LogoutAll)).Methods("POST")
 
 	// Collaborator Routes
-	r.HandleFunc("/collab/request", services.RequestCollaboration).Methods("POST")
-	r.HandleFunc("/collab/approve", services.ApproveCollaboration).Methods("POST")
-	r.HandleFunc("/collab/project", services.GetProjectCollaborators).Methods("GET")
-	r.HandleFunc("/collab/user/requests", services.GetUserCollaborationRequests).Methods("GET")
+	r.Handle("/collab/request", protected(services.RequestCollaboration)).Methods("POST")
+	r.Handle("/collab/approve", protected(services.ApproveCollaboration)).Methods("POST")
+	r.Handle("/collab/project", protected(services.GetProjectCollaborators)).Methods("GET")
+	r.Handle("/collab/user/requests", protected(services.GetUserCollaborationRequests)).Methods("GET")
 	r.HandleFunc("/collab/token/{super_user_key}/{username}", services.GetCollaboratorToken).Methods("GET")
-	r.HandleFunc("/collab/remove/{collab_id}", services.RemoveCollaborator).Methods("DELETE")
+	r.Handle("/collab/remove/{collab_id}", protected(services.RemoveCollaborator)).Methods("DELETE")
+	r.Handle("/collab/role", protected(services.UpdateCollaboratorRole)).Methods("POST")
+	r.Handle("/collab/github", protected(services.GetRepoAccess)).Methods("GET")
+	r.Handle("/collab/github/reconcile", protected(services.ReconcileRepoAccess)).Methods("POST")
 
 	// WebSocket Routes
 	r.HandleFunc("/ws", services.HandleWebSocket).Methods("GET")
 	r.HandleFunc("/ws/online-users", services.GetOnlineUsers).Methods("GET")
-	r.HandleFunc("/ws/user-status", services.CheckUserOnlineStatus).Methods("GET")
+	r.Handle("/ws/user-status", protected(services.CheckUserOnlineStatus)).Methods("GET")
+	r.Handle("/ws/rooms", protected(services.GetProjectRooms)).Methods("GET")
+	r.Handle("/ws/ticket", protected(services.IssueWebSocketTicket)).Methods("POST")
 
 	// File Sharing Routes
-	r.HandleFunc("/share/file", services.ShareFile).Methods("POST")
-	r.HandleFunc("/share/code", services.ShareCode).Methods("POST")
-	r.HandleFunc("/share/bulk", services.ShareBulkFiles).Methods("POST")
-	r.HandleFunc("/share/collaborators", services.GetShareableCollaborators).Methods("GET")
+	r.Handle("/share/file", protected(services.ShareFile)).Methods("POST")
+	r.Handle("/share/code", protected(services.ShareCode)).Methods("POST")
+	r.Handle("/share/bulk", protected(services.ShareBulkFiles)).Methods("POST")
+	r.Handle("/share/collaborators", protected(services.GetShareableCollaborators)).Methods("GET")
 
 	// Activity Tracking Routes
-	r.HandleFunc("/activity/user", services.GetUserActivities).Methods("GET")
-	r.HandleFunc("/activity/project", services.GetProjectActivities).Methods("GET")
-	r.HandleFunc("/activity/team", services.GetRecentTeamActivities).Methods("GET")
+	r.Handle("/activity/user", protected(services.GetUserActivities)).Methods("GET")
+	r.Handle("/activity/project", protected(services.GetProjectActivities)).Methods("GET")
+	r.Handle("/activity/team", protected(services.GetRecentTeamActivities)).Methods("GET")
 
 	// Version Control Routes
-	r.HandleFunc("/version/commit", services.CommitFileVersion).Methods("POST")
-	r.HandleFunc("/version/history", services.GetFileHistory).Methods("GET")
-	r.HandleFunc("/version/project", services.GetProjectVersions).Methods("GET")
-	r.HandleFunc("/version/conflicts", services.GetFileConflicts).Methods("GET")
-	r.HandleFunc("/version/resolve", services.ResolveConflict).Methods("POST")
+	r.Handle("/version/commit", protected(services.CommitFileVersion)).Methods("POST")
+	r.Handle("/version/history", protected(services.GetFileHistory)).Methods("GET")
+	r.Handle("/version/project", protected(services.GetProjectVersions)).Methods("GET")
+	r.Handle("/version/conflicts", protected(services.GetFileConflicts)).Methods("GET")
+	r.Handle("/version/conflict", protected(services.GetConflict)).Methods("GET")
+	r.Handle("/version/resolve", protected(services.ResolveConflict)).Methods("POST")
+	r.Handle("/version/ignore", protected(services.IgnoreConflict)).Methods("POST")
+	r.Handle("/version/changeset", protected(services.CommitChangeset)).Methods("POST")
+	r.Handle("/version/changeset", protected(services.GetChangeset)).Methods("GET")
+	r.Handle("/version/changesets", protected(services.GetProjectChangesets)).Methods("GET")
+	r.Handle("/version/changeset/revert", protected(services.RevertChangeset)).Methods("POST")
+	r.Handle("/version/file", protected(services.GetFileVersion)).Methods("GET")
+	r.Handle("/version/restore", protected(services.RestoreFileVersion)).Methods("POST")
+	r.Handle("/version/delete", protected(services.DeleteFile)).Methods("POST")
+	r.Handle("/version/undelete", protected(services.UndeleteFile)).Methods("POST")
+	r.Handle("/version/diff", protected(services.GetVersionDiff)).Methods("GET")
+	r.Handle("/version/blame", protected(services.GetFileBlame)).Methods("GET")
+	r.Handle("/version/snapshot", protected(services.GetProjectSnapshot)).Methods("GET")
+	r.Handle("/version/snapshot/archive", protected(services.DownloadProjectSnapshot)).Methods("GET")
+	r.Handle("/version/sync", protected(services.GetSyncStatus)).Methods("GET")
+	r.Handle("/version/sync/retry", protected(services.RetrySync)).Methods("POST")
+
+	// Branch and Tag Routes
+	r.Handle("/version/branches", protected(services.GetBranches)).Methods("GET")
+	r.Handle("/version/branch", protected(services.CreateBranch)).Methods("POST")
+	r.Handle("/version/branch", protected(services.DeleteBranch)).Methods("DELETE")
+	r.Handle("/version/branch/merge", protected(services.FastForwardBranch)).Methods("POST")
+	r.Handle("/version/tags", protected(services.GetTags)).Methods("GET")
+	r.Handle("/version/tag", protected(services.CreateTag)).Methods("POST")
+	r.Handle("/version/tag", protected(services.DeleteTag)).Methods("DELETE")
+
+	// Upload Routes
+	r.Handle("/version/upload", protected(services.CreateUpload)).Methods("POST")
+	r.Handle("/version/upload", protected(services.GetUpload)).Methods("GET")
+	r.Handle("/version/upload", protected(services.AbortUpload)).Methods("DELETE")
+	r.Handle("/version/upload/chunk", protected(services.UploadChunk)).Methods("PUT")
+	r.Handle("/version/upload/commit", protected(services.CommitUpload)).Methods("POST")
+	r.Handle("/version/upload/limit", protected(services.GetFileSizeLimit)).Methods("GET")
+	r.Handle("/version/upload/limit", protected(services.SetFileSizeLimit)).Methods("POST")
+	r.Handle("/version/content", protected(services.GetFileContent)).Methods("GET")
 
 	// Health check
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
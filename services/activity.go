@@ -32,28 +32,13 @@ func LogActivity(userID, projectID uuid.UUID, action, description string, metada
 	return activityModel.CreateActivity(userID, projectID, action, description, metadata, ipAddress, userAgent)
 }
 
-// GetUserActivities - Retrieves activities for a specific user
+// GetUserActivities - Retrieves activities for the session user
 func GetUserActivities(w http.ResponseWriter, r *http.Request) {
-	userEmail := r.URL.Query().Get("user_email")
-	limit := r.URL.Query().Get("limit")
-
-	if userEmail == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "user_email is required",
-		})
-		return
-	}
-
-	userModel := &db.UserModel{DB: db.DB}
-	user, err := userModel.GetUserByEmail(userEmail)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "User not found",
-		})
+	user, ok := requireUser(w, r)
+	if !ok {
 		return
 	}
+	limit := r.URL.Query().Get("limit")
 
 	limitInt := 50
 	if limit != "" {
@@ -76,7 +61,7 @@ func GetUserActivities(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":    true,
-		"user_email": userEmail,
+		"user_email": user.EMAIL,
 		"activities": activities,
 		"total":      len(activities),
 	})
@@ -111,6 +96,10 @@ func GetProjectActivities(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return
+	}
+
 	activityModel := &db.ActivityModel{DB: db.DB}
 	activities, err := activityModel.GetProjectActivities(projectUUID, limitInt)
 	if err != nil {
@@ -159,6 +148,10 @@ func GetRecentTeamActivities(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return
+	}
+
 	activityModel := &db.ActivityModel{DB: db.DB}
 	activities, err := activityModel.GetProjectActivities(projectUUID, limitInt)
 	if err != nil {
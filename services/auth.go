@@ -0,0 +1,232 @@
+package services
+
+import (
+	"app/urtc/db"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type contextKey string
+
+const (
+	userContextKey    contextKey = "user"
+	sessionContextKey contextKey = "session"
+)
+
+const defaultSessionTTL = 7 * 24 * time.Hour
+
+// sessionTTL - Session lifetime, configurable through SESSION_TTL_HOURS
+func sessionTTL() time.Duration {
+	if hours, err := strconv.Atoi(os.Getenv("SESSION_TTL_HOURS")); err == nil && hours > 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return defaultSessionTTL
+}
+
+// generateToken - Returns a random opaque token
+func generateToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// hashToken - Tokens are only ever stored as their SHA-256 hash
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueSession - Creates a new server-side session and returns the raw token for the client
+func IssueSession(userID uuid.UUID, r *http.Request) (string, *db.Session, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	sessionModel := &db.SessionModel{DB: db.DB}
+	session, err := sessionModel.CreateSession(
+		userID,
+		hashToken(token),
+		r.RemoteAddr,
+		r.UserAgent(),
+		time.Now().Add(sessionTTL()),
+	)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, session, nil
+}
+
+// ResolveSession - Looks up the active session and user behind a raw token
+func ResolveSession(token string) (*db.Session, *db.User, error) {
+	sessionModel := &db.SessionModel{DB: db.DB}
+	session, err := sessionModel.GetActiveSession(hashToken(token))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	userModel := &db.UserModel{DB: db.DB}
+	user, err := userModel.GetUserByID(session.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return session, user, nil
+}
+
+// withSession - Stores the resolved session and user in the request context
+func withSession(r *http.Request, session *db.Session, user *db.User) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionContextKey, session)
+	ctx = context.WithValue(ctx, userContextKey, user)
+	return r.WithContext(ctx)
+}
+
+// CurrentUser - Returns the user authenticated by AuthRequired
+func CurrentUser(r *http.Request) (*db.User, bool) {
+	user, ok := r.Context().Value(userContextKey).(*db.User)
+	return user, ok && user != nil
+}
+
+// CurrentSession - Returns the session authenticated by AuthRequired
+func CurrentSession(r *http.Request) (*db.Session, bool) {
+	session, ok := r.Context().Value(sessionContextKey).(*db.Session)
+	return session, ok && session != nil
+}
+
+// optionalUser - The user behind a Bearer session on a route that doesn't require one, or nil
+func optionalUser(r *http.Request) *db.User {
+	if user, ok := CurrentUser(r); ok {
+		return user
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil
+	}
+	_, user, err := ResolveSession(token)
+	if err != nil {
+		return nil
+	}
+	return user
+}
+
+// requireUser - Writes a 401 and returns false when the request has no session user
+func requireUser(w http.ResponseWriter, r *http.Request) (*db.User, bool) {
+	user, ok := CurrentUser(r)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Authentication required",
+		})
+		return nil, false
+	}
+	return user, true
+}
+
+// StartSessionCleanup - Periodically purges expired and revoked sessions
+func StartSessionCleanup(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		sessionModel := &db.SessionModel{DB: db.DB}
+		for range ticker.C {
+			removed, err := sessionModel.DeleteExpiredSessions(time.Now())
+			if err != nil {
+				log.Printf("Session cleanup failed: %v", err)
+				continue
+			}
+			if removed > 0 {
+				log.Printf("Session cleanup removed %d sessions", removed)
+			}
+		}
+	}()
+}
+
+// GetSession - Returns the user and expiry of the current session
+func GetSession(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	session, _ := CurrentSession(r)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"user":       user,
+		"session_id": session.ID,
+		"expires_at": session.ExpiresAt,
+	})
+}
+
+// Logout - Revokes the current session
+func Logout(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireUser(w, r); !ok {
+		return
+	}
+	session, _ := CurrentSession(r)
+
+	sessionModel := &db.SessionModel{DB: db.DB}
+	if err := sessionModel.RevokeSession(session.ID); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to revoke session",
+		})
+		return
+	}
+
+	// Live WebSocket connections opened with this session go with it
+	DisconnectSession(session.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Logged out successfully",
+	})
+}
+
+// LogoutAll - Revokes every session of the current user, on every device
+func LogoutAll(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	sessionModel := &db.SessionModel{DB: db.DB}
+	sessionIDs, err := sessionModel.RevokeUserSessions(user.ID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to revoke sessions",
+		})
+		return
+	}
+
+	for _, sessionID := range sessionIDs {
+		DisconnectSession(sessionID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":          true,
+		"message":          "Logged out of every session",
+		"revoked_sessions": len(sessionIDs),
+	})
+}
@@ -0,0 +1,279 @@
+package services
+
+import (
+	"app/urtc/db"
+	"container/list"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// blameCacheSize - Blames kept in memory, one per head version
+const blameCacheSize = 128
+
+// blameOrigin - The version that last changed a line
+type blameOrigin struct {
+	VersionID uuid.UUID
+	Version   int
+	UserID    uuid.UUID
+	CommitMsg string
+	CreatedAt time.Time
+}
+
+// fileBlame - The lines of one version of a file and where each came from. Never modified once
+// built, so cached blames are shared between requests.
+type fileBlame struct {
+	lines   []string
+	origins []*blameOrigin
+}
+
+// BlameLine - One line of a blamed file
+type BlameLine struct {
+	Line      int       `json:"line"`
+	Text      string    `json:"text"`
+	VersionID uuid.UUID `json:"version_id"`
+	Version   int       `json:"version"`
+	UserID    uuid.UUID `json:"user_id"`
+	Username  string    `json:"username"`
+	CommitMsg string    `json:"commit_message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// blameCache - Least recently used blames by head version ID. Versions never change, so an
+// entry stays valid until it is evicted.
+type blameCache struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[uuid.UUID]*list.Element
+}
+
+type blameCacheItem struct {
+	versionID uuid.UUID
+	blame     *fileBlame
+}
+
+var blames = &blameCache{
+	order:   list.New(),
+	entries: make(map[uuid.UUID]*list.Element),
+}
+
+func (c *blameCache) get(versionID uuid.UUID) (*fileBlame, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[versionID]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*blameCacheItem).blame, true
+}
+
+func (c *blameCache) put(versionID uuid.UUID, blame *fileBlame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[versionID]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[versionID] = c.order.PushFront(&blameCacheItem{versionID: versionID, blame: blame})
+	for c.order.Len() > blameCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*blameCacheItem).versionID)
+	}
+}
+
+// blameChain - Walks a file's versions, oldest first, carrying each line's origin through the
+// diff between consecutive versions. Starts from the newest version that already has a cached
+// blame, so blaming the next version after a commit only diffs once.
+func blameChain(chain []db.FileVersion) (*fileBlame, error) {
+	versionModel := &db.VersionModel{DB: db.DB}
+
+	current := &fileBlame{}
+	start := 0
+	for k := len(chain) - 1; k >= 0; k-- {
+		if cached, ok := blames.get(chain[k].ID); ok {
+			current, start = cached, k+1
+			break
+		}
+	}
+
+	for _, fv := range chain[start:] {
+		// A deletion or a binary version empties the file; lines coming back later are new again
+		content := ""
+		if !fv.IsDeleted && !fv.IsBinary {
+			full, err := versionModel.GetVersionByID(fv.ID)
+			if err != nil {
+				return nil, err
+			}
+			content = full.Content
+		}
+
+		origin := &blameOrigin{
+			VersionID: fv.ID,
+			Version:   fv.Version,
+			UserID:    fv.UserID,
+			CommitMsg: fv.CommitMsg,
+			CreatedAt: fv.CreatedAt,
+		}
+
+		lines := splitLinesKeepEnds(content)
+		next := &fileBlame{lines: lines, origins: make([]*blameOrigin, len(lines))}
+		for _, edit := range lineEdits(current.lines, lines) {
+			switch edit.kind {
+			case "context":
+				next.origins[edit.new] = current.origins[edit.old]
+			case "insert":
+				next.origins[edit.new] = origin
+			}
+		}
+		current = next
+	}
+
+	if len(chain) > 0 {
+		blames.put(chain[len(chain)-1].ID, current)
+	}
+	return current, nil
+}
+
+// GetFileBlame - Shows, for each line of a text file, the version that last changed it
+func GetFileBlame(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filePath := query.Get("file_path")
+
+	projectUUID, err := uuid.Parse(query.Get("project_id"))
+	if err != nil || filePath == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "project_id and file_path are required",
+		})
+		return
+	}
+
+	version := 0
+	if v := query.Get("version"); v != "" {
+		version, err = strconv.Atoi(v)
+		if err != nil || version < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Invalid version",
+			})
+			return
+		}
+	}
+
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return
+	}
+
+	ref, ok := resolveRef(w, projectUUID, query.Get("ref"))
+	if !ok {
+		return
+	}
+
+	versionModel := &db.VersionModel{DB: db.DB}
+	var head *db.FileVersion
+	if version > 0 {
+		head, err = versionModel.GetVersion(projectUUID, filePath, version)
+	} else {
+		head, err = latestFileVersion(projectUUID, filePath, ref)
+	}
+	if err == nil && head.IsDeleted {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "File not found",
+		})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch file",
+		})
+		return
+	}
+
+	if head.IsBinary {
+		writePatchError(w, newPatchError(http.StatusUnprocessableEntity, PatchErrBinaryFile, "Binary files have no lines to blame"))
+		return
+	}
+
+	// The versions before head are the ones its own branch saw, whichever ref it was reached through
+	branchModel := &db.BranchModel{DB: db.DB}
+	chainRef, err := branchModel.ResolveRef(projectUUID, head.Branch)
+	if err == db.ErrRefNotFound {
+		chainRef, err = ref, nil
+	}
+	var chain []db.FileVersion
+	if err == nil {
+		chain, err = versionModel.GetFileChain(projectUUID, filePath, chainRef, head.Version)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch file history",
+		})
+		return
+	}
+	// With head's branch deleted its history can't be traced; head is all there is
+	if len(chain) == 0 || chain[len(chain)-1].ID != head.ID {
+		chain = []db.FileVersion{*head}
+	}
+
+	blame, err := blameChain(chain)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to compute blame",
+		})
+		return
+	}
+
+	userModel := &db.UserModel{DB: db.DB}
+	usernames := make(map[uuid.UUID]string)
+	lines := make([]BlameLine, len(blame.lines))
+	for i, text := range blame.lines {
+		origin := blame.origins[i]
+		username, seen := usernames[origin.UserID]
+		if !seen {
+			if user, err := userModel.GetUserByID(origin.UserID); err == nil {
+				username = user.USERNAME
+			}
+			usernames[origin.UserID] = username
+		}
+
+		lines[i] = BlameLine{
+			Line:      i + 1,
+			Text:      strings.TrimSuffix(text, "\n"),
+			VersionID: origin.VersionID,
+			Version:   origin.Version,
+			UserID:    origin.UserID,
+			Username:  username,
+			CommitMsg: origin.CommitMsg,
+			CreatedAt: origin.CreatedAt,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"project_id": projectUUID,
+		"file_path":  head.FilePath,
+		"version":    head.Version,
+		"version_id": head.ID,
+		"branch":     head.Branch,
+		"lines":      lines,
+	})
+}
@@ -0,0 +1,570 @@
+package services
+
+import (
+	"app/urtc/db"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// RefErrNotFound - Patch error code for an unknown branch or tag
+const RefErrNotFound = "ref_not_found"
+
+// refNamePattern - Branch and tag names such as "level-3-prototype" or "release/alpha-2"
+var refNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]{0,99}$`)
+
+type BranchRequest struct {
+	ProjectID string `json:"project_id"`
+	Name      string `json:"name"`
+	From      string `json:"from,omitempty"` // parent branch, the default branch if empty
+}
+
+type TagRequest struct {
+	ProjectID string `json:"project_id"`
+	Name      string `json:"name"`
+	Ref       string `json:"ref,omitempty"` // branch to tag, the default branch if empty
+	Message   string `json:"message"`
+}
+
+// resolveRef - Looks up a branch or tag name from a request; writes the error response otherwise
+func resolveRef(w http.ResponseWriter, projectID uuid.UUID, name string) (*db.Ref, bool) {
+	branchModel := &db.BranchModel{DB: db.DB}
+	ref, err := branchModel.ResolveRef(projectID, name)
+	if err == db.ErrRefNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Branch or tag not found",
+			"ref":   name,
+		})
+		return nil, false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to resolve branch",
+		})
+		return nil, false
+	}
+
+	return ref, true
+}
+
+// resolveBranch - Like resolveRef, but only branches can be written to
+func resolveBranch(w http.ResponseWriter, projectID uuid.UUID, name string) (*db.Ref, bool) {
+	ref, ok := resolveRef(w, projectID, name)
+	if !ok {
+		return nil, false
+	}
+
+	if ref.IsTag() {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Tags are read-only; commit to a branch instead",
+			"ref":   name,
+		})
+		return nil, false
+	}
+
+	return ref, true
+}
+
+// resolvePatchBranch - resolveBranch for handlers that report errors as patch errors
+func resolvePatchBranch(projectID uuid.UUID, name string) (*db.Ref, *PatchError) {
+	branchModel := &db.BranchModel{DB: db.DB}
+	ref, err := branchModel.ResolveRef(projectID, name)
+	if err == db.ErrRefNotFound || (err == nil && ref.IsTag()) {
+		return nil, newPatchError(http.StatusNotFound, RefErrNotFound, "Branch "+strconv.Quote(name)+" not found")
+	}
+	if err != nil {
+		return nil, newPatchError(http.StatusInternalServerError, PatchErrApplyFailed, "Failed to resolve branch")
+	}
+	return ref, nil
+}
+
+func writeInvalidRefName(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": "Names must start with a letter or digit and use only letters, digits, '.', '_', '-' and '/' (up to 100 characters)",
+	})
+}
+
+// GetBranches - List a project's branches, starting with the default branch
+func GetBranches(w http.ResponseWriter, r *http.Request) {
+	projectID := r.URL.Query().Get("project_id")
+	projectUUID, err := uuid.Parse(projectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return
+	}
+
+	branchModel := &db.BranchModel{DB: db.DB}
+	branches, err := branchModel.GetProjectBranches(projectUUID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch branches",
+		})
+		return
+	}
+
+	response := []map[string]interface{}{{
+		"name":    db.DefaultBranch,
+		"default": true,
+	}}
+	for _, b := range branches {
+		response = append(response, map[string]interface{}{
+			"name":       b.Name,
+			"parent":     b.Parent,
+			"forked_at":  b.ForkedAt,
+			"created_by": b.CreatedBy,
+			"created_at": b.CreatedAt,
+			"default":    false,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"project_id":     projectID,
+		"default_branch": db.DefaultBranch,
+		"branches":       response,
+		"total":          len(response),
+	})
+}
+
+// CreateBranch - Fork a branch from another branch as it is now
+func CreateBranch(w http.ResponseWriter, r *http.Request) {
+	var req BranchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	projectUUID, err := uuid.Parse(req.ProjectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	if !refNamePattern.MatchString(req.Name) {
+		writeInvalidRefName(w)
+		return
+	}
+
+	user, _, ok := authorizeProject(w, r, projectUUID, PermCommit)
+	if !ok {
+		return
+	}
+
+	parent := req.From
+	if parent == "" {
+		parent = db.DefaultBranch
+	}
+
+	branchModel := &db.BranchModel{DB: db.DB}
+	branch, err := branchModel.CreateBranch(projectUUID, user.ID, req.Name, parent)
+	switch {
+	case err == db.ErrRefExists:
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "A branch or tag named " + req.Name + " already exists",
+		})
+		return
+	case err == db.ErrRefNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Branch " + parent + " not found; branches can only be forked from branches",
+		})
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to create branch",
+		})
+		return
+	}
+
+	LogActivity(
+		user.ID,
+		projectUUID,
+		"branch_created",
+		"Created branch "+branch.Name+" from "+branch.Parent,
+		map[string]interface{}{
+			"branch": branch.Name,
+			"parent": branch.Parent,
+		},
+		r,
+	)
+
+	NotifyProjectMembers(
+		projectUUID,
+		user.ID,
+		"branch_created",
+		user.USERNAME+" created branch "+branch.Name,
+		map[string]interface{}{
+			"project_id": req.ProjectID,
+			"branch":     branch.Name,
+			"parent":     branch.Parent,
+		},
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"branch":  branch,
+	})
+}
+
+// DeleteBranch - Delete a branch, archiving the versions committed on it
+func DeleteBranch(w http.ResponseWriter, r *http.Request) {
+	projectID := r.URL.Query().Get("project_id")
+	name := r.URL.Query().Get("name")
+	force := r.URL.Query().Get("force") == "true"
+
+	projectUUID, err := uuid.Parse(projectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	user, _, ok := authorizeProject(w, r, projectUUID, PermManageBranches)
+	if !ok {
+		return
+	}
+
+	branchModel := &db.BranchModel{DB: db.DB}
+	archived, archivedVersions, err := branchModel.DeleteBranch(projectUUID, name, force)
+	if err != nil {
+		writeBranchError(w, name, err)
+		return
+	}
+
+	LogActivity(
+		user.ID,
+		projectUUID,
+		"branch_deleted",
+		"Deleted branch "+name,
+		map[string]interface{}{
+			"branch":            name,
+			"archived_as":       archived,
+			"versions_archived": archivedVersions,
+		},
+		r,
+	)
+
+	NotifyProjectMembers(
+		projectUUID,
+		user.ID,
+		"branch_deleted",
+		user.USERNAME+" deleted branch "+name,
+		map[string]interface{}{
+			"project_id": projectID,
+			"branch":     name,
+		},
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":           true,
+		"branch":            name,
+		"archived_as":       archived,
+		"versions_archived": archivedVersions,
+	})
+}
+
+// FastForwardBranch - Bring a branch's commits into its parent when the parent has not changed the same files
+func FastForwardBranch(w http.ResponseWriter, r *http.Request) {
+	var req BranchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	projectUUID, err := uuid.Parse(req.ProjectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	user, _, ok := authorizeProject(w, r, projectUUID, PermCommit)
+	if !ok {
+		return
+	}
+
+	branchModel := &db.BranchModel{DB: db.DB}
+	branch, files, err := branchModel.FastForward(projectUUID, user.ID, req.Name)
+	if err != nil {
+		writeBranchError(w, req.Name, err)
+		return
+	}
+
+	LogActivity(
+		user.ID,
+		projectUUID,
+		"branch_merged",
+		"Fast-forwarded "+branch.Parent+" to "+branch.Name,
+		map[string]interface{}{
+			"branch": branch.Name,
+			"into":   branch.Parent,
+			"files":  files,
+		},
+		r,
+	)
+
+	NotifyProjectMembers(
+		projectUUID,
+		user.ID,
+		"branch_merged",
+		user.USERNAME+" merged "+branch.Name+" into "+branch.Parent,
+		map[string]interface{}{
+			"project_id": req.ProjectID,
+			"branch":     branch.Name,
+			"into":       branch.Parent,
+			"files":      files,
+		},
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"branch":     branch.Name,
+		"into":       branch.Parent,
+		"files":      files,
+		"file_count": len(files),
+		"forked_at":  branch.ForkedAt,
+	})
+}
+
+// writeBranchError - Maps branch model errors to responses
+func writeBranchError(w http.ResponseWriter, name string, err error) {
+	var diverged *db.BranchDivergedError
+	status, message := http.StatusInternalServerError, "Failed to update branch"
+
+	switch {
+	case errors.As(err, &diverged):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "Cannot fast-forward: the parent branch also changed these files since " + name + " was forked",
+			"files": diverged.Files,
+		})
+		return
+	case err == db.ErrRefNotFound:
+		status, message = http.StatusNotFound, "Branch "+name+" not found"
+	case err == db.ErrDefaultBranch:
+		status, message = http.StatusBadRequest, "The default branch cannot be deleted or merged"
+	case err == db.ErrBranchHasChildren:
+		status, message = http.StatusConflict, "Other branches were forked from "+name+"; merge or delete them first"
+	case err == db.ErrBranchTagged:
+		status, message = http.StatusConflict, "Tags point at versions on "+name+"; delete them first"
+	case err == db.ErrBranchNotMerged:
+		status, message = http.StatusConflict, name+" has versions that are not merged; pass force=true to discard them"
+	case err == db.ErrNothingToFastForward:
+		status, message = http.StatusConflict, name+" has no versions to merge"
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": message,
+	})
+}
+
+// GetTags - List a project's tags
+func GetTags(w http.ResponseWriter, r *http.Request) {
+	projectID := r.URL.Query().Get("project_id")
+	projectUUID, err := uuid.Parse(projectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return
+	}
+
+	branchModel := &db.BranchModel{DB: db.DB}
+	tags, err := branchModel.GetProjectTags(projectUUID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch tags",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"project_id": projectID,
+		"tags":       tags,
+		"total":      len(tags),
+	})
+}
+
+// CreateTag - Name the current state of a branch, e.g. for a milestone build
+func CreateTag(w http.ResponseWriter, r *http.Request) {
+	var req TagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	projectUUID, err := uuid.Parse(req.ProjectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	if !refNamePattern.MatchString(req.Name) {
+		writeInvalidRefName(w)
+		return
+	}
+
+	user, _, ok := authorizeProject(w, r, projectUUID, PermCommit)
+	if !ok {
+		return
+	}
+
+	ref, ok := resolveBranch(w, projectUUID, req.Ref)
+	if !ok {
+		return
+	}
+
+	branchModel := &db.BranchModel{DB: db.DB}
+	tag, err := branchModel.CreateTag(projectUUID, user.ID, req.Name, ref, req.Message)
+	if err == db.ErrRefExists {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "A branch or tag named " + req.Name + " already exists",
+		})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to create tag",
+		})
+		return
+	}
+
+	LogActivity(
+		user.ID,
+		projectUUID,
+		"tag_created",
+		"Tagged "+tag.Branch+" as "+tag.Name,
+		map[string]interface{}{
+			"tag":        tag.Name,
+			"branch":     tag.Branch,
+			"file_count": tag.FileCount,
+		},
+		r,
+	)
+
+	NotifyProjectMembers(
+		projectUUID,
+		user.ID,
+		"tag_created",
+		user.USERNAME+" tagged "+tag.Branch+" as "+tag.Name,
+		map[string]interface{}{
+			"project_id": req.ProjectID,
+			"tag":        tag.Name,
+			"branch":     tag.Branch,
+		},
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"tag":     tag,
+	})
+}
+
+// DeleteTag - Delete a tag; the versions it named stay in history
+func DeleteTag(w http.ResponseWriter, r *http.Request) {
+	projectID := r.URL.Query().Get("project_id")
+	name := r.URL.Query().Get("name")
+
+	projectUUID, err := uuid.Parse(projectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	user, _, ok := authorizeProject(w, r, projectUUID, PermManageBranches)
+	if !ok {
+		return
+	}
+
+	branchModel := &db.BranchModel{DB: db.DB}
+	err = branchModel.DeleteTag(projectUUID, name)
+	if err == db.ErrRefNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Tag " + name + " not found",
+		})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to delete tag",
+		})
+		return
+	}
+
+	LogActivity(
+		user.ID,
+		projectUUID,
+		"tag_deleted",
+		"Deleted tag "+name,
+		map[string]interface{}{
+			"tag": name,
+		},
+		r,
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"tag":     name,
+	})
+}
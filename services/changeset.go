@@ -0,0 +1,384 @@
+package services
+
+import (
+	"app/urtc/db"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// Machine-readable changeset error codes, alongside the patch error codes
+const (
+	ChangesetErrInvalidAction = "invalid_action"
+	ChangesetErrDuplicatePath = "duplicate_file_path"
+	ChangesetErrFileExists    = "file_exists"
+	ChangesetErrFileNotFound  = "file_not_found"
+	ChangesetErrEmpty         = "empty_changeset"
+	ChangesetErrMissingField  = "missing_field"
+)
+
+type ChangesetRequest struct {
+	ProjectID string            `json:"project_id"`
+	Message   string            `json:"message"`
+	Branch    string            `json:"branch,omitempty"` // the default branch if empty
+	Changes   []ChangesetChange `json:"changes"`
+}
+
+// ChangesetChange - One file in a changeset. "add" creates a file that does not exist yet,
+// "edit" and "delete" must name the file's latest version as base_version.
+type ChangesetChange struct {
+	Action      string          `json:"action"` // "add", "edit" or "delete"
+	FilePath    string          `json:"file_path"`
+	FileName    string          `json:"file_name,omitempty"`
+	FileType    string          `json:"file_type,omitempty"`
+	Content     *string         `json:"content,omitempty"`
+	FileHash    string          `json:"file_hash,omitempty"` // optional except with a patch
+	BaseVersion int             `json:"base_version,omitempty"`
+	PatchType   string          `json:"patch_type,omitempty"` // edits may send a delta instead of content
+	Patch       json.RawMessage `json:"patch,omitempty"`
+}
+
+// CommitChangeset - Commits adds, edits and deletes of many files atomically under one message
+func CommitChangeset(w http.ResponseWriter, r *http.Request) {
+	var req ChangesetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	if req.ProjectID == "" || req.Message == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "project_id and message are required",
+		})
+		return
+	}
+
+	projectUUID, err := uuid.Parse(req.ProjectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	user, _, ok := authorizeProject(w, r, projectUUID, PermCommit)
+	if !ok {
+		return
+	}
+
+	ref, ok := resolveBranch(w, projectUUID, req.Branch)
+	if !ok {
+		return
+	}
+
+	if len(req.Changes) == 0 {
+		writePatchError(w, newPatchError(http.StatusBadRequest, ChangesetErrEmpty, "A changeset needs at least one change"))
+		return
+	}
+
+	limit, perr := fileSizeLimit(projectUUID)
+	if perr != nil {
+		writePatchError(w, perr)
+		return
+	}
+
+	files := make([]db.ChangesetFile, 0, len(req.Changes))
+	seen := make(map[string]bool, len(req.Changes))
+	for i, change := range req.Changes {
+		file, perr := prepareChangesetFile(projectUUID, ref, change)
+		if perr == nil {
+			perr = checkFileSize(int64(len(file.Content)), limit)
+		}
+		if perr == nil && seen[change.FilePath] {
+			perr = newPatchError(http.StatusBadRequest, ChangesetErrDuplicatePath, change.FilePath+" appears more than once")
+		}
+		if perr != nil {
+			if perr.Details == nil {
+				perr.Details = map[string]interface{}{}
+			}
+			perr.Details["change_index"] = i
+			perr.Details["file_path"] = change.FilePath
+			writePatchError(w, perr)
+			return
+		}
+		seen[change.FilePath] = true
+		files = append(files, file)
+	}
+
+	changesetModel := &db.ChangesetModel{DB: db.DB}
+	changeset, err := changesetModel.CreateChangeset(projectUUID, user.ID, ref, req.Message, files)
+
+	var fileErr *db.ChangesetFileError
+	if errors.As(err, &fileErr) {
+		writePatchError(w, changesetFileError(fileErr))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to commit changeset: " + err.Error(),
+		})
+		return
+	}
+
+	paths := make([]string, 0, len(changeset.Files))
+	for _, fv := range changeset.Files {
+		paths = append(paths, fv.FilePath)
+	}
+
+	LogActivity(
+		user.ID,
+		projectUUID,
+		"changeset_commit",
+		"Committed "+strconv.Itoa(len(paths))+" files: "+req.Message,
+		map[string]interface{}{
+			"changeset_id": changeset.ID,
+			"branch":       changeset.Branch,
+			"files":        paths,
+		},
+		r,
+	)
+
+	NotifyProjectMembers(
+		projectUUID,
+		user.ID,
+		"changeset_committed",
+		user.USERNAME+" committed "+strconv.Itoa(len(paths))+" files",
+		map[string]interface{}{
+			"project_id":   req.ProjectID,
+			"changeset_id": changeset.ID,
+			"branch":       changeset.Branch,
+			"message":      req.Message,
+			"files":        changesetSummary(changeset),
+		},
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"changeset_id": changeset.ID,
+		"branch":       changeset.Branch,
+		"message":      req.Message,
+		"files":        changesetSummary(changeset),
+		"total":        len(changeset.Files),
+	})
+}
+
+// prepareChangesetFile - Validates one change and builds the full file it will store
+func prepareChangesetFile(projectID uuid.UUID, ref *db.Ref, change ChangesetChange) (db.ChangesetFile, *PatchError) {
+	file := db.ChangesetFile{
+		Action:      change.Action,
+		FilePath:    change.FilePath,
+		FileName:    change.FileName,
+		FileType:    change.FileType,
+		FileHash:    change.FileHash,
+		BaseVersion: change.BaseVersion,
+	}
+
+	if change.FilePath == "" {
+		return file, newPatchError(http.StatusBadRequest, PatchErrPathRequired, "file_path is required")
+	}
+
+	switch change.Action {
+	case db.ChangeAdd, db.ChangeEdit:
+		if change.Action == db.ChangeEdit && change.BaseVersion <= 0 {
+			return file, newPatchError(http.StatusBadRequest, PatchErrBaseRequired, "base_version is required to edit a file")
+		}
+
+		if len(change.Patch) > 0 {
+			if change.Action == db.ChangeAdd {
+				return file, newPatchError(http.StatusBadRequest, PatchErrInvalid, "A new file must be sent as content, not a patch")
+			}
+			content, base, perr := resolvePatch(projectID, ref, change.FilePath, change.BaseVersion, change.PatchType, change.Patch, change.FileHash)
+			if perr != nil {
+				return file, perr
+			}
+			file.Content = content
+			if file.FileName == "" {
+				file.FileName = base.FileName
+			}
+			if file.FileType == "" {
+				file.FileType = base.FileType
+			}
+		} else {
+			if change.Content == nil {
+				return file, newPatchError(http.StatusBadRequest, ChangesetErrMissingField, "content or patch is required")
+			}
+			file.Content = *change.Content
+			if perr := checkContentHash(file.Content, file.FileHash); perr != nil {
+				return file, perr
+			}
+		}
+
+	case db.ChangeDelete:
+		if change.BaseVersion <= 0 {
+			return file, newPatchError(http.StatusBadRequest, PatchErrBaseRequired, "base_version is required to delete a file")
+		}
+		file.Content, file.FileHash = "", ""
+
+	default:
+		return file, newPatchError(http.StatusBadRequest, ChangesetErrInvalidAction, "action must be add, edit or delete")
+	}
+
+	// Edits and deletes keep the existing name and type unless told otherwise
+	if file.FileName == "" || file.FileType == "" {
+		versionModel := &db.VersionModel{DB: db.DB}
+		if latest, err := versionModel.GetLatestVersion(projectID, change.FilePath, ref); err == nil {
+			if file.FileName == "" {
+				file.FileName = latest.FileName
+			}
+			if file.FileType == "" {
+				file.FileType = latest.FileType
+			}
+		}
+	}
+	if file.FileName == "" {
+		file.FileName = path.Base(change.FilePath)
+	}
+
+	return file, nil
+}
+
+// changesetFileError - Reports the file that made the changeset fail
+func changesetFileError(fileErr *db.ChangesetFileError) *PatchError {
+	var perr *PatchError
+	switch {
+	case fileErr.Action == db.ChangeAdd:
+		perr = newPatchError(http.StatusConflict, ChangesetErrFileExists, fileErr.FilePath+" already exists; edit it instead")
+	case !fileErr.Exists && fileErr.Action != db.ChangeRestore:
+		perr = newPatchError(http.StatusNotFound, ChangesetErrFileNotFound, fileErr.FilePath+" does not exist")
+	default:
+		perr = newPatchError(http.StatusConflict, PatchErrStaleBase, fileErr.FilePath+" changed since base_version; fetch the latest version and retry")
+	}
+
+	perr.Details = map[string]interface{}{
+		"file_path":      fileErr.FilePath,
+		"base_version":   fileErr.BaseVersion,
+		"latest_version": fileErr.LatestVersion,
+	}
+	return perr
+}
+
+// changesetSummary - The files of a changeset as returned to clients
+func changesetSummary(changeset *db.Changeset) []map[string]interface{} {
+	files := make([]map[string]interface{}, 0, len(changeset.Files))
+	for _, fv := range changeset.Files {
+		files = append(files, map[string]interface{}{
+			"version_id": fv.ID,
+			"file_path":  fv.FilePath,
+			"version":    fv.Version,
+			"file_hash":  fv.FileHash,
+			"is_deleted": fv.IsDeleted,
+		})
+	}
+	return files
+}
+
+// GetChangeset - Get one changeset and the file versions it created
+func GetChangeset(w http.ResponseWriter, r *http.Request) {
+	changesetUUID, err := uuid.Parse(r.URL.Query().Get("changeset_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid changeset ID",
+		})
+		return
+	}
+
+	changesetModel := &db.ChangesetModel{DB: db.DB}
+	changeset, err := changesetModel.GetChangeset(changesetUUID)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Changeset not found",
+		})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch changeset",
+		})
+		return
+	}
+
+	if _, _, ok := authorizeProject(w, r, changeset.ProjectID, PermViewProject); !ok {
+		return
+	}
+
+	// Only changesets of projects linked to GitHub have a sync job
+	syncModel := &db.SyncModel{DB: db.DB}
+	var githubSync *db.SyncJob
+	if job, err := syncModel.GetChangesetSyncJob(changeset.ID); err == nil {
+		githubSync = job
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"changeset":   changesetResponse(changeset),
+		"github_sync": githubSync,
+	})
+}
+
+// GetProjectChangesets - Get a project's history grouped by changeset
+func GetProjectChangesets(w http.ResponseWriter, r *http.Request) {
+	projectID := r.URL.Query().Get("project_id")
+	projectUUID, err := uuid.Parse(projectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return
+	}
+
+	changesetModel := &db.ChangesetModel{DB: db.DB}
+	changesets, err := changesetModel.GetProjectChangesets(projectUUID, 50)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch changesets",
+		})
+		return
+	}
+
+	response := make([]map[string]interface{}, 0, len(changesets))
+	for i := range changesets {
+		response = append(response, changesetResponse(&changesets[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"project_id": projectID,
+		"changesets": response,
+		"total":      len(response),
+	})
+}
+
+func changesetResponse(changeset *db.Changeset) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         changeset.ID,
+		"project_id": changeset.ProjectID,
+		"user_id":    changeset.UserID,
+		"message":    changeset.Message,
+		"branch":     changeset.Branch,
+		"created_at": changeset.CreatedAt,
+		"files":      changesetSummary(changeset),
+	}
+}
@@ -12,9 +12,14 @@ import (
 )
 
 type CollabRequest struct {
-	OwnerEmail        string `json:"owner_email"`
 	CollaboratorEmail string `json:"collaborator_email"`
 	ProjectID         string `json:"project_id"`
+	Role              string `json:"role,omitempty"` // "viewer", "editor" (default) or "maintainer"
+}
+
+type CollabRoleUpdate struct {
+	CollabID string `json:"collab_id"`
+	Role     string `json:"role"`
 }
 
 type CollabApproval struct {
@@ -44,33 +49,48 @@ func RequestCollaboration(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate project exists and owner has access
-	userModel := &db.UserModel{DB: db.DB}
-	owner, err := userModel.GetUserByEmail(req.OwnerEmail)
+	projectID, err := uuid.Parse(req.ProjectID)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
+		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Owner not found",
+			"error": "Invalid project ID",
 		})
 		return
 	}
 
-	// Verify project belongs to owner
-	projectModel := &db.ProjectModel{DB: db.DB}
-	projectID, err := uuid.Parse(req.ProjectID)
-	if err != nil {
+	// Maintainers and the owner can invite collaborators
+	inviter, inviterRole, ok := authorizeProject(w, r, projectID, PermManageCollaborators)
+	if !ok {
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = db.RoleEditor
+	}
+	if !IsValidCollaboratorRole(req.Role) {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Invalid project ID",
+			"error": "Role must be 'viewer', 'editor' or 'maintainer'",
 		})
 		return
 	}
 
-	project, err := projectModel.GetProjectByID(projectID)
-	if err != nil || project.OwnerID != owner.ID {
+	// Only the owner can hand out the maintainer role
+	if req.Role == db.RoleMaintainer && inviterRole != db.RoleOwner {
 		w.WriteHeader(http.StatusForbidden)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Project not found or access denied",
+			"error": "Only the project owner can invite maintainers",
+		})
+		return
+	}
+
+	userModel := &db.UserModel{DB: db.DB}
+	projectModel := &db.ProjectModel{DB: db.DB}
+	project, err := projectModel.GetProjectByID(projectID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Project not found",
 		})
 		return
 	}
@@ -98,7 +118,7 @@ func RequestCollaboration(w http.ResponseWriter, r *http.Request) {
 
 	// Create collaboration request with PENDING status
 	collabModel := &db.CollaboratorModel{DB: db.DB}
-	collab, err := collabModel.CreateCollaboration(collaborator.ID, projectID, "pending")
+	collab, err := collabModel.CreateCollaboration(collaborator.ID, projectID, "pending", req.Role)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -112,7 +132,7 @@ func RequestCollaboration(w http.ResponseWriter, r *http.Request) {
 		CollabID:          collab.ID.String(),
 		ProjectID:         project.ID.String(),
 		ProjectName:       project.Name,
-		ProjectOwner:      owner.USERNAME,
+		ProjectOwner:      inviter.USERNAME,
 		CollaboratorEmail: collaborator.EMAIL,
 		CollaboratorName:  collaborator.USERNAME,
 		Status:            collab.Status,
@@ -135,12 +155,18 @@ func RequestCollaboration(w http.ResponseWriter, r *http.Request) {
 		"message":   "Collaboration request sent successfully",
 		"collab_id": collab.ID,
 		"status":    collab.Status,
+		"role":      collab.Role,
 		//"notification": notification,
 	})
 }
 
-// ApproveCollaboration - Approves/Rejects collaboration with token authentication
+// ApproveCollaboration - Approves/Rejects collaboration for the session user
 func ApproveCollaboration(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
 	var req CollabApproval
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -180,29 +206,13 @@ func ApproveCollaboration(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get collaborator user
-	userModel := &db.UserModel{DB: db.DB}
-	collaborator, err := userModel.GetUserByID(collab.UserID)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to fetch collaborator details",
-		})
-		return
-	}
-
-	// Authenticate collaborator using token
-	tokenModel := &db.TokenModel{DB: db.DB}
-	storedToken, err := tokenModel.GetToken(collaborator.USERNAME)
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
+	// Only the invited collaborator can accept or decline their own request
+	if collab.UserID != user.ID {
+		w.WriteHeader(http.StatusForbidden)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Collaborator authentication failed",
+			"error": "Only the invited collaborator can respond to this request",
 		})
 		return
-	} else {
-		fmt.Println("Stored Token: ", storedToken.GITHUB_TOKEN)
-		// In real implementation, verify token validity with session ID implementation via middleware to be added
 	}
 
 	// Update collaboration status
@@ -215,6 +225,14 @@ func ApproveCollaboration(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Mirror the answer to the project's GitHub repository. Rejecting a collaboration that was
+	// approved before takes the access away again.
+	if req.Status == "approved" {
+		queueRepoAccess(collab.ProjectID, collab.UserID, db.AccessGrant, collab.Role)
+	} else if collab.Status == "approved" {
+		queueRepoAccess(collab.ProjectID, collab.UserID, db.AccessRevoke, "")
+	}
+
 	// Get project details for notification
 	projectModel := &db.ProjectModel{DB: db.DB}
 	project, _ := projectModel.GetProjectByID(collab.ProjectID)
@@ -222,7 +240,7 @@ func ApproveCollaboration(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("\n=== COLLABORATION %s ===\n", req.Status)
 	fmt.Printf("Collaboration ID: %s\n", req.CollabID)
 	fmt.Printf("Project: %s\n", project.Name)
-	fmt.Printf("Collaborator: %s (%s)\n", collaborator.USERNAME, collaborator.EMAIL)
+	fmt.Printf("Collaborator: %s (%s)\n", user.USERNAME, user.EMAIL)
 	fmt.Printf("New Status: %s\n", req.Status)
 	fmt.Printf("==========================================\n\n")
 
@@ -255,6 +273,10 @@ func GetProjectCollaborators(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return
+	}
+
 	collabModel := &db.CollaboratorModel{DB: db.DB}
 	collaborators, err := collabModel.GetProjectCollaborators(projectUUID)
 	if err != nil {
@@ -276,22 +298,8 @@ func GetProjectCollaborators(w http.ResponseWriter, r *http.Request) {
 
 // GetUserCollaborationRequests - Lists pending collaboration requests for a user
 func GetUserCollaborationRequests(w http.ResponseWriter, r *http.Request) {
-	userEmail := r.URL.Query().Get("user_email")
-	if userEmail == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "user_email is required",
-		})
-		return
-	}
-
-	userModel := &db.UserModel{DB: db.DB}
-	user, err := userModel.GetUserByEmail(userEmail)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "User not found",
-		})
+	user, ok := requireUser(w, r)
+	if !ok {
 		return
 	}
 
@@ -308,7 +316,7 @@ func GetUserCollaborationRequests(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":    true,
-		"user_email": userEmail,
+		"user_email": user.EMAIL,
 		"requests":   requests,
 		"total":      len(requests),
 	})
@@ -350,6 +358,11 @@ func GetCollaboratorToken(w http.ResponseWriter, r *http.Request) {
 
 // RemoveCollaborator - Removes a collaborator from a project
 func RemoveCollaborator(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
 	vars := mux.Vars(r)
 	collabID := vars["collab_id"]
 
@@ -363,6 +376,31 @@ func RemoveCollaborator(w http.ResponseWriter, r *http.Request) {
 	}
 
 	collabModel := &db.CollaboratorModel{DB: db.DB}
+	collab, err := collabModel.GetCollaborationByID(collabUUID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Collaboration not found",
+		})
+		return
+	}
+
+	// Collaborators can always leave a project; removing someone else needs the manage permission
+	if collab.UserID != user.ID {
+		_, role, ok := authorizeProject(w, r, collab.ProjectID, PermManageCollaborators)
+		if !ok {
+			return
+		}
+
+		if collab.Role == db.RoleMaintainer && role != db.RoleOwner {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Only the project owner can remove maintainers",
+			})
+			return
+		}
+	}
+
 	err = collabModel.DeleteCollaboration(collabUUID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -372,9 +410,101 @@ func RemoveCollaborator(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if collab.Status == "approved" {
+		queueRepoAccess(collab.ProjectID, collab.UserID, db.AccessRevoke, "")
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
 		"message": "Collaborator removed successfully",
 	})
 }
+
+// UpdateCollaboratorRole - Changes the role of an existing collaborator
+func UpdateCollaboratorRole(w http.ResponseWriter, r *http.Request) {
+	var req CollabRoleUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	if !IsValidCollaboratorRole(req.Role) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Role must be 'viewer', 'editor' or 'maintainer'",
+		})
+		return
+	}
+
+	collabID, err := uuid.Parse(req.CollabID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid collaboration ID",
+		})
+		return
+	}
+
+	collabModel := &db.CollaboratorModel{DB: db.DB}
+	collab, err := collabModel.GetCollaborationByID(collabID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Collaboration not found",
+		})
+		return
+	}
+
+	user, role, ok := authorizeProject(w, r, collab.ProjectID, PermManageCollaborators)
+	if !ok {
+		return
+	}
+
+	// Granting or revoking maintainer is reserved for the owner
+	if (req.Role == db.RoleMaintainer || collab.Role == db.RoleMaintainer) && role != db.RoleOwner {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Only the project owner can change maintainer roles",
+		})
+		return
+	}
+
+	err = collabModel.UpdateCollaborationRole(collabID, req.Role)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to update collaborator role",
+		})
+		return
+	}
+
+	if collab.Status == "approved" {
+		queueRepoAccess(collab.ProjectID, collab.UserID, db.AccessGrant, req.Role)
+	}
+
+	LogActivity(
+		user.ID,
+		collab.ProjectID,
+		"collaborator_role_changed",
+		"Changed collaborator role to "+req.Role,
+		map[string]interface{}{
+			"collab_id": collab.ID,
+			"user_id":   collab.UserID,
+			"old_role":  collab.Role,
+			"new_role":  req.Role,
+		},
+		r,
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"message":   "Collaborator role updated",
+		"collab_id": req.CollabID,
+		"role":      req.Role,
+	})
+}
@@ -0,0 +1,515 @@
+package services
+
+import (
+	"app/urtc/db"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Diff formats
+const (
+	DiffFormatText   = "text"
+	DiffFormatJSON   = "json"
+	DiffFormatBinary = "binary"
+)
+
+// DiffErrNotJSON - A JSON diff was asked for files that are not JSON
+const DiffErrNotJSON = "not_json"
+
+const (
+	defaultDiffContext = 3
+	maxDiffContext     = 100
+)
+
+// DiffLine - One line of a hunk. Line numbers are 1-based and 0 on the side the line is not in.
+type DiffLine struct {
+	Type      string `json:"type"` // "context", "delete" or "insert"
+	OldLine   int    `json:"old_line,omitempty"`
+	NewLine   int    `json:"new_line,omitempty"`
+	Text      string `json:"text"`                 // without its newline
+	NoNewline bool   `json:"no_newline,omitempty"` // last line of a file that doesn't end in a newline
+}
+
+// DiffHunk - A changed region with its surrounding context, as in a unified diff
+type DiffHunk struct {
+	OldStart int        `json:"old_start"`
+	OldCount int        `json:"old_count"`
+	NewStart int        `json:"new_start"`
+	NewCount int        `json:"new_count"`
+	Lines    []DiffLine `json:"lines"`
+}
+
+// JSONDiffOp - A JSON Patch (RFC 6902) operation turning the old document into the new one.
+// OldValue is extra information for reviewers and is ignored when the patch is applied.
+type JSONDiffOp struct {
+	Op       string          `json:"op"`
+	Path     string          `json:"path"`
+	Value    json.RawMessage `json:"value,omitempty"`
+	OldValue json.RawMessage `json:"old_value,omitempty"`
+}
+
+// Text diff
+
+type lineEdit struct {
+	kind     string // "context", "delete" or "insert"
+	old, new int    // 0-based line indexes; -1 on the side the line is not in
+}
+
+// lineEdits - The shortest edit script from a to b, one entry per line
+func lineEdits(a, b []string) []lineEdit {
+	matches := matchLines(a, b)
+
+	var edits []lineEdit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && matches[i] == j:
+			edits = append(edits, lineEdit{"context", i, j})
+			i++
+			j++
+		case i < len(a) && matches[i] < 0:
+			edits = append(edits, lineEdit{"delete", i, -1})
+			i++
+		default:
+			edits = append(edits, lineEdit{"insert", -1, j})
+			j++
+		}
+	}
+	return edits
+}
+
+// diffLines - Groups the changes between a and b into hunks with context lines around them
+func diffLines(a, b []string, context int) []DiffHunk {
+	edits := lineEdits(a, b)
+
+	// Lines of each file before every edit, for hunk headers
+	oldBefore := make([]int, len(edits)+1)
+	newBefore := make([]int, len(edits)+1)
+	for k, edit := range edits {
+		oldBefore[k+1], newBefore[k+1] = oldBefore[k], newBefore[k]
+		if edit.old >= 0 {
+			oldBefore[k+1]++
+		}
+		if edit.new >= 0 {
+			newBefore[k+1]++
+		}
+	}
+
+	hunks := []DiffHunk{}
+	for k := 0; k < len(edits); {
+		if edits[k].kind == "context" {
+			k++
+			continue
+		}
+
+		// Extend over changes whose context would touch or overlap
+		start := k - context
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for next := k; next < len(edits); next++ {
+			if edits[next].kind == "context" {
+				continue
+			}
+			if next-end > 2*context {
+				break
+			}
+			end = next + 1
+		}
+		stop := end + context
+		if stop > len(edits) {
+			stop = len(edits)
+		}
+
+		hunk := DiffHunk{
+			OldStart: oldBefore[start] + 1,
+			OldCount: oldBefore[stop] - oldBefore[start],
+			NewStart: newBefore[start] + 1,
+			NewCount: newBefore[stop] - newBefore[start],
+		}
+		// An empty side names the line it comes after
+		if hunk.OldCount == 0 {
+			hunk.OldStart--
+		}
+		if hunk.NewCount == 0 {
+			hunk.NewStart--
+		}
+
+		for _, edit := range edits[start:stop] {
+			line := DiffLine{Type: edit.kind}
+			var text string
+			if edit.old >= 0 {
+				line.OldLine, text = edit.old+1, a[edit.old]
+			}
+			if edit.new >= 0 {
+				line.NewLine, text = edit.new+1, b[edit.new]
+			}
+			line.Text = strings.TrimSuffix(text, "\n")
+			line.NoNewline = !strings.HasSuffix(text, "\n")
+			hunk.Lines = append(hunk.Lines, line)
+		}
+
+		hunks = append(hunks, hunk)
+		k = stop
+	}
+
+	return hunks
+}
+
+// formatUnifiedDiff - Writes hunks in the format `diff -u` produces, which diff-based commits accept
+func formatUnifiedDiff(oldName, newName string, hunks []DiffHunk) string {
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+	for _, hunk := range hunks {
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", hunk.OldStart, hunk.OldCount, hunk.NewStart, hunk.NewCount)
+		for _, line := range hunk.Lines {
+			prefix := " "
+			switch line.Type {
+			case "delete":
+				prefix = "-"
+			case "insert":
+				prefix = "+"
+			}
+			out.WriteString(prefix + line.Text + "\n")
+			if line.NoNewline {
+				out.WriteString("\\ No newline at end of file\n")
+			}
+		}
+	}
+	return out.String()
+}
+
+// JSON diff
+
+// diffJSON - JSON Patch operations that turn a into b. Object members are compared by key and
+// array elements by a line-style diff of their values, so an edited element of a list of scene
+// objects shows up as changes inside it rather than a removal and an addition.
+func diffJSON(a, b interface{}, path string, ops []JSONDiffOp) []JSONDiffOp {
+	if jsonEqual(a, b) {
+		return ops
+	}
+
+	switch va := a.(type) {
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(va)+len(vb))
+		for key := range va {
+			keys = append(keys, key)
+		}
+		for key := range vb {
+			if _, inA := va[key]; !inA {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			child := path + "/" + escapeJSONPointer(key)
+			oldValue, inA := va[key]
+			newValue, inB := vb[key]
+			switch {
+			case !inB:
+				ops = append(ops, JSONDiffOp{Op: "remove", Path: child, OldValue: encodeJSONValue(oldValue)})
+			case !inA:
+				ops = append(ops, JSONDiffOp{Op: "add", Path: child, Value: encodeJSONValue(newValue)})
+			default:
+				ops = diffJSON(oldValue, newValue, child, ops)
+			}
+		}
+		return ops
+
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		return diffJSONArray(va, vb, path, ops)
+	}
+
+	return append(ops, JSONDiffOp{Op: "replace", Path: path, Value: encodeJSONValue(b), OldValue: encodeJSONValue(a)})
+}
+
+func diffJSONArray(a, b []interface{}, path string, ops []JSONDiffOp) []JSONDiffOp {
+	encodedA := make([]string, len(a))
+	for i, value := range a {
+		encodedA[i] = string(encodeJSONValue(value))
+	}
+	encodedB := make([]string, len(b))
+	for i, value := range b {
+		encodedB[i] = string(encodeJSONValue(value))
+	}
+	matches := matchLines(encodedA, encodedB)
+
+	// pos is the index in the array as the operations so far have left it
+	pos, i, j := 0, 0, 0
+	for i < len(a) || j < len(b) {
+		if i < len(a) && j < len(b) && matches[i] == j {
+			pos, i, j = pos+1, i+1, j+1
+			continue
+		}
+
+		// A run of unmatched elements on each side; pair them up first
+		oldEnd := i
+		for oldEnd < len(a) && matches[oldEnd] < 0 {
+			oldEnd++
+		}
+		newEnd := len(b)
+		if oldEnd < len(a) {
+			newEnd = matches[oldEnd]
+		}
+
+		for i < oldEnd && j < newEnd {
+			ops = diffJSON(a[i], b[j], path+"/"+strconv.Itoa(pos), ops)
+			pos, i, j = pos+1, i+1, j+1
+		}
+		for ; i < oldEnd; i++ {
+			ops = append(ops, JSONDiffOp{Op: "remove", Path: path + "/" + strconv.Itoa(pos), OldValue: encodeJSONValue(a[i])})
+		}
+		for ; j < newEnd; j++ {
+			ops = append(ops, JSONDiffOp{Op: "add", Path: path + "/" + strconv.Itoa(pos), Value: encodeJSONValue(b[j])})
+			pos++
+		}
+	}
+	return ops
+}
+
+// encodeJSONValue - Canonical encoding, as applyJSONPatch writes documents
+func encodeJSONValue(value interface{}) json.RawMessage {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+func escapeJSONPointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+// isJSONDocument - Whether content is a JSON object or array, the shape of scene and prefab files
+func isJSONDocument(content string) (interface{}, bool) {
+	trimmed := strings.TrimSpace(content)
+	if trimmed == "" || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return nil, false
+	}
+	doc, err := decodeJSON([]byte(trimmed))
+	if err != nil {
+		return nil, false
+	}
+	return doc, true
+}
+
+// Handler
+
+// loadDiffSide - One side of a diff, by version ID or by version number of file_path
+func loadDiffSide(projectID uuid.UUID, filePath, versionParam, idParam string) (*db.FileVersion, error) {
+	versionModel := &db.VersionModel{DB: db.DB}
+
+	if idParam != "" {
+		versionID, err := uuid.Parse(idParam)
+		if err != nil {
+			return nil, sql.ErrNoRows
+		}
+		fv, err := versionModel.GetVersionByID(versionID)
+		if err != nil {
+			return nil, err
+		}
+		if fv.ProjectID != projectID {
+			return nil, sql.ErrNoRows
+		}
+		return fv, nil
+	}
+
+	version, err := strconv.Atoi(versionParam)
+	if err != nil || filePath == "" {
+		return nil, sql.ErrNoRows
+	}
+	return versionModel.GetVersion(projectID, filePath, version)
+}
+
+func diffSideSummary(fv *db.FileVersion) map[string]interface{} {
+	return map[string]interface{}{
+		"version_id": fv.ID,
+		"version":    fv.Version,
+		"file_path":  fv.FilePath,
+		"file_hash":  fv.FileHash,
+		"file_size":  fv.FileSize,
+		"branch":     fv.Branch,
+		"is_deleted": fv.IsDeleted,
+		"is_binary":  fv.IsBinary,
+		"created_at": fv.CreatedAt,
+	}
+}
+
+// GetVersionDiff - Compares two versions of a file: a unified diff with structured hunks, plus
+// a JSON Patch for JSON files such as scenes
+func GetVersionDiff(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filePath := query.Get("file_path")
+
+	projectUUID, err := uuid.Parse(query.Get("project_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	if query.Get("from") == "" && query.Get("from_id") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "from (with file_path) or from_id is required",
+		})
+		return
+	}
+
+	context := defaultDiffContext
+	if c := query.Get("context"); c != "" {
+		context, err = strconv.Atoi(c)
+		if err != nil || context < 0 || context > maxDiffContext {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "context must be between 0 and " + strconv.Itoa(maxDiffContext),
+			})
+			return
+		}
+	}
+
+	format := query.Get("format")
+	if format != "" && format != "auto" && format != DiffFormatText && format != DiffFormatJSON {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "format must be auto, text or json",
+		})
+		return
+	}
+
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return
+	}
+
+	from, err := loadDiffSide(projectUUID, filePath, query.Get("from"), query.Get("from_id"))
+	if err != nil {
+		writeDiffSideError(w, "from", err)
+		return
+	}
+
+	// Without a "to" side, compare against the latest version on ref
+	var to *db.FileVersion
+	if query.Get("to") != "" || query.Get("to_id") != "" {
+		to, err = loadDiffSide(projectUUID, filePath, query.Get("to"), query.Get("to_id"))
+	} else {
+		ref, ok := resolveRef(w, projectUUID, query.Get("ref"))
+		if !ok {
+			return
+		}
+		versionModel := &db.VersionModel{DB: db.DB}
+		var history []db.FileVersion
+		history, err = versionModel.GetFileHistory(projectUUID, from.FilePath, ref, 1)
+		if err == nil && len(history) == 0 {
+			err = sql.ErrNoRows
+		}
+		if err == nil {
+			to, err = versionModel.GetVersionByID(history[0].ID)
+		}
+	}
+	if err != nil {
+		writeDiffSideError(w, "to", err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"success":    true,
+		"project_id": projectUUID,
+		"from":       diffSideSummary(from),
+		"to":         diffSideSummary(to),
+		"identical":  from.FileHash == to.FileHash && from.IsDeleted == to.IsDeleted,
+	}
+
+	// Binary assets are compared by hash only
+	if from.IsBinary || to.IsBinary {
+		response["format"] = DiffFormatBinary
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	oldName, newName := "a/"+from.FilePath, "b/"+to.FilePath
+	if from.IsDeleted {
+		oldName = "/dev/null"
+	}
+	if to.IsDeleted {
+		newName = "/dev/null"
+	}
+
+	hunks := diffLines(splitLinesKeepEnds(from.Content), splitLinesKeepEnds(to.Content), context)
+	additions, deletions := 0, 0
+	for _, hunk := range hunks {
+		for _, line := range hunk.Lines {
+			switch line.Type {
+			case "insert":
+				additions++
+			case "delete":
+				deletions++
+			}
+		}
+	}
+
+	response["format"] = DiffFormatText
+	response["diff"] = formatUnifiedDiff(oldName, newName, hunks)
+	response["hunks"] = hunks
+	response["additions"] = additions
+	response["deletions"] = deletions
+
+	if format != DiffFormatText {
+		oldDoc, oldIsJSON := isJSONDocument(from.Content)
+		newDoc, newIsJSON := isJSONDocument(to.Content)
+		switch {
+		case oldIsJSON && newIsJSON:
+			response["format"] = DiffFormatJSON
+			response["json_diff"] = diffJSON(oldDoc, newDoc, "", []JSONDiffOp{})
+		case format == DiffFormatJSON:
+			writePatchError(w, newPatchError(http.StatusUnprocessableEntity, DiffErrNotJSON, "Both versions must be JSON documents for a JSON diff"))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeDiffSideError(w http.ResponseWriter, side string, err error) {
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Version not found",
+			"side":  side,
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": "Failed to fetch version",
+	})
+}
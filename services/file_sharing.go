@@ -4,23 +4,29 @@ import (
 	"app/urtc/db"
 	"encoding/json"
 	"net/http"
+	"path"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type FileShareRequest struct {
-	SenderEmail    string `json:"sender_email"`
-	RecipientEmail string `json:"recipient_email"`
-	ProjectID      string `json:"project_id"`
-	FileName       string `json:"file_name"`
-	FileContent    string `json:"file_content"` // Base64 encoded
-	FileType       string `json:"file_type"`    // "asset", "script", "scene", etc.
-	Message        string `json:"message"`
+	RecipientEmail string          `json:"recipient_email"`
+	ProjectID      string          `json:"project_id"`
+	FileName       string          `json:"file_name"`
+	FileContent    string          `json:"file_content"` // Base64 encoded
+	FileType       string          `json:"file_type"`    // "asset", "script", "scene", etc.
+	Message        string          `json:"message"`
+	FilePath       string          `json:"file_path,omitempty"`
+	BaseVersion    int             `json:"base_version,omitempty"`
+	PatchType      string          `json:"patch_type,omitempty"` // "json_patch" or "text_diff"; sent instead of file_content
+	Patch          json.RawMessage `json:"patch,omitempty"`
+	FileHash       string          `json:"file_hash,omitempty"`
+	Branch         string          `json:"branch,omitempty"`     // branch the patch base is read from
+	VersionID      string          `json:"version_id,omitempty"` // shares a committed version, such as an uploaded asset, by reference
 }
 
 type CodeShareRequest struct {
-	SenderEmail    string `json:"sender_email"`
 	RecipientEmail string `json:"recipient_email"`
 	ProjectID      string `json:"project_id"`
 	FileName       string `json:"file_name"`
@@ -31,17 +37,22 @@ type CodeShareRequest struct {
 }
 
 type BulkFileShareRequest struct {
-	SenderEmail    string      `json:"sender_email"`
 	RecipientEmail string      `json:"recipient_email"`
 	ProjectID      string      `json:"project_id"`
 	Files          []FileShare `json:"files"`
 	Message        string      `json:"message"`
+	Branch         string      `json:"branch,omitempty"`
 }
 
 type FileShare struct {
-	FileName    string `json:"file_name"`
-	FileContent string `json:"file_content"`
-	FileType    string `json:"file_type"`
+	FileName    string          `json:"file_name"`
+	FileContent string          `json:"file_content"`
+	FileType    string          `json:"file_type"`
+	FilePath    string          `json:"file_path,omitempty"`
+	BaseVersion int             `json:"base_version,omitempty"`
+	PatchType   string          `json:"patch_type,omitempty"`
+	Patch       json.RawMessage `json:"patch,omitempty"`
+	FileHash    string          `json:"file_hash,omitempty"`
 }
 
 type ShareableCollaborator struct {
@@ -54,6 +65,11 @@ type ShareableCollaborator struct {
 
 // ShareFile - Share a single file with a collaborator
 func ShareFile(w http.ResponseWriter, r *http.Request) {
+	sender, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
 	var req FileShareRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -64,25 +80,26 @@ func ShareFile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate required fields
-	if req.SenderEmail == "" || req.RecipientEmail == "" || req.FileName == "" || req.FileContent == "" {
+	if req.FileName == "" && req.FilePath != "" {
+		req.FileName = path.Base(req.FilePath)
+	}
+	if req.RecipientEmail == "" || (req.VersionID == "" && (req.FileName == "" || (req.FileContent == "" && len(req.Patch) == 0))) {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
 			"error": "Missing required fields",
 		})
 		return
 	}
-
-	// Get sender and recipient users
-	userModel := &db.UserModel{DB: db.DB}
-	_, err := userModel.GetUserByEmail(req.SenderEmail)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
+	if req.VersionID != "" && req.ProjectID == "" {
+		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Sender not found",
+			"error": "project_id is required to share a version",
 		})
 		return
 	}
 
+	// Get recipient user; the sender is the session user
+	userModel := &db.UserModel{DB: db.DB}
 	recipient, err := userModel.GetUserByEmail(req.RecipientEmail)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
@@ -92,26 +109,40 @@ func ShareFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify collaboration exists if project_id is provided
-	if req.ProjectID != "" {
-		projectUUID, err := uuid.Parse(req.ProjectID)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{
-				"error": "Invalid project ID",
-			})
+	// Verify both sides belong to the project if project_id is provided
+	if !authorizeShare(w, r, req.ProjectID, recipient.ID) {
+		return
+	}
+
+	// Deltas are applied here so the recipient always gets the whole file
+	if len(req.Patch) > 0 {
+		content, perr := resolveSharedPatch(req.ProjectID, req.Branch, req.FilePath, req.BaseVersion, req.PatchType, req.Patch, req.FileHash)
+		if perr != nil {
+			writePatchError(w, perr)
 			return
 		}
+		req.FileContent = content
+	}
 
-		collabModel := &db.CollaboratorModel{DB: db.DB}
-		collab, err := collabModel.GetCollaborationByUserAndProject(recipient.ID, projectUUID)
-		if err != nil || collab.Status != "approved" {
-			w.WriteHeader(http.StatusForbidden)
+	// A shared version is sent as a reference the recipient downloads from /version/content
+	var shared *db.FileVersion
+	if req.VersionID != "" {
+		versionUUID, err := uuid.Parse(req.VersionID)
+		if err == nil {
+			versionModel := &db.VersionModel{DB: db.DB}
+			shared, err = versionModel.GetVersionByID(versionUUID)
+		}
+		if err != nil || shared.ProjectID.String() != req.ProjectID || shared.IsDeleted {
+			w.WriteHeader(http.StatusNotFound)
 			json.NewEncoder(w).Encode(map[string]string{
-				"error": "Recipient is not an approved collaborator",
+				"error": "Version not found",
 			})
 			return
 		}
+		req.FileName, req.FilePath, req.FileContent = shared.FileName, shared.FilePath, ""
+		if req.FileType == "" {
+			req.FileType = shared.FileType
+		}
 	}
 
 	// Send file via WebSocket
@@ -120,9 +151,19 @@ func ShareFile(w http.ResponseWriter, r *http.Request) {
 		"file_name":    req.FileName,
 		"file_content": req.FileContent,
 		"file_type":    req.FileType,
-		"sender_email": req.SenderEmail,
+		"sender_email": sender.EMAIL,
 		"message":      req.Message,
 	}
+	if req.FilePath != "" {
+		metadata["file_path"] = req.FilePath
+	}
+	if shared != nil {
+		metadata["version_id"] = shared.ID
+		metadata["version"] = shared.Version
+		metadata["file_hash"] = shared.FileHash
+		metadata["file_size"] = shared.FileSize
+		metadata["is_binary"] = shared.IsBinary
+	}
 
 	SendNotificationToUser(
 		recipient.ID.String(),
@@ -143,6 +184,11 @@ func ShareFile(w http.ResponseWriter, r *http.Request) {
 
 // ShareCode - Share code snippet with a collaborator
 func ShareCode(w http.ResponseWriter, r *http.Request) {
+	sender, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
 	var req CodeShareRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -153,7 +199,7 @@ func ShareCode(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate required fields
-	if req.SenderEmail == "" || req.RecipientEmail == "" || req.Code == "" {
+	if req.RecipientEmail == "" || req.Code == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
 			"error": "Missing required fields",
@@ -161,23 +207,18 @@ func ShareCode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get sender and recipient users
+	// Get recipient user; the sender is the session user
 	userModel := &db.UserModel{DB: db.DB}
-	_, err := userModel.GetUserByEmail(req.SenderEmail)
+	recipient, err := userModel.GetUserByEmail(req.RecipientEmail)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Sender not found",
+			"error": "Recipient not found",
 		})
 		return
 	}
 
-	recipient, err := userModel.GetUserByEmail(req.RecipientEmail)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Recipient not found",
-		})
+	if !authorizeShare(w, r, req.ProjectID, recipient.ID) {
 		return
 	}
 
@@ -188,7 +229,7 @@ func ShareCode(w http.ResponseWriter, r *http.Request) {
 		"code":         req.Code,
 		"language":     req.Language,
 		"line_number":  req.LineNumber,
-		"sender_email": req.SenderEmail,
+		"sender_email": sender.EMAIL,
 		"message":      req.Message,
 	}
 
@@ -210,6 +251,11 @@ func ShareCode(w http.ResponseWriter, r *http.Request) {
 
 // ShareBulkFiles - Share multiple files at once
 func ShareBulkFiles(w http.ResponseWriter, r *http.Request) {
+	sender, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
 	var req BulkFileShareRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -220,7 +266,7 @@ func ShareBulkFiles(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate required fields
-	if req.SenderEmail == "" || req.RecipientEmail == "" || len(req.Files) == 0 {
+	if req.RecipientEmail == "" || len(req.Files) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
 			"error": "Missing required fields",
@@ -228,32 +274,50 @@ func ShareBulkFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get sender and recipient users
+	// Get recipient user; the sender is the session user
 	userModel := &db.UserModel{DB: db.DB}
-	_, err := userModel.GetUserByEmail(req.SenderEmail)
+	recipient, err := userModel.GetUserByEmail(req.RecipientEmail)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Sender not found",
+			"error": "Recipient not found",
 		})
 		return
 	}
 
-	recipient, err := userModel.GetUserByEmail(req.RecipientEmail)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Recipient not found",
-		})
+	if !authorizeShare(w, r, req.ProjectID, recipient.ID) {
 		return
 	}
 
+	for i := range req.Files {
+		file := &req.Files[i]
+		if len(file.Patch) == 0 {
+			continue
+		}
+
+		content, perr := resolveSharedPatch(req.ProjectID, req.Branch, file.FilePath, file.BaseVersion, file.PatchType, file.Patch, file.FileHash)
+		if perr != nil {
+			if perr.Details == nil {
+				perr.Details = map[string]interface{}{}
+			}
+			perr.Details["file_index"] = i
+			writePatchError(w, perr)
+			return
+		}
+		file.FileContent = content
+		file.Patch = nil
+		file.PatchType = ""
+		if file.FileName == "" {
+			file.FileName = path.Base(file.FilePath)
+		}
+	}
+
 	// Send files via WebSocket
 	metadata := map[string]interface{}{
 		"project_id":   req.ProjectID,
 		"files":        req.Files,
 		"file_count":   len(req.Files),
-		"sender_email": req.SenderEmail,
+		"sender_email": sender.EMAIL,
 		"message":      req.Message,
 	}
 
@@ -274,6 +338,58 @@ func ShareBulkFiles(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// resolveSharedPatch - Rebuilds a shared file from a delta against the latest version on a branch
+func resolveSharedPatch(projectID, branch, filePath string, baseVersion int, patchType string, patch json.RawMessage, fileHash string) (string, *PatchError) {
+	if projectID == "" {
+		return "", newPatchError(http.StatusBadRequest, PatchErrProjectRequired, "project_id is required for patches")
+	}
+	projectUUID, err := uuid.Parse(projectID)
+	if err != nil {
+		return "", newPatchError(http.StatusBadRequest, PatchErrProjectRequired, "Invalid project ID")
+	}
+
+	ref, perr := resolvePatchBranch(projectUUID, branch)
+	if perr != nil {
+		return "", perr
+	}
+
+	content, _, perr := resolvePatch(projectUUID, ref, filePath, baseVersion, patchType, patch, fileHash)
+	return content, perr
+}
+
+// authorizeShare - For project-scoped shares, the sender needs the share permission and the
+// recipient must be able to view the project
+func authorizeShare(w http.ResponseWriter, r *http.Request, projectID string, recipientID uuid.UUID) bool {
+	if projectID == "" {
+		return true
+	}
+
+	projectUUID, err := uuid.Parse(projectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return false
+	}
+
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermShareFiles); !ok {
+		return false
+	}
+
+	collabModel := &db.CollaboratorModel{DB: db.DB}
+	recipientRole, err := collabModel.GetUserRole(recipientID, projectUUID)
+	if err != nil || !RoleAllows(recipientRole, PermViewProject) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Recipient is not an approved collaborator",
+		})
+		return false
+	}
+
+	return true
+}
+
 // GetShareableCollaborators - Get list of approved collaborators for file sharing
 func GetShareableCollaborators(w http.ResponseWriter, r *http.Request) {
 	projectID := r.URL.Query().Get("project_id")
@@ -294,6 +410,10 @@ func GetShareableCollaborators(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return
+	}
+
 	collabModel := &db.CollaboratorModel{DB: db.DB}
 	collaborators, err := collabModel.GetProjectCollaborators(projectUUID)
 	if err != nil {
@@ -3,57 +3,263 @@ package services
 import (
 	"app/urtc/db"
 	"context"
+	"crypto/subtle"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
 )
 
-var githubOAuthConfig *oauth2.Config
+var (
+	githubOAuthOnce   sync.Once
+	githubOAuthConfig *oauth2.Config
+)
 
-func init() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
+// githubOAuth - The OAuth app settings, read from the environment on first use, after main has
+// loaded .env
+func githubOAuth() *oauth2.Config {
+	githubOAuthOnce.Do(func() {
+		githubOAuthConfig = &oauth2.Config{
+			ClientID:     os.Getenv("GITHUB_CLIENT_ID"),
+			ClientSecret: os.Getenv("GITHUB_CLIENT_SECRET"),
+			Scopes:       []string{"repo", "user"},
+			Endpoint:     github.Endpoint,
+			RedirectURL:  os.Getenv("GITHUB_CALLBACK_URL"),
+		}
+	})
+	return githubOAuthConfig
+}
+
+const (
+	oauthStateTTL      = 10 * time.Minute
+	oauthStateCookie   = "urtc_oauth_state"
+	maxClientStateSize = 512
+)
+
+var errRedirectNotAllowed = errors.New("redirect_uri must be a loopback address or listed in OAUTH_REDIRECT_URIS")
+
+// isLoopbackRedirect - Plain http to this machine, which is where a desktop plugin listens
+func isLoopbackRedirect(u *url.URL) bool {
+	if u.Scheme != "http" || u.User != nil || u.Port() == "" {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// loginRedirectURI - Where the session is sent once login finishes. "port" is short for
+// http://127.0.0.1:{port}/callback. Other URIs have to be loopback or listed in OAUTH_REDIRECT_URIS,
+// so a login link can't hand the session to somebody else's server.
+func loginRedirectURI(r *http.Request) (string, error) {
+	raw := r.URL.Query().Get("redirect_uri")
+	if port := r.URL.Query().Get("port"); port != "" {
+		if raw != "" {
+			return "", errors.New("use either redirect_uri or port")
+		}
+		number, err := strconv.Atoi(port)
+		if err != nil || number < 1 || number > 65535 {
+			return "", errors.New("port must be between 1 and 65535")
+		}
+		return fmt.Sprintf("http://127.0.0.1:%d/callback", number), nil
+	}
+	if raw == "" {
+		return "", nil
 	}
 
-	githubOAuthConfig = &oauth2.Config{
-		ClientID:     os.Getenv("GITHUB_CLIENT_ID"),
-		ClientSecret: os.Getenv("GITHUB_CLIENT_SECRET"),
-		Scopes:       []string{"repo", "user"},
-		Endpoint:     github.Endpoint,
-		RedirectURL:  os.Getenv("GITHUB_CALLBACK_URL"),
+	u, err := url.Parse(raw)
+	if err != nil || u.Fragment != "" {
+		return "", errRedirectNotAllowed
 	}
+	if isLoopbackRedirect(u) {
+		return raw, nil
+	}
+	for _, allowed := range strings.Split(os.Getenv("OAUTH_REDIRECT_URIS"), ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && allowed == raw {
+			return raw, nil
+		}
+	}
+	return "", errRedirectNotAllowed
+}
+
+// setOAuthStateCookie - Ties a login to the browser that started it, so a callback link made
+// for someone else's login is refused. A negative maxAge clears it.
+func setOAuthStateCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    value,
+		Path:     "/github/callback",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(githubOAuth().RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
 }
 
+// GitHubLoginHandler - Starts a login with a fresh state and PKCE verifier and sends the browser to GitHub
 func GitHubLoginHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Config:", githubOAuthConfig)
-	url := githubOAuthConfig.AuthCodeURL("randomstate")
-	http.Redirect(w, r, url, http.StatusFound)
+	redirectURI, err := loginRedirectURI(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	clientState := r.URL.Query().Get("client_state")
+	if len(clientState) > maxClientStateSize {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": fmt.Sprintf("client_state can't be longer than %d characters", maxClientStateSize),
+		})
+		return
+	}
+
+	state, err := generateToken()
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	stateModel := &db.OAuthStateModel{DB: db.DB}
+	if _, err := stateModel.CreateOAuthState(hashToken(state), verifier, redirectURI, clientState, time.Now().Add(oauthStateTTL)); err != nil {
+		log.Printf("Failed to store OAuth state: %v", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	setOAuthStateCookie(w, state, int(oauthStateTTL.Seconds()))
+	authURL := githubOAuth().AuthCodeURL(state, oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// StartOAuthStateCleanup - Periodically purges logins that were started but never finished
+func StartOAuthStateCleanup(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		stateModel := &db.OAuthStateModel{DB: db.DB}
+		for range ticker.C {
+			removed, err := stateModel.DeleteExpiredOAuthStates(time.Now())
+			if err != nil {
+				log.Printf("OAuth state cleanup failed: %v", err)
+				continue
+			}
+			if removed > 0 {
+				log.Printf("OAuth state cleanup removed %d logins", removed)
+			}
+		}
+	}()
+}
+
+// loginFailed - Reports a failed login to the client that started it: back to its redirect_uri
+// with an error when it gave one, otherwise as plain text
+func loginFailed(w http.ResponseWriter, r *http.Request, login *db.OAuthState, message string, status int) {
+	if login == nil || login.RedirectURI == "" {
+		http.Error(w, message, status)
+		return
+	}
+
+	params := url.Values{}
+	params.Set("error", message)
+	redirectToClient(w, r, login, params)
+}
+
+// redirectToClient - Sends the browser back to the login's redirect_uri with params added to its query
+func redirectToClient(w http.ResponseWriter, r *http.Request, login *db.OAuthState, params url.Values) {
+	target, err := url.Parse(login.RedirectURI)
+	if err != nil {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if login.ClientState != "" {
+		query.Set("state", login.ClientState)
+	}
+	target.RawQuery = query.Encode()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, target.String(), http.StatusFound)
 }
 
+// GitHubCallbackHandler - Finishes a login: checks the state against the browser and the stored login,
+// exchanges the code with its PKCE verifier and issues a session
 func GitHubCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie(oauthStateCookie)
+	if state == "" || err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Error(w, "Login state doesn't match, please sign in again", http.StatusBadRequest)
+		return
+	}
+	setOAuthStateCookie(w, "", -1)
+
+	stateModel := &db.OAuthStateModel{DB: db.DB}
+	login, err := stateModel.ConsumeOAuthState(hashToken(state))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to load OAuth state: %v", err)
+		}
+		http.Error(w, "Login expired or was already used, please sign in again", http.StatusBadRequest)
+		return
+	}
+
+	if reason := r.URL.Query().Get("error"); reason != "" {
+		log.Printf("GitHub login denied: %s", reason)
+		message := "GitHub login failed"
+		if reason == "access_denied" {
+			message = "GitHub login was cancelled"
+		}
+		loginFailed(w, r, login, message, http.StatusForbidden)
+		return
+	}
+
 	code := r.URL.Query().Get("code")
-	token, err := githubOAuthConfig.Exchange(context.Background(), code)
+	if code == "" {
+		loginFailed(w, r, login, "Missing authorization code", http.StatusBadRequest)
+		return
+	}
+
+	token, err := githubOAuth().Exchange(context.Background(), code, oauth2.VerifierOption(login.Verifier))
 	if err != nil {
-		http.Error(w, "Failed to exchange token: "+err.Error(), http.StatusInternalServerError)
+		log.Printf("Failed to exchange GitHub code: %v", err)
+		loginFailed(w, r, login, "Failed to exchange token", http.StatusInternalServerError)
 		return
 	}
 
 	accessToken := token.AccessToken
-	fmt.Println(accessToken)
 
 	client := oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(token))
 	resp, err := client.Get("https://api.github.com/user")
 	if err != nil {
-		http.Error(w, "Failed to get user info", http.StatusInternalServerError)
+		log.Printf("Failed to get GitHub user: %v", err)
+		loginFailed(w, r, login, "Failed to get user info", http.StatusInternalServerError)
 		return
 	}
 	defer resp.Body.Close()
@@ -66,7 +272,8 @@ func GitHubCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-		http.Error(w, "Failed to parse user info", http.StatusInternalServerError)
+		log.Printf("Failed to parse GitHub user: %v", err)
+		loginFailed(w, r, login, "Failed to parse user info", http.StatusInternalServerError)
 		return
 	}
 
@@ -74,7 +281,8 @@ func GitHubCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	if user.Email == "" {
 		emailResp, err := client.Get("https://api.github.com/user/emails")
 		if err != nil {
-			http.Error(w, "Failed to get user emails", http.StatusInternalServerError)
+			log.Printf("Failed to get GitHub emails: %v", err)
+			loginFailed(w, r, login, "Failed to get user emails", http.StatusInternalServerError)
 			return
 		}
 		defer emailResp.Body.Close()
@@ -86,7 +294,8 @@ func GitHubCallbackHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if err := json.NewDecoder(emailResp.Body).Decode(&emails); err != nil {
-			http.Error(w, "Failed to parse user emails", http.StatusInternalServerError)
+			log.Printf("Failed to parse GitHub emails: %v", err)
+			loginFailed(w, r, login, "Failed to parse user emails", http.StatusInternalServerError)
 			return
 		}
 
@@ -99,48 +308,59 @@ func GitHubCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if user.Email == "" {
-		http.Error(w, "Email not available, please make your email public on GitHub", http.StatusBadRequest)
+		loginFailed(w, r, login, "Email not available, please make your email public on GitHub", http.StatusBadRequest)
 		return
 	}
 
 	userModel := &db.UserModel{DB: db.DB}
 
 	// Check if the user already exists
-	newUser, err := userModel.GetUserByEmail(user.Email)
-	if err == nil {
-		// User exists, update token
-		stored_data := StoreAccessToken(newUser.USERNAME, accessToken, newUser.ID)
-		if stored_data {
-			fmt.Println("Data Updated Successfully")
-			w.WriteHeader(http.StatusOK)
-		} else {
-			fmt.Println("Unable to update token")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		fmt.Fprintf(w, "Welcome back, %s! Your email is %s", newUser.USERNAME, newUser.EMAIL)
-	} else {
+	welcome := "Welcome back"
+	existingUser, err := userModel.GetUserByEmail(user.Email)
+	if err != nil {
 		// Create new user
-		newUser, err := userModel.CreateUser(int64(user.ID), user.Login, user.Email)
+		existingUser, err = userModel.CreateUser(int64(user.ID), user.Login, user.Email)
 		if err != nil {
-			http.Error(w, "Failed to save user: "+err.Error(), http.StatusInternalServerError)
+			log.Printf("Failed to create user %s: %v", user.Login, err)
+			loginFailed(w, r, login, "Failed to save user", http.StatusInternalServerError)
 			return
 		}
+		welcome = "Welcome"
+	}
 
-		// Store the github data
-		stored_data := StoreAccessToken(newUser.USERNAME, accessToken, newUser.ID)
-		if stored_data {
-			fmt.Println("Data Stored Successfully")
-			w.WriteHeader(http.StatusOK)
-		} else {
-			fmt.Println("Unable to save token")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		fmt.Fprintf(w, "Welcome, %s! Your email is %s", newUser.USERNAME, newUser.EMAIL)
+	// Store or update the github data
+	if !StoreAccessToken(existingUser.USERNAME, accessToken, existingUser.ID) {
+		log.Printf("Failed to store GitHub token for %s", existingUser.USERNAME)
+		loginFailed(w, r, login, "Failed to store GitHub token", http.StatusInternalServerError)
+		return
+	}
+
+	// Issue a server-side session; later requests authenticate with this token, not with emails
+	sessionToken, session, err := IssueSession(existingUser.ID, r)
+	if err != nil {
+		log.Printf("Failed to create session for %s: %v", existingUser.USERNAME, err)
+		loginFailed(w, r, login, "Failed to create session", http.StatusInternalServerError)
+		return
 	}
 
-	fmt.Fprintf(w, "\nYou can now continue working in your game engine")
+	if login.RedirectURI != "" {
+		params := url.Values{}
+		params.Set("session_token", sessionToken)
+		params.Set("expires_at", session.ExpiresAt.UTC().Format(time.RFC3339))
+		params.Set("user_id", existingUser.ID.String())
+		params.Set("username", existingUser.USERNAME)
+		redirectToClient(w, r, login, params)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"message":       fmt.Sprintf("%s, %s! You can now continue working in your game engine", welcome, existingUser.USERNAME),
+		"session_token": sessionToken,
+		"expires_at":    session.ExpiresAt,
+		"user":          existingUser,
+	})
 }
 
 func StoreAccessToken(username, githubToken string, user_id uuid.UUID) bool {
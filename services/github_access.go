@@ -0,0 +1,463 @@
+package services
+
+import (
+	"app/urtc/db"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	accessBatchSize        = 50
+	accessChangeTimeout    = 2 * time.Minute
+	accessReconcileTimeout = 5 * time.Minute
+)
+
+// repoRoleName - The repository role matching a project role
+func repoRoleName(role string) string {
+	switch role {
+	case db.RoleViewer:
+		return "read"
+	case db.RoleMaintainer:
+		return "maintain"
+	}
+	return "write"
+}
+
+// repoPermission - A repository role as the collaborators API spells it
+func repoPermission(roleName string) string {
+	switch roleName {
+	case "read":
+		return "pull"
+	case "write":
+		return "push"
+	}
+	return roleName
+}
+
+// personalRepo - Repositories owned by a user have a single collaborator level, which can push
+func personalRepo(repo *GitHubRepository) bool {
+	return repo.Owner.Type != "Organization"
+}
+
+// accessClient - The GitHub client for changing a project's repository access, acting as the
+// project owner, who manages the repository's collaborators
+func accessClient(projectID uuid.UUID) (GitHubClient, *db.Project, *db.GitHubRepo, error) {
+	projectModel := &db.ProjectModel{DB: db.DB}
+	project, err := projectModel.GetProjectByID(projectID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	repo := project.Repo
+	if repo == nil {
+		return nil, nil, nil, permanentf("the project is no longer linked to a GitHub repository")
+	}
+
+	tokenModel := &db.TokenModel{DB: db.DB}
+	token, err := tokenModel.GetTokenByUserID(project.OwnerID)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil, permanentf("the project owner has no GitHub token")
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return newGitHubClient(token.GITHUB_TOKEN), project, repo, nil
+}
+
+// findInvitation - The pending invitation of a login, if any
+func findInvitation(invitations []GitHubInvitation, login string) *GitHubInvitation {
+	for i := range invitations {
+		if strings.EqualFold(invitations[i].Invitee.Login, login) {
+			return &invitations[i]
+		}
+	}
+	return nil
+}
+
+// revokeRepoAccess - Cancels a login's pending invitation and removes them as a collaborator.
+// Access that is already gone counts as revoked.
+func revokeRepoAccess(ctx context.Context, client GitHubClient, repo *db.GitHubRepo, login string, invitation *GitHubInvitation) error {
+	if invitation != nil {
+		if err := client.DeleteInvitation(ctx, repo.Owner, repo.Name, invitation.ID); err != nil && err != ErrGitHubNotFound {
+			return err
+		}
+	}
+	if err := client.RemoveCollaborator(ctx, repo.Owner, repo.Name, login); err != nil && err != ErrGitHubNotFound {
+		return err
+	}
+	return nil
+}
+
+// applyAccessChange - Brings one login's access on the repository in line with a change. The
+// note explains anything that couldn't be mirrored exactly.
+func applyAccessChange(ctx context.Context, change *db.AccessChange) (string, error) {
+	client, _, repo, err := accessClient(change.ProjectID)
+	if err != nil {
+		return "", err
+	}
+	repository, repo, err := fetchLinkedRepo(ctx, client, change.ProjectID, repo)
+	if err != nil {
+		return "", err
+	}
+	invitations, err := client.ListInvitations(ctx, repo.Owner, repo.Name)
+	if err != nil {
+		return "", err
+	}
+	invitation := findInvitation(invitations, change.GitHubLogin)
+
+	if change.Action == db.AccessRevoke {
+		return "", revokeRepoAccess(ctx, client, repo, change.GitHubLogin, invitation)
+	}
+
+	personal := personalRepo(repository)
+	if personal && change.Role == db.RoleViewer {
+		note := "personal repositories can't grant read-only access, so viewers get none"
+		return note, revokeRepoAccess(ctx, client, repo, change.GitHubLogin, invitation)
+	}
+
+	var notes []string
+	if personal && change.Role == db.RoleMaintainer {
+		notes = append(notes, "personal repositories give collaborators write access")
+	}
+
+	roleName := repoRoleName(change.Role)
+	if invitation != nil {
+		if !personal && invitation.Permissions != roleName {
+			if err := client.UpdateInvitation(ctx, repo.Owner, repo.Name, invitation.ID, roleName); err != nil {
+				return "", err
+			}
+		}
+		notes = append(notes, "invitation pending")
+		return strings.Join(notes, "; "), nil
+	}
+
+	invited, err := client.AddCollaborator(ctx, repo.Owner, repo.Name, change.GitHubLogin, repoPermission(roleName))
+	if err == ErrGitHubNotFound {
+		return "", permanentf("GitHub user %s not found", change.GitHubLogin)
+	}
+	if err != nil {
+		return "", err
+	}
+	if invited {
+		notes = append(notes, "invitation sent")
+	}
+	return strings.Join(notes, "; "), nil
+}
+
+// runAccessChanges - Applies every access change that is due
+func runAccessChanges() {
+	accessModel := &db.AccessModel{DB: db.DB}
+
+	for {
+		changes, err := accessModel.GetDueAccessChanges(time.Now(), accessBatchSize)
+		if err != nil {
+			log.Printf("GitHub access sync failed to load changes: %v", err)
+			return
+		}
+
+		for i := range changes {
+			change := &changes[i]
+			ctx, cancel := context.WithTimeout(context.Background(), accessChangeTimeout)
+			note, err := applyAccessChange(ctx, change)
+			cancel()
+
+			if err == nil {
+				if err := accessModel.MarkAccessApplied(change, note); err != nil {
+					log.Printf("GitHub access sync failed to record change %s: %v", change.ID, err)
+				}
+				continue
+			}
+
+			var retryAt *time.Time
+			if retryableSyncError(err) && change.Attempts+1 < maxSyncAttempts {
+				next := time.Now().Add(syncRetryDelay(change.Attempts))
+				retryAt = &next
+			}
+			log.Printf("GitHub access %s for %s failed (attempt %d): %v", change.Action, change.GitHubLogin, change.Attempts+1, err)
+			if err := accessModel.MarkAccessAttemptFailed(change, err.Error(), retryAt); err != nil {
+				log.Printf("GitHub access sync failed to record change %s: %v", change.ID, err)
+			}
+		}
+
+		// Every change handled above is applied or pushed back, so a full batch means more are waiting
+		if len(changes) < accessBatchSize {
+			return
+		}
+	}
+}
+
+// reconcileRepoAccess - Refreshes the project's repository link, then compares the repository's
+// collaborators and invitations with the project's approved collaborators and queues a change
+// for every login that differs. Logins with a change still pending are left to it, and
+// collaborators who never signed in to this server were added on GitHub directly and are left
+// alone.
+func reconcileRepoAccess(ctx context.Context, projectID uuid.UUID) (int, error) {
+	client, project, repo, err := accessClient(projectID)
+	if err != nil {
+		return 0, err
+	}
+	repository, repo, err := fetchLinkedRepo(ctx, client, projectID, repo)
+	if err != nil {
+		return 0, err
+	}
+	collaborators, err := client.ListCollaborators(ctx, repo.Owner, repo.Name)
+	if err != nil {
+		return 0, err
+	}
+	invitations, err := client.ListInvitations(ctx, repo.Owner, repo.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	// What each login has on GitHub now, counting invitations as access
+	current := make(map[string]string)
+	for _, collaborator := range collaborators {
+		current[strings.ToLower(collaborator.Login)] = collaborator.RoleName
+	}
+	for _, invitation := range invitations {
+		current[strings.ToLower(invitation.Invitee.Login)] = invitation.Permissions
+	}
+
+	collabModel := &db.CollaboratorModel{DB: db.DB}
+	accounts, err := collabModel.GetApprovedAccounts(projectID)
+	if err != nil {
+		return 0, err
+	}
+
+	accessModel := &db.AccessModel{DB: db.DB}
+	changes, err := accessModel.GetProjectAccessChanges(projectID)
+	if err != nil {
+		return 0, err
+	}
+	pending := make(map[string]bool)
+	for _, change := range changes {
+		if change.Status == db.AccessPending {
+			pending[strings.ToLower(change.GitHubLogin)] = true
+		}
+	}
+
+	userModel := &db.UserModel{DB: db.DB}
+	owners := map[string]bool{strings.ToLower(repository.Owner.Login): true}
+	if owner, err := userModel.GetUserByID(project.OwnerID); err == nil {
+		owners[strings.ToLower(owner.USERNAME)] = true
+	}
+
+	personal := personalRepo(repository)
+	queued := 0
+	queue := func(userID uuid.UUID, login, action, role string) error {
+		ok, err := accessModel.QueueAccessChange(projectID, &userID, login, action, role)
+		if ok {
+			queued++
+		}
+		return err
+	}
+
+	desired := make(map[string]bool)
+	for _, account := range accounts {
+		key := strings.ToLower(account.Username)
+		if owners[key] || (personal && account.Role == db.RoleViewer) {
+			continue
+		}
+		desired[key] = true
+		if pending[key] {
+			continue
+		}
+
+		roleName, ok := current[key]
+		if !ok || (!personal && roleName != repoRoleName(account.Role)) {
+			if err := queue(account.UserID, account.Username, db.AccessGrant, account.Role); err != nil {
+				return queued, err
+			}
+		}
+	}
+
+	for key := range current {
+		if desired[key] || owners[key] || pending[key] {
+			continue
+		}
+		user, err := userModel.GetUser(key)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return queued, err
+		}
+		if err := queue(user.ID, user.USERNAME, db.AccessRevoke, ""); err != nil {
+			return queued, err
+		}
+	}
+
+	return queued, nil
+}
+
+// runAccessReconciliation - Reconciles the access of every linked project
+func runAccessReconciliation() {
+	projectModel := &db.ProjectModel{DB: db.DB}
+	projectIDs, err := projectModel.GetLinkedProjectIDs()
+	if err != nil {
+		log.Printf("GitHub access reconciliation failed to load projects: %v", err)
+		return
+	}
+
+	for _, projectID := range projectIDs {
+		ctx, cancel := context.WithTimeout(context.Background(), accessReconcileTimeout)
+		queued, err := reconcileRepoAccess(ctx, projectID)
+		cancel()
+		if err != nil {
+			log.Printf("GitHub access reconciliation of project %s failed: %v", projectID, err)
+			continue
+		}
+		if queued > 0 {
+			log.Printf("GitHub access reconciliation queued %d changes for project %s", queued, projectID)
+		}
+	}
+}
+
+// StartGitHubAccessSync - Periodically applies queued collaborator access changes to linked
+// GitHub repositories
+func StartGitHubAccessSync(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			runAccessChanges()
+		}
+	}()
+}
+
+// StartGitHubAccessReconciliation - Periodically fixes drift between project collaborators and
+// the collaborators of their GitHub repositories, and follows repositories renamed or
+// transferred while no webhook was listening
+func StartGitHubAccessReconciliation(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			runAccessReconciliation()
+		}
+	}()
+}
+
+// queueRepoAccess - Queues a change to a collaborator's access on the project's repository.
+// A change that fails to queue is picked up by the next reconciliation.
+func queueRepoAccess(projectID, userID uuid.UUID, action, role string) {
+	userModel := &db.UserModel{DB: db.DB}
+	user, err := userModel.GetUserByID(userID)
+	if err == nil {
+		accessModel := &db.AccessModel{DB: db.DB}
+		_, err = accessModel.QueueAccessChange(projectID, &userID, user.USERNAME, action, role)
+	}
+	if err != nil {
+		log.Printf("Failed to queue GitHub access %s for user %s on project %s: %v", action, userID, projectID, err)
+	}
+}
+
+// GetRepoAccess - The state of each collaborator's access on a project's GitHub repository
+func GetRepoAccess(w http.ResponseWriter, r *http.Request) {
+	projectUUID, err := uuid.Parse(r.URL.Query().Get("project_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return
+	}
+
+	projectModel := &db.ProjectModel{DB: db.DB}
+	repo, err := projectModel.GetGitHubRepo(projectUUID)
+	if err != nil && err != sql.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch project",
+		})
+		return
+	}
+
+	accessModel := &db.AccessModel{DB: db.DB}
+	changes, err := accessModel.GetProjectAccessChanges(projectUUID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch repository access",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"project_id": projectUUID,
+		"repo":       repo,
+		"access":     changes,
+		"total":      len(changes),
+	})
+}
+
+// ReconcileRepoAccess - Retries a project's failed access changes and checks its repository
+// for drift right away
+func ReconcileRepoAccess(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ProjectID string `json:"project_id"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	projectUUID, err := uuid.Parse(req.ProjectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermManageCollaborators); !ok {
+		return
+	}
+
+	projectModel := &db.ProjectModel{DB: db.DB}
+	if _, err := projectModel.GetGitHubRepo(projectUUID); err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Project is not linked to a GitHub repository",
+		})
+		return
+	}
+
+	accessModel := &db.AccessModel{DB: db.DB}
+	retried, err := accessModel.RetryFailedAccessChanges(projectUUID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to retry access changes",
+		})
+		return
+	}
+
+	queued, err := reconcileRepoAccess(r.Context(), projectUUID)
+	if err != nil {
+		writeGitHubFailure(w, fmt.Sprintf("Failed to check the repository (retried %d changes)", retried), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"retried": retried,
+		"queued":  queued,
+	})
+}
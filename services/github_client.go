@@ -0,0 +1,534 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultGitHubAPIURL - Overridden with GITHUB_API_URL, e.g. to point at a local fake server
+const defaultGitHubAPIURL = "https://api.github.com"
+
+// GitHubClient - The GitHub REST calls the server makes. Implemented over HTTP by
+// NewGitHubClient; anything else, such as a client for a local fake server, can stand in.
+type GitHubClient interface {
+	// GetRepository - Repository metadata; ErrGitHubNotFound if it doesn't exist or the token can't see it
+	GetRepository(ctx context.Context, owner, repo string) (*GitHubRepository, error)
+	// GetRepositoryByID - Repository metadata by its numeric ID, which survives renames and transfers
+	GetRepositoryByID(ctx context.Context, repoID int64) (*GitHubRepository, error)
+	// GetTree - The entries of a tree, all the way down when recursive. truncated is set when
+	// GitHub cut a recursive listing short.
+	GetTree(ctx context.Context, owner, repo, treeSHA string, recursive bool) (entries []GitTreeItem, truncated bool, err error)
+	// GetBlob - Streams the raw content of a blob
+	GetBlob(ctx context.Context, owner, repo, blobSHA string) (io.ReadCloser, error)
+	// GetBranchHead - The commit a branch points at; ErrGitHubNotFound if the branch doesn't exist
+	GetBranchHead(ctx context.Context, owner, repo, branch string) (string, error)
+	// GetCommitTree - The tree of a commit
+	GetCommitTree(ctx context.Context, owner, repo, commitSHA string) (string, error)
+	// CreateBlob - Uploads file content and returns its blob SHA
+	CreateBlob(ctx context.Context, owner, repo string, content io.Reader) (string, error)
+	// CreateTree - Creates a tree from base with the entries changed; an entry without a SHA removes the path
+	CreateTree(ctx context.Context, owner, repo, baseTree string, entries []GitTreeEntry) (string, error)
+	// CreateCommit - Creates a commit; it is not on any branch until a ref points at it
+	CreateCommit(ctx context.Context, owner, repo string, commit GitCommit) (string, error)
+	// CreateBranch - Creates a branch pointing at a commit
+	CreateBranch(ctx context.Context, owner, repo, branch, commitSHA string) error
+	// UpdateBranch - Moves a branch to a commit; fails unless it is a fast-forward
+	UpdateBranch(ctx context.Context, owner, repo, branch, commitSHA string) error
+	// CreateFile - Commits one file through the contents API, which unlike the Git Data API works on an empty repository
+	CreateFile(ctx context.Context, owner, repo, branch, path, message string, content io.Reader, author *GitSignature) (string, error)
+	// CreateRepository - Creates a repository under an organization, or under the token's user when org is empty
+	CreateRepository(ctx context.Context, org string, options GitHubRepoOptions) (*GitHubRepository, error)
+	// GenerateRepository - Creates a repository from a template repository under owner
+	GenerateRepository(ctx context.Context, templateOwner, templateRepo, owner string, options GitHubRepoOptions) (*GitHubRepository, error)
+	// RenameBranch - Renames a branch; renaming the default branch keeps it the default
+	RenameBranch(ctx context.Context, owner, repo, branch, newName string) error
+	// ListCollaborators - Users given access to the repository directly, not through an organization
+	ListCollaborators(ctx context.Context, owner, repo string) ([]GitHubCollaborator, error)
+	// ListInvitations - Invitations to the repository that haven't been accepted yet
+	ListInvitations(ctx context.Context, owner, repo string) ([]GitHubInvitation, error)
+	// AddCollaborator - Invites a user, or changes the permission of an existing collaborator.
+	// invited is set when an invitation was sent.
+	AddCollaborator(ctx context.Context, owner, repo, username, permission string) (invited bool, err error)
+	// UpdateInvitation - Changes the permission a pending invitation grants
+	UpdateInvitation(ctx context.Context, owner, repo string, invitationID int64, permission string) error
+	// RemoveCollaborator - Takes away a collaborator's access
+	RemoveCollaborator(ctx context.Context, owner, repo, username string) error
+	// DeleteInvitation - Cancels a pending invitation
+	DeleteInvitation(ctx context.Context, owner, repo string, invitationID int64) error
+}
+
+// GitHubRepository - The parts of a repository the server keeps
+type GitHubRepository struct {
+	ID            int64  `json:"id"`
+	Name          string `json:"name"`
+	FullName      string `json:"full_name"`
+	Description   string `json:"description"`
+	Private       bool   `json:"private"`
+	Visibility    string `json:"visibility"`
+	HTMLURL       string `json:"html_url"`
+	CloneURL      string `json:"clone_url"`
+	SSHURL        string `json:"ssh_url"`
+	DefaultBranch string `json:"default_branch"`
+	Owner         struct {
+		Login string `json:"login"`
+		Type  string `json:"type"` // "User" or "Organization"
+	} `json:"owner"`
+	Permissions struct {
+		Admin bool `json:"admin"`
+	} `json:"permissions"` // what the token can do
+}
+
+// GitHubRepoOptions - Settings of a repository to create. AutoInit and GitignoreTemplate don't
+// apply to repositories generated from a template.
+type GitHubRepoOptions struct {
+	Name              string `json:"name"`
+	Description       string `json:"description,omitempty"`
+	Private           bool   `json:"private"`
+	AutoInit          bool   `json:"auto_init,omitempty"`          // commit a README
+	GitignoreTemplate string `json:"gitignore_template,omitempty"` // one of GitHub's .gitignore templates, e.g. "Unity"
+}
+
+// GitHubCollaborator - A user with direct access to a repository
+type GitHubCollaborator struct {
+	Login    string `json:"login"`
+	RoleName string `json:"role_name"` // "read", "triage", "write", "maintain" or "admin"
+}
+
+// GitHubInvitation - A pending invitation to a repository
+type GitHubInvitation struct {
+	ID      int64 `json:"id"`
+	Invitee struct {
+		Login string `json:"login"`
+	} `json:"invitee"`
+	Permissions string `json:"permissions"` // "read", "triage", "write", "maintain" or "admin"
+}
+
+// GitTreeItem - An entry of an existing tree
+type GitTreeItem struct {
+	Path string `json:"path"`
+	Mode string `json:"mode"`
+	Type string `json:"type"` // "blob", "tree" or "commit" (a submodule)
+	SHA  string `json:"sha"`
+	Size int64  `json:"size"`
+}
+
+// GitTreeEntry - A file to add, change or remove in a tree
+type GitTreeEntry struct {
+	Path string  `json:"path"`
+	Mode string  `json:"mode"`
+	Type string  `json:"type"`
+	SHA  *string `json:"sha"` // nil removes the path
+}
+
+// GitSignature - Author of a commit
+type GitSignature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Date  time.Time `json:"date"`
+}
+
+// GitCommit - A commit to create
+type GitCommit struct {
+	Message string        `json:"message"`
+	Tree    string        `json:"tree"`
+	Parents []string      `json:"parents"`
+	Author  *GitSignature `json:"author,omitempty"`
+}
+
+// ErrGitHubNotFound - The repository, branch or object doesn't exist (or the token can't see it)
+var ErrGitHubNotFound = errors.New("not found on GitHub")
+
+// GitHubError - A GitHub API call that failed with an HTTP status
+type GitHubError struct {
+	Status  int
+	Message string
+}
+
+func (e *GitHubError) Error() string {
+	return fmt.Sprintf("GitHub API returned %d: %s", e.Status, e.Message)
+}
+
+// Temporary - Whether the same call may succeed later: server errors, rate limits, and
+// conflicts with a concurrent push to the branch
+func (e *GitHubError) Temporary() bool {
+	switch {
+	case e.Status >= 500, e.Status == http.StatusTooManyRequests, e.Status == http.StatusConflict:
+		return true
+	case e.Status == http.StatusForbidden:
+		return strings.Contains(strings.ToLower(e.Message), "rate limit")
+	case e.Status == http.StatusUnprocessableEntity:
+		return strings.Contains(strings.ToLower(e.Message), "fast forward")
+	}
+	return false
+}
+
+// githubAPIClient - GitHubClient over the GitHub REST API
+type githubAPIClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// NewGitHubClient - A client for the GitHub API at baseURL acting with an OAuth token
+func NewGitHubClient(baseURL, token string) GitHubClient {
+	return &githubAPIClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 10 * time.Minute},
+	}
+}
+
+// newGitHubClient - Builds the client used for a token. A variable so a fake can be swapped in.
+var newGitHubClient = func(token string) GitHubClient {
+	baseURL := os.Getenv("GITHUB_API_URL")
+	if baseURL == "" {
+		baseURL = defaultGitHubAPIURL
+	}
+	return NewGitHubClient(baseURL, token)
+}
+
+// send - Makes a request and returns the response if it succeeded; the caller closes the body
+func (c *githubAPIClient) send(ctx context.Context, method, path, accept string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "token "+c.token)
+	req.Header.Set("Accept", accept)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrGitHubNotFound
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&apiErr)
+		if apiErr.Message == "" {
+			apiErr.Message = resp.Status
+		}
+		return nil, &GitHubError{Status: resp.StatusCode, Message: apiErr.Message}
+	}
+
+	return resp, nil
+}
+
+func (c *githubAPIClient) do(ctx context.Context, method, path string, body io.Reader, out interface{}) error {
+	resp, err := c.send(ctx, method, path, "application/vnd.github.v3+json", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *githubAPIClient) doJSON(ctx context.Context, method, path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, method, path, bytes.NewReader(body), out)
+}
+
+func repoPath(owner, repo string) string {
+	return "/repos/" + url.PathEscape(owner) + "/" + url.PathEscape(repo)
+}
+
+// refPath - Branch names keep their slashes in ref URLs
+func refPath(branch string) string {
+	parts := strings.Split(branch, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+func (c *githubAPIClient) GetRepository(ctx context.Context, owner, repo string) (*GitHubRepository, error) {
+	var repository GitHubRepository
+	if err := c.do(ctx, http.MethodGet, repoPath(owner, repo), nil, &repository); err != nil {
+		return nil, err
+	}
+	return &repository, nil
+}
+
+func (c *githubAPIClient) GetRepositoryByID(ctx context.Context, repoID int64) (*GitHubRepository, error) {
+	var repository GitHubRepository
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/repositories/%d", repoID), nil, &repository); err != nil {
+		return nil, err
+	}
+	return &repository, nil
+}
+
+func (c *githubAPIClient) GetTree(ctx context.Context, owner, repo, treeSHA string, recursive bool) ([]GitTreeItem, bool, error) {
+	treeURL := repoPath(owner, repo) + "/git/trees/" + url.PathEscape(treeSHA)
+	if recursive {
+		treeURL += "?recursive=1"
+	}
+
+	var tree struct {
+		Tree      []GitTreeItem `json:"tree"`
+		Truncated bool          `json:"truncated"`
+	}
+	if err := c.do(ctx, http.MethodGet, treeURL, nil, &tree); err != nil {
+		return nil, false, err
+	}
+	return tree.Tree, tree.Truncated, nil
+}
+
+func (c *githubAPIClient) GetBlob(ctx context.Context, owner, repo, blobSHA string) (io.ReadCloser, error) {
+	resp, err := c.send(ctx, http.MethodGet, repoPath(owner, repo)+"/git/blobs/"+url.PathEscape(blobSHA), "application/vnd.github.raw", nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *githubAPIClient) GetBranchHead(ctx context.Context, owner, repo, branch string) (string, error) {
+	var ref struct {
+		Object struct {
+			SHA string `json:"sha"`
+		} `json:"object"`
+	}
+	err := c.do(ctx, http.MethodGet, repoPath(owner, repo)+"/git/ref/heads/"+refPath(branch), nil, &ref)
+	// An empty repository has no refs at all and answers 409
+	if apiErr, ok := err.(*GitHubError); ok && apiErr.Status == http.StatusConflict {
+		return "", ErrGitHubNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return ref.Object.SHA, nil
+}
+
+func (c *githubAPIClient) GetCommitTree(ctx context.Context, owner, repo, commitSHA string) (string, error) {
+	var commit struct {
+		Tree struct {
+			SHA string `json:"sha"`
+		} `json:"tree"`
+	}
+	if err := c.do(ctx, http.MethodGet, repoPath(owner, repo)+"/git/commits/"+url.PathEscape(commitSHA), nil, &commit); err != nil {
+		return "", err
+	}
+	return commit.Tree.SHA, nil
+}
+
+// base64JSONBody - Streams {"<prefix fields>","content":"<base64>"<suffix>} without holding the
+// encoded content in memory
+func base64JSONBody(prefix string, content io.Reader, suffix string) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		if _, err := io.WriteString(pw, prefix+`"content":"`); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		encoder := base64.NewEncoder(base64.StdEncoding, pw)
+		if _, err := io.Copy(encoder, content); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if err := encoder.Close(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		_, err := io.WriteString(pw, `"`+suffix)
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+func (c *githubAPIClient) CreateBlob(ctx context.Context, owner, repo string, content io.Reader) (string, error) {
+	var blob struct {
+		SHA string `json:"sha"`
+	}
+	body := base64JSONBody(`{"encoding":"base64",`, content, `}`)
+	if err := c.do(ctx, http.MethodPost, repoPath(owner, repo)+"/git/blobs", body, &blob); err != nil {
+		return "", err
+	}
+	return blob.SHA, nil
+}
+
+func (c *githubAPIClient) CreateTree(ctx context.Context, owner, repo, baseTree string, entries []GitTreeEntry) (string, error) {
+	request := map[string]interface{}{"tree": entries}
+	if baseTree != "" {
+		request["base_tree"] = baseTree
+	}
+
+	var tree struct {
+		SHA string `json:"sha"`
+	}
+	if err := c.doJSON(ctx, http.MethodPost, repoPath(owner, repo)+"/git/trees", request, &tree); err != nil {
+		return "", err
+	}
+	return tree.SHA, nil
+}
+
+func (c *githubAPIClient) CreateCommit(ctx context.Context, owner, repo string, commit GitCommit) (string, error) {
+	var created struct {
+		SHA string `json:"sha"`
+	}
+	if err := c.doJSON(ctx, http.MethodPost, repoPath(owner, repo)+"/git/commits", commit, &created); err != nil {
+		return "", err
+	}
+	return created.SHA, nil
+}
+
+func (c *githubAPIClient) CreateBranch(ctx context.Context, owner, repo, branch, commitSHA string) error {
+	return c.doJSON(ctx, http.MethodPost, repoPath(owner, repo)+"/git/refs", map[string]string{
+		"ref": "refs/heads/" + branch,
+		"sha": commitSHA,
+	}, nil)
+}
+
+func (c *githubAPIClient) UpdateBranch(ctx context.Context, owner, repo, branch, commitSHA string) error {
+	return c.doJSON(ctx, http.MethodPatch, repoPath(owner, repo)+"/git/refs/heads/"+refPath(branch), map[string]interface{}{
+		"sha":   commitSHA,
+		"force": false,
+	}, nil)
+}
+
+func (c *githubAPIClient) CreateFile(ctx context.Context, owner, repo, branch, path, message string, content io.Reader, author *GitSignature) (string, error) {
+	// Without a branch GitHub uses the default one, which an empty repository doesn't have yet
+	fields := map[string]interface{}{"message": message}
+	if branch != "" {
+		fields["branch"] = branch
+	}
+	if author != nil {
+		fields["author"] = author
+	}
+	prefix, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+
+	var created struct {
+		Commit struct {
+			SHA string `json:"sha"`
+		} `json:"commit"`
+	}
+	// Splice the streamed content into the object: {"message":...,"content":"..."}
+	body := base64JSONBody(string(prefix[:len(prefix)-1])+",", content, `}`)
+	if err := c.do(ctx, http.MethodPut, repoPath(owner, repo)+"/contents/"+refPath(path), body, &created); err != nil {
+		return "", err
+	}
+	return created.Commit.SHA, nil
+}
+
+func (c *githubAPIClient) CreateRepository(ctx context.Context, org string, options GitHubRepoOptions) (*GitHubRepository, error) {
+	createURL := "/user/repos"
+	if org != "" {
+		createURL = "/orgs/" + url.PathEscape(org) + "/repos"
+	}
+
+	var repository GitHubRepository
+	if err := c.doJSON(ctx, http.MethodPost, createURL, options, &repository); err != nil {
+		return nil, err
+	}
+	return &repository, nil
+}
+
+func (c *githubAPIClient) GenerateRepository(ctx context.Context, templateOwner, templateRepo, owner string, options GitHubRepoOptions) (*GitHubRepository, error) {
+	var repository GitHubRepository
+	err := c.doJSON(ctx, http.MethodPost, repoPath(templateOwner, templateRepo)+"/generate", map[string]interface{}{
+		"owner":       owner,
+		"name":        options.Name,
+		"description": options.Description,
+		"private":     options.Private,
+	}, &repository)
+	if err != nil {
+		return nil, err
+	}
+	return &repository, nil
+}
+
+func (c *githubAPIClient) RenameBranch(ctx context.Context, owner, repo, branch, newName string) error {
+	return c.doJSON(ctx, http.MethodPost, repoPath(owner, repo)+"/branches/"+refPath(branch)+"/rename", map[string]string{
+		"new_name": newName,
+	}, nil)
+}
+
+// githubPageSize - Items per page when listing; GitHub's maximum
+const githubPageSize = 100
+
+func (c *githubAPIClient) ListCollaborators(ctx context.Context, owner, repo string) ([]GitHubCollaborator, error) {
+	var all []GitHubCollaborator
+	for page := 1; ; page++ {
+		var collaborators []GitHubCollaborator
+		listURL := fmt.Sprintf("%s/collaborators?affiliation=direct&per_page=%d&page=%d", repoPath(owner, repo), githubPageSize, page)
+		if err := c.do(ctx, http.MethodGet, listURL, nil, &collaborators); err != nil {
+			return nil, err
+		}
+		all = append(all, collaborators...)
+		if len(collaborators) < githubPageSize {
+			return all, nil
+		}
+	}
+}
+
+func (c *githubAPIClient) ListInvitations(ctx context.Context, owner, repo string) ([]GitHubInvitation, error) {
+	var all []GitHubInvitation
+	for page := 1; ; page++ {
+		var invitations []GitHubInvitation
+		listURL := fmt.Sprintf("%s/invitations?per_page=%d&page=%d", repoPath(owner, repo), githubPageSize, page)
+		if err := c.do(ctx, http.MethodGet, listURL, nil, &invitations); err != nil {
+			return nil, err
+		}
+		all = append(all, invitations...)
+		if len(invitations) < githubPageSize {
+			return all, nil
+		}
+	}
+}
+
+func (c *githubAPIClient) AddCollaborator(ctx context.Context, owner, repo, username, permission string) (bool, error) {
+	body, err := json.Marshal(map[string]string{"permission": permission})
+	if err != nil {
+		return false, err
+	}
+
+	// 201 with the invitation for a new collaborator, 204 when the user already had access
+	resp, err := c.send(ctx, http.MethodPut, repoPath(owner, repo)+"/collaborators/"+url.PathEscape(username),
+		"application/vnd.github.v3+json", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusCreated, nil
+}
+
+func (c *githubAPIClient) UpdateInvitation(ctx context.Context, owner, repo string, invitationID int64, permission string) error {
+	return c.doJSON(ctx, http.MethodPatch, fmt.Sprintf("%s/invitations/%d", repoPath(owner, repo), invitationID), map[string]string{
+		"permissions": permission,
+	}, nil)
+}
+
+func (c *githubAPIClient) RemoveCollaborator(ctx context.Context, owner, repo, username string) error {
+	return c.do(ctx, http.MethodDelete, repoPath(owner, repo)+"/collaborators/"+url.PathEscape(username), nil, nil)
+}
+
+func (c *githubAPIClient) DeleteInvitation(ctx context.Context, owner, repo string, invitationID int64) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("%s/invitations/%d", repoPath(owner, repo), invitationID), nil, nil)
+}
@@ -0,0 +1,404 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// githubRequest - A request as the fake GitHub server received it
+type githubRequest struct {
+	Method string
+	Path   string // escaped, as sent
+	Query  string
+	Accept string
+	Auth   string
+	Type   string
+	Body   []byte
+}
+
+// fakeGitHubServer - A local GitHub API answering every request with respond. The client it
+// returns talks to it over HTTP; requests lists what it was sent.
+func fakeGitHubServer(t *testing.T, respond func(w http.ResponseWriter, req githubRequest)) (GitHubClient, *[]githubRequest) {
+	t.Helper()
+	var requests []githubRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading the request body: %v", err)
+		}
+		req := githubRequest{
+			Method: r.Method,
+			Path:   r.URL.EscapedPath(),
+			Query:  r.URL.RawQuery,
+			Accept: r.Header.Get("Accept"),
+			Auth:   r.Header.Get("Authorization"),
+			Type:   r.Header.Get("Content-Type"),
+			Body:   body,
+		}
+		requests = append(requests, req)
+		respond(w, req)
+	}))
+	t.Cleanup(srv.Close)
+	return NewGitHubClient(srv.URL+"/", "gho_test"), &requests
+}
+
+func replyJSON(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	io.WriteString(w, body)
+}
+
+func TestGitHubClientErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		notFound  bool
+		message   string
+		temporary bool
+	}{
+		{"not found", http.StatusNotFound, `{"message":"Not Found"}`, true, "", false},
+		{"server error", http.StatusBadGateway, `{"message":"Server Error"}`, false, "Server Error", true},
+		{"rate limited", http.StatusTooManyRequests, `{"message":"Too many requests"}`, false, "Too many requests", true},
+		{"primary rate limit", http.StatusForbidden, `{"message":"API rate limit exceeded for user ID 1."}`, false, "API rate limit exceeded for user ID 1.", true},
+		{"forbidden", http.StatusForbidden, `{"message":"Resource not accessible by integration"}`, false, "Resource not accessible by integration", false},
+		{"bad credentials", http.StatusUnauthorized, `{"message":"Bad credentials"}`, false, "Bad credentials", false},
+		{"concurrent push", http.StatusConflict, `{"message":"Reference update failed"}`, false, "Reference update failed", true},
+		{"not a fast forward", http.StatusUnprocessableEntity, `{"message":"Update is not a fast forward"}`, false, "Update is not a fast forward", true},
+		{"validation failed", http.StatusUnprocessableEntity, `{"message":"Validation Failed"}`, false, "Validation Failed", false},
+		{"no message", http.StatusServiceUnavailable, `<html>down</html>`, false, "503 Service Unavailable", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := fakeGitHubServer(t, func(w http.ResponseWriter, req githubRequest) {
+				replyJSON(w, tt.status, tt.body)
+			})
+
+			_, err := client.GetRepository(context.Background(), "octocat", "MyUnityGame")
+			if tt.notFound {
+				if err != ErrGitHubNotFound {
+					t.Fatalf("got %v, want ErrGitHubNotFound", err)
+				}
+				return
+			}
+
+			var apiErr *GitHubError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("got %v, want a *GitHubError", err)
+			}
+			if apiErr.Status != tt.status || apiErr.Message != tt.message {
+				t.Errorf("got %d %q, want %d %q", apiErr.Status, apiErr.Message, tt.status, tt.message)
+			}
+			if apiErr.Temporary() != tt.temporary {
+				t.Errorf("Temporary() = %v, want %v", apiErr.Temporary(), tt.temporary)
+			}
+		})
+	}
+}
+
+func TestGitHubClientGetRepository(t *testing.T) {
+	client, requests := fakeGitHubServer(t, func(w http.ResponseWriter, req githubRequest) {
+		replyJSON(w, http.StatusOK, `{
+			"id": 1296269, "name": "My Game", "full_name": "my-studio/My Game", "private": true,
+			"default_branch": "develop", "owner": {"login": "my-studio", "type": "Organization"},
+			"permissions": {"admin": true, "push": true, "pull": true}
+		}`)
+	})
+
+	repo, err := client.GetRepository(context.Background(), "my-studio", "My Game")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.ID != 1296269 || repo.DefaultBranch != "develop" || repo.Owner.Login != "my-studio" || !repo.Private || !repo.Permissions.Admin {
+		t.Errorf("decoded %+v", repo)
+	}
+
+	req := (*requests)[0]
+	if req.Method != http.MethodGet || req.Path != "/repos/my-studio/My%20Game" {
+		t.Errorf("requested %s %s", req.Method, req.Path)
+	}
+	if req.Auth != "token gho_test" || req.Accept != "application/vnd.github.v3+json" {
+		t.Errorf("headers: Authorization %q, Accept %q", req.Auth, req.Accept)
+	}
+}
+
+func TestGitHubClientGetBranchHead(t *testing.T) {
+	client, requests := fakeGitHubServer(t, func(w http.ResponseWriter, req githubRequest) {
+		switch req.Path {
+		case "/repos/octocat/game/git/ref/heads/feature/double%20jump":
+			replyJSON(w, http.StatusOK, `{"ref":"refs/heads/feature/double jump","object":{"sha":"aa218f56"}}`)
+		case "/repos/octocat/empty/git/ref/heads/main":
+			replyJSON(w, http.StatusConflict, `{"message":"Git Repository is empty."}`)
+		default:
+			replyJSON(w, http.StatusNotFound, `{"message":"Not Found"}`)
+		}
+	})
+	ctx := context.Background()
+
+	// Slashes in branch names stay path separators
+	head, err := client.GetBranchHead(ctx, "octocat", "game", "feature/double jump")
+	if err != nil || head != "aa218f56" {
+		t.Errorf("got %q, %v; requested %s", head, err, (*requests)[0].Path)
+	}
+
+	// An empty repository has no branches at all
+	if _, err := client.GetBranchHead(ctx, "octocat", "empty", "main"); err != ErrGitHubNotFound {
+		t.Errorf("empty repository: got %v, want ErrGitHubNotFound", err)
+	}
+	if _, err := client.GetBranchHead(ctx, "octocat", "game", "gone"); err != ErrGitHubNotFound {
+		t.Errorf("missing branch: got %v, want ErrGitHubNotFound", err)
+	}
+}
+
+func TestGitHubClientGetBlob(t *testing.T) {
+	content := []byte{0x89, 'P', 'N', 'G', 0, 1, 2, 3}
+	client, requests := fakeGitHubServer(t, func(w http.ResponseWriter, req githubRequest) {
+		w.Write(content)
+	})
+
+	body, err := client.GetBlob(context.Background(), "octocat", "game", "3a0f86fb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("got %v, want %v", got, content)
+	}
+
+	req := (*requests)[0]
+	if req.Path != "/repos/octocat/game/git/blobs/3a0f86fb" || req.Accept != "application/vnd.github.raw" {
+		t.Errorf("requested %s with Accept %q", req.Path, req.Accept)
+	}
+}
+
+func TestGitHubClientCreateBlob(t *testing.T) {
+	// Larger than the pipe's buffers, so the body is really streamed
+	content := bytes.Repeat([]byte("Texture\x00\xff"), 200<<10)
+
+	client, requests := fakeGitHubServer(t, func(w http.ResponseWriter, req githubRequest) {
+		replyJSON(w, http.StatusCreated, `{"sha":"3a0f86fb"}`)
+	})
+
+	sha, err := client.CreateBlob(context.Background(), "octocat", "game", bytes.NewReader(content))
+	if err != nil || sha != "3a0f86fb" {
+		t.Fatalf("got %q, %v", sha, err)
+	}
+
+	req := (*requests)[0]
+	if req.Method != http.MethodPost || req.Path != "/repos/octocat/game/git/blobs" || req.Type != "application/json" {
+		t.Errorf("requested %s %s as %q", req.Method, req.Path, req.Type)
+	}
+	var blob struct {
+		Encoding string `json:"encoding"`
+		Content  string `json:"content"`
+	}
+	if err := json.Unmarshal(req.Body, &blob); err != nil {
+		t.Fatalf("body isn't JSON: %v", err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(blob.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob.Encoding != "base64" || !bytes.Equal(decoded, content) {
+		t.Errorf("encoding %q, %d bytes decoded, want %d", blob.Encoding, len(decoded), len(content))
+	}
+}
+
+// failingReader - Content that can't be read to the end
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("disk went away") }
+
+func TestGitHubClientCreateBlobReadError(t *testing.T) {
+	client, _ := fakeGitHubServer(t, func(w http.ResponseWriter, req githubRequest) {
+		replyJSON(w, http.StatusCreated, `{"sha":"3a0f86fb"}`)
+	})
+
+	if _, err := client.CreateBlob(context.Background(), "octocat", "game", failingReader{}); err == nil {
+		t.Error("a blob was created from content that couldn't be read")
+	}
+}
+
+func TestGitHubClientCreateFile(t *testing.T) {
+	client, requests := fakeGitHubServer(t, func(w http.ResponseWriter, req githubRequest) {
+		replyJSON(w, http.StatusCreated, `{"content":{"sha":"95b966ae"},"commit":{"sha":"7638417d"}}`)
+	})
+
+	author := &GitSignature{Name: "Octo Cat", Email: "octocat@example.com", Date: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	sha, err := client.CreateFile(context.Background(), "octocat", "empty", "main", "Assets/Scripts/Player Controller.cs", "First commit", strings.NewReader("class Player {}"), author)
+	if err != nil || sha != "7638417d" {
+		t.Fatalf("got %q, %v", sha, err)
+	}
+
+	req := (*requests)[0]
+	if req.Method != http.MethodPut || req.Path != "/repos/octocat/empty/contents/Assets/Scripts/Player%20Controller.cs" {
+		t.Errorf("requested %s %s", req.Method, req.Path)
+	}
+	var file struct {
+		Message string        `json:"message"`
+		Branch  string        `json:"branch"`
+		Author  *GitSignature `json:"author"`
+		Content string        `json:"content"`
+	}
+	if err := json.Unmarshal(req.Body, &file); err != nil {
+		t.Fatalf("body isn't JSON: %v\n%s", err, req.Body)
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(file.Content)
+	if file.Message != "First commit" || file.Branch != "main" || string(decoded) != "class Player {}" {
+		t.Errorf("sent %+v with content %q", file, decoded)
+	}
+	if file.Author == nil || *file.Author != *author {
+		t.Errorf("author %+v, want %+v", file.Author, author)
+	}
+}
+
+func TestGitHubClientCreateTree(t *testing.T) {
+	client, requests := fakeGitHubServer(t, func(w http.ResponseWriter, req githubRequest) {
+		replyJSON(w, http.StatusCreated, `{"sha":"cd8274d1"}`)
+	})
+	ctx := context.Background()
+
+	blob := "3a0f86fb"
+	entries := []GitTreeEntry{
+		{Path: "Assets/Boss.cs", Mode: "100644", Type: "blob", SHA: &blob},
+		{Path: "Assets/Old.cs", Mode: "100644", Type: "blob"},
+	}
+	sha, err := client.CreateTree(ctx, "octocat", "game", "9fb037999", entries)
+	if err != nil || sha != "cd8274d1" {
+		t.Fatalf("got %q, %v", sha, err)
+	}
+	if _, err := client.CreateTree(ctx, "octocat", "game", "", entries[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	var withBase, withoutBase map[string]interface{}
+	json.Unmarshal((*requests)[0].Body, &withBase)
+	json.Unmarshal((*requests)[1].Body, &withoutBase)
+
+	if withBase["base_tree"] != "9fb037999" {
+		t.Errorf("base_tree = %v", withBase["base_tree"])
+	}
+	if _, ok := withoutBase["base_tree"]; ok {
+		t.Error("base_tree sent for a tree without a base")
+	}
+
+	// A removed path is sent with "sha": null, which GitHub takes as a deletion
+	tree := withBase["tree"].([]interface{})
+	removed := tree[1].(map[string]interface{})
+	if sha, ok := removed["sha"]; !ok || sha != nil {
+		t.Errorf("removed entry: %v", removed)
+	}
+	if tree[0].(map[string]interface{})["sha"] != blob {
+		t.Errorf("changed entry: %v", tree[0])
+	}
+}
+
+func TestGitHubClientCreateCommit(t *testing.T) {
+	client, requests := fakeGitHubServer(t, func(w http.ResponseWriter, req githubRequest) {
+		replyJSON(w, http.StatusCreated, `{"sha":"7638417d"}`)
+	})
+
+	sha, err := client.CreateCommit(context.Background(), "octocat", "game", GitCommit{
+		Message: "Boss fight",
+		Tree:    "cd8274d1",
+		Parents: []string{"aa218f56"},
+	})
+	if err != nil || sha != "7638417d" {
+		t.Fatalf("got %q, %v", sha, err)
+	}
+
+	var commit map[string]interface{}
+	json.Unmarshal((*requests)[0].Body, &commit)
+	want := map[string]interface{}{"message": "Boss fight", "tree": "cd8274d1", "parents": []interface{}{"aa218f56"}}
+	if !reflect.DeepEqual(commit, want) {
+		t.Errorf("sent %v, want %v", commit, want)
+	}
+}
+
+func TestGitHubClientRefs(t *testing.T) {
+	client, requests := fakeGitHubServer(t, func(w http.ResponseWriter, req githubRequest) {
+		if req.Method == http.MethodPatch && strings.Contains(string(req.Body), "behind") {
+			replyJSON(w, http.StatusUnprocessableEntity, `{"message":"Update is not a fast forward"}`)
+			return
+		}
+		replyJSON(w, http.StatusOK, `{}`)
+	})
+	ctx := context.Background()
+
+	if err := client.CreateBranch(ctx, "octocat", "game", "feature/boss", "aa218f56"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.UpdateBranch(ctx, "octocat", "game", "feature/boss", "7638417d"); err != nil {
+		t.Fatal(err)
+	}
+
+	created, updated := (*requests)[0], (*requests)[1]
+	var createBody map[string]interface{}
+	json.Unmarshal(created.Body, &createBody)
+	if created.Method != http.MethodPost || created.Path != "/repos/octocat/game/git/refs" ||
+		!reflect.DeepEqual(createBody, map[string]interface{}{"ref": "refs/heads/feature/boss", "sha": "aa218f56"}) {
+		t.Errorf("create: %s %s %s", created.Method, created.Path, created.Body)
+	}
+
+	// Sync never force-pushes: a branch that moved elsewhere is left for the retry
+	var updateBody map[string]interface{}
+	json.Unmarshal(updated.Body, &updateBody)
+	if updated.Method != http.MethodPatch || updated.Path != "/repos/octocat/game/git/refs/heads/feature/boss" ||
+		!reflect.DeepEqual(updateBody, map[string]interface{}{"sha": "7638417d", "force": false}) {
+		t.Errorf("update: %s %s %s", updated.Method, updated.Path, updated.Body)
+	}
+
+	err := client.UpdateBranch(ctx, "octocat", "game", "main", "behind")
+	var apiErr *GitHubError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnprocessableEntity || !apiErr.Temporary() {
+		t.Errorf("non fast-forward update: got %v", err)
+	}
+}
+
+func TestGitHubClientTruncatedTree(t *testing.T) {
+	client, requests := fakeGitHubServer(t, func(w http.ResponseWriter, req githubRequest) {
+		switch {
+		case req.Path == "/repos/octocat/game/git/trees/root" && req.Query == "recursive=1":
+			replyJSON(w, http.StatusOK, `{"tree":[{"path":"README.md","type":"blob","sha":"r"}],"truncated":true}`)
+		case req.Path == "/repos/octocat/game/git/trees/root":
+			replyJSON(w, http.StatusOK, `{"tree":[
+				{"path":"README.md","mode":"100644","type":"blob","sha":"r","size":12},
+				{"path":"Assets","mode":"040000","type":"tree","sha":"assets"}
+			]}`)
+		case req.Path == "/repos/octocat/game/git/trees/assets":
+			replyJSON(w, http.StatusOK, `{"tree":[{"path":"Boss.cs","mode":"100644","type":"blob","sha":"b","size":30}]}`)
+		default:
+			replyJSON(w, http.StatusNotFound, `{"message":"Not Found"}`)
+		}
+	})
+
+	items, err := listRepoTree(context.Background(), client, "octocat", "game", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, item := range items {
+		paths = append(paths, item.Path)
+	}
+	if want := []string{"README.md", "Assets/Boss.cs"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("got %v, want %v", paths, want)
+	}
+	if len(*requests) != 3 {
+		t.Errorf("made %d requests, want 3", len(*requests))
+	}
+}
@@ -0,0 +1,423 @@
+package services
+
+import (
+	"app/urtc/db"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Reasons an imported repository file was left out
+const (
+	SkipTooLarge  = "too_large"
+	SkipSubmodule = "submodule"
+	SkipSymlink   = "symlink"
+)
+
+// maxSkippedListed - Skipped files listed in an import response; the count covers the rest
+const maxSkippedListed = 1000
+
+// An import is done within one request, so what it brings in is capped
+const (
+	defaultImportMaxFiles   = 10000
+	defaultImportMaxTotalMB = 2048
+)
+
+// importLimits - The most files and bytes one import brings in, configurable through
+// IMPORT_MAX_FILES and IMPORT_MAX_TOTAL_MB
+func importLimits() (maxFiles int, maxBytes int64) {
+	maxFiles, maxBytes = defaultImportMaxFiles, defaultImportMaxTotalMB<<20
+	if n, err := strconv.Atoi(os.Getenv("IMPORT_MAX_FILES")); err == nil && n > 0 {
+		maxFiles = n
+	}
+	if mb, err := strconv.ParseInt(os.Getenv("IMPORT_MAX_TOTAL_MB"), 10, 64); err == nil && mb > 0 {
+		maxBytes = mb << 20
+	}
+	return maxFiles, maxBytes
+}
+
+// ImportRequest - A GitHub repository to import as a new project
+type ImportRequest struct {
+	Owner         string   `json:"owner"`
+	Repo          string   `json:"repo"`
+	Branch        string   `json:"branch"`           // defaults to the repository's default branch
+	Name          string   `json:"name"`             // project name; defaults to the repository name
+	Paths         []string `json:"paths"`            // only files under these paths; all files if empty
+	Exclude       []string `json:"exclude"`          // glob patterns for files or folders to leave out
+	MaxFileSizeMB *int64   `json:"max_file_size_mb"` // larger files are skipped
+}
+
+// SkippedFile - A repository file an import left out
+type SkippedFile struct {
+	FilePath string `json:"file_path"`
+	Size     int64  `json:"size,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// importFileType - The file type recorded for an imported file, from its extension
+func importFileType(filePath string) string {
+	switch strings.ToLower(path.Ext(filePath)) {
+	case ".cs", ".gd", ".js", ".ts", ".lua", ".py", ".c", ".cpp", ".h", ".hpp", ".shader", ".hlsl", ".glsl", ".compute":
+		return "script"
+	case ".unity", ".tscn", ".umap", ".scene":
+		return "scene"
+	}
+	return "asset"
+}
+
+// importIncluded - Whether a path is under one of the requested paths
+func importIncluded(filePath string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		p = strings.Trim(p, "/")
+		if p == "" || filePath == p || strings.HasPrefix(filePath, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// importExcluded - Whether a pattern matches the path, its file name or any folder it is in,
+// so "Library" leaves out everything under Library/ and "*.psd" every Photoshop file
+func importExcluded(filePath string, patterns []string) bool {
+	segments := strings.Split(filePath, "/")
+	for _, pattern := range patterns {
+		pattern = strings.Trim(pattern, "/")
+		if pattern == "" {
+			continue
+		}
+		if ok, _ := path.Match(pattern, filePath); ok {
+			return true
+		}
+		for i, segment := range segments {
+			if ok, _ := path.Match(pattern, segment); ok {
+				return true
+			}
+			if ok, _ := path.Match(pattern, strings.Join(segments[:i+1], "/")); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// listRepoTree - Every entry under a tree. A recursive listing GitHub truncated is redone one
+// folder at a time.
+func listRepoTree(ctx context.Context, client GitHubClient, owner, repo, treeSHA string) ([]GitTreeItem, error) {
+	items, truncated, err := client.GetTree(ctx, owner, repo, treeSHA, true)
+	if err != nil || !truncated {
+		return items, err
+	}
+
+	var walk func(sha, prefix string) ([]GitTreeItem, error)
+	walk = func(sha, prefix string) ([]GitTreeItem, error) {
+		level, _, err := client.GetTree(ctx, owner, repo, sha, false)
+		if err != nil {
+			return nil, err
+		}
+
+		var all []GitTreeItem
+		for _, item := range level {
+			item.Path = prefix + item.Path
+			if item.Type == "tree" {
+				children, err := walk(item.SHA, item.Path+"/")
+				if err != nil {
+					return nil, err
+				}
+				all = append(all, children...)
+				continue
+			}
+			all = append(all, item)
+		}
+		return all, nil
+	}
+	return walk(treeSHA, "")
+}
+
+// importBlob - Downloads a file into the blob store
+func importBlob(ctx context.Context, client GitHubClient, owner, repo string, item GitTreeItem, limit int64) (*db.ImportedFile, bool, error) {
+	body, err := client.GetBlob(ctx, owner, repo, item.SHA)
+	if err != nil {
+		return nil, false, err
+	}
+	defer body.Close()
+
+	content, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(content)) > limit {
+		return nil, false, nil
+	}
+
+	hash, err := db.Blobs.Put(content)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &db.ImportedFile{
+		FilePath: item.Path,
+		FileName: path.Base(item.Path),
+		FileType: importFileType(item.Path),
+		Hash:     hash,
+		Size:     int64(len(content)),
+		IsBinary: !utf8.Valid(content) || bytes.IndexByte(content, 0) >= 0,
+	}, true, nil
+}
+
+// ImportRepository - Creates a project from an existing GitHub repository, linked to it and
+// seeded with the files of one branch
+func ImportRepository(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req ImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+	if req.Owner == "" || req.Repo == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "owner and repo are required",
+		})
+		return
+	}
+
+	// Files can't be larger than the server accepts, nor than GitHub serves
+	limit := db.DefaultMaxFileSize()
+	if limit > githubMaxBlobMiB<<20 {
+		limit = githubMaxBlobMiB << 20
+	}
+	if req.MaxFileSizeMB != nil {
+		if *req.MaxFileSizeMB <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "max_file_size_mb must be positive",
+			})
+			return
+		}
+		if *req.MaxFileSizeMB < limit>>20 {
+			limit = *req.MaxFileSizeMB << 20
+		}
+	}
+
+	tokenModel := &db.TokenModel{DB: db.DB}
+	token, err := tokenModel.GetToken(user.USERNAME)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "No GitHub token stored; log in with GitHub again",
+		})
+		return
+	}
+
+	ctx := r.Context()
+	client := newGitHubClient(token.GITHUB_TOKEN)
+
+	repo, err := client.GetRepository(ctx, req.Owner, req.Repo)
+	if err == ErrGitHubNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Repository not found, or your GitHub account can't see it",
+		})
+		return
+	}
+	if err != nil {
+		writeGitHubFailure(w, "Failed to fetch the repository", err)
+		return
+	}
+
+	name := req.Name
+	if name == "" {
+		name = repo.Name
+	}
+	projectModel := &db.ProjectModel{DB: db.DB}
+	if _, err := projectModel.GetProjectByName(user.ID, name); err == nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "You already have a project with this name",
+			"name":  name,
+		})
+		return
+	} else if err != sql.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to check existing projects",
+		})
+		return
+	}
+
+	branch := req.Branch
+	if branch == "" {
+		branch = repo.DefaultBranch
+	}
+
+	// An empty repository has no branches; the project then starts empty
+	var files []db.ImportedFile
+	skipped := []SkippedFile{}
+	skippedCount := 0
+	skip := func(item GitTreeItem, reason string) {
+		skippedCount++
+		if len(skipped) < maxSkippedListed {
+			skipped = append(skipped, SkippedFile{FilePath: item.Path, Size: item.Size, Reason: reason})
+		}
+	}
+
+	commitSHA, err := client.GetBranchHead(ctx, repo.Owner.Login, repo.Name, branch)
+	if err == ErrGitHubNotFound && req.Branch != "" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":  "Branch not found in the repository",
+			"branch": branch,
+		})
+		return
+	}
+	if err != nil && err != ErrGitHubNotFound {
+		writeGitHubFailure(w, "Failed to fetch the branch", err)
+		return
+	}
+
+	if err == nil {
+		var items []GitTreeItem
+		treeSHA, err := client.GetCommitTree(ctx, repo.Owner.Login, repo.Name, commitSHA)
+		if err == nil {
+			items, err = listRepoTree(ctx, client, repo.Owner.Login, repo.Name, treeSHA)
+		}
+		if err != nil {
+			writeGitHubFailure(w, "Failed to list the repository files", err)
+			return
+		}
+
+		// The tree gives every size, so an import that is too big is refused before any download
+		var selected []GitTreeItem
+		var totalSize int64
+		for _, item := range items {
+			if item.Type == "tree" || !importIncluded(item.Path, req.Paths) || importExcluded(item.Path, req.Exclude) {
+				continue
+			}
+			switch {
+			case item.Type == "commit":
+				skip(item, SkipSubmodule)
+				continue
+			case item.Mode == "120000":
+				skip(item, SkipSymlink)
+				continue
+			case item.Size > limit:
+				skip(item, SkipTooLarge)
+				continue
+			}
+			selected = append(selected, item)
+			totalSize += item.Size
+		}
+
+		maxFiles, maxBytes := importLimits()
+		if len(selected) > maxFiles || totalSize > maxBytes {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":          "The import is too large; narrow it with paths, exclude or max_file_size_mb",
+				"file_count":     len(selected),
+				"total_size":     totalSize,
+				"max_files":      maxFiles,
+				"max_total_size": maxBytes,
+			})
+			return
+		}
+
+		for _, item := range selected {
+			file, fits, err := importBlob(ctx, client, repo.Owner.Login, repo.Name, item, limit)
+			if err != nil {
+				writeGitHubFailure(w, "Failed to download "+item.Path, err)
+				return
+			}
+			if !fits {
+				skip(item, SkipTooLarge)
+				continue
+			}
+			files = append(files, *file)
+		}
+	}
+
+	link := repoLink(repo, branch)
+	message := fmt.Sprintf("Import %s@%s", repo.FullName, branch)
+	secret, err := generateToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to create project",
+		})
+		return
+	}
+	project, changeset, err := projectModel.ImportProject(user.ID, name, repo.Description, link, secret, message, files)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to create project",
+		})
+		return
+	}
+
+	LogActivity(
+		user.ID,
+		project.ID,
+		"project_import",
+		fmt.Sprintf("Imported %d files from %s", len(files), repo.FullName),
+		map[string]interface{}{
+			"repository":    repo.FullName,
+			"branch":        branch,
+			"commit_sha":    commitSHA,
+			"file_count":    len(files),
+			"skipped_count": skippedCount,
+		},
+		r,
+	)
+
+	var changesetID interface{}
+	if changeset != nil {
+		changesetID = changeset.ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"project":        project,
+		"repo":           link,
+		"repo_url":       repo.HTMLURL,
+		"webhook_secret": secret,
+		"commit_sha":     commitSHA,
+		"changeset_id":   changesetID,
+		"file_count":     len(files),
+		"skipped":        skipped,
+		"skipped_count":  skippedCount,
+	})
+}
+
+// writeGitHubFailure - Reports a GitHub API call that failed while serving a request
+func writeGitHubFailure(w http.ResponseWriter, message string, err error) {
+	status := http.StatusBadGateway
+	if apiErr, ok := err.(*GitHubError); ok && (apiErr.Status == http.StatusUnauthorized || apiErr.Status == http.StatusForbidden) {
+		status = http.StatusForbidden
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":  message,
+		"detail": err.Error(),
+	})
+}
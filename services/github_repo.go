@@ -0,0 +1,73 @@
+package services
+
+import (
+	"app/urtc/db"
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// repoVisibility - Older API versions only say whether a repository is private
+func repoVisibility(repo *GitHubRepository) string {
+	if repo.Visibility != "" {
+		return repo.Visibility
+	}
+	if repo.Private {
+		return "private"
+	}
+	return "public"
+}
+
+// repoLink - What is stored about a repository for a project whose main branch syncs to branch
+func repoLink(repo *GitHubRepository, branch string) db.GitHubRepo {
+	return db.GitHubRepo{
+		ID:            repo.ID,
+		Owner:         repo.Owner.Login,
+		Name:          repo.Name,
+		DefaultBranch: branch,
+		Visibility:    repoVisibility(repo),
+		HTMLURL:       repo.HTMLURL,
+		CloneURL:      repo.CloneURL,
+		SSHURL:        repo.SSHURL,
+	}
+}
+
+// refreshRepoLink - Stores a repository's current owner, name, visibility and URLs for a
+// project, keeping the branch it syncs to. Nothing is written when nothing changed.
+func refreshRepoLink(projectID uuid.UUID, stored *db.GitHubRepo, current *GitHubRepository) (*db.GitHubRepo, error) {
+	link := repoLink(current, stored.DefaultBranch)
+	if link == *stored {
+		return stored, nil
+	}
+
+	projectModel := &db.ProjectModel{DB: db.DB}
+	if err := projectModel.SetGitHubRepo(projectID, link); err != nil {
+		return stored, err
+	}
+	return &link, nil
+}
+
+// fetchLinkedRepo - Looks up a project's repository by its ID, so a rename or transfer on GitHub
+// is followed, and refreshes the stored link. Links made before IDs were stored are looked up
+// by name once and get their ID.
+func fetchLinkedRepo(ctx context.Context, client GitHubClient, projectID uuid.UUID, stored *db.GitHubRepo) (*GitHubRepository, *db.GitHubRepo, error) {
+	var repository *GitHubRepository
+	var err error
+	if stored.ID != 0 {
+		repository, err = client.GetRepositoryByID(ctx, stored.ID)
+	} else {
+		repository, err = client.GetRepository(ctx, stored.Owner, stored.Name)
+	}
+	if err == ErrGitHubNotFound {
+		return nil, nil, permanentf("repository %s/%s not found", stored.Owner, stored.Name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	link, err := refreshRepoLink(projectID, stored, repository)
+	if err != nil {
+		return nil, nil, err
+	}
+	return repository, link, nil
+}
@@ -0,0 +1,526 @@
+package services
+
+import (
+	"app/urtc/db"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxSyncAttempts  = 8
+	syncRetryBase    = 30 * time.Second
+	syncRetryMax     = time.Hour
+	syncJobTimeout   = 15 * time.Minute
+	syncJobLease     = syncJobTimeout + time.Minute // a claimed job is left alone this long
+	githubMaxBlobMiB = 100                          // GitHub rejects larger files
+)
+
+// permanentSyncError - A sync failure retrying won't fix, such as a missing repository or token
+type permanentSyncError struct {
+	err error
+}
+
+func (e *permanentSyncError) Error() string { return e.err.Error() }
+
+func permanentf(format string, args ...interface{}) error {
+	return &permanentSyncError{err: fmt.Errorf(format, args...)}
+}
+
+// retryableSyncError - Whether a failed job should be tried again. Network and database errors
+// are; GitHub errors only when GitHub says so.
+func retryableSyncError(err error) bool {
+	var permanent *permanentSyncError
+	if errors.As(err, &permanent) {
+		return false
+	}
+	if errors.Is(err, ErrGitHubNotFound) {
+		return false
+	}
+	var apiErr *GitHubError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	return true
+}
+
+// syncRetryDelay - Exponential backoff after the given number of failed attempts
+func syncRetryDelay(attempts int) time.Duration {
+	delay := syncRetryBase << uint(attempts)
+	if delay <= 0 || delay > syncRetryMax {
+		return syncRetryMax
+	}
+	return delay
+}
+
+// repoFilePath - Where a project file goes in the repository; "" if it can't go anywhere
+func repoFilePath(filePath string) string {
+	return strings.TrimPrefix(path.Clean("/"+filePath), "/")
+}
+
+// syncClient - The GitHub client for a job, acting as the committing user when they have a
+// token and as the project owner otherwise
+func syncClient(projectID, userID uuid.UUID) (GitHubClient, error) {
+	tokenModel := &db.TokenModel{DB: db.DB}
+	token, err := tokenModel.GetTokenByUserID(userID)
+	if err == sql.ErrNoRows {
+		projectModel := &db.ProjectModel{DB: db.DB}
+		var project *db.Project
+		project, err = projectModel.GetProjectByID(projectID)
+		if err == nil {
+			token, err = tokenModel.GetTokenByUserID(project.OwnerID)
+		}
+	}
+	if err == sql.ErrNoRows {
+		return nil, permanentf("neither the committer nor the project owner has a GitHub token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newGitHubClient(token.GITHUB_TOKEN), nil
+}
+
+// versionContent - Opens the content of a version for upload. A variable so tests can serve
+// content without the database.
+var versionContent = func(fv *db.FileVersion) io.ReadCloser {
+	if fv.IsBinary {
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := db.Blobs.WriteTo(fv.FileHash, pw)
+			pw.CloseWithError(err)
+		}()
+		return pr
+	}
+
+	versionModel := &db.VersionModel{DB: db.DB}
+	full, err := versionModel.GetVersionByID(fv.ID)
+	if err != nil {
+		pr, pw := io.Pipe()
+		pw.CloseWithError(err)
+		return pr
+	}
+	return io.NopCloser(strings.NewReader(full.Content))
+}
+
+// syncCommit - What a job puts in its git commit
+type syncCommit struct {
+	userID  uuid.UUID
+	message string
+	at      time.Time
+	files   []db.FileVersion
+}
+
+func loadSyncCommit(job *db.SyncJob) (*syncCommit, error) {
+	if job.MergedFrom != "" {
+		versionModel := &db.VersionModel{DB: db.DB}
+		files, err := versionModel.GetFastForwardedVersions(job.ProjectID, job.Branch, *job.MergedAt)
+		if err != nil {
+			return nil, err
+		}
+		userID := uuid.Nil
+		if job.UserID != nil {
+			userID = *job.UserID
+		}
+		return &syncCommit{
+			userID:  userID,
+			message: "Merge branch '" + job.MergedFrom + "' into " + job.Branch,
+			at:      *job.MergedAt,
+			files:   files,
+		}, nil
+	}
+
+	if job.ChangesetID != nil {
+		changesetModel := &db.ChangesetModel{DB: db.DB}
+		changeset, err := changesetModel.GetChangeset(*job.ChangesetID)
+		if err != nil {
+			return nil, err
+		}
+		return &syncCommit{
+			userID:  changeset.UserID,
+			message: changeset.Message,
+			at:      changeset.CreatedAt,
+			files:   changeset.Files,
+		}, nil
+	}
+
+	versionModel := &db.VersionModel{DB: db.DB}
+	fv, err := versionModel.GetVersionByID(*job.VersionID)
+	if err != nil {
+		return nil, err
+	}
+	fv.Content = ""
+
+	message := fv.CommitMsg
+	if message == "" {
+		message = "Update " + fv.FilePath
+		if fv.IsDeleted {
+			message = "Delete " + fv.FilePath
+		}
+	}
+	return &syncCommit{userID: fv.UserID, message: message, at: fv.CreatedAt, files: []db.FileVersion{*fv}}, nil
+}
+
+// syncJob - Turns one job into a git commit on the repository, pushed as the committing user.
+// Returns the commit and a note on anything left out.
+func syncJob(ctx context.Context, job *db.SyncJob) (string, string, error) {
+	projectModel := &db.ProjectModel{DB: db.DB}
+	syncModel := &db.SyncModel{DB: db.DB}
+
+	repo, err := projectModel.GetGitHubRepo(job.ProjectID)
+	if err == sql.ErrNoRows {
+		return "", "", permanentf("the project is not linked to a GitHub repository")
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	commit, err := loadSyncCommit(job)
+	if err != nil {
+		return "", "", err
+	}
+
+	client, err := syncClient(job.ProjectID, commit.userID)
+	if err != nil {
+		return "", "", err
+	}
+
+	var author *GitSignature
+	userModel := &db.UserModel{DB: db.DB}
+	if user, err := userModel.GetUserByID(commit.userID); err == nil {
+		author = &GitSignature{Name: user.USERNAME, Email: user.EMAIL, Date: commit.at}
+	}
+
+	return pushCommit(ctx, client, repo, job, commit, author, func(commitSHA string) error {
+		return syncModel.SetSyncCommit(job.ID, commitSHA)
+	})
+}
+
+// pushCommit - Uploads a job's changed files as blobs, builds a tree on top of the branch head,
+// commits it and moves the branch. record remembers the commit before the branch is moved, so a
+// retry can reuse it. Returns the commit and a note on anything left out.
+func pushCommit(ctx context.Context, client GitHubClient, repo *db.GitHubRepo, job *db.SyncJob, commit *syncCommit, author *GitSignature, record func(commitSHA string) error) (string, string, error) {
+	// The server's default branch is the repository's default branch; others keep their names
+	branch := job.Branch
+	if branch == db.DefaultBranch {
+		branch = repo.DefaultBranch
+	}
+
+	var notes []string
+	var uploads []db.FileVersion
+	for _, fv := range commit.files {
+		if repoFilePath(fv.FilePath) == "" {
+			continue
+		}
+		if fv.FileSize > githubMaxBlobMiB<<20 {
+			notes = append(notes, fmt.Sprintf("%s was left out: larger than GitHub's %d MB limit", fv.FilePath, githubMaxBlobMiB))
+			continue
+		}
+		uploads = append(uploads, fv)
+	}
+
+	head, err := client.GetBranchHead(ctx, repo.Owner, repo.Name, branch)
+	newBranch := false
+	if err == ErrGitHubNotFound && branch != repo.DefaultBranch {
+		// A branch that isn't on GitHub yet starts from the default branch
+		head, err = client.GetBranchHead(ctx, repo.Owner, repo.Name, repo.DefaultBranch)
+		newBranch = err == nil
+	}
+	if err == ErrGitHubNotFound {
+		// The Git Data API doesn't work on an empty repository; the first file goes in through
+		// the contents API and becomes the default branch's first commit
+		var first *db.FileVersion
+		for i := range uploads {
+			if !uploads[i].IsDeleted {
+				first = &uploads[i]
+				break
+			}
+		}
+		if first == nil {
+			return "", strings.Join(append(notes, "Nothing to commit to the empty repository"), "; "), nil
+		}
+
+		content := versionContent(first)
+		head, err = client.CreateFile(ctx, repo.Owner, repo.Name, "", repoFilePath(first.FilePath), commit.message, content, author)
+		content.Close()
+		if err != nil {
+			return "", "", err
+		}
+		newBranch = branch != repo.DefaultBranch
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	// A commit built by an earlier attempt that crashed before recording success
+	if job.CommitSHA != "" {
+		if head == job.CommitSHA {
+			return head, strings.Join(notes, "; "), nil
+		}
+		if !newBranch && client.UpdateBranch(ctx, repo.Owner, repo.Name, branch, job.CommitSHA) == nil {
+			return job.CommitSHA, strings.Join(notes, "; "), nil
+		}
+	}
+
+	var entries []GitTreeEntry
+	for i := range uploads {
+		fv := &uploads[i]
+		entry := GitTreeEntry{Path: repoFilePath(fv.FilePath), Mode: "100644", Type: "blob"}
+		if !fv.IsDeleted {
+			content := versionContent(fv)
+			sha, err := client.CreateBlob(ctx, repo.Owner, repo.Name, content)
+			content.Close()
+			if err != nil {
+				return "", "", fmt.Errorf("uploading %s: %w", fv.FilePath, err)
+			}
+			entry.SHA = &sha
+		}
+		entries = append(entries, entry)
+	}
+
+	baseTree, err := client.GetCommitTree(ctx, repo.Owner, repo.Name, head)
+	if err != nil {
+		return "", "", err
+	}
+	tree := baseTree
+	if len(entries) > 0 {
+		tree, err = client.CreateTree(ctx, repo.Owner, repo.Name, baseTree, entries)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	commitSHA := head
+	if tree != baseTree {
+		commitSHA, err = client.CreateCommit(ctx, repo.Owner, repo.Name, GitCommit{
+			Message: commit.message,
+			Tree:    tree,
+			Parents: []string{head},
+			Author:  author,
+		})
+		if err != nil {
+			return "", "", err
+		}
+		if err := record(commitSHA); err != nil {
+			return "", "", err
+		}
+	} else {
+		notes = append(notes, "The repository already had these contents")
+	}
+
+	if newBranch {
+		err = client.CreateBranch(ctx, repo.Owner, repo.Name, branch, commitSHA)
+	} else if commitSHA != head {
+		err = client.UpdateBranch(ctx, repo.Owner, repo.Name, branch, commitSHA)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	return commitSHA, strings.Join(notes, "; "), nil
+}
+
+// nextSyncAttempt - When a job that failed after the given number of earlier attempts is tried
+// again; nil if it should be marked failed
+func nextSyncAttempt(attempts int, err error, now time.Time) *time.Time {
+	if !retryableSyncError(err) || attempts+1 >= maxSyncAttempts {
+		return nil
+	}
+	next := now.Add(syncRetryDelay(attempts))
+	return &next
+}
+
+// runSyncJobs - Syncs every job that is due, one at a time. Each job is claimed first, so
+// overlapping runs and other servers never push the same job twice.
+func runSyncJobs() {
+	syncModel := &db.SyncModel{DB: db.DB}
+
+	for {
+		job, err := syncModel.ClaimSyncJob(time.Now(), syncJobLease)
+		if err == sql.ErrNoRows {
+			return
+		}
+		if err != nil {
+			log.Printf("GitHub sync failed to claim a job: %v", err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), syncJobTimeout)
+		commitSHA, note, err := syncJob(ctx, job)
+		cancel()
+
+		if err == nil {
+			if err := syncModel.MarkSynced(job.ID, commitSHA, note); err != nil {
+				// Left running; it is claimed again once the lease runs out
+				log.Printf("GitHub sync failed to record job %s: %v", job.ID, err)
+			}
+			continue
+		}
+
+		log.Printf("GitHub sync of job %s failed (attempt %d): %v", job.ID, job.Attempts+1, err)
+		if err := syncModel.MarkSyncAttemptFailed(job.ID, err.Error(), nextSyncAttempt(job.Attempts, err, time.Now())); err != nil {
+			log.Printf("GitHub sync failed to record job %s: %v", job.ID, err)
+		}
+	}
+}
+
+// StartGitHubSync - Periodically mirrors new changesets and commits to linked GitHub repositories
+func StartGitHubSync(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			runSyncJobs()
+		}
+	}()
+}
+
+// lookupSyncJob - The job of a changeset or, failing that, of a version; sql.ErrNoRows for IDs that aren't valid
+func lookupSyncJob(changesetID, versionID string) (*db.SyncJob, error) {
+	syncModel := &db.SyncModel{DB: db.DB}
+	if changesetID != "" {
+		id, err := uuid.Parse(changesetID)
+		if err != nil {
+			return nil, sql.ErrNoRows
+		}
+		return syncModel.GetChangesetSyncJob(id)
+	}
+
+	id, err := uuid.Parse(versionID)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	return syncModel.GetVersionSyncJob(id)
+}
+
+// GetSyncStatus - GitHub sync state of a changeset, of a version committed on its own, or of a
+// project's recent commits
+func GetSyncStatus(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	syncModel := &db.SyncModel{DB: db.DB}
+
+	projectUUID, err := uuid.Parse(query.Get("project_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return
+	}
+
+	projectModel := &db.ProjectModel{DB: db.DB}
+	repo, err := projectModel.GetGitHubRepo(projectUUID)
+	if err != nil && err != sql.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch project",
+		})
+		return
+	}
+
+	if changesetID, versionID := query.Get("changeset_id"), query.Get("version_id"); changesetID != "" || versionID != "" {
+		job, err := lookupSyncJob(changesetID, versionID)
+		if err == nil && job.ProjectID != projectUUID {
+			err = sql.ErrNoRows
+		}
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "No GitHub sync for this commit",
+			})
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Failed to fetch sync status",
+			})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"repo":    repo,
+			"sync":    job,
+		})
+		return
+	}
+
+	limit := 50
+	if l := query.Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 500 {
+			limit = parsed
+		}
+	}
+
+	jobs, err := syncModel.GetProjectSyncJobs(projectUUID, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch sync status",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"project_id": projectUUID,
+		"repo":       repo,
+		"jobs":       jobs,
+		"total":      len(jobs),
+	})
+}
+
+// RetrySync - Puts a project's failed GitHub syncs back in the queue
+func RetrySync(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ProjectID string `json:"project_id"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	projectUUID, err := uuid.Parse(req.ProjectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermManageProject); !ok {
+		return
+	}
+
+	syncModel := &db.SyncModel{DB: db.DB}
+	retried, err := syncModel.RetryFailedSyncJobs(projectUUID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to retry sync",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"retried": retried,
+	})
+}
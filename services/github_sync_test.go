@@ -0,0 +1,433 @@
+package services
+
+import (
+	"app/urtc/db"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// fakeGit - An in-memory repository behind the GitHubClient calls sync makes. Blob SHAs are
+// the content itself so trees are easy to compare.
+type fakeGit struct {
+	GitHubClient // anything sync isn't expected to call panics
+
+	branches map[string]string            // branch -> commit
+	commits  map[string]GitCommit         // commit -> commit
+	trees    map[string]map[string]string // tree -> path -> blob
+	failures map[string][]error           // method -> errors returned by its next calls
+	calls    []string
+	next     int
+}
+
+func newFakeGit() *fakeGit {
+	return &fakeGit{
+		branches: make(map[string]string),
+		commits:  make(map[string]GitCommit),
+		trees:    map[string]map[string]string{"tree0": {}},
+		failures: make(map[string][]error),
+	}
+}
+
+func (f *fakeGit) call(method string) error {
+	f.calls = append(f.calls, method)
+	if errs := f.failures[method]; len(errs) > 0 {
+		f.failures[method] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+func (f *fakeGit) id(prefix string) string {
+	f.next++
+	return fmt.Sprintf("%s%d", prefix, f.next)
+}
+
+// files - The files on a branch, path -> content
+func (f *fakeGit) files(branch string) map[string]string {
+	return f.trees[f.commits[f.branches[branch]].Tree]
+}
+
+func (f *fakeGit) GetBranchHead(ctx context.Context, owner, repo, branch string) (string, error) {
+	if err := f.call("GetBranchHead"); err != nil {
+		return "", err
+	}
+	head, ok := f.branches[branch]
+	if !ok {
+		return "", ErrGitHubNotFound
+	}
+	return head, nil
+}
+
+func (f *fakeGit) GetCommitTree(ctx context.Context, owner, repo, commitSHA string) (string, error) {
+	if err := f.call("GetCommitTree"); err != nil {
+		return "", err
+	}
+	commit, ok := f.commits[commitSHA]
+	if !ok {
+		return "", ErrGitHubNotFound
+	}
+	return commit.Tree, nil
+}
+
+func (f *fakeGit) CreateBlob(ctx context.Context, owner, repo string, content io.Reader) (string, error) {
+	if err := f.call("CreateBlob"); err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(content)
+	return string(data), err
+}
+
+func (f *fakeGit) CreateTree(ctx context.Context, owner, repo, baseTree string, entries []GitTreeEntry) (string, error) {
+	if err := f.call("CreateTree"); err != nil {
+		return "", err
+	}
+	tree := make(map[string]string)
+	for path, blob := range f.trees[baseTree] {
+		tree[path] = blob
+	}
+	for _, entry := range entries {
+		if entry.SHA == nil {
+			delete(tree, entry.Path)
+		} else {
+			tree[entry.Path] = *entry.SHA
+		}
+	}
+	// Same content, same tree, as on GitHub
+	for sha, existing := range f.trees {
+		if reflect.DeepEqual(existing, tree) {
+			return sha, nil
+		}
+	}
+	sha := f.id("tree")
+	f.trees[sha] = tree
+	return sha, nil
+}
+
+func (f *fakeGit) CreateCommit(ctx context.Context, owner, repo string, commit GitCommit) (string, error) {
+	if err := f.call("CreateCommit"); err != nil {
+		return "", err
+	}
+	sha := f.id("commit")
+	f.commits[sha] = commit
+	return sha, nil
+}
+
+func (f *fakeGit) CreateBranch(ctx context.Context, owner, repo, branch, commitSHA string) error {
+	if err := f.call("CreateBranch"); err != nil {
+		return err
+	}
+	if _, exists := f.branches[branch]; exists {
+		return &GitHubError{Status: http.StatusUnprocessableEntity, Message: "Reference already exists"}
+	}
+	f.branches[branch] = commitSHA
+	return nil
+}
+
+func (f *fakeGit) UpdateBranch(ctx context.Context, owner, repo, branch, commitSHA string) error {
+	if err := f.call("UpdateBranch"); err != nil {
+		return err
+	}
+	head, ok := f.branches[branch]
+	if !ok {
+		return ErrGitHubNotFound
+	}
+	// Only fast-forwards: the new commit has to descend from the head
+	for sha := commitSHA; sha != head; {
+		parents := f.commits[sha].Parents
+		if len(parents) == 0 {
+			return &GitHubError{Status: http.StatusUnprocessableEntity, Message: "Update is not a fast forward"}
+		}
+		sha = parents[0]
+	}
+	f.branches[branch] = commitSHA
+	return nil
+}
+
+func (f *fakeGit) CreateFile(ctx context.Context, owner, repo, branch, path, message string, content io.Reader, author *GitSignature) (string, error) {
+	if err := f.call("CreateFile"); err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return "", err
+	}
+	tree := f.id("tree")
+	f.trees[tree] = map[string]string{path: string(data)}
+	sha := f.id("commit")
+	f.commits[sha] = GitCommit{Message: message, Tree: tree}
+	f.branches["main"] = sha
+	return sha, nil
+}
+
+// seed - Gives the repository a first commit on main
+func (f *fakeGit) seed() string {
+	f.commits["commit0"] = GitCommit{Message: "Initial commit", Tree: "tree0"}
+	f.branches["main"] = "commit0"
+	return "commit0"
+}
+
+var testRepo = &db.GitHubRepo{Owner: "octocat", Name: "MyUnityGame", DefaultBranch: "main"}
+
+func init() {
+	// Content is the path and version, so every version has its own blob
+	versionContent = func(fv *db.FileVersion) io.ReadCloser {
+		return io.NopCloser(strings.NewReader(fmt.Sprintf("%s@%d", fv.FilePath, fv.Version)))
+	}
+}
+
+func testVersion(path string, version int, deleted bool) db.FileVersion {
+	return db.FileVersion{ID: uuid.New(), FilePath: path, Version: version, IsDeleted: deleted}
+}
+
+func testJob(branch string, files ...db.FileVersion) (*db.SyncJob, *syncCommit) {
+	job := &db.SyncJob{ID: uuid.New(), Branch: branch, Status: db.SyncRunning}
+	commit := &syncCommit{message: fmt.Sprintf("%d files", len(files)), at: time.Now(), files: files}
+	return job, commit
+}
+
+func push(t *testing.T, git *fakeGit, job *db.SyncJob, commit *syncCommit) (string, string, error) {
+	t.Helper()
+	return pushCommit(context.Background(), git, testRepo, job, commit, nil, func(commitSHA string) error {
+		job.CommitSHA = commitSHA
+		return nil
+	})
+}
+
+func TestPushCommitOrdering(t *testing.T) {
+	git := newFakeGit()
+	head := git.seed()
+
+	steps := []struct {
+		name   string
+		branch string
+		files  []db.FileVersion
+		want   map[string]string
+	}{
+		{
+			name:   "add a file",
+			branch: db.DefaultBranch,
+			files:  []db.FileVersion{testVersion("Assets/Player.cs", 1, false)},
+			want:   map[string]string{"Assets/Player.cs": "Assets/Player.cs@1"},
+		},
+		{
+			name:   "edit it and add another",
+			branch: db.DefaultBranch,
+			files:  []db.FileVersion{testVersion("Assets/Player.cs", 2, false), testVersion("Assets/Enemy.cs", 1, false)},
+			want:   map[string]string{"Assets/Player.cs": "Assets/Player.cs@2", "Assets/Enemy.cs": "Assets/Enemy.cs@1"},
+		},
+		{
+			name:   "delete the first",
+			branch: db.DefaultBranch,
+			files:  []db.FileVersion{testVersion("Assets/Player.cs", 3, true)},
+			want:   map[string]string{"Assets/Enemy.cs": "Assets/Enemy.cs@1"},
+		},
+		{
+			name:   "paths are cleaned",
+			branch: db.DefaultBranch,
+			files:  []db.FileVersion{testVersion("/Assets/../Assets/Boss.cs", 1, false)},
+			want:   map[string]string{"Assets/Enemy.cs": "Assets/Enemy.cs@1", "Assets/Boss.cs": "/Assets/../Assets/Boss.cs@1"},
+		},
+	}
+
+	for _, step := range steps {
+		job, commit := testJob(step.branch, step.files...)
+		sha, _, err := push(t, git, job, commit)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		if git.branches["main"] != sha {
+			t.Errorf("%s: main is at %s, want %s", step.name, git.branches["main"], sha)
+		}
+		if parents := git.commits[sha].Parents; len(parents) != 1 || parents[0] != head {
+			t.Errorf("%s: parents %v, want [%s]", step.name, parents, head)
+		}
+		if job.CommitSHA != sha {
+			t.Errorf("%s: recorded %q, want %q", step.name, job.CommitSHA, sha)
+		}
+		if got := git.files("main"); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: files %v, want %v", step.name, got, step.want)
+		}
+		head = sha
+	}
+}
+
+func TestPushCommitBranches(t *testing.T) {
+	git := newFakeGit()
+	base := git.seed()
+
+	// A branch that isn't on GitHub yet starts from the default branch
+	job, commit := testJob("prototype", testVersion("Assets/Level.cs", 1, false))
+	sha, _, err := push(t, git, job, commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if git.branches["prototype"] != sha || git.branches["main"] != base {
+		t.Fatalf("branches %v: want prototype at %s and main untouched", git.branches, sha)
+	}
+	if parents := git.commits[sha].Parents; len(parents) != 1 || parents[0] != base {
+		t.Errorf("parents %v, want [%s]", parents, base)
+	}
+
+	// Later commits go on top of it
+	job, commit = testJob("prototype", testVersion("Assets/Level.cs", 2, false))
+	next, _, err := push(t, git, job, commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if git.branches["prototype"] != next || git.commits[next].Parents[0] != sha {
+		t.Errorf("prototype at %s with parents %v, want %s on top of %s", git.branches["prototype"], git.commits[next].Parents, next, sha)
+	}
+}
+
+func TestPushCommitEmptyRepository(t *testing.T) {
+	git := newFakeGit()
+
+	// Deletions first: the first file to exist goes in through the contents API
+	job, commit := testJob(db.DefaultBranch,
+		testVersion("Assets/Old.cs", 2, true),
+		testVersion("Assets/Player.cs", 1, false),
+		testVersion("Assets/Enemy.cs", 1, false),
+	)
+	sha, _, err := push(t, git, job, commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"Assets/Player.cs": "Assets/Player.cs@1", "Assets/Enemy.cs": "Assets/Enemy.cs@1"}
+	if got := git.files("main"); !reflect.DeepEqual(got, want) || git.branches["main"] != sha {
+		t.Errorf("main at %s with %v, want %s with %v", git.branches["main"], got, sha, want)
+	}
+	if git.calls[1] != "CreateFile" {
+		t.Errorf("calls %v: want CreateFile after the head lookup", git.calls)
+	}
+
+	// Nothing but deletions has nothing to commit
+	git = newFakeGit()
+	job, commit = testJob(db.DefaultBranch, testVersion("Assets/Old.cs", 2, true))
+	sha, note, err := push(t, git, job, commit)
+	if err != nil || sha != "" || note == "" {
+		t.Errorf("got %q, %q, %v: want no commit and a note", sha, note, err)
+	}
+}
+
+func TestPushCommitResumesRecordedCommit(t *testing.T) {
+	git := newFakeGit()
+	git.seed()
+
+	// An earlier attempt built the commit and crashed before moving the branch
+	job, commit := testJob(db.DefaultBranch, testVersion("Assets/Player.cs", 1, false))
+	git.failures["UpdateBranch"] = []error{errors.New("connection reset")}
+	if _, _, err := push(t, git, job, commit); err == nil {
+		t.Fatal("first attempt succeeded")
+	}
+	built := job.CommitSHA
+	commits := len(git.commits)
+
+	sha, _, err := push(t, git, job, commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha != built || git.branches["main"] != built || len(git.commits) != commits {
+		t.Errorf("retry pushed %s (%d commits), want the recorded %s without a new commit", sha, len(git.commits)-commits, built)
+	}
+
+	// Already on the branch: nothing left to do
+	sha, _, err = push(t, git, job, commit)
+	if err != nil || sha != built || len(git.commits) != commits {
+		t.Errorf("second retry got %s, %v, want %s", sha, err, built)
+	}
+}
+
+func TestPushCommitFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		err       error
+		retryable bool
+	}{
+		{"network error", "CreateBlob", errors.New("connection reset by peer"), true},
+		{"server error", "CreateTree", &GitHubError{Status: http.StatusBadGateway, Message: "Bad Gateway"}, true},
+		{"rate limit", "GetBranchHead", &GitHubError{Status: http.StatusForbidden, Message: "API rate limit exceeded"}, true},
+		{"concurrent push", "UpdateBranch", &GitHubError{Status: http.StatusUnprocessableEntity, Message: "Update is not a fast forward"}, true},
+		{"revoked token", "GetCommitTree", &GitHubError{Status: http.StatusUnauthorized, Message: "Bad credentials"}, false},
+		{"no push access", "CreateCommit", &GitHubError{Status: http.StatusForbidden, Message: "Resource not accessible by integration"}, false},
+		{"repository gone", "CreateBlob", ErrGitHubNotFound, false},
+	}
+
+	now := time.Now()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			git := newFakeGit()
+			head := git.seed()
+			git.failures[tt.method] = []error{tt.err}
+
+			job, commit := testJob(db.DefaultBranch, testVersion("Assets/Player.cs", 1, false))
+			_, _, err := push(t, git, job, commit)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if git.branches["main"] != head {
+				t.Errorf("main moved to %s after a failure", git.branches["main"])
+			}
+
+			retryAt := nextSyncAttempt(job.Attempts, err, now)
+			if (retryAt != nil) != tt.retryable {
+				t.Fatalf("retry at %v, want retryable %v", retryAt, tt.retryable)
+			}
+			if !tt.retryable {
+				return
+			}
+
+			// The retry goes through once GitHub recovers
+			sha, _, err := push(t, git, job, commit)
+			if err != nil || git.branches["main"] != sha {
+				t.Errorf("retry got %s, %v; main at %s", sha, err, git.branches["main"])
+			}
+		})
+	}
+}
+
+func TestNextSyncAttempt(t *testing.T) {
+	now := time.Now()
+	temporary := errors.New("connection reset")
+
+	tests := []struct {
+		attempts int
+		err      error
+		want     time.Duration // 0 when the job should be marked failed
+	}{
+		{0, temporary, 30 * time.Second},
+		{1, temporary, time.Minute},
+		{3, temporary, 4 * time.Minute},
+		{6, temporary, 32 * time.Minute},
+		{maxSyncAttempts - 1, temporary, 0},
+		{0, permanentf("the project is not linked to a GitHub repository"), 0},
+		{0, fmt.Errorf("uploading Assets/Player.cs: %w", ErrGitHubNotFound), 0},
+		{0, &GitHubError{Status: http.StatusTooManyRequests}, 30 * time.Second},
+		{0, &GitHubError{Status: http.StatusUnprocessableEntity, Message: "Validation Failed"}, 0},
+	}
+
+	for _, tt := range tests {
+		got := nextSyncAttempt(tt.attempts, tt.err, now)
+		switch {
+		case tt.want == 0 && got != nil:
+			t.Errorf("attempts %d, %v: retry at %v, want failed", tt.attempts, tt.err, *got)
+		case tt.want != 0 && (got == nil || got.Sub(now) != tt.want):
+			t.Errorf("attempts %d, %v: retry at %v, want after %v", tt.attempts, tt.err, got, tt.want)
+		}
+	}
+
+	if delay := syncRetryDelay(40); delay != syncRetryMax {
+		t.Errorf("delay after 40 attempts is %v, want the %v cap", delay, syncRetryMax)
+	}
+}
@@ -0,0 +1,591 @@
+package services
+
+import (
+	"app/urtc/db"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// maxWebhookCommitsListed - Commits of a push kept in its activity metadata
+const maxWebhookCommitsListed = 20
+
+type webhookUser struct {
+	Login string `json:"login"`
+}
+
+type webhookCommit struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+	URL     string `json:"url"`
+	Author  struct {
+		Name     string `json:"name"`
+		Username string `json:"username"`
+	} `json:"author"`
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
+}
+
+type webhookPullRequest struct {
+	Title   string      `json:"title"`
+	HTMLURL string      `json:"html_url"`
+	State   string      `json:"state"`
+	Merged  bool        `json:"merged"`
+	User    webhookUser `json:"user"`
+	Head    struct {
+		Ref string `json:"ref"`
+		SHA string `json:"sha"`
+	} `json:"head"`
+	Base struct {
+		Ref string `json:"ref"`
+	} `json:"base"`
+}
+
+// webhookPayload - The fields of the push, pull_request, member and repository events the server uses
+type webhookPayload struct {
+	Action     string           `json:"action"`
+	Sender     webhookUser      `json:"sender"`
+	Repository GitHubRepository `json:"repository"`
+
+	// push
+	Ref     string          `json:"ref"`
+	Before  string          `json:"before"`
+	After   string          `json:"after"`
+	Compare string          `json:"compare"`
+	Created bool            `json:"created"`
+	Deleted bool            `json:"deleted"`
+	Forced  bool            `json:"forced"`
+	Commits []webhookCommit `json:"commits"`
+
+	// pull_request
+	Number      int                 `json:"number"`
+	PullRequest *webhookPullRequest `json:"pull_request"`
+
+	// member
+	Member *webhookUser `json:"member"`
+
+	// repository renamed or transferred, member permission changes
+	Changes struct {
+		Repository struct {
+			Name struct {
+				From string `json:"from"`
+			} `json:"name"`
+		} `json:"repository"`
+		Owner struct {
+			From struct {
+				User         *webhookUser `json:"user"`
+				Organization *webhookUser `json:"organization"`
+			} `json:"from"`
+		} `json:"owner"`
+		Permission struct {
+			From string `json:"from"`
+			To   string `json:"to"`
+		} `json:"permission"`
+	} `json:"changes"`
+}
+
+// webhookEvent - How a delivery is recorded in the activity feed
+type webhookEvent struct {
+	action      string
+	description string
+	metadata    map[string]interface{}
+}
+
+// verifyWebhookSignature - Checks the X-Hub-Signature-256 header, an HMAC-SHA256 of the raw
+// body keyed with the webhook secret
+func verifyWebhookSignature(secret string, body []byte, header string) bool {
+	signature, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+	if err != nil || !strings.HasPrefix(header, "sha256=") {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+// webhookJSON - The JSON document of a delivery, sent as is or form-encoded in a payload field
+func webhookJSON(r *http.Request, body []byte) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return body, nil
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(values.Get("payload")), nil
+}
+
+func pluralize(n int, word string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", word)
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
+
+// describePush - A push to a branch or tag
+func describePush(p *webhookPayload) webhookEvent {
+	kind, name := "branch", strings.TrimPrefix(p.Ref, "refs/heads/")
+	if strings.HasPrefix(p.Ref, "refs/tags/") {
+		kind, name = "tag", strings.TrimPrefix(p.Ref, "refs/tags/")
+	}
+
+	var description string
+	switch {
+	case p.Deleted:
+		description = fmt.Sprintf("%s deleted %s %s on GitHub", p.Sender.Login, kind, name)
+	case kind == "tag":
+		description = fmt.Sprintf("%s pushed tag %s to GitHub", p.Sender.Login, name)
+	case p.Forced:
+		description = fmt.Sprintf("%s force-pushed %s to %s on GitHub", p.Sender.Login, pluralize(len(p.Commits), "commit"), name)
+	default:
+		description = fmt.Sprintf("%s pushed %s to %s on GitHub", p.Sender.Login, pluralize(len(p.Commits), "commit"), name)
+	}
+
+	commits := make([]map[string]interface{}, 0, len(p.Commits))
+	for i, commit := range p.Commits {
+		if i == maxWebhookCommitsListed {
+			break
+		}
+		commits = append(commits, map[string]interface{}{
+			"sha":      commit.ID,
+			"message":  commit.Message,
+			"author":   commit.Author.Name,
+			"username": commit.Author.Username,
+			"url":      commit.URL,
+			"added":    commit.Added,
+			"removed":  commit.Removed,
+			"modified": commit.Modified,
+		})
+	}
+
+	return webhookEvent{
+		action:      "github_push",
+		description: description,
+		metadata: map[string]interface{}{
+			"ref":          p.Ref,
+			kind:           name,
+			"before":       p.Before,
+			"after":        p.After,
+			"compare":      p.Compare,
+			"created":      p.Created,
+			"deleted":      p.Deleted,
+			"forced":       p.Forced,
+			"commit_count": len(p.Commits),
+			"commits":      commits,
+		},
+	}
+}
+
+// describePullRequest - A pull request opened, closed, merged and so on
+func describePullRequest(p *webhookPayload) webhookEvent {
+	pr := p.PullRequest
+	verb := strings.ReplaceAll(p.Action, "_", " ")
+	if p.Action == "closed" && pr.Merged {
+		verb = "merged"
+	}
+	if p.Action == "synchronize" {
+		verb = "pushed to"
+	}
+
+	return webhookEvent{
+		action:      "github_pull_request",
+		description: fmt.Sprintf("%s %s pull request #%d: %s", p.Sender.Login, verb, p.Number, pr.Title),
+		metadata: map[string]interface{}{
+			"pr_action": p.Action,
+			"number":    p.Number,
+			"title":     pr.Title,
+			"url":       pr.HTMLURL,
+			"state":     pr.State,
+			"merged":    pr.Merged,
+			"author":    pr.User.Login,
+			"head":      pr.Head.Ref,
+			"head_sha":  pr.Head.SHA,
+			"base":      pr.Base.Ref,
+		},
+	}
+}
+
+// describeMember - A collaborator added to, removed from or changed on the repository
+func describeMember(p *webhookPayload) webhookEvent {
+	var description string
+	switch p.Action {
+	case "added":
+		description = fmt.Sprintf("%s added %s to the GitHub repository", p.Sender.Login, p.Member.Login)
+	case "removed":
+		description = fmt.Sprintf("%s removed %s from the GitHub repository", p.Sender.Login, p.Member.Login)
+	default:
+		description = fmt.Sprintf("%s changed the GitHub access of %s", p.Sender.Login, p.Member.Login)
+	}
+
+	metadata := map[string]interface{}{
+		"member_action": p.Action,
+		"member":        p.Member.Login,
+	}
+	if p.Changes.Permission.From != "" {
+		metadata["permission_from"] = p.Changes.Permission.From
+	}
+	if p.Changes.Permission.To != "" {
+		metadata["permission_to"] = p.Changes.Permission.To
+	}
+
+	return webhookEvent{action: "github_member", description: description, metadata: metadata}
+}
+
+// describeRepository - A change to the repository itself
+func describeRepository(p *webhookPayload) webhookEvent {
+	var description string
+	switch p.Action {
+	case "renamed":
+		description = fmt.Sprintf("%s renamed the GitHub repository to %s", p.Sender.Login, p.Repository.FullName)
+	case "transferred":
+		description = fmt.Sprintf("%s transferred the GitHub repository to %s", p.Sender.Login, p.Repository.FullName)
+	default:
+		description = fmt.Sprintf("%s %s the GitHub repository", p.Sender.Login, p.Action)
+	}
+
+	return webhookEvent{
+		action:      "github_repository",
+		description: description,
+		metadata: map[string]interface{}{
+			"repository_action": p.Action,
+			"private":           p.Repository.Private,
+			"default_branch":    p.Repository.DefaultBranch,
+		},
+	}
+}
+
+// previousRepoName - Where a renamed or transferred repository was before, which is what
+// projects linked before repository IDs were stored still point at
+func previousRepoName(p *webhookPayload) (string, string) {
+	owner, name := p.Repository.Owner.Login, p.Repository.Name
+	if p.Changes.Repository.Name.From != "" {
+		name = p.Changes.Repository.Name.From
+	}
+	if from := p.Changes.Owner.From; from.Organization != nil {
+		owner = from.Organization.Login
+	} else if from.User != nil {
+		owner = from.User.Login
+	}
+	return owner, name
+}
+
+// describeEvent - How an event is recorded in the activity feed; false for events that aren't
+func describeEvent(event string, p *webhookPayload) (webhookEvent, bool) {
+	switch {
+	case event == "push":
+		return describePush(p), true
+	case event == "pull_request" && p.PullRequest != nil:
+		return describePullRequest(p), true
+	case event == "member" && p.Member != nil:
+		return describeMember(p), true
+	case event == "repository":
+		return describeRepository(p), true
+	}
+	return webhookEvent{}, false
+}
+
+// linkedProjects - The projects a delivery's repository is linked to. They are found by
+// repository ID, which survives renames and transfers, then by name.
+func linkedProjects(event string, p *webhookPayload) ([]db.Project, error) {
+	projectModel := &db.ProjectModel{DB: db.DB}
+	if p.Repository.ID != 0 {
+		projects, err := projectModel.GetProjectsByRepoID(p.Repository.ID)
+		if err != nil || len(projects) > 0 {
+			return projects, err
+		}
+	}
+
+	owner, name := p.Repository.Owner.Login, p.Repository.Name
+	if event == "repository" {
+		owner, name = previousRepoName(p)
+	}
+	if owner == "" || name == "" {
+		return nil, nil
+	}
+	return projectModel.GetProjectsByRepo(owner, name)
+}
+
+// signedProjects - The projects whose own webhook secret signed a delivery. A project without
+// a secret can't be verified, so it never receives deliveries.
+func signedProjects(projects []db.Project, body []byte, signature string) []db.Project {
+	var signed []db.Project
+	for _, project := range projects {
+		if project.WebhookSecret != "" && verifyWebhookSignature(project.WebhookSecret, body, signature) {
+			signed = append(signed, project)
+		}
+	}
+	return signed
+}
+
+// refreshLinkedRepo - Re-reads a project's repository from GitHub by ID, after a delivery showed
+// it differently from what is stored. The payload is never stored as is.
+func refreshLinkedRepo(projectID uuid.UUID) {
+	client, _, repo, err := accessClient(projectID)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), syncJobTimeout)
+		defer cancel()
+		_, _, err = fetchLinkedRepo(ctx, client, projectID, repo)
+	}
+	if err != nil {
+		log.Printf("Failed to refresh the repository of project %s: %v", projectID, err)
+	}
+}
+
+// GitHubWebhook - Receives push, pull_request, member and repository events from GitHub and
+// records them in the activity feed of the projects linked to the repository. Each delivery
+// must be signed with the webhook secret of the project it is recorded for.
+func GitHubWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to read request body",
+		})
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	delivery := r.Header.Get("X-GitHub-Delivery")
+
+	// The payload is only trusted once a project's secret has verified it; until then it just
+	// says which projects to check the signature against
+	document, err := webhookJSON(r, body)
+	var payload webhookPayload
+	if err == nil {
+		err = json.Unmarshal(document, &payload)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid webhook payload",
+		})
+		return
+	}
+
+	projects, err := linkedProjects(event, &payload)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to find linked projects",
+		})
+		return
+	}
+
+	projects = signedProjects(projects, body, r.Header.Get("X-Hub-Signature-256"))
+	if len(projects) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid webhook signature",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, ok := describeEvent(event, &payload); !ok {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"event":    event,
+			"ignored":  true,
+			"projects": len(projects),
+		})
+		return
+	}
+
+	userModel := &db.UserModel{DB: db.DB}
+	sender, err := userModel.GetUser(payload.Sender.Login)
+	if err != nil && err != sql.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to look up the sender",
+		})
+		return
+	}
+
+	syncModel := &db.SyncModel{DB: db.DB}
+	recorded := 0
+	for _, project := range projects {
+		// A rename, transfer or visibility change shows up in every delivery; what is stored
+		// is fetched from GitHub instead of taken from the payload
+		if project.Repo != nil && payload.Repository.ID != 0 && repoLink(&payload.Repository, project.Repo.DefaultBranch) != *project.Repo {
+			go refreshLinkedRepo(project.ID)
+		}
+
+		// Pushes made by GitHub sync are this server's own commits coming back
+		if event == "push" && !payload.Deleted {
+			if own, err := syncModel.IsSyncCommit(project.ID, payload.After); err == nil && own {
+				continue
+			}
+		}
+
+		// The sender is credited when they are a member of the project. Anyone else, whether
+		// or not they use this server, is labelled external and the activity goes to the
+		// project owner, whose account the repository is linked through.
+		external := true
+		if sender != nil {
+			if _, err := Authorize(sender.ID, project.ID, PermViewProject); err == nil {
+				external = false
+			}
+		}
+
+		described := describeSender(event, payload, external)
+		described.metadata["event"] = event
+		described.metadata["delivery_id"] = delivery
+		described.metadata["repository"] = payload.Repository.FullName
+		described.metadata["repository_url"] = payload.Repository.HTMLURL
+		described.metadata["github_login"] = payload.Sender.Login
+		described.metadata["external"] = external
+
+		actorID, excludeID := project.OwnerID, uuid.Nil
+		if !external {
+			actorID, excludeID = sender.ID, sender.ID
+		}
+		if err := LogActivity(actorID, project.ID, described.action, described.description, described.metadata, r); err != nil {
+			log.Printf("Failed to record GitHub %s event for project %s: %v", event, project.ID, err)
+		}
+
+		notification := make(map[string]interface{}, len(described.metadata)+2)
+		for key, value := range described.metadata {
+			notification[key] = value
+		}
+		notification["project_id"] = project.ID
+		notification["action"] = described.action
+		NotifyProjectMembers(project.ID, excludeID, "github_event", described.description, notification)
+		recorded++
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"event":    event,
+		"projects": recorded,
+	})
+}
+
+// describeSender - An event as recorded for one project, where a sender who isn't a member is
+// named as external
+func describeSender(event string, p webhookPayload, external bool) webhookEvent {
+	if external {
+		p.Sender.Login += " (external)"
+	}
+	described, _ := describeEvent(event, &p)
+	return described
+}
+
+// webhookEvents - The events to choose when adding the webhook on GitHub
+var webhookEvents = []string{"push", "pull_request", "member", "repository"}
+
+// writeWebhookSecret - Responds with the secret to set on a project's webhook
+func writeWebhookSecret(w http.ResponseWriter, projectID uuid.UUID, secret string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"project_id":     projectID,
+		"webhook_secret": secret,
+		"events":         webhookEvents,
+	})
+}
+
+// GetWebhookSecret - The secret of the webhook on a project's repository. Projects linked
+// before each had its own secret are given one here.
+func GetWebhookSecret(w http.ResponseWriter, r *http.Request) {
+	projectUUID, err := uuid.Parse(r.URL.Query().Get("project_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermManageProject); !ok {
+		return
+	}
+
+	projectModel := &db.ProjectModel{DB: db.DB}
+	secret, err := generateToken()
+	if err == nil {
+		secret, err = projectModel.EnsureWebhookSecret(projectUUID, secret)
+	}
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Project is not linked to a GitHub repository",
+		})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch webhook secret",
+		})
+		return
+	}
+
+	writeWebhookSecret(w, projectUUID, secret)
+}
+
+// RotateWebhookSecret - Replaces the secret of the webhook on a project's repository. Deliveries
+// are rejected until the new secret is set on GitHub.
+func RotateWebhookSecret(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ProjectID string `json:"project_id"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	projectUUID, err := uuid.Parse(req.ProjectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	user, _, ok := authorizeProject(w, r, projectUUID, PermManageProject)
+	if !ok {
+		return
+	}
+
+	projectModel := &db.ProjectModel{DB: db.DB}
+	secret, err := generateToken()
+	if err == nil {
+		err = projectModel.SetWebhookSecret(projectUUID, secret)
+	}
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Project is not linked to a GitHub repository",
+		})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to rotate webhook secret",
+		})
+		return
+	}
+
+	LogActivity(
+		user.ID,
+		projectUUID,
+		"webhook_secret_rotated",
+		"Rotated the GitHub webhook secret",
+		map[string]interface{}{},
+		r,
+	)
+
+	writeWebhookSecret(w, projectUUID, secret)
+}
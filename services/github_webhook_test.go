@@ -0,0 +1,223 @@
+package services
+
+import (
+	"app/urtc/db"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// recordedDelivery - A payload saved from a webhook's Recent Deliveries tab
+func recordedDelivery(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", "webhooks", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func parseDelivery(t *testing.T, contentType string, body []byte) *webhookPayload {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/github/webhook", strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", contentType)
+
+	document, err := webhookJSON(r, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(document, &payload); err != nil {
+		t.Fatal(err)
+	}
+	return &payload
+}
+
+func TestDescribeRecordedDeliveries(t *testing.T) {
+	tests := []struct {
+		file        string
+		event       string
+		action      string
+		description string
+		metadata    map[string]interface{}
+	}{
+		{
+			file:        "push.json",
+			event:       "push",
+			action:      "github_push",
+			description: "octocat pushed 2 commits to main on GitHub",
+			metadata: map[string]interface{}{
+				"branch":       "main",
+				"after":        "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+				"commit_count": 2,
+				"forced":       false,
+			},
+		},
+		{
+			file:        "pull_request_merged.json",
+			event:       "pull_request",
+			action:      "github_pull_request",
+			description: "octocat merged pull request #42: Double jump",
+			metadata: map[string]interface{}{
+				"number": 42,
+				"merged": true,
+				"author": "hubot",
+				"head":   "double-jump",
+				"base":   "main",
+			},
+		},
+		{
+			file:        "member_edited.json",
+			event:       "member",
+			action:      "github_member",
+			description: "octocat changed the GitHub access of hubot",
+			metadata: map[string]interface{}{
+				"member":          "hubot",
+				"permission_from": "write",
+				"permission_to":   "admin",
+			},
+		},
+		{
+			file:        "repository_renamed.json",
+			event:       "repository",
+			action:      "github_repository",
+			description: "octocat renamed the GitHub repository to octocat/Platformer",
+			metadata: map[string]interface{}{
+				"repository_action": "renamed",
+				"private":           false,
+			},
+		},
+		{
+			file:        "repository_transferred.json",
+			event:       "repository",
+			action:      "github_repository",
+			description: "octocat transferred the GitHub repository to my-studio/MyUnityGame",
+			metadata: map[string]interface{}{
+				"repository_action": "transferred",
+				"private":           true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			body := recordedDelivery(t, tt.file)
+
+			// GitHub sends the same document as JSON or as a form field, depending on the webhook
+			form := url.Values{"payload": {string(body)}}.Encode()
+			for contentType, delivery := range map[string][]byte{
+				"application/json":                  body,
+				"application/x-www-form-urlencoded": []byte(form),
+			} {
+				described, ok := describeEvent(tt.event, parseDelivery(t, contentType, delivery))
+				if !ok {
+					t.Fatalf("%s: event ignored", contentType)
+				}
+				if described.action != tt.action || described.description != tt.description {
+					t.Errorf("%s: got %s %q, want %s %q", contentType, described.action, described.description, tt.action, tt.description)
+				}
+				for key, want := range tt.metadata {
+					if got := described.metadata[key]; !reflect.DeepEqual(got, want) {
+						t.Errorf("%s: metadata %s = %v, want %v", contentType, key, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDescribeIgnoredDeliveries(t *testing.T) {
+	payload := parseDelivery(t, "application/json", recordedDelivery(t, "ping.json"))
+	if _, ok := describeEvent("ping", payload); ok {
+		t.Error("ping was described")
+	}
+	if _, ok := describeEvent("pull_request", payload); ok {
+		t.Error("pull_request without a pull request was described")
+	}
+}
+
+func TestDescribeExternalSender(t *testing.T) {
+	payload := parseDelivery(t, "application/json", recordedDelivery(t, "push.json"))
+
+	member := describeSender("push", *payload, false)
+	if member.description != "octocat pushed 2 commits to main on GitHub" {
+		t.Errorf("member: %q", member.description)
+	}
+
+	external := describeSender("push", *payload, true)
+	if external.description != "octocat (external) pushed 2 commits to main on GitHub" {
+		t.Errorf("external: %q", external.description)
+	}
+	if payload.Sender.Login != "octocat" {
+		t.Errorf("the payload's sender became %q", payload.Sender.Login)
+	}
+}
+
+func TestPreviousRepoName(t *testing.T) {
+	tests := []struct {
+		file  string
+		owner string
+		name  string
+	}{
+		{"repository_renamed.json", "octocat", "MyUnityGame"},
+		{"repository_transferred.json", "octocat", "MyUnityGame"},
+		{"push.json", "octocat", "MyUnityGame"},
+	}
+
+	for _, tt := range tests {
+		owner, name := previousRepoName(parseDelivery(t, "application/json", recordedDelivery(t, tt.file)))
+		if owner != tt.owner || name != tt.name {
+			t.Errorf("%s: got %s/%s, want %s/%s", tt.file, owner, name, tt.owner, tt.name)
+		}
+	}
+}
+
+func TestSignedProjects(t *testing.T) {
+	body := recordedDelivery(t, "push.json")
+
+	linked := db.Project{ID: uuid.New(), WebhookSecret: "secret-of-the-linked-project"}
+	other := db.Project{ID: uuid.New(), WebhookSecret: "secret-of-another-project"}
+	unsecured := db.Project{ID: uuid.New()}
+	projects := []db.Project{linked, other, unsecured}
+
+	tests := []struct {
+		name      string
+		body      []byte
+		signature string
+		want      []uuid.UUID
+	}{
+		{"signed by the project", body, sign(linked.WebhookSecret, body), []uuid.UUID{linked.ID}},
+		{"signed by another project", body, sign(other.WebhookSecret, body), []uuid.UUID{other.ID}},
+		{"empty secret", body, sign("", body), nil},
+		{"unknown secret", body, sign("guessed", body), nil},
+		{"body changed after signing", []byte(strings.Replace(string(body), "octocat", "hubot", 1)), sign(linked.WebhookSecret, body), nil},
+		{"sha1 signature", body, strings.Replace(sign(linked.WebhookSecret, body), "sha256=", "sha1=", 1), nil},
+		{"no signature", body, "", nil},
+	}
+
+	for _, tt := range tests {
+		var got []uuid.UUID
+		for _, project := range signedProjects(projects, tt.body, tt.signature) {
+			got = append(got, project.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
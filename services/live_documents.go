@@ -0,0 +1,672 @@
+package services
+
+import (
+	"app/urtc/db"
+	"database/sql"
+	"log"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// docHistoryLimit - Operations kept per document for transforming late operations.
+	// Clients further behind than this must reopen the document.
+	docHistoryLimit = 1000
+	docSnapshotMsg  = "Live editing snapshot"
+)
+
+// DocumentPayload - The document part of a co-editing message
+type DocumentPayload struct {
+	FilePath    string         `json:"file_path"`
+	Revision    int            `json:"revision"`
+	Operation   *TextOperation `json:"operation,omitempty"`
+	Content     string         `json:"content,omitempty"`
+	BaseVersion int            `json:"base_version,omitempty"`
+}
+
+type docParticipant struct {
+	client *Client
+}
+
+// liveDocument - Server-held state of a script being co-edited. The server is the single
+// source of truth: every operation is transformed against what the client had not yet
+// seen, applied here and then relayed to the other participants in revision order.
+type liveDocument struct {
+	projectID    uuid.UUID
+	filePath     string
+	fileName     string
+	fileType     string
+	content      string
+	revision     int
+	history      []*TextOperation // operations that produced revisions historyStart+1 .. revision
+	historyStart int
+	baseVersion  int // file_versions version the content was last loaded from or saved to
+	dirty        bool
+	lastEditor   uuid.UUID
+	participants map[string]docParticipant // connectionID -> participant
+	closed       bool
+	loaded       chan struct{} // closed once the content has been read from the database
+	loadErr      error
+	mutex        sync.Mutex
+	saveMutex    sync.Mutex // one snapshot at a time
+}
+
+type documentRegistry struct {
+	docs  map[string]*liveDocument // projectID/filePath -> document
+	mutex sync.Mutex
+}
+
+var liveDocs = &documentRegistry{
+	docs: make(map[string]*liveDocument),
+}
+
+func documentKey(projectID uuid.UUID, filePath string) string {
+	return projectID.String() + "/" + filePath
+}
+
+// contentHash - SHA-256 of file content, hex encoded, as the blob store keys it
+func contentHash(content string) string {
+	return db.HashContent([]byte(content))
+}
+
+// load - Starts the document from the latest version on the default branch, or empty for a new
+// file. Holds the document's lock, not the registry's, so a slow load only holds up this document.
+func (d *liveDocument) load() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	defer close(d.loaded)
+
+	versionModel := &db.VersionModel{DB: db.DB}
+	latest, err := versionModel.GetLatestVersion(d.projectID, d.filePath, nil)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		d.loadErr = err
+		d.closed = true
+		return
+	}
+
+	d.content = latest.Content
+	d.baseVersion = latest.Version
+	d.fileName = latest.FileName
+	d.fileType = latest.FileType
+}
+
+// isLoaded - Reports whether the document is past loading, without waiting for it
+func (d *liveDocument) isLoaded() bool {
+	select {
+	case <-d.loaded:
+		return true
+	default:
+		return false
+	}
+}
+
+// openDocument - Returns the document, loading it first if nobody has it open yet. Others opening
+// it meanwhile wait for the same load.
+func openDocument(projectID uuid.UUID, filePath string) (*liveDocument, error) {
+	key := documentKey(projectID, filePath)
+
+	liveDocs.mutex.Lock()
+	doc, exists := liveDocs.docs[key]
+	if !exists {
+		doc = &liveDocument{
+			projectID:    projectID,
+			filePath:     filePath,
+			fileName:     path.Base(filePath),
+			fileType:     "script",
+			participants: make(map[string]docParticipant),
+			loaded:       make(chan struct{}),
+		}
+		liveDocs.docs[key] = doc
+	}
+	liveDocs.mutex.Unlock()
+
+	if !exists {
+		doc.load()
+		if doc.loadErr != nil {
+			liveDocs.mutex.Lock()
+			if liveDocs.docs[key] == doc {
+				delete(liveDocs.docs, key)
+			}
+			liveDocs.mutex.Unlock()
+		} else {
+			log.Printf("Opened live document %s at version %d", key, doc.baseVersion)
+		}
+	}
+
+	<-doc.loaded
+	if doc.loadErr != nil {
+		return nil, doc.loadErr
+	}
+	return doc, nil
+}
+
+func (d *liveDocument) participantInfos() []ClientInfo {
+	infos := make([]ClientInfo, 0, len(d.participants))
+	for _, p := range d.participants {
+		infos = append(infos, p.client.info())
+	}
+	return infos
+}
+
+// broadcastLocked - Sends a message to every participant except one connection.
+// Called with the document lock held so participants see revisions in order;
+// returns the connections that couldn't take the message so the caller can drop them after unlocking.
+func (d *liveDocument) broadcastLocked(msg Message, exceptConnectionID string) []*Client {
+	var failed []*Client
+	for connectionID, p := range d.participants {
+		if connectionID == exceptConnectionID {
+			continue
+		}
+		if err := p.client.send(msg); err != nil {
+			failed = append(failed, p.client)
+		}
+	}
+	return failed
+}
+
+func dropClients(clients []*Client) {
+	for _, client := range clients {
+		manager.removeClient(client)
+	}
+}
+
+// handleOpenDocument - Joins a connection to a document and sends it the current state
+func handleOpenDocument(client *Client, projectID string, payload *DocumentPayload) {
+	if payload == nil || payload.FilePath == "" {
+		client.sendError("document.file_path is required")
+		return
+	}
+	projectUUID, err := uuid.Parse(projectID)
+	if err != nil {
+		client.sendError("Invalid project_id")
+		return
+	}
+	userUUID, err := uuid.Parse(client.UserID)
+	if err != nil {
+		client.sendError("Invalid user")
+		return
+	}
+
+	role, err := Authorize(userUUID, projectUUID, PermViewProject)
+	if err != nil {
+		client.sendError("Not an approved collaborator on this project")
+		return
+	}
+
+	// A document can be unloaded between opening and joining it; open it again then
+	var doc *liveDocument
+	for {
+		doc, err = openDocument(projectUUID, payload.FilePath)
+		if err != nil {
+			log.Printf("Failed to load document %s: %v", documentKey(projectUUID, payload.FilePath), err)
+			client.sendError("Failed to open document")
+			return
+		}
+
+		doc.mutex.Lock()
+		if !doc.closed {
+			break
+		}
+		doc.mutex.Unlock()
+	}
+
+	canEdit := RoleAllows(role, PermCommit)
+	doc.participants[client.ID] = docParticipant{client: client}
+
+	// Late joiners get the full current text and carry on from its revision
+	client.send(Message{
+		Type:      "doc_state",
+		ProjectID: projectID,
+		Timestamp: getCurrentTimestamp(),
+		Document: &DocumentPayload{
+			FilePath:    doc.filePath,
+			Revision:    doc.revision,
+			Content:     doc.content,
+			BaseVersion: doc.baseVersion,
+		},
+		Metadata: map[string]interface{}{
+			"can_edit":     canEdit,
+			"participants": doc.participantInfos(),
+		},
+	})
+
+	failed := doc.broadcastLocked(Message{
+		Type:      "doc_joined",
+		SenderID:  client.UserID,
+		ProjectID: projectID,
+		Timestamp: getCurrentTimestamp(),
+		Document:  &DocumentPayload{FilePath: doc.filePath, Revision: doc.revision},
+		Metadata: map[string]interface{}{
+			"client": client.info(),
+		},
+	}, client.ID)
+	doc.mutex.Unlock()
+
+	dropClients(failed)
+}
+
+// handleDocumentOperation - Transforms an operation against everything the sender had not
+// seen, applies it, acknowledges it and relays it to the other participants
+func handleDocumentOperation(client *Client, projectID string, payload *DocumentPayload) {
+	if payload == nil || payload.FilePath == "" || payload.Operation == nil {
+		client.sendError("document.file_path and document.operation are required")
+		return
+	}
+	projectUUID, err := uuid.Parse(projectID)
+	if err != nil {
+		client.sendError("Invalid project_id")
+		return
+	}
+
+	userUUID, err := uuid.Parse(client.UserID)
+	if err != nil {
+		client.sendError("Invalid user")
+		return
+	}
+
+	// Checked on every operation, so a role change takes effect mid-session
+	if _, err := Authorize(userUUID, projectUUID, PermCommit); err != nil {
+		client.sendError("Your role on this project does not allow editing")
+		return
+	}
+
+	key := documentKey(projectUUID, payload.FilePath)
+	liveDocs.mutex.Lock()
+	doc, exists := liveDocs.docs[key]
+	liveDocs.mutex.Unlock()
+	if !exists || !doc.isLoaded() {
+		client.sendError("Open the document before editing it")
+		return
+	}
+
+	doc.mutex.Lock()
+	if _, joined := doc.participants[client.ID]; doc.closed || !joined {
+		doc.mutex.Unlock()
+		client.sendError("Open the document before editing it")
+		return
+	}
+
+	// Too far behind (or ahead): the client has to start again from the current state
+	if payload.Revision < doc.historyStart || payload.Revision > doc.revision {
+		revision := doc.revision
+		doc.mutex.Unlock()
+		client.send(Message{
+			Type:      "doc_resync",
+			ProjectID: projectID,
+			Message:   "Document revision is no longer available, reopen the document",
+			Timestamp: getCurrentTimestamp(),
+			Document:  &DocumentPayload{FilePath: payload.FilePath, Revision: revision},
+		})
+		return
+	}
+
+	op := payload.Operation
+	for _, concurrent := range doc.history[payload.Revision-doc.historyStart:] {
+		op, _, err = transformOperations(op, concurrent)
+		if err != nil {
+			break
+		}
+	}
+
+	var content string
+	if err == nil {
+		content, err = op.Apply(doc.content)
+	}
+	if err != nil {
+		revision := doc.revision
+		doc.mutex.Unlock()
+		log.Printf("Rejected operation on %s from connection %s: %v", key, client.ID, err)
+		client.send(Message{
+			Type:      "doc_resync",
+			ProjectID: projectID,
+			Message:   "Operation does not match the document: " + err.Error(),
+			Timestamp: getCurrentTimestamp(),
+			Document:  &DocumentPayload{FilePath: payload.FilePath, Revision: revision},
+		})
+		return
+	}
+
+	if !op.isNoop() {
+		doc.dirty = true
+		doc.lastEditor = userUUID
+	}
+	doc.applyLocked(op, content)
+
+	var failed []*Client
+	if err := client.send(Message{
+		Type:      "doc_ack",
+		ProjectID: projectID,
+		Timestamp: getCurrentTimestamp(),
+		Document:  &DocumentPayload{FilePath: doc.filePath, Revision: doc.revision},
+	}); err != nil {
+		failed = append(failed, client)
+	}
+
+	failed = append(failed, doc.broadcastLocked(Message{
+		Type:               "doc_op",
+		SenderID:           client.UserID,
+		SenderConnectionID: client.ID,
+		ProjectID:          projectID,
+		Timestamp:          getCurrentTimestamp(),
+		Document:           &DocumentPayload{FilePath: doc.filePath, Revision: doc.revision, Operation: op},
+	}, client.ID)...)
+	doc.mutex.Unlock()
+
+	dropClients(failed)
+}
+
+// handleCloseDocument - Removes a connection from a document at its request
+func handleCloseDocument(client *Client, projectID string, payload *DocumentPayload) {
+	if payload == nil || payload.FilePath == "" {
+		client.sendError("document.file_path is required")
+		return
+	}
+	projectUUID, err := uuid.Parse(projectID)
+	if err != nil {
+		client.sendError("Invalid project_id")
+		return
+	}
+
+	leaveDocument(client, documentKey(projectUUID, payload.FilePath))
+	client.send(Message{
+		Type:      "doc_closed",
+		ProjectID: projectID,
+		Timestamp: getCurrentTimestamp(),
+		Document:  &DocumentPayload{FilePath: payload.FilePath},
+	})
+}
+
+// leaveDocument - Removes a participant; the last one out saves and unloads the document
+func leaveDocument(client *Client, key string) {
+	liveDocs.mutex.Lock()
+	doc, exists := liveDocs.docs[key]
+	liveDocs.mutex.Unlock()
+	if !exists || !doc.isLoaded() {
+		return
+	}
+
+	doc.mutex.Lock()
+	if _, joined := doc.participants[client.ID]; !joined {
+		doc.mutex.Unlock()
+		return
+	}
+	delete(doc.participants, client.ID)
+
+	idle := len(doc.participants) == 0
+	var failed []*Client
+	if !idle {
+		failed = doc.broadcastLocked(Message{
+			Type:      "doc_left",
+			SenderID:  client.UserID,
+			ProjectID: doc.projectID.String(),
+			Timestamp: getCurrentTimestamp(),
+			Document:  &DocumentPayload{FilePath: doc.filePath, Revision: doc.revision},
+			Metadata: map[string]interface{}{
+				"client": client.info(),
+			},
+		}, client.ID)
+	}
+	doc.mutex.Unlock()
+
+	if idle {
+		unloadIfIdle(key, doc)
+	}
+	dropClients(failed)
+}
+
+// unloadIfIdle - Saves a document nobody has open any more and drops it from the registry. It stays
+// registered while it is saved, so anyone reopening it meanwhile gets the live text. A document
+// whose save failed stays loaded and is saved again by StartDocumentSnapshots.
+func unloadIfIdle(key string, doc *liveDocument) {
+	snapshotDocument(doc)
+
+	liveDocs.mutex.Lock()
+	defer liveDocs.mutex.Unlock()
+	doc.mutex.Lock()
+	defer doc.mutex.Unlock()
+
+	if doc.closed || doc.dirty || len(doc.participants) > 0 || liveDocs.docs[key] != doc {
+		return
+	}
+	doc.closed = true
+	delete(liveDocs.docs, key)
+	log.Printf("Closed live document %s", key)
+}
+
+// closeClientDocuments - Leaves every document a closed connection had open
+func closeClientDocuments(client *Client) {
+	liveDocs.mutex.Lock()
+	docs := make(map[string]*liveDocument, len(liveDocs.docs))
+	for key, doc := range liveDocs.docs {
+		docs[key] = doc
+	}
+	liveDocs.mutex.Unlock()
+
+	for key, doc := range docs {
+		if !doc.isLoaded() {
+			continue
+		}
+		doc.mutex.Lock()
+		_, joined := doc.participants[client.ID]
+		doc.mutex.Unlock()
+		if joined {
+			leaveDocument(client, key)
+		}
+	}
+}
+
+// applyLocked - Makes op, which turns the text into content, the next revision
+func (d *liveDocument) applyLocked(op *TextOperation, content string) {
+	d.content = content
+	d.revision++
+	d.history = append(d.history, op)
+	if len(d.history) > docHistoryLimit {
+		trim := len(d.history) - docHistoryLimit
+		d.history = d.history[trim:]
+		d.historyStart += trim
+	}
+}
+
+// rebaseLocked - Brings changes committed by others into the live text. saved is the text as of
+// revision; the change from it to target is transformed past the edits made since and applied
+// like any other operation, then relayed to every participant. Returns false if those edits are
+// no longer in the history.
+func (d *liveDocument) rebaseLocked(saved, target string, revision int) (bool, []*Client) {
+	if revision < d.historyStart {
+		return false, nil
+	}
+
+	op := diffOperation(saved, target)
+	var err error
+	for _, concurrent := range d.history[revision-d.historyStart:] {
+		op, _, err = transformOperations(op, concurrent)
+		if err != nil {
+			return false, nil
+		}
+	}
+
+	content, err := op.Apply(d.content)
+	if err != nil {
+		return false, nil
+	}
+	if op.isNoop() {
+		return true, nil
+	}
+
+	d.applyLocked(op, content)
+	return true, d.broadcastLocked(Message{
+		Type:      "doc_op",
+		ProjectID: d.projectID.String(),
+		Timestamp: getCurrentTimestamp(),
+		Document:  &DocumentPayload{FilePath: d.filePath, Revision: d.revision, Operation: op},
+	}, "")
+}
+
+// snapshotDocument - Saves unsaved edits as a new file version on top of the version they started
+// from. Changes committed meanwhile are merged in and brought into the live text; edits that
+// overlap with them are recorded as a conflict and the live text moves on to the latest version.
+func snapshotDocument(doc *liveDocument) {
+	doc.saveMutex.Lock()
+	defer doc.saveMutex.Unlock()
+
+	doc.mutex.Lock()
+	if !doc.dirty {
+		doc.mutex.Unlock()
+		return
+	}
+	content, editor, revision, baseVersion := doc.content, doc.lastEditor, doc.revision, doc.baseVersion
+	doc.dirty = false
+	doc.mutex.Unlock()
+
+	key := documentKey(doc.projectID, doc.filePath)
+
+	// A new file started out empty
+	base := &db.FileVersion{}
+	var err error
+	if baseVersion > 0 {
+		base, err = loadBaseVersion(doc.projectID, doc.filePath, baseVersion)
+	}
+	var result *textCommit
+	if err == nil {
+		result, err = commitText(doc.projectID, editor, db.DefaultRef(), base, doc.filePath, doc.fileName, doc.fileType, "", content, docSnapshotMsg)
+	}
+	if err != nil {
+		log.Printf("Failed to snapshot live document %s: %v", key, err)
+		doc.mutex.Lock()
+		doc.dirty = true
+		doc.mutex.Unlock()
+		return
+	}
+
+	if result.Version == nil {
+		resolveSnapshotConflict(doc, editor, content, revision, result)
+		return
+	}
+
+	doc.mutex.Lock()
+	var failed []*Client
+	rebased := true
+	if result.MergedWith > 0 {
+		rebased, failed = doc.rebaseLocked(content, result.Content, revision)
+	}
+	if rebased {
+		doc.baseVersion = result.Version.Version
+	} else {
+		// The live text lacks the merged changes; the next snapshot merges it again from the old base
+		doc.dirty = true
+	}
+	failed = append(failed, doc.broadcastLocked(Message{
+		Type:      "doc_snapshot",
+		ProjectID: doc.projectID.String(),
+		Timestamp: getCurrentTimestamp(),
+		Document:  &DocumentPayload{FilePath: doc.filePath, Revision: revision, BaseVersion: doc.baseVersion},
+		Metadata: map[string]interface{}{
+			"version_id":          result.Version.ID,
+			"merged_with_version": result.MergedWith,
+		},
+	}, "")...)
+	doc.mutex.Unlock()
+
+	dropClients(failed)
+}
+
+// resolveSnapshotConflict - Records live edits that overlap with a version committed meanwhile
+// and moves the live text on to that version. Edits made after the snapshot are carried over.
+func resolveSnapshotConflict(doc *liveDocument, editor uuid.UUID, content string, revision int, result *textCommit) {
+	key := documentKey(doc.projectID, doc.filePath)
+
+	email := ""
+	userModel := &db.UserModel{DB: db.DB}
+	if user, err := userModel.GetUserByID(editor); err == nil {
+		email = user.EMAIL
+	}
+
+	conflict, err := recordConflict(doc.projectID, db.DefaultBranch, doc.filePath, editor, email, content, result)
+	if err != nil {
+		doc.mutex.Lock()
+		doc.dirty = true
+		doc.mutex.Unlock()
+		return
+	}
+	log.Printf("Live document %s conflicts with version %d, recorded as %s", key, result.Latest.Version, conflict.ID)
+
+	latest := ""
+	if !result.Latest.IsDeleted {
+		latest = result.Latest.Content
+	}
+
+	// Edits made since the snapshot keep the document dirty
+	doc.mutex.Lock()
+	rebased, failed := doc.rebaseLocked(content, latest, revision)
+	if !rebased {
+		// Too far behind to carry the newest edits over; everyone starts again from the latest version
+		log.Printf("Live document %s reset to version %d", key, result.Latest.Version)
+		doc.content = latest
+		doc.revision++
+		doc.history = nil
+		doc.historyStart = doc.revision
+		doc.dirty = false
+		failed = doc.broadcastLocked(Message{
+			Type:      "doc_resync",
+			ProjectID: doc.projectID.String(),
+			Message:   "Document was replaced by a newer version, reopen the document",
+			Timestamp: getCurrentTimestamp(),
+			Document:  &DocumentPayload{FilePath: doc.filePath, Revision: doc.revision},
+		}, "")
+	}
+	doc.baseVersion = result.Latest.Version
+	failed = append(failed, doc.broadcastLocked(Message{
+		Type:      "doc_conflict",
+		ProjectID: doc.projectID.String(),
+		Message:   "Live edits overlap with a newer version and were saved as a conflict",
+		Timestamp: getCurrentTimestamp(),
+		Document:  &DocumentPayload{FilePath: doc.filePath, Revision: doc.revision, BaseVersion: doc.baseVersion},
+		Metadata: map[string]interface{}{
+			"conflict_id":    conflict.ID,
+			"latest_version": result.Latest.Version,
+			"conflict_count": len(result.Hunks),
+		},
+	}, "")...)
+	doc.mutex.Unlock()
+
+	dropClients(failed)
+}
+
+// StartDocumentSnapshots - Periodically saves every open document with unsaved edits, and unloads
+// the ones left open only because an earlier save failed
+func StartDocumentSnapshots(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			liveDocs.mutex.Lock()
+			docs := make(map[string]*liveDocument, len(liveDocs.docs))
+			for key, doc := range liveDocs.docs {
+				docs[key] = doc
+			}
+			liveDocs.mutex.Unlock()
+
+			for key, doc := range docs {
+				if !doc.isLoaded() {
+					continue
+				}
+				doc.mutex.Lock()
+				idle := len(doc.participants) == 0
+				doc.mutex.Unlock()
+
+				if idle {
+					unloadIfIdle(key, doc)
+				} else {
+					snapshotDocument(doc)
+				}
+			}
+		}
+	}()
+}
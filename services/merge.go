@@ -0,0 +1,261 @@
+package services
+
+import (
+	"strings"
+)
+
+const (
+	// maxDiffEdits - Beyond this many differing lines the middle of a file is treated as
+	// rewritten wholesale instead of searched for common lines
+	maxDiffEdits = 2000
+
+	conflictMarkerLocal  = "<<<<<<< local"
+	conflictMarkerBase   = "||||||| base"
+	conflictMarkerSplit  = "======="
+	conflictMarkerRemote = ">>>>>>> remote"
+)
+
+// MergeHunk - A region both sides changed differently. Line numbers are 1-based;
+// a count of 0 means the side inserted nothing there.
+type MergeHunk struct {
+	BaseStart   int    `json:"base_start"`
+	BaseCount   int    `json:"base_count"`
+	LocalStart  int    `json:"local_start"`
+	LocalCount  int    `json:"local_count"`
+	RemoteStart int    `json:"remote_start"`
+	RemoteCount int    `json:"remote_count"`
+	MergedStart int    `json:"merged_start"` // first line of the conflict block in the merged content
+	MergedCount int    `json:"merged_count"` // lines in the block, markers included
+	Base        string `json:"base"`
+	Local       string `json:"local"`
+	Remote      string `json:"remote"`
+}
+
+// mergeText - Line-based three-way merge (diff3). Changes made by only one side, or made
+// identically by both, are taken; regions both sides changed differently are wrapped in
+// conflict markers and reported as hunks.
+func mergeText(base, local, remote string) (string, []MergeHunk) {
+	baseLines := splitLinesKeepEnds(base)
+	localLines := splitLinesKeepEnds(local)
+	remoteLines := splitLinesKeepEnds(remote)
+
+	toLocal := matchLines(baseLines, localLines)
+	toRemote := matchLines(baseLines, remoteLines)
+
+	var merged []string
+	var hunks []MergeHunk
+	i, a, b := 0, 0, 0
+
+	for i < len(baseLines) || a < len(localLines) || b < len(remoteLines) {
+		// Next base line both sides kept; everything before it is one chunk
+		next := i
+		for next < len(baseLines) && (toLocal[next] < 0 || toRemote[next] < 0) {
+			next++
+		}
+
+		localEnd, remoteEnd := len(localLines), len(remoteLines)
+		if next < len(baseLines) {
+			localEnd, remoteEnd = toLocal[next], toRemote[next]
+		}
+
+		if next == i && localEnd == a && remoteEnd == b {
+			// Stable line
+			merged = append(merged, baseLines[i])
+			i, a, b = i+1, a+1, b+1
+			continue
+		}
+
+		baseChunk, localChunk, remoteChunk := baseLines[i:next], localLines[a:localEnd], remoteLines[b:remoteEnd]
+		switch {
+		case linesEqual(localChunk, baseChunk):
+			merged = append(merged, remoteChunk...)
+		case linesEqual(remoteChunk, baseChunk), linesEqual(localChunk, remoteChunk):
+			merged = append(merged, localChunk...)
+		default:
+			hunk := MergeHunk{
+				BaseStart:   i + 1,
+				BaseCount:   len(baseChunk),
+				LocalStart:  a + 1,
+				LocalCount:  len(localChunk),
+				RemoteStart: b + 1,
+				RemoteCount: len(remoteChunk),
+				MergedStart: len(merged) + 1,
+				Base:        strings.Join(baseChunk, ""),
+				Local:       strings.Join(localChunk, ""),
+				Remote:      strings.Join(remoteChunk, ""),
+			}
+
+			block := []string{conflictMarkerLocal + "\n"}
+			block = appendTerminated(block, localChunk)
+			block = append(block, conflictMarkerBase+"\n")
+			block = appendTerminated(block, baseChunk)
+			block = append(block, conflictMarkerSplit+"\n")
+			block = appendTerminated(block, remoteChunk)
+			block = append(block, conflictMarkerRemote+"\n")
+
+			hunk.MergedCount = len(block)
+			merged = append(merged, block...)
+			hunks = append(hunks, hunk)
+		}
+
+		i, a, b = next, localEnd, remoteEnd
+	}
+
+	return strings.Join(merged, ""), hunks
+}
+
+// mergeWithDeletion - Local edits to a file the other side deleted. There is nothing left to merge
+// them into, so the whole file is one conflict.
+func mergeWithDeletion(base, local string) (string, []MergeHunk) {
+	baseLines, localLines := splitLinesKeepEnds(base), splitLinesKeepEnds(local)
+
+	block := []string{conflictMarkerLocal + "\n"}
+	block = appendTerminated(block, localLines)
+	block = append(block, conflictMarkerBase+"\n")
+	block = appendTerminated(block, baseLines)
+	block = append(block, conflictMarkerSplit+"\n", conflictMarkerRemote+"\n")
+
+	hunk := MergeHunk{
+		BaseStart:   1,
+		BaseCount:   len(baseLines),
+		LocalStart:  1,
+		LocalCount:  len(localLines),
+		RemoteStart: 1,
+		MergedStart: 1,
+		MergedCount: len(block),
+		Base:        base,
+		Local:       local,
+	}
+	return strings.Join(block, ""), []MergeHunk{hunk}
+}
+
+// appendTerminated - Appends lines, making sure the last one ends in a newline so a marker can follow
+func appendTerminated(dst, lines []string) []string {
+	for i, line := range lines {
+		if i == len(lines)-1 && !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		dst = append(dst, line)
+	}
+	return dst
+}
+
+func linesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// matchLines - For every line of a, the index of the line it corresponds to in b (or -1),
+// following a shortest edit script. Matches are strictly increasing.
+func matchLines(a, b []string) []int {
+	matches := make([]int, len(a))
+	for i := range matches {
+		matches[i] = -1
+	}
+
+	// Common prefix and suffix cover most real edits and keep the search small
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		matches[prefix] = prefix
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		matches[len(a)-1-suffix] = len(b) - 1 - suffix
+		suffix++
+	}
+
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	for _, pair := range myersMatches(midA, midB) {
+		matches[prefix+pair[0]] = prefix + pair[1]
+	}
+	return matches
+}
+
+// myersMatches - Matched line pairs from Myers' O((N+M)D) diff. Gives up (no matches)
+// if the inputs differ by more than maxDiffEdits lines.
+func myersMatches(a, b []string) [][2]int {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return nil
+	}
+
+	maxD := n + m
+	if maxD > maxDiffEdits {
+		maxD = maxDiffEdits
+	}
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+	var trace [][]int
+
+	for d := 0; d <= maxD; d++ {
+		// Round d only reads diagonals -d..d of the previous round
+		snapshot := make([]int, 2*d+1)
+		copy(snapshot, v[offset-d:offset+d+1])
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				return backtrackMatches(a, b, trace, d)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrackMatches(a, b []string, trace [][]int, d int) [][2]int {
+	var pairs [][2]int
+	x, y := len(a), len(b)
+
+	for ; d > 0; d-- {
+		v := trace[d] // indexed by k + d
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[d+k-1] < v[d+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[d+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			pairs = append(pairs, [2]int{x, y})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		pairs = append(pairs, [2]int{x, y})
+	}
+
+	// Collected back to front
+	for i, j := 0, len(pairs)-1; i < j; i, j = i+1, j-1 {
+		pairs[i], pairs[j] = pairs[j], pairs[i]
+	}
+	return pairs
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"app/urtc/db"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultMessageRetention = 7 * 24 * time.Hour
+	replayBatchSize         = 500
+
+	// Caps on what is stored for one recipient; messages beyond them are only sent live.
+	// A full queue still replays in one batch.
+	maxQueuedMessages     = replayBatchSize
+	maxQueuedMessageBytes = 256 << 10
+	maxQueuedBytes        = 16 << 20
+)
+
+// ephemeralMessageTypes - Presence and session chatter that is meaningless once the moment has passed.
+// Every other message sent to a specific user is stored until that user acknowledges it.
+var ephemeralMessageTypes = map[string]bool{
+	"typing":             true,
+	"pong":               true,
+	"error":              true,
+	"connection_success": true,
+	"joined_project":     true,
+	"left_project":       true,
+	"member_joined":      true,
+	"member_left":        true,
+	"project_message":    true,
+	"session_revoked":    true,
+	"doc_state":          true,
+	"doc_op":             true,
+	"doc_ack":            true,
+	"doc_resync":         true,
+	"doc_joined":         true,
+	"doc_left":           true,
+	"doc_closed":         true,
+	"doc_snapshot":       true,
+	"github_event":       true,
+}
+
+// messageRetention - How long undelivered messages are kept, configurable through MESSAGE_RETENTION_HOURS
+func messageRetention() time.Duration {
+	if hours, err := strconv.Atoi(os.Getenv("MESSAGE_RETENTION_HOURS")); err == nil && hours > 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return defaultMessageRetention
+}
+
+func isDurableMessage(msg Message) bool {
+	return msg.RecipientID != "" && !ephemeralMessageTypes[msg.Type]
+}
+
+// persistMessage - Stores a durable message and stamps it with the queue ID clients acknowledge
+func persistMessage(msg *Message) {
+	recipientID, err := uuid.Parse(msg.RecipientID)
+	if err != nil {
+		return
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to encode %s message for %s: %v", msg.Type, msg.RecipientID, err)
+		return
+	}
+
+	if len(payload) > maxQueuedMessageBytes {
+		log.Printf("Not queueing %s message for %s: %d bytes is over the limit", msg.Type, msg.RecipientID, len(payload))
+		return
+	}
+
+	queueModel := &db.MessageQueueModel{DB: db.DB}
+	queued, err := queueModel.EnqueueMessage(
+		recipientID, msg.Type, payload, time.Now().Add(messageRetention()), maxQueuedMessages, maxQueuedBytes,
+	)
+	if err == db.ErrQueueFull {
+		log.Printf("Not queueing %s message for %s: their queue is full", msg.Type, msg.RecipientID)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to queue %s message for %s: %v", msg.Type, msg.RecipientID, err)
+		return
+	}
+
+	msg.MessageID = queued.ID.String()
+}
+
+// markMessageDelivered - Records that a queued message reached at least one connection
+func markMessageDelivered(messageID string) {
+	id, err := uuid.Parse(messageID)
+	if err != nil {
+		return
+	}
+
+	queueModel := &db.MessageQueueModel{DB: db.DB}
+	if err := queueModel.MarkDelivered(id); err != nil {
+		log.Printf("Failed to mark message %s delivered: %v", messageID, err)
+	}
+}
+
+// acknowledgeMessage - Handles an "ack" from a client; any of the user's devices can acknowledge
+func acknowledgeMessage(client *Client, messageID string) {
+	id, err := uuid.Parse(messageID)
+	if err != nil {
+		client.sendError("Invalid message_id")
+		return
+	}
+	userID, err := uuid.Parse(client.UserID)
+	if err != nil {
+		return
+	}
+
+	queueModel := &db.MessageQueueModel{DB: db.DB}
+	if err := queueModel.AcknowledgeMessage(id, userID); err != nil {
+		log.Printf("Ack for message %s from user %s not applied: %v", messageID, client.UserID, err)
+	}
+}
+
+// replayQueuedMessages - Sends every unacknowledged message to a freshly connected client, oldest
+// first, skipping those an earlier pass already sent. Runs before the client's writer starts.
+func replayQueuedMessages(client *Client) {
+	userID, err := uuid.Parse(client.UserID)
+	if err != nil {
+		return
+	}
+
+	queueModel := &db.MessageQueueModel{DB: db.DB}
+	pending, err := queueModel.GetPendingMessages(userID, replayBatchSize)
+	if err != nil {
+		log.Printf("Failed to load queued messages for %s: %v", client.UserID, err)
+		return
+	}
+
+	replayed := 0
+	for _, queued := range pending {
+		if client.replayed[queued.ID.String()] {
+			continue
+		}
+
+		var msg Message
+		if err := json.Unmarshal(queued.Payload, &msg); err != nil {
+			log.Printf("Skipping unreadable queued message %s: %v", queued.ID, err)
+			continue
+		}
+		msg.MessageID = queued.ID.String()
+		msg.Replayed = true
+
+		if err := client.writeJSON(msg); err != nil {
+			log.Printf("Replay to %s (connection %s) failed: %v", client.UserID, client.ID, err)
+			return
+		}
+		client.replayed[msg.MessageID] = true
+		replayed++
+		if queued.DeliveredAt == nil {
+			markMessageDelivered(msg.MessageID)
+		}
+	}
+
+	if replayed > 0 {
+		log.Printf("Replayed %d queued messages to user %s", replayed, client.UserID)
+	}
+}
+
+// StartMessageQueueCleanup - Periodically purges acknowledged messages and those past the retention window
+func StartMessageQueueCleanup(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		queueModel := &db.MessageQueueModel{DB: db.DB}
+		for range ticker.C {
+			removed, err := queueModel.DeleteExpiredMessages(time.Now())
+			if err != nil {
+				log.Printf("Message queue cleanup failed: %v", err)
+				continue
+			}
+			if removed > 0 {
+				log.Printf("Message queue cleanup removed %d messages", removed)
+			}
+		}
+	}()
+}
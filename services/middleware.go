@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,7 +25,7 @@ func CORS(next http.Handler) http.Handler {
 
 		w.Header().Set("Access-Control-Allow-Origin", allowedOrigins)
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-User-ID, X-Project-ID")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-User-ID, X-Project-ID, X-Chunk-SHA256")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		// Handle preflight
@@ -200,9 +201,6 @@ func AuthRequired(next http.Handler) http.Handler {
 		}
 
 		token := parts[1]
-
-		// Validate token (implement your token validation logic)
-		// For now, we'll just check if it's not empty
 		if token == "" {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusUnauthorized)
@@ -212,9 +210,19 @@ func AuthRequired(next http.Handler) http.Handler {
 			return
 		}
 
-		// Add token to context for use in handlers
-		ctx := context.WithValue(r.Context(), "token", token)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		// Resolve the session token to a user; expired and revoked sessions are rejected
+		session, user, err := ResolveSession(token)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Invalid or expired session",
+			})
+			return
+		}
+
+		// Add session and user to context for use in handlers
+		next.ServeHTTP(w, withSession(r, session, user))
 	})
 }
 
@@ -275,6 +283,44 @@ func JSONContentType(next http.Handler) http.Handler {
 	})
 }
 
+// defaultMaxRequestBodyMB - Largest request body unless MAX_REQUEST_BODY_MB says otherwise
+const defaultMaxRequestBodyMB = 32
+
+// bodyLimitExempt - Routes that read their body with their own limit
+var bodyLimitExempt = map[string]bool{
+	"/version/upload/chunk": true,
+}
+
+// Body Size Limit Middleware - Rejects request bodies over MAX_REQUEST_BODY_MB; larger files go
+// through chunked uploads
+func BodySizeLimit(next http.Handler) http.Handler {
+	limit := int64(defaultMaxRequestBodyMB) << 20
+	if mb, err := strconv.ParseInt(os.Getenv("MAX_REQUEST_BODY_MB"), 10, 64); err == nil && mb > 0 {
+		limit = mb << 20
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bodyLimitExempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.ContentLength > limit {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":            "Request body too large; use /version/upload for large files",
+				"max_request_size": limit,
+			})
+			return
+		}
+
+		// Bodies without a length are cut off at the limit while being read
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
 // Security Headers Middleware
 func SecurityHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,694 @@
+package services
+
+import (
+	"app/urtc/db"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Patch types accepted in place of full file content
+const (
+	PatchTypeJSON = "json_patch" // RFC 6902 JSON Patch, for scene and asset JSON
+	PatchTypeText = "text_diff"  // unified diff, for scripts and other text
+)
+
+// Machine-readable patch error codes
+const (
+	PatchErrInvalid         = "invalid_patch"
+	PatchErrUnsupported     = "unsupported_patch_type"
+	PatchErrBaseRequired    = "base_version_required"
+	PatchErrBaseNotFound    = "base_not_found"
+	PatchErrStaleBase       = "stale_base_version"
+	PatchErrBaseNotJSON     = "base_not_json"
+	PatchErrApplyFailed     = "patch_apply_failed"
+	PatchErrTestFailed      = "patch_test_failed"
+	PatchErrHashRequired    = "file_hash_required"
+	PatchErrHashMismatch    = "hash_mismatch"
+	PatchErrPathRequired    = "file_path_required"
+	PatchErrProjectRequired = "project_id_required"
+	PatchErrBinaryFile      = "binary_file"
+)
+
+// PatchError - Why a delta was rejected, returned to the client as {"error", "code", "details"}
+type PatchError struct {
+	Status  int
+	Code    string
+	Message string
+	Details map[string]interface{}
+}
+
+func (e *PatchError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newPatchError(status int, code, message string) *PatchError {
+	return &PatchError{Status: status, Code: code, Message: message}
+}
+
+func writePatchError(w http.ResponseWriter, perr *PatchError) {
+	body := map[string]interface{}{
+		"success": false,
+		"error":   perr.Message,
+		"code":    perr.Code,
+	}
+	if perr.Details != nil {
+		body["details"] = perr.Details
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(perr.Status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// resolvePatch - Applies a delta to the latest version of a file on a branch. The delta must be made
+// against that exact version and the result must match the hash the client computed.
+func resolvePatch(projectID uuid.UUID, ref *db.Ref, filePath string, baseVersion int, patchType string, patch json.RawMessage, fileHash string) (string, *db.FileVersion, *PatchError) {
+	if filePath == "" {
+		return "", nil, newPatchError(http.StatusBadRequest, PatchErrPathRequired, "file_path is required for patches")
+	}
+	if baseVersion <= 0 {
+		return "", nil, newPatchError(http.StatusBadRequest, PatchErrBaseRequired, "base_version is required for patches")
+	}
+	if fileHash == "" {
+		return "", nil, newPatchError(http.StatusBadRequest, PatchErrHashRequired, "file_hash of the patched file is required")
+	}
+
+	versionModel := &db.VersionModel{DB: db.DB}
+	latest, err := versionModel.GetLatestVersion(projectID, filePath, ref)
+	if err == sql.ErrNoRows {
+		return "", nil, newPatchError(http.StatusNotFound, PatchErrBaseNotFound, "No committed version of "+filePath+" to patch")
+	}
+	if err != nil {
+		return "", nil, newPatchError(http.StatusInternalServerError, PatchErrApplyFailed, "Failed to load base version")
+	}
+
+	if latest.Version != baseVersion {
+		perr := newPatchError(http.StatusConflict, PatchErrStaleBase, "Patch was made against an older version; fetch the latest version and rebase")
+		perr.Details = map[string]interface{}{
+			"base_version":   baseVersion,
+			"latest_version": latest.Version,
+			"latest_hash":    latest.FileHash,
+		}
+		return "", latest, perr
+	}
+
+	if latest.IsBinary {
+		return "", latest, newPatchError(http.StatusUnprocessableEntity, PatchErrBinaryFile, filePath+" is a binary file; upload a new version instead of a patch")
+	}
+
+	content, perr := applyPatch(latest.Content, patchType, patch)
+	if perr != nil {
+		return "", latest, perr
+	}
+
+	if perr := checkContentHash(content, fileHash); perr != nil {
+		perr.Message = "Patched content does not match file_hash"
+		return "", latest, perr
+	}
+
+	return content, latest, nil
+}
+
+// checkContentHash - The server hashes everything it stores itself; a hash sent by the client
+// only has to agree with it
+func checkContentHash(content, fileHash string) *PatchError {
+	if fileHash == "" {
+		return nil
+	}
+
+	if actual := contentHash(content); !strings.EqualFold(actual, fileHash) {
+		perr := newPatchError(http.StatusUnprocessableEntity, PatchErrHashMismatch, "Content does not match file_hash")
+		perr.Details = map[string]interface{}{
+			"expected_hash": fileHash,
+			"actual_hash":   actual,
+		}
+		return perr
+	}
+	return nil
+}
+
+// applyPatch - Applies a delta of the given type to some content
+func applyPatch(content, patchType string, patch json.RawMessage) (string, *PatchError) {
+	switch patchType {
+	case PatchTypeJSON:
+		var ops []jsonPatchOp
+		if err := json.Unmarshal(patch, &ops); err != nil {
+			return "", newPatchError(http.StatusBadRequest, PatchErrInvalid, "JSON patch must be an array of operations")
+		}
+		return applyJSONPatch(content, ops)
+
+	case PatchTypeText:
+		var diff string
+		if err := json.Unmarshal(patch, &diff); err != nil {
+			return "", newPatchError(http.StatusBadRequest, PatchErrInvalid, "Text diff must be a string in unified diff format")
+		}
+		return applyUnifiedDiff(content, diff)
+
+	default:
+		perr := newPatchError(http.StatusBadRequest, PatchErrUnsupported, "Unsupported patch_type "+strconv.Quote(patchType))
+		perr.Details = map[string]interface{}{
+			"supported": []string{PatchTypeJSON, PatchTypeText},
+		}
+		return "", perr
+	}
+}
+
+// JSON Patch (RFC 6902)
+
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// applyJSONPatch - Applies the operations in order; the whole patch fails if any operation does.
+// The result is written in canonical form: object keys sorted, no insignificant whitespace,
+// numbers exactly as they were written.
+func applyJSONPatch(content string, ops []jsonPatchOp) (string, *PatchError) {
+	doc, err := decodeJSON([]byte(content))
+	if err != nil {
+		return "", newPatchError(http.StatusUnprocessableEntity, PatchErrBaseNotJSON, "Base version is not valid JSON")
+	}
+
+	for i, op := range ops {
+		doc, err = applyJSONPatchOp(doc, op)
+		if err != nil {
+			code := PatchErrApplyFailed
+			if op.Op == "test" {
+				code = PatchErrTestFailed
+			}
+			perr := newPatchError(http.StatusUnprocessableEntity, code, err.Error())
+			perr.Details = map[string]interface{}{
+				"operation_index": i,
+				"op":              op.Op,
+				"path":            op.Path,
+			}
+			return "", perr
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return "", newPatchError(http.StatusUnprocessableEntity, PatchErrApplyFailed, "Failed to encode patched document")
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("trailing data after JSON value")
+	}
+	return value, nil
+}
+
+func applyJSONPatchOp(doc interface{}, op jsonPatchOp) (interface{}, error) {
+	path, err := parseJSONPointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, fmt.Errorf("%s operation requires a value", op.Op)
+		}
+		value, err := decodeJSON(op.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value: %v", err)
+		}
+
+		switch op.Op {
+		case "add":
+			return addJSONValue(doc, path, value)
+		case "replace":
+			return replaceJSONValue(doc, path, value)
+		default:
+			current, err := getJSONValue(doc, path)
+			if err != nil {
+				return nil, err
+			}
+			if !jsonEqual(current, value) {
+				return nil, fmt.Errorf("test failed at %s", op.Path)
+			}
+			return doc, nil
+		}
+
+	case "remove":
+		doc, _, err = removeJSONValue(doc, path)
+		return doc, err
+
+	case "move", "copy":
+		from, err := parseJSONPointer(op.From)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from: %v", err)
+		}
+
+		if op.Op == "move" {
+			if op.Path == op.From {
+				return doc, nil
+			}
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, fmt.Errorf("cannot move %s into one of its own children", op.From)
+			}
+			doc, value, err := removeJSONValue(doc, from)
+			if err != nil {
+				return nil, err
+			}
+			return addJSONValue(doc, path, value)
+		}
+
+		value, err := getJSONValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addJSONValue(doc, path, deepCopyJSON(value))
+
+	default:
+		return nil, fmt.Errorf("unknown operation %q", op.Op)
+	}
+}
+
+// parseJSONPointer - Splits an RFC 6901 pointer into unescaped reference tokens
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+
+	limit := length - 1
+	if allowEnd {
+		limit = length
+	}
+	if index > limit {
+		return 0, fmt.Errorf("array index %d out of range", index)
+	}
+	return index, nil
+}
+
+func getJSONValue(node interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch container := node.(type) {
+		case map[string]interface{}:
+			child, exists := container[token]
+			if !exists {
+				return nil, fmt.Errorf("path member %q not found", token)
+			}
+			node = child
+		case []interface{}:
+			index, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			node = container[index]
+		default:
+			return nil, fmt.Errorf("cannot index into a scalar with %q", token)
+		}
+	}
+	return node, nil
+}
+
+// updateJSONChild - Rewrites the child at path[0] of node with fn and returns the updated node
+func updateJSONChild(node interface{}, path []string, fn func(interface{}, []string) (interface{}, error)) (interface{}, error) {
+	switch container := node.(type) {
+	case map[string]interface{}:
+		child, exists := container[path[0]]
+		if !exists {
+			return nil, fmt.Errorf("path member %q not found", path[0])
+		}
+		updated, err := fn(child, path[1:])
+		if err != nil {
+			return nil, err
+		}
+		container[path[0]] = updated
+		return container, nil
+	case []interface{}:
+		index, err := arrayIndex(path[0], len(container), false)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := fn(container[index], path[1:])
+		if err != nil {
+			return nil, err
+		}
+		container[index] = updated
+		return container, nil
+	default:
+		return nil, fmt.Errorf("cannot index into a scalar with %q", path[0])
+	}
+}
+
+func addJSONValue(node interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	if len(path) > 1 {
+		return updateJSONChild(node, path, func(child interface{}, rest []string) (interface{}, error) {
+			return addJSONValue(child, rest, value)
+		})
+	}
+
+	switch container := node.(type) {
+	case map[string]interface{}:
+		container[path[0]] = value
+		return container, nil
+	case []interface{}:
+		index, err := arrayIndex(path[0], len(container), true)
+		if err != nil {
+			return nil, err
+		}
+		container = append(container, nil)
+		copy(container[index+1:], container[index:])
+		container[index] = value
+		return container, nil
+	default:
+		return nil, fmt.Errorf("cannot add %q to a scalar", path[0])
+	}
+}
+
+func replaceJSONValue(node interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return updateJSONChild(node, path, func(child interface{}, rest []string) (interface{}, error) {
+		if len(rest) == 0 {
+			return value, nil
+		}
+		return replaceJSONValue(child, rest, value)
+	})
+}
+
+func removeJSONValue(node interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the whole document")
+	}
+
+	if len(path) > 1 {
+		var removed interface{}
+		updated, err := updateJSONChild(node, path, func(child interface{}, rest []string) (interface{}, error) {
+			var err error
+			child, removed, err = removeJSONValue(child, rest)
+			return child, err
+		})
+		return updated, removed, err
+	}
+
+	switch container := node.(type) {
+	case map[string]interface{}:
+		removed, exists := container[path[0]]
+		if !exists {
+			return nil, nil, fmt.Errorf("path member %q not found", path[0])
+		}
+		delete(container, path[0])
+		return container, removed, nil
+	case []interface{}:
+		index, err := arrayIndex(path[0], len(container), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		removed := container[index]
+		return append(container[:index], container[index+1:]...), removed, nil
+	default:
+		return nil, nil, fmt.Errorf("cannot remove %q from a scalar", path[0])
+	}
+}
+
+func deepCopyJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			copied[key] = deepCopyJSON(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, child := range v {
+			copied[i] = deepCopyJSON(child)
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
+// jsonEqual - Structural equality for "test"; 1 and 1.0 are the same number
+func jsonEqual(a, b interface{}) bool {
+	numA, aIsNumber := a.(json.Number)
+	numB, bIsNumber := b.(json.Number)
+	if aIsNumber && bIsNumber {
+		fa, errA := numA.Float64()
+		fb, errB := numB.Float64()
+		if errA != nil || errB != nil {
+			return numA == numB
+		}
+		return fa == fb
+	}
+
+	switch va := a.(type) {
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok || len(va) != len(vb) {
+			return false
+		}
+		for key, child := range va {
+			other, exists := vb[key]
+			if !exists || !jsonEqual(child, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok || len(va) != len(vb) {
+			return false
+		}
+		for i := range va {
+			if !jsonEqual(va[i], vb[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
+
+// Unified diff
+
+type diffHunk struct {
+	oldStart, oldCount int
+	newStart, newCount int
+	oldLines, newLines []string // lines including their trailing newline, if any
+}
+
+// applyUnifiedDiff - Applies a unified diff (as produced by `diff -u` or `git diff`) to content.
+// Hunks must match the content exactly at the positions they name; no fuzzy matching is done,
+// so a diff made against different content is rejected instead of being misapplied.
+func applyUnifiedDiff(content, diff string) (string, *PatchError) {
+	hunks, err := parseUnifiedDiff(diff)
+	if err != nil {
+		return "", newPatchError(http.StatusBadRequest, PatchErrInvalid, err.Error())
+	}
+
+	lines := splitLinesKeepEnds(content)
+	var result strings.Builder
+	cursor := 0
+
+	for i, hunk := range hunks {
+		start := hunk.oldStart - 1
+		if hunk.oldCount == 0 {
+			start = hunk.oldStart
+		}
+
+		if start < cursor || start+len(hunk.oldLines) > len(lines) {
+			return "", hunkMismatch(i, hunk, "hunk is out of range or overlaps the previous one")
+		}
+		for j, line := range hunk.oldLines {
+			if lines[start+j] != line {
+				return "", hunkMismatch(i, hunk, fmt.Sprintf("line %d does not match", start+j+1))
+			}
+		}
+
+		for _, line := range lines[cursor:start] {
+			result.WriteString(line)
+		}
+		for _, line := range hunk.newLines {
+			result.WriteString(line)
+		}
+		cursor = start + len(hunk.oldLines)
+	}
+
+	for _, line := range lines[cursor:] {
+		result.WriteString(line)
+	}
+	return result.String(), nil
+}
+
+func hunkMismatch(index int, hunk diffHunk, reason string) *PatchError {
+	perr := newPatchError(http.StatusUnprocessableEntity, PatchErrApplyFailed, "Diff does not apply to the base version: "+reason)
+	perr.Details = map[string]interface{}{
+		"hunk_index": index,
+		"old_start":  hunk.oldStart,
+	}
+	return perr
+}
+
+func splitLinesKeepEnds(content string) []string {
+	lines := strings.SplitAfter(content, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func parseUnifiedDiff(diff string) ([]diffHunk, error) {
+	rawLines := strings.Split(diff, "\n")
+	var hunks []diffHunk
+
+	for i := 0; i < len(rawLines); i++ {
+		line := rawLines[i]
+		if !strings.HasPrefix(line, "@@") {
+			// File headers (---/+++, diff --git, index ...) carry nothing we need
+			continue
+		}
+
+		var hunk diffHunk
+		if err := parseHunkHeader(line, &hunk); err != nil {
+			return nil, err
+		}
+
+		oldLeft, newLeft := hunk.oldCount, hunk.newCount
+		var lastOld, lastNew bool // which side the previous line belonged to, for "\ No newline"
+		for (oldLeft > 0 || newLeft > 0) && i+1 < len(rawLines) {
+			i++
+			body := rawLines[i]
+			if body == "" {
+				// Some tools drop the leading space of empty context lines
+				body = " "
+			}
+
+			text := body[1:] + "\n"
+			switch body[0] {
+			case ' ':
+				hunk.oldLines = append(hunk.oldLines, text)
+				hunk.newLines = append(hunk.newLines, text)
+				oldLeft--
+				newLeft--
+				lastOld, lastNew = true, true
+			case '-':
+				hunk.oldLines = append(hunk.oldLines, text)
+				oldLeft--
+				lastOld, lastNew = true, false
+			case '+':
+				hunk.newLines = append(hunk.newLines, text)
+				newLeft--
+				lastOld, lastNew = false, true
+			case '\\':
+				trimLastNewline(&hunk, lastOld, lastNew)
+			default:
+				return nil, fmt.Errorf("unexpected line in hunk: %q", rawLines[i])
+			}
+		}
+		if oldLeft != 0 || newLeft != 0 {
+			return nil, fmt.Errorf("hunk %q is shorter than its header says", line)
+		}
+
+		// A "\ No newline at end of file" marker may follow the last counted line
+		if i+1 < len(rawLines) && strings.HasPrefix(rawLines[i+1], "\\") {
+			i++
+			trimLastNewline(&hunk, lastOld, lastNew)
+		}
+
+		hunks = append(hunks, hunk)
+	}
+
+	if len(hunks) == 0 {
+		return nil, fmt.Errorf("diff contains no hunks")
+	}
+	return hunks, nil
+}
+
+func trimLastNewline(hunk *diffHunk, oldSide, newSide bool) {
+	if oldSide && len(hunk.oldLines) > 0 {
+		last := len(hunk.oldLines) - 1
+		hunk.oldLines[last] = strings.TrimSuffix(hunk.oldLines[last], "\n")
+	}
+	if newSide && len(hunk.newLines) > 0 {
+		last := len(hunk.newLines) - 1
+		hunk.newLines[last] = strings.TrimSuffix(hunk.newLines[last], "\n")
+	}
+}
+
+// parseHunkHeader - Parses "@@ -oldStart[,oldCount] +newStart[,newCount] @@"
+func parseHunkHeader(line string, hunk *diffHunk) error {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[0] != "@@" || fields[3] != "@@" ||
+		!strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return fmt.Errorf("invalid hunk header %q", line)
+	}
+
+	var err error
+	if hunk.oldStart, hunk.oldCount, err = parseHunkRange(fields[1][1:]); err != nil {
+		return fmt.Errorf("invalid hunk header %q", line)
+	}
+	if hunk.newStart, hunk.newCount, err = parseHunkRange(fields[2][1:]); err != nil {
+		return fmt.Errorf("invalid hunk header %q", line)
+	}
+	return nil
+}
+
+func parseHunkRange(r string) (int, int, error) {
+	start, count := r, "1"
+	if comma := strings.IndexByte(r, ','); comma >= 0 {
+		start, count = r[:comma], r[comma+1:]
+	}
+
+	s, err := strconv.Atoi(start)
+	if err != nil || s < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q", r)
+	}
+	c, err := strconv.Atoi(count)
+	if err != nil || c < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q", r)
+	}
+	return s, c, nil
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"app/urtc/db"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// Permission - An action a user can take on a project
+type Permission string
+
+const (
+	PermViewProject         Permission = "view_project"         // read history, conflicts, collaborators and activity
+	PermShareFiles          Permission = "share_files"          // push files and code to collaborators
+	PermCommit              Permission = "commit"               // create new file versions
+	PermResolveConflicts    Permission = "resolve_conflicts"    // resolve or ignore file conflicts
+	PermManageBranches      Permission = "manage_branches"      // delete branches and tags
+	PermManageCollaborators Permission = "manage_collaborators" // invite, remove and change roles
+	PermManageProject       Permission = "manage_project"       // change project settings such as the file size limit
+	PermDeleteProject       Permission = "delete_project"       // delete the project
+)
+
+var (
+	ErrProjectNotFound = errors.New("project not found")
+	ErrForbidden       = errors.New("permission denied")
+)
+
+// roleRank - Higher roles include every permission of lower ones
+var roleRank = map[string]int{
+	db.RoleViewer:     1,
+	db.RoleEditor:     2,
+	db.RoleMaintainer: 3,
+	db.RoleOwner:      4,
+}
+
+// permissionMinRole - The least privileged role that holds each permission
+var permissionMinRole = map[Permission]string{
+	PermViewProject:         db.RoleViewer,
+	PermShareFiles:          db.RoleEditor,
+	PermCommit:              db.RoleEditor,
+	PermResolveConflicts:    db.RoleMaintainer,
+	PermManageBranches:      db.RoleMaintainer,
+	PermManageCollaborators: db.RoleMaintainer,
+	PermManageProject:       db.RoleOwner,
+	PermDeleteProject:       db.RoleOwner,
+}
+
+// IsValidCollaboratorRole - Roles that can be granted through the collaborators table
+func IsValidCollaboratorRole(role string) bool {
+	return role == db.RoleViewer || role == db.RoleEditor || role == db.RoleMaintainer
+}
+
+// RoleAllows - Checks whether a role holds a permission
+func RoleAllows(role string, perm Permission) bool {
+	minRole, ok := permissionMinRole[perm]
+	if !ok {
+		return false
+	}
+	return roleRank[role] >= roleRank[minRole]
+}
+
+// Authorize - Central permission check; returns the user's role on the project
+func Authorize(userID, projectID uuid.UUID, perm Permission) (string, error) {
+	collabModel := &db.CollaboratorModel{DB: db.DB}
+	role, err := collabModel.GetUserRole(userID, projectID)
+	if err == sql.ErrNoRows {
+		return "", ErrProjectNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !RoleAllows(role, perm) {
+		return role, ErrForbidden
+	}
+
+	return role, nil
+}
+
+// authorizeProject - Runs Authorize for the session user and writes the error response on failure
+func authorizeProject(w http.ResponseWriter, r *http.Request, projectID uuid.UUID, perm Permission) (*db.User, string, bool) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return nil, "", false
+	}
+
+	role, err := Authorize(user.ID, projectID, perm)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		switch err {
+		case ErrProjectNotFound:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Project not found",
+			})
+		case ErrForbidden:
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error":      "You do not have permission to " + permissionDescription(perm),
+				"permission": string(perm),
+			})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Failed to check project permissions",
+			})
+		}
+		return nil, "", false
+	}
+
+	return user, role, true
+}
+
+func permissionDescription(perm Permission) string {
+	switch perm {
+	case PermViewProject:
+		return "view this project"
+	case PermShareFiles:
+		return "share files in this project"
+	case PermCommit:
+		return "commit to this project"
+	case PermResolveConflicts:
+		return "resolve conflicts in this project"
+	case PermManageBranches:
+		return "delete branches and tags of this project"
+	case PermManageCollaborators:
+		return "manage collaborators of this project"
+	case PermManageProject:
+		return "change the settings of this project"
+	case PermDeleteProject:
+		return "delete this project"
+	}
+	return "perform this action"
+}
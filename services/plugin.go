@@ -2,15 +2,51 @@ package services
 
 import (
 	"app/urtc/db"
-	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type MetaUser struct {
-	EMAIL        string `json:"user_email"`
-	PROJECT_NAME string `json:"project_name"`
+	PROJECT_NAME  string `json:"project_name"`
+	Description   string `json:"description"`
+	Private       bool   `json:"private"`
+	Organization  string `json:"organization"`   // create the repository under this organization instead of the user
+	Template      string `json:"template"`       // "owner/name" of a template repository to start from
+	Engine        string `json:"engine"`         // "unity", "godot" or "unreal": start with a README and the engine's .gitignore
+	AutoInit      bool   `json:"auto_init"`      // start with a README
+	DefaultBranch string `json:"default_branch"` // rename the repository's default branch
+}
+
+// engineGitignore - GitHub's .gitignore template for each supported engine
+var engineGitignore = map[string]string{
+	"unity":  "Unity",
+	"godot":  "Godot",
+	"unreal": "UnrealEngine",
+}
+
+// branchWaitAttempts - How many seconds to wait for a repository generated from a template to get its branch
+const branchWaitAttempts = 10
+
+// waitForBranch - GitHub fills a repository generated from a template in the background; its
+// default branch can't be renamed before it exists
+func waitForBranch(ctx context.Context, client GitHubClient, owner, repo, branch string) error {
+	for attempt := 0; ; attempt++ {
+		_, err := client.GetBranchHead(ctx, owner, repo, branch)
+		if err != ErrGitHubNotFound || attempt == branchWaitAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
 }
 
 // type CollabRequest struct {
@@ -23,94 +59,252 @@ type MetaUser struct {
 // 	Status   string `json:"status"`
 // }
 
+// PushProject - Creates a project with a new GitHub repository linked to it
 func PushProject(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
 
 	var metaUser MetaUser
-	json.NewDecoder(r.Body).Decode(&metaUser)
-
-	userModel := &db.UserModel{
-		DB: db.DB,
+	if err := json.NewDecoder(r.Body).Decode(&metaUser); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request body",
+		})
+		return
 	}
-	user, err := userModel.GetUserByEmail(metaUser.EMAIL)
-	if err != nil {
-		fmt.Println("Error : ", err)
+	if strings.TrimSpace(metaUser.PROJECT_NAME) == "" {
 		w.WriteHeader(http.StatusBadRequest)
-	} else {
-		fmt.Println(user.USERNAME, user.ID, user.GITHUB_ID, user.EMAIL, user.CREATED_AT)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "project_name is required",
+		})
+		return
+	}
 
-		//starting a new project from here
-		projectModel := &db.ProjectModel{
-			DB: db.DB,
+	options := GitHubRepoOptions{
+		Name:        metaUser.PROJECT_NAME,
+		Description: metaUser.Description,
+		Private:     metaUser.Private,
+		AutoInit:    metaUser.AutoInit,
+	}
+	if metaUser.Engine != "" {
+		gitignore, ok := engineGitignore[strings.ToLower(metaUser.Engine)]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "engine must be 'unity', 'godot' or 'unreal'",
+			})
+			return
 		}
+		options.AutoInit, options.GitignoreTemplate = true, gitignore
+	}
 
-		tokenModel := &db.TokenModel{
-			DB: db.DB,
+	var templateOwner, templateRepo string
+	if metaUser.Template != "" {
+		parts := strings.Split(metaUser.Template, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "template must be 'owner/name'",
+			})
+			return
 		}
-
-		token, err := tokenModel.GetToken(user.USERNAME)
-		if err != nil {
-			fmt.Println("Error Fetching Token : ", err)
+		if options.AutoInit {
 			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "A template can't be combined with auto_init or engine",
+			})
 			return
 		}
+		templateOwner, templateRepo = parts[0], parts[1]
+	} else if metaUser.DefaultBranch != "" {
+		// GitHub can only rename a branch that exists, so the repository gets a first commit
+		options.AutoInit = true
+	}
+
+	projectModel := &db.ProjectModel{DB: db.DB}
+	tokenModel := &db.TokenModel{DB: db.DB}
+
+	token, err := tokenModel.GetToken(user.USERNAME)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "No GitHub token stored; log in with GitHub again",
+		})
+		return
+	}
+
+	//Check if a project by this name already exists
+	if _, err := projectModel.GetProjectByName(user.ID, metaUser.PROJECT_NAME); err == nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "You already have a project with this name",
+			"name":  metaUser.PROJECT_NAME,
+		})
+		return
+	} else if err != sql.ErrNoRows {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to check existing projects",
+		})
+		return
+	}
+
+	ctx := r.Context()
+	client := newGitHubClient(token.GITHUB_TOKEN)
 
-		//Check if a project by this name already exists
-		project, err := projectModel.GetProjectByName(user.ID, metaUser.PROJECT_NAME)
-		if err != nil {
-			project, err := projectModel.CreateProject(user.ID, metaUser.PROJECT_NAME, metaUser.PROJECT_NAME)
-			if err != nil {
-				fmt.Println("Error : ", err)
-				w.WriteHeader(http.StatusInternalServerError)
-			}
-			fmt.Println("Project Created Succesfully")
-
-			//Start Initializing a github repo here
-			payload := map[string]interface{}{
-				"name":    metaUser.PROJECT_NAME,
-				"private": false,
-			}
-
-			body, _ := json.Marshal(payload)
-
-			req, _ := http.NewRequest("POST", "https://api.github.com/user/repos", bytes.NewBuffer(body))
-			req.Header.Set("Authorization", "token "+token.GITHUB_TOKEN)
-			req.Header.Set("Accept", "application/vnd.github.v3+json")
-
-			client := &http.Client{}
-			resp, err := client.Do(req)
-			if err != nil {
-				fmt.Println("Error:", err)
-				return
-			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode == 201 {
-				fmt.Println("Repository created successfully!")
-			} else {
-				fmt.Println("Failed to create repository. Status:", resp.Status)
-			}
-
-			var repos struct {
-				Name    string `json:"name"`
-				HTMLURL string `json:"html_url"` // This is the repo link
-			}
-
-			if err := json.NewDecoder(resp.Body).Decode(&repos); err != nil {
-				http.Error(w, "Failed to parse repos", http.StatusInternalServerError)
-				return
-			}
-
-			fmt.Fprintln(w, "success : ", http.StatusOK)
-			fmt.Fprintln(w, "message : Collaboration started successfully for project ", project.Name)
-			fmt.Fprintln(w, "project_id : ", project.ID)
-			fmt.Fprintf(w, "github repo URL: %s", repos.HTMLURL)
+	owner := metaUser.Organization
+	if owner == "" {
+		owner = user.USERNAME
+	}
 
+	var repo *GitHubRepository
+	if templateOwner != "" {
+		repo, err = client.GenerateRepository(ctx, templateOwner, templateRepo, owner, options)
+	} else {
+		repo, err = client.CreateRepository(ctx, metaUser.Organization, options)
+	}
+
+	pushed := db.PushedRepo{
+		OwnerID:           user.ID,
+		Private:           options.Private,
+		Template:          metaUser.Template,
+		GitignoreTemplate: options.GitignoreTemplate,
+		AutoInit:          options.AutoInit,
+	}
+	if err == nil {
+		pushed.RepoID = repo.ID
+		if err := projectModel.RecordPushedRepo(pushed); err != nil {
+			log.Printf("Failed to record repository %s as created for a push: %v", repo.FullName, err)
+		}
+	}
+
+	// A repository an earlier push created and then failed to link is picked up, but only with
+	// the settings this push asks for
+	reused := false
+	if apiErr, ok := err.(*GitHubError); ok && apiErr.Status == http.StatusUnprocessableEntity {
+		existing, differs := pushedRepository(ctx, client, owner, metaUser.PROJECT_NAME, pushed)
+		if differs {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error":    "A repository from an earlier push exists with different settings; push with the same private, template, engine and auto_init",
+				"repo_url": existing.HTMLURL,
+			})
+			return
+		}
+		if existing != nil {
+			repo, err, reused = existing, nil, true
+		}
+	}
+	if err == ErrGitHubNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Template repository or organization not found, or your GitHub account can't use it",
+		})
+		return
+	}
+	if apiErr, ok := err.(*GitHubError); ok && apiErr.Status == http.StatusUnprocessableEntity {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":  "GitHub refused the repository; a repository with this name may already exist",
+			"detail": apiErr.Message,
+		})
+		return
+	}
+	if err != nil {
+		writeGitHubFailure(w, "Failed to create the repository", err)
+		return
+	}
+
+	// A rename that fails leaves the repository usable on the branch GitHub picked
+	var notes []string
+	if metaUser.DefaultBranch != "" && metaUser.DefaultBranch != repo.DefaultBranch {
+		err := waitForBranch(ctx, client, repo.Owner.Login, repo.Name, repo.DefaultBranch)
+		if err == nil {
+			err = client.RenameBranch(ctx, repo.Owner.Login, repo.Name, repo.DefaultBranch, metaUser.DefaultBranch)
+		}
+		if err == nil {
+			repo.DefaultBranch = metaUser.DefaultBranch
 		} else {
-			fmt.Println("Project already exists with the name : ", project.Name)
-			w.WriteHeader(http.StatusBadRequest)
+			notes = append(notes, fmt.Sprintf("Failed to rename the default branch to %s: %v", metaUser.DefaultBranch, err))
 		}
 	}
 
+	// Linking the repo lets commits made on the server be synced to it. The project is created
+	// linked, so a failure leaves only the repository, which a retry reuses.
+	link := repoLink(repo, repo.DefaultBranch)
+	secret, err := generateToken()
+	var project *db.Project
+	if err == nil {
+		project, err = projectModel.CreateLinkedProject(user.ID, metaUser.PROJECT_NAME, metaUser.Description, link, secret)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":    "Failed to create project; retry to link the repository that was created",
+			"repo_url": repo.HTMLURL,
+		})
+		return
+	}
+
+	LogActivity(
+		user.ID,
+		project.ID,
+		"project_created",
+		"Created project with GitHub repository "+repo.FullName,
+		map[string]interface{}{
+			"repository": repo.FullName,
+			"private":    repo.Private,
+			"template":   metaUser.Template,
+			"engine":     metaUser.Engine,
+			"reused":     reused,
+		},
+		r,
+	)
+
+	response := map[string]interface{}{
+		"success":        true,
+		"message":        "Collaboration started successfully for project " + project.Name,
+		"project":        project,
+		"repo":           link,
+		"repo_url":       repo.HTMLURL,
+		"private":        repo.Private,
+		"webhook_secret": secret,
+		"reused":         reused,
+	}
+	if len(notes) > 0 {
+		response["notes"] = notes
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// pushedRepository - The repository owner/name if an earlier push by the same user created it
+// and failed before linking it. differs is set when it was created with other settings than
+// want, or has been made public or private since.
+func pushedRepository(ctx context.Context, client GitHubClient, owner, name string, want db.PushedRepo) (repo *GitHubRepository, differs bool) {
+	repo, err := client.GetRepository(ctx, owner, name)
+	if err != nil || !repo.Permissions.Admin {
+		return nil, false
+	}
+
+	projectModel := &db.ProjectModel{DB: db.DB}
+	pushed, err := projectModel.GetPushedRepo(repo.ID)
+	if err != nil || pushed.OwnerID != want.OwnerID {
+		return nil, false
+	}
+	linked, err := projectModel.GetProjectsByRepoID(repo.ID)
+	if err != nil || len(linked) > 0 {
+		return nil, false
+	}
+
+	differs = repo.Private != want.Private || pushed.Private != want.Private ||
+		pushed.Template != want.Template || pushed.GitignoreTemplate != want.GitignoreTemplate ||
+		pushed.AutoInit != want.AutoInit
+	return repo, differs
 }
 
 // func RequestCollaboration(w http.ResponseWriter, r *http.Request) {
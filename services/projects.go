@@ -5,9 +5,30 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
+// projectLine - One project in the plain-text listings. The listings are public, so its GitHub
+// repository, which may be private, is only listed for members of the project.
+func projectLine(project *db.Project, viewer *db.User) string {
+	line := fmt.Sprintf("ID : %s , Owner ID : %s, Name : %s, Description : %s, Created At : %s", project.ID.String(), project.OwnerID.String(), project.Name, project.Description, project.CreatedAt)
+	if repo := project.Repo; repo != nil && canViewProject(viewer, project.ID) {
+		line += fmt.Sprintf(", Repository : %s/%s, Repository ID : %d, Default Branch : %s, Visibility : %s, URL : %s, Clone URL : %s, SSH URL : %s",
+			repo.Owner, repo.Name, repo.ID, repo.DefaultBranch, repo.Visibility, repo.HTMLURL, repo.CloneURL, repo.SSHURL)
+	}
+	return line + " \n"
+}
+
+// canViewProject - Whether a possibly anonymous user is a member of the project
+func canViewProject(user *db.User, projectID uuid.UUID) bool {
+	if user == nil {
+		return false
+	}
+	_, err := Authorize(user.ID, projectID, PermViewProject)
+	return err == nil
+}
+
 func NProjects(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	username := vars["owner"]
@@ -53,9 +74,9 @@ func GetProjects(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusBadRequest)
 		}
 
+		viewer := optionalUser(r)
 		for i := 0; i < len(projects); i++ {
-			project := projects[i]
-			fmt.Fprintf(w, "ID : %s , Owner ID : %s, Name : %s, Description : %s, Created At : %s \n", project.ID.String(), project.OwnerID.String(), project.Name, project.Description, project.CreatedAt)
+			fmt.Fprint(w, projectLine(&projects[i], viewer))
 		}
 	}
 }
@@ -80,11 +101,11 @@ func GetProject(w http.ResponseWriter, r *http.Request) {
 		project, err := projectModel.GetProjectByName(ownerID, nameStr)
 		if err != nil {
 			fmt.Println("Error : ", err)
-			w.WriteHeader(http.StatusBadRequest)
-
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
 		}
 
-		fmt.Fprintf(w, "ID : %s , Owner ID : %s, Name : %s, Description : %s, Created At : %s \n", project.ID.String(), project.OwnerID.String(), project.Name, project.Description, project.CreatedAt)
+		fmt.Fprint(w, projectLine(project, optionalUser(r)))
 	}
 }
 
@@ -96,27 +117,34 @@ func DeleteProject(w http.ResponseWriter, r *http.Request) {
 	userModel := &db.UserModel{
 		DB: db.DB,
 	}
-	user, err := userModel.GetUser(username)
+	owner, err := userModel.GetUser(username)
 	if err != nil {
 		http.Error(w, "Invalid owner ID", http.StatusBadRequest)
-		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
+	projectModel := &db.ProjectModel{
+		DB: db.DB,
+	}
+	project, err := projectModel.GetProjectByName(owner.ID, projectName)
+	if err != nil {
+		fmt.Println("Error : ", err)
+		http.Error(w, "Project not found", http.StatusNotFound)
 		return
-	} else {
-		ownerID := user.ID
-		projectModel := &db.ProjectModel{
-			DB: db.DB,
-		}
-		project, err := projectModel.GetProjectByName(ownerID, projectName)
-		if err != nil {
-			fmt.Println("Error : ", err)
-			w.WriteHeader(http.StatusBadRequest)
+	}
 
-		}
-		projectID := project.ID
-		err = projectModel.DeleteProject(ownerID, projectID)
-		if err != nil {
-			fmt.Println("Error : ", err)
-		}
+	// Only the project owner can delete it
+	user, _, ok := authorizeProject(w, r, project.ID, PermDeleteProject)
+	if !ok {
+		return
+	}
+
+	err = projectModel.DeleteProject(user.ID, project.ID)
+	if err != nil {
+		fmt.Println("Error : ", err)
+		http.Error(w, "Failed to delete project", http.StatusInternalServerError)
+		return
 	}
+
+	fmt.Fprintf(w, "Project %s deleted", project.Name)
 }
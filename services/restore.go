@@ -0,0 +1,590 @@
+package services
+
+import (
+	"app/urtc/db"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// RestoreErrNotDeleted - Undelete was asked for a file that still exists
+const RestoreErrNotDeleted = "file_not_deleted"
+
+type RestoreRequest struct {
+	ProjectID   string `json:"project_id"`
+	FilePath    string `json:"file_path"`
+	Version     int    `json:"version"`                // the version whose content comes back
+	BaseVersion int    `json:"base_version,omitempty"` // the latest version on the branch if 0
+	Branch      string `json:"branch,omitempty"`       // the default branch if empty
+	CommitMsg   string `json:"commit_message,omitempty"`
+}
+
+// FileChangeRequest - Deletes or undeletes a file
+type FileChangeRequest struct {
+	ProjectID   string `json:"project_id"`
+	FilePath    string `json:"file_path"`
+	BaseVersion int    `json:"base_version,omitempty"` // the latest version on the branch if 0
+	Branch      string `json:"branch,omitempty"`       // the default branch if empty
+	CommitMsg   string `json:"commit_message,omitempty"`
+}
+
+type RevertRequest struct {
+	ChangesetID string `json:"changeset_id"`
+	Message     string `json:"message,omitempty"`
+}
+
+// fileVersionResponse - A version as returned to clients
+func fileVersionResponse(fv *db.FileVersion) FileVersion {
+	return FileVersion{
+		ID:          fv.ID,
+		ProjectID:   fv.ProjectID,
+		UserID:      fv.UserID,
+		FilePath:    fv.FilePath,
+		FileName:    fv.FileName,
+		FileType:    fv.FileType,
+		Version:     fv.Version,
+		FileHash:    fv.FileHash,
+		FileSize:    fv.FileSize,
+		Content:     fv.Content,
+		CommitMsg:   fv.CommitMsg,
+		IsDeleted:   fv.IsDeleted,
+		IsBinary:    fv.IsBinary,
+		ChangesetID: fv.ChangesetID,
+		Branch:      fv.Branch,
+		CreatedAt:   fv.CreatedAt,
+	}
+}
+
+// latestFileVersion - The newest version of a file on a branch, deletions included, without content
+func latestFileVersion(projectID uuid.UUID, filePath string, ref *db.Ref) (*db.FileVersion, error) {
+	versionModel := &db.VersionModel{DB: db.DB}
+	history, err := versionModel.GetFileHistory(projectID, filePath, ref, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &history[0], nil
+}
+
+// GetFileVersion - Get one version of a file with its content, by version_id or by file path and version number
+func GetFileVersion(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	versionModel := &db.VersionModel{DB: db.DB}
+
+	var fv *db.FileVersion
+	if versionID := query.Get("version_id"); versionID != "" {
+		versionUUID, err := uuid.Parse(versionID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Invalid version ID",
+			})
+			return
+		}
+
+		fv, err = versionModel.GetVersionByID(versionUUID)
+		if err == nil {
+			if _, _, ok := authorizeProject(w, r, fv.ProjectID, PermViewProject); !ok {
+				return
+			}
+		} else if err != sql.ErrNoRows {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Failed to fetch version",
+			})
+			return
+		}
+	} else {
+		projectUUID, err := uuid.Parse(query.Get("project_id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "version_id, or project_id, file_path and version are required",
+			})
+			return
+		}
+		version, err := strconv.Atoi(query.Get("version"))
+		if err != nil || query.Get("file_path") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "version_id, or project_id, file_path and version are required",
+			})
+			return
+		}
+
+		if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+			return
+		}
+
+		fv, err = versionModel.GetVersion(projectUUID, query.Get("file_path"), version)
+		if err != nil && err != sql.ErrNoRows {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Failed to fetch version",
+			})
+			return
+		}
+	}
+
+	if fv == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Version not found",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"version": fileVersionResponse(fv),
+	})
+}
+
+// RestoreFileVersion - Commits an older version's content as the new latest version of a file
+func RestoreFileVersion(w http.ResponseWriter, r *http.Request) {
+	var req RestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	if req.ProjectID == "" || req.FilePath == "" || req.Version <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "project_id, file_path and version are required",
+		})
+		return
+	}
+
+	projectUUID, err := uuid.Parse(req.ProjectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	user, _, ok := authorizeProject(w, r, projectUUID, PermCommit)
+	if !ok {
+		return
+	}
+
+	ref, ok := resolveBranch(w, projectUUID, req.Branch)
+	if !ok {
+		return
+	}
+
+	versionModel := &db.VersionModel{DB: db.DB}
+	source, err := versionModel.GetVersion(projectUUID, req.FilePath, req.Version)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Version not found",
+		})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch version",
+		})
+		return
+	}
+	if source.IsDeleted {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Version " + strconv.Itoa(source.Version) + " deletes the file; there is nothing to restore",
+		})
+		return
+	}
+
+	if req.BaseVersion == 0 {
+		if latest, err := latestFileVersion(projectUUID, req.FilePath, ref); err == nil {
+			req.BaseVersion = latest.Version
+		}
+	}
+	if req.CommitMsg == "" {
+		req.CommitMsg = "Restore " + req.FilePath + " to version " + strconv.Itoa(source.Version)
+	}
+
+	commitFileChange(w, r, user, projectUUID, ref, db.ChangesetFile{
+		Action:      db.ChangeRestore,
+		FilePath:    req.FilePath,
+		FileName:    source.FileName,
+		FileType:    source.FileType,
+		BaseVersion: req.BaseVersion,
+		Source:      source,
+	}, req.CommitMsg, "file_restore", "Restored")
+}
+
+// DeleteFile - Marks a file deleted on a branch; its history is kept
+func DeleteFile(w http.ResponseWriter, r *http.Request) {
+	req, projectUUID, user, ref, ok := decodeFileChange(w, r)
+	if !ok {
+		return
+	}
+
+	latest, err := latestFileVersion(projectUUID, req.FilePath, ref)
+	if err == sql.ErrNoRows || (err == nil && latest.IsDeleted) {
+		writePatchError(w, newPatchError(http.StatusNotFound, ChangesetErrFileNotFound, req.FilePath+" does not exist"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch file",
+		})
+		return
+	}
+
+	if req.BaseVersion == 0 {
+		req.BaseVersion = latest.Version
+	}
+	if req.CommitMsg == "" {
+		req.CommitMsg = "Delete " + req.FilePath
+	}
+
+	commitFileChange(w, r, user, projectUUID, ref, db.ChangesetFile{
+		Action:      db.ChangeDelete,
+		FilePath:    req.FilePath,
+		FileName:    latest.FileName,
+		FileType:    latest.FileType,
+		BaseVersion: req.BaseVersion,
+	}, req.CommitMsg, "file_delete", "Deleted")
+}
+
+// UndeleteFile - Brings a deleted file back with the content it had before it was deleted
+func UndeleteFile(w http.ResponseWriter, r *http.Request) {
+	req, projectUUID, user, ref, ok := decodeFileChange(w, r)
+	if !ok {
+		return
+	}
+
+	latest, err := latestFileVersion(projectUUID, req.FilePath, ref)
+	if err == sql.ErrNoRows {
+		writePatchError(w, newPatchError(http.StatusNotFound, ChangesetErrFileNotFound, req.FilePath+" has no history"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch file",
+		})
+		return
+	}
+	if !latest.IsDeleted {
+		writePatchError(w, newPatchError(http.StatusConflict, RestoreErrNotDeleted, req.FilePath+" is not deleted"))
+		return
+	}
+
+	versionModel := &db.VersionModel{DB: db.DB}
+	source, err := versionModel.GetLastLiveVersion(projectUUID, req.FilePath, ref)
+	if err == sql.ErrNoRows {
+		writePatchError(w, newPatchError(http.StatusNotFound, ChangesetErrFileNotFound, req.FilePath+" has no content to bring back"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch file",
+		})
+		return
+	}
+
+	if req.BaseVersion == 0 {
+		req.BaseVersion = latest.Version
+	}
+	if req.CommitMsg == "" {
+		req.CommitMsg = "Undelete " + req.FilePath
+	}
+
+	commitFileChange(w, r, user, projectUUID, ref, db.ChangesetFile{
+		Action:      db.ChangeRestore,
+		FilePath:    req.FilePath,
+		FileName:    source.FileName,
+		FileType:    source.FileType,
+		BaseVersion: req.BaseVersion,
+		Source:      source,
+	}, req.CommitMsg, "file_undelete", "Undeleted")
+}
+
+// decodeFileChange - Reads a FileChangeRequest and checks the caller may commit to its branch
+func decodeFileChange(w http.ResponseWriter, r *http.Request) (*FileChangeRequest, uuid.UUID, *db.User, *db.Ref, bool) {
+	var req FileChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request body",
+		})
+		return nil, uuid.Nil, nil, nil, false
+	}
+
+	if req.ProjectID == "" || req.FilePath == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "project_id and file_path are required",
+		})
+		return nil, uuid.Nil, nil, nil, false
+	}
+
+	projectUUID, err := uuid.Parse(req.ProjectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return nil, uuid.Nil, nil, nil, false
+	}
+
+	user, _, ok := authorizeProject(w, r, projectUUID, PermCommit)
+	if !ok {
+		return nil, uuid.Nil, nil, nil, false
+	}
+
+	ref, ok := resolveBranch(w, projectUUID, req.Branch)
+	if !ok {
+		return nil, uuid.Nil, nil, nil, false
+	}
+
+	return &req, projectUUID, user, ref, true
+}
+
+// commitFileChange - Commits a restore, delete or undelete and reports it like a commit
+func commitFileChange(w http.ResponseWriter, r *http.Request, user *db.User, projectID uuid.UUID, ref *db.Ref, file db.ChangesetFile, commitMsg, action, verb string) {
+	versionModel := &db.VersionModel{DB: db.DB}
+	version, err := versionModel.CommitChange(projectID, user.ID, ref, file, commitMsg)
+
+	var fileErr *db.ChangesetFileError
+	if errors.As(err, &fileErr) {
+		writePatchError(w, changesetFileError(fileErr))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to create version: " + err.Error(),
+		})
+		return
+	}
+
+	metadata := map[string]interface{}{
+		"file_path":  file.FilePath,
+		"version":    version.Version,
+		"file_hash":  version.FileHash,
+		"branch":     version.Branch,
+		"is_deleted": version.IsDeleted,
+	}
+	if file.Source != nil {
+		metadata["restored_from"] = file.Source.Version
+	}
+	LogActivity(user.ID, projectID, action, verb+" "+file.FilePath, metadata, r)
+
+	NotifyProjectMembers(
+		projectID,
+		user.ID,
+		"file_updated",
+		user.USERNAME+" "+strings.ToLower(verb)+" "+file.FilePath,
+		map[string]interface{}{
+			"project_id": projectID,
+			"file_path":  file.FilePath,
+			"version":    version.Version,
+			"branch":     version.Branch,
+			"action":     action,
+			"is_deleted": version.IsDeleted,
+			"user_email": user.EMAIL,
+		},
+	)
+
+	response := map[string]interface{}{
+		"success":    true,
+		"version_id": version.ID,
+		"version":    version.Version,
+		"file_path":  version.FilePath,
+		"branch":     version.Branch,
+		"file_hash":  version.FileHash,
+		"file_size":  version.FileSize,
+		"is_deleted": version.IsDeleted,
+		"is_binary":  version.IsBinary,
+		"commit_msg": commitMsg,
+	}
+	if file.Source != nil {
+		response["restored_from"] = file.Source.Version
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RevertChangeset - Undoes every file of a changeset in a new changeset. Each file must still be
+// at the version the changeset left it at.
+func RevertChangeset(w http.ResponseWriter, r *http.Request) {
+	var req RevertRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	changesetUUID, err := uuid.Parse(req.ChangesetID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid changeset ID",
+		})
+		return
+	}
+
+	changesetModel := &db.ChangesetModel{DB: db.DB}
+	reverted, err := changesetModel.GetChangeset(changesetUUID)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Changeset not found",
+		})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch changeset",
+		})
+		return
+	}
+
+	user, _, ok := authorizeProject(w, r, reverted.ProjectID, PermCommit)
+	if !ok {
+		return
+	}
+
+	ref, perr := resolvePatchBranch(reverted.ProjectID, reverted.Branch)
+	if perr != nil {
+		writePatchError(w, perr)
+		return
+	}
+
+	// Each file goes back to the version before the changeset, or away if the changeset added it
+	versionModel := &db.VersionModel{DB: db.DB}
+	files := make([]db.ChangesetFile, 0, len(reverted.Files))
+	for _, fv := range reverted.Files {
+		previous, err := versionModel.GetPreviousVersion(reverted.ProjectID, fv.FilePath, ref, fv.Version)
+		if err == sql.ErrNoRows {
+			previous = nil
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Failed to fetch previous version of " + fv.FilePath,
+			})
+			return
+		}
+
+		file := db.ChangesetFile{
+			FilePath:    fv.FilePath,
+			FileName:    fv.FileName,
+			FileType:    fv.FileType,
+			BaseVersion: fv.Version,
+		}
+		switch {
+		case previous != nil && !previous.IsDeleted:
+			file.Action, file.Source = db.ChangeRestore, previous
+			file.FileName, file.FileType = previous.FileName, previous.FileType
+		case fv.IsDeleted:
+			// Deleted something that was already gone; nothing to undo
+			continue
+		default:
+			file.Action = db.ChangeDelete
+		}
+		files = append(files, file)
+	}
+
+	if len(files) == 0 {
+		writePatchError(w, newPatchError(http.StatusBadRequest, ChangesetErrEmpty, "The changeset has nothing to revert"))
+		return
+	}
+
+	if req.Message == "" {
+		req.Message = "Revert \"" + reverted.Message + "\""
+	}
+
+	changeset, err := changesetModel.CreateChangeset(reverted.ProjectID, user.ID, ref, req.Message, files)
+
+	var fileErr *db.ChangesetFileError
+	if errors.As(err, &fileErr) {
+		perr := changesetFileError(fileErr)
+		if perr.Code == PatchErrStaleBase {
+			perr.Message = fileErr.FilePath + " changed after the changeset; revert the later changes first"
+		}
+		writePatchError(w, perr)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to revert changeset: " + err.Error(),
+		})
+		return
+	}
+
+	paths := make([]string, 0, len(changeset.Files))
+	for _, fv := range changeset.Files {
+		paths = append(paths, fv.FilePath)
+	}
+
+	LogActivity(
+		user.ID,
+		reverted.ProjectID,
+		"changeset_revert",
+		"Reverted "+strconv.Itoa(len(paths))+" files: "+reverted.Message,
+		map[string]interface{}{
+			"changeset_id":          changeset.ID,
+			"reverted_changeset_id": reverted.ID,
+			"branch":                changeset.Branch,
+			"files":                 paths,
+		},
+		r,
+	)
+
+	for _, fv := range changeset.Files {
+		NotifyProjectMembers(
+			reverted.ProjectID,
+			user.ID,
+			"file_updated",
+			user.USERNAME+" reverted "+fv.FilePath,
+			map[string]interface{}{
+				"project_id":            reverted.ProjectID,
+				"file_path":             fv.FilePath,
+				"version":               fv.Version,
+				"branch":                fv.Branch,
+				"action":                "changeset_revert",
+				"is_deleted":            fv.IsDeleted,
+				"changeset_id":          changeset.ID,
+				"reverted_changeset_id": reverted.ID,
+				"user_email":            user.EMAIL,
+			},
+		)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":               true,
+		"changeset_id":          changeset.ID,
+		"reverted_changeset_id": reverted.ID,
+		"branch":                changeset.Branch,
+		"message":               req.Message,
+		"files":                 changesetSummary(changeset),
+		"total":                 len(changeset.Files),
+	})
+}
@@ -0,0 +1,339 @@
+package services
+
+import (
+	"app/urtc/db"
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Archive formats
+const (
+	ArchiveZip   = "zip"
+	ArchiveTarGz = "tar.gz"
+)
+
+// unsafeArchiveChars - Anything that doesn't belong in an archive or download file name
+var unsafeArchiveChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// SnapshotFile - One file of a project snapshot
+type SnapshotFile struct {
+	FilePath  string    `json:"file_path"`
+	VersionID uuid.UUID `json:"version_id"`
+	Version   int       `json:"version"`
+	FileHash  string    `json:"file_hash"`
+	FileSize  int64     `json:"file_size"`
+	IsBinary  bool      `json:"is_binary"`
+	UserID    uuid.UUID `json:"user_id"`
+	Branch    string    `json:"branch"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// snapshotPoint - Where in history a snapshot is taken
+type snapshotPoint struct {
+	projectID   uuid.UUID
+	ref         *db.Ref
+	at          *time.Time
+	changesetID *uuid.UUID
+}
+
+// label - Short description of the point, used in archive names
+func (p *snapshotPoint) label() string {
+	switch {
+	case p.changesetID != nil:
+		return "changeset-" + p.changesetID.String()[:8]
+	case p.at != nil:
+		return p.ref.Name + "-" + p.at.UTC().Format("20060102T150405Z")
+	}
+	return p.ref.Name
+}
+
+// resolveSnapshotPoint - Reads project_id and one of ref, ref with at, or changeset_id, checks
+// the user may view the project and writes the error response on failure
+func resolveSnapshotPoint(w http.ResponseWriter, r *http.Request) (*snapshotPoint, bool) {
+	query := r.URL.Query()
+
+	projectUUID, err := uuid.Parse(query.Get("project_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return nil, false
+	}
+
+	point := &snapshotPoint{projectID: projectUUID}
+
+	if changesetID := query.Get("changeset_id"); changesetID != "" {
+		if query.Get("ref") != "" || query.Get("at") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "changeset_id can't be combined with ref or at",
+			})
+			return nil, false
+		}
+		changesetUUID, err := uuid.Parse(changesetID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Invalid changeset ID",
+			})
+			return nil, false
+		}
+		point.changesetID = &changesetUUID
+	}
+
+	if at := query.Get("at"); at != "" {
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "at must be an RFC 3339 timestamp, such as 2024-01-01T12:00:00Z",
+			})
+			return nil, false
+		}
+		point.at = &t
+	}
+
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return nil, false
+	}
+
+	refName := query.Get("ref")
+	if point.changesetID != nil {
+		changesetModel := &db.ChangesetModel{DB: db.DB}
+		snapshotModel := &db.SnapshotModel{DB: db.DB}
+		changeset, err := changesetModel.GetChangeset(*point.changesetID)
+		var at time.Time
+		if err == nil && changeset.ProjectID != projectUUID {
+			err = sql.ErrNoRows
+		}
+		if err == nil {
+			refName, at, err = snapshotModel.GetChangesetPoint(*point.changesetID)
+		}
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Changeset not found",
+			})
+			return nil, false
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Failed to fetch changeset",
+			})
+			return nil, false
+		}
+		point.at = &at
+	}
+
+	ref, ok := resolveRef(w, projectUUID, refName)
+	if !ok {
+		return nil, false
+	}
+	if ref.IsTag() && point.at != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "A tag is already a point in time; at can only be used with branches",
+		})
+		return nil, false
+	}
+	point.ref = ref
+
+	return point, true
+}
+
+// loadSnapshot - The files of the project at the point, writing the error response on failure
+func loadSnapshot(w http.ResponseWriter, point *snapshotPoint) ([]db.FileVersion, bool) {
+	snapshotModel := &db.SnapshotModel{DB: db.DB}
+	files, err := snapshotModel.GetSnapshot(point.projectID, point.ref, point.at)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to build snapshot",
+		})
+		return nil, false
+	}
+	return files, true
+}
+
+// GetProjectSnapshot - Lists every file of a project as it was at a timestamp, changeset or tag
+func GetProjectSnapshot(w http.ResponseWriter, r *http.Request) {
+	point, ok := resolveSnapshotPoint(w, r)
+	if !ok {
+		return
+	}
+
+	files, ok := loadSnapshot(w, point)
+	if !ok {
+		return
+	}
+
+	var totalSize int64
+	response := make([]SnapshotFile, 0, len(files))
+	for _, fv := range files {
+		totalSize += fv.FileSize
+		response = append(response, SnapshotFile{
+			FilePath:  fv.FilePath,
+			VersionID: fv.ID,
+			Version:   fv.Version,
+			FileHash:  fv.FileHash,
+			FileSize:  fv.FileSize,
+			IsBinary:  fv.IsBinary,
+			UserID:    fv.UserID,
+			Branch:    fv.Branch,
+			CreatedAt: fv.CreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"project_id":   point.projectID,
+		"ref":          point.ref.Name,
+		"at":           point.at,
+		"changeset_id": point.changesetID,
+		"files":        response,
+		"file_count":   len(response),
+		"total_size":   totalSize,
+	})
+}
+
+// DownloadProjectSnapshot - Streams a project snapshot as a zip or tar.gz archive
+func DownloadProjectSnapshot(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ArchiveZip
+	}
+	if format != ArchiveZip && format != ArchiveTarGz {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "format must be zip or tar.gz",
+		})
+		return
+	}
+
+	point, ok := resolveSnapshotPoint(w, r)
+	if !ok {
+		return
+	}
+
+	projectModel := &db.ProjectModel{DB: db.DB}
+	project, err := projectModel.GetProjectByID(point.projectID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch project",
+		})
+		return
+	}
+
+	files, ok := loadSnapshot(w, point)
+	if !ok {
+		return
+	}
+
+	// Everything goes under one folder so extracting doesn't spill into the current directory
+	root := unsafeArchiveChars.ReplaceAllString(project.Name+"-"+point.label(), "_")
+
+	contentType := "application/zip"
+	if format == ArchiveTarGz {
+		contentType = "application/gzip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": root + "." + format}))
+	w.Header().Set("X-Snapshot-Files", strconv.Itoa(len(files)))
+
+	if format == ArchiveZip {
+		err = writeZipSnapshot(w, root, files)
+	} else {
+		err = writeTarGzSnapshot(w, root, files)
+	}
+	if err != nil {
+		// Headers are gone; the archive is left unterminated so the client sees it is broken
+		log.Printf("Snapshot download of project %s failed: %v", point.projectID, err)
+	}
+}
+
+// archivePath - Where a file goes in the archive. Cleaning it as an absolute path first keeps
+// "../" from escaping the root folder.
+func archivePath(root, filePath string) string {
+	clean := path.Clean("/" + filePath)
+	if clean == "/" {
+		return ""
+	}
+	return root + clean
+}
+
+func writeZipSnapshot(w io.Writer, root string, files []db.FileVersion) error {
+	archive := zip.NewWriter(w)
+	for i := range files {
+		fv := &files[i]
+		name := archivePath(root, fv.FilePath)
+		if name == "" {
+			continue
+		}
+
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: fv.CreatedAt}
+		// Binary assets are usually compressed already
+		if fv.IsBinary {
+			header.Method = zip.Store
+		}
+		entry, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if _, err := db.WriteVersionContent(fv, entry); err != nil {
+			return fmt.Errorf("%s: %w", fv.FilePath, err)
+		}
+	}
+	return archive.Close()
+}
+
+func writeTarGzSnapshot(w io.Writer, root string, files []db.FileVersion) error {
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+	for i := range files {
+		fv := &files[i]
+		name := archivePath(root, fv.FilePath)
+		if name == "" {
+			continue
+		}
+
+		size := fv.FileSize
+		if fv.Content != "" {
+			size = int64(len(fv.Content))
+		}
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     size,
+			ModTime:  fv.CreatedAt,
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := db.WriteVersionContent(fv, archive); err != nil {
+			return fmt.Errorf("%s: %w", fv.FilePath, err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return compressed.Close()
+}
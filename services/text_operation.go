@@ -0,0 +1,240 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// TextOperation - A single edit to a text document, in the format used by ot.js:
+// a list of components where a positive number retains that many characters,
+// a negative number deletes that many and a string inserts it. Lengths count
+// Unicode code points. An operation must span the whole document it applies to.
+type TextOperation struct {
+	ops          []textOp
+	baseLength   int
+	targetLength int
+}
+
+type textOp struct {
+	retain int
+	insert string
+	delete int
+}
+
+var (
+	errOperationLength = errors.New("operation does not span the document")
+	errOperationFormat = errors.New("operation components must be non-zero integers or non-empty strings")
+)
+
+func (o *TextOperation) retain(n int) {
+	if n <= 0 {
+		return
+	}
+	o.baseLength += n
+	o.targetLength += n
+	if last := len(o.ops) - 1; last >= 0 && o.ops[last].retain > 0 {
+		o.ops[last].retain += n
+		return
+	}
+	o.ops = append(o.ops, textOp{retain: n})
+}
+
+func (o *TextOperation) insertText(s string) {
+	if s == "" {
+		return
+	}
+	o.targetLength += len([]rune(s))
+	last := len(o.ops) - 1
+	if last >= 0 && o.ops[last].insert != "" {
+		o.ops[last].insert += s
+		return
+	}
+	// Keep inserts ahead of deletes so equivalent operations have one representation
+	if last >= 0 && o.ops[last].delete > 0 {
+		if last > 0 && o.ops[last-1].insert != "" {
+			o.ops[last-1].insert += s
+			return
+		}
+		o.ops = append(o.ops, o.ops[last])
+		o.ops[last] = textOp{insert: s}
+		return
+	}
+	o.ops = append(o.ops, textOp{insert: s})
+}
+
+func (o *TextOperation) deleteText(n int) {
+	if n <= 0 {
+		return
+	}
+	o.baseLength += n
+	if last := len(o.ops) - 1; last >= 0 && o.ops[last].delete > 0 {
+		o.ops[last].delete += n
+		return
+	}
+	o.ops = append(o.ops, textOp{delete: n})
+}
+
+// isNoop - Reports whether the operation leaves the document unchanged
+func (o *TextOperation) isNoop() bool {
+	return len(o.ops) == 0 || (len(o.ops) == 1 && o.ops[0].retain > 0)
+}
+
+// diffOperation - An operation turning from into to, built from a line diff so unchanged lines
+// are retained and concurrent edits to them survive a transform
+func diffOperation(from, to string) *TextOperation {
+	a, b := splitLinesKeepEnds(from), splitLinesKeepEnds(to)
+
+	op := &TextOperation{}
+	for _, edit := range lineEdits(a, b) {
+		switch edit.kind {
+		case "context":
+			op.retain(utf8.RuneCountInString(a[edit.old]))
+		case "delete":
+			op.deleteText(utf8.RuneCountInString(a[edit.old]))
+		case "insert":
+			op.insertText(b[edit.new])
+		}
+	}
+	return op
+}
+
+// Apply - Applies the operation to a document
+func (o *TextOperation) Apply(doc string) (string, error) {
+	text := []rune(doc)
+	if len(text) != o.baseLength {
+		return "", errOperationLength
+	}
+
+	result := make([]rune, 0, o.targetLength)
+	pos := 0
+	for _, op := range o.ops {
+		switch {
+		case op.retain > 0:
+			result = append(result, text[pos:pos+op.retain]...)
+			pos += op.retain
+		case op.insert != "":
+			result = append(result, []rune(op.insert)...)
+		case op.delete > 0:
+			pos += op.delete
+		}
+	}
+	return string(result), nil
+}
+
+// transformOperations - Given two operations made concurrently against the same document,
+// returns a' and b' such that applying a then b' equals applying b then a'.
+// When both insert at the same position, a's insert goes first.
+func transformOperations(a, b *TextOperation) (*TextOperation, *TextOperation, error) {
+	if a.baseLength != b.baseLength {
+		return nil, nil, errOperationLength
+	}
+
+	aPrime, bPrime := &TextOperation{}, &TextOperation{}
+	aOps, bOps := append([]textOp(nil), a.ops...), append([]textOp(nil), b.ops...)
+	i, j := 0, 0
+
+	for i < len(aOps) || j < len(bOps) {
+		if i < len(aOps) && aOps[i].insert != "" {
+			aPrime.insertText(aOps[i].insert)
+			bPrime.retain(len([]rune(aOps[i].insert)))
+			i++
+			continue
+		}
+		if j < len(bOps) && bOps[j].insert != "" {
+			aPrime.retain(len([]rune(bOps[j].insert)))
+			bPrime.insertText(bOps[j].insert)
+			j++
+			continue
+		}
+		if i >= len(aOps) || j >= len(bOps) {
+			return nil, nil, errOperationLength
+		}
+
+		opA, opB := &aOps[i], &bOps[j]
+		n := min(opA.retain+opA.delete, opB.retain+opB.delete)
+
+		switch {
+		case opA.retain > 0 && opB.retain > 0:
+			aPrime.retain(n)
+			bPrime.retain(n)
+		case opA.delete > 0 && opB.retain > 0:
+			aPrime.deleteText(n)
+		case opA.retain > 0 && opB.delete > 0:
+			bPrime.deleteText(n)
+		}
+		// Both deleting the same range: nothing left for either side to do
+
+		if opA.retain > 0 {
+			opA.retain -= n
+		} else {
+			opA.delete -= n
+		}
+		if opB.retain > 0 {
+			opB.retain -= n
+		} else {
+			opB.delete -= n
+		}
+		if opA.retain == 0 && opA.delete == 0 {
+			i++
+		}
+		if opB.retain == 0 && opB.delete == 0 {
+			j++
+		}
+	}
+
+	return aPrime, bPrime, nil
+}
+
+// MarshalJSON - Encodes the operation as [retain, "insert", -delete, ...]
+func (o TextOperation) MarshalJSON() ([]byte, error) {
+	components := make([]interface{}, 0, len(o.ops))
+	for _, op := range o.ops {
+		switch {
+		case op.retain > 0:
+			components = append(components, op.retain)
+		case op.insert != "":
+			components = append(components, op.insert)
+		case op.delete > 0:
+			components = append(components, -op.delete)
+		}
+	}
+	return json.Marshal(components)
+}
+
+// UnmarshalJSON - Decodes and normalizes an operation sent by a client
+func (o *TextOperation) UnmarshalJSON(data []byte) error {
+	var components []json.RawMessage
+	if err := json.Unmarshal(data, &components); err != nil {
+		return err
+	}
+
+	*o = TextOperation{}
+	for _, raw := range components {
+		var text string
+		if err := json.Unmarshal(raw, &text); err == nil {
+			if text == "" {
+				return errOperationFormat
+			}
+			o.insertText(text)
+			continue
+		}
+
+		var n int
+		if err := json.Unmarshal(raw, &n); err != nil || n == 0 {
+			return errOperationFormat
+		}
+		if n > 0 {
+			o.retain(n)
+		} else {
+			o.deleteText(-n)
+		}
+	}
+	return nil
+}
+
+// String - Compact form for logs
+func (o *TextOperation) String() string {
+	return fmt.Sprintf("op(%d->%d, %d components)", o.baseLength, o.targetLength, len(o.ops))
+}
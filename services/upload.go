@@ -0,0 +1,792 @@
+package services
+
+import (
+	"app/urtc/db"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Machine-readable upload error codes, alongside the patch error codes
+const (
+	UploadErrNotFound      = "upload_not_found"
+	UploadErrNotOpen       = "upload_not_open"
+	UploadErrTooLarge      = "file_too_large"
+	UploadErrChunkIndex    = "invalid_chunk_index"
+	UploadErrChunkSize     = "invalid_chunk_size"
+	UploadErrChunkHash     = "chunk_hash_mismatch"
+	UploadErrChunkRequired = "chunk_hash_required"
+	UploadErrIncomplete    = "upload_incomplete"
+)
+
+const (
+	defaultChunkSize = 8 << 20
+	minChunkSize     = 256 << 10
+	maxChunkSize     = 64 << 20
+
+	// uploadSessionTTL - An upload is dropped after this long without a chunk arriving
+	uploadSessionTTL = 24 * time.Hour
+)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+type UploadRequest struct {
+	ProjectID   string `json:"project_id"`
+	FilePath    string `json:"file_path"`
+	FileName    string `json:"file_name"`
+	FileType    string `json:"file_type"`
+	TotalSize   int64  `json:"total_size"`
+	ChunkSize   int64  `json:"chunk_size,omitempty"` // defaultChunkSize if 0
+	FileHash    string `json:"file_hash,omitempty"`  // optional SHA-256 of the whole file, checked on commit
+	BaseVersion int    `json:"base_version,omitempty"`
+	Branch      string `json:"branch,omitempty"` // the default branch if empty
+}
+
+type UploadCommitRequest struct {
+	UploadID    string `json:"upload_id"`
+	CommitMsg   string `json:"commit_message"`
+	BaseVersion int    `json:"base_version,omitempty"` // overrides the one given when the upload was created
+}
+
+type FileSizeLimitRequest struct {
+	ProjectID   string `json:"project_id"`
+	MaxFileSize *int64 `json:"max_file_size"` // bytes; null restores the server default
+}
+
+// fileSizeLimit - The largest file a project accepts
+func fileSizeLimit(projectID uuid.UUID) (int64, *PatchError) {
+	projectModel := &db.ProjectModel{DB: db.DB}
+	limit, _, err := projectModel.GetMaxFileSize(projectID)
+	if err != nil {
+		return 0, newPatchError(http.StatusInternalServerError, PatchErrApplyFailed, "Failed to load the project's file size limit")
+	}
+	return limit, nil
+}
+
+// checkFileSize - Rejects a file over the project's limit
+func checkFileSize(size, limit int64) *PatchError {
+	if size <= limit {
+		return nil
+	}
+	perr := newPatchError(http.StatusRequestEntityTooLarge, UploadErrTooLarge, "File is larger than this project allows")
+	perr.Details = map[string]interface{}{
+		"file_size":     size,
+		"max_file_size": limit,
+	}
+	return perr
+}
+
+// loadUpload - Gets an upload for the user who started it, writing the error response otherwise.
+// Other users, even on the same project, are told it does not exist.
+func loadUpload(w http.ResponseWriter, r *http.Request, uploadID string) (*db.User, *db.Upload, bool) {
+	uploadUUID, err := uuid.Parse(uploadID)
+	if err != nil {
+		writePatchError(w, newPatchError(http.StatusBadRequest, UploadErrNotFound, "Invalid upload ID"))
+		return nil, nil, false
+	}
+
+	uploadModel := &db.UploadModel{DB: db.DB}
+	upload, err := uploadModel.GetUpload(uploadUUID)
+	if err == sql.ErrNoRows {
+		writePatchError(w, newPatchError(http.StatusNotFound, UploadErrNotFound, "Upload not found"))
+		return nil, nil, false
+	}
+	if err != nil {
+		writePatchError(w, newPatchError(http.StatusInternalServerError, UploadErrNotFound, "Failed to fetch upload"))
+		return nil, nil, false
+	}
+
+	user, _, ok := authorizeProject(w, r, upload.ProjectID, PermCommit)
+	if !ok {
+		return nil, nil, false
+	}
+	if upload.UserID != user.ID {
+		writePatchError(w, newPatchError(http.StatusNotFound, UploadErrNotFound, "Upload not found"))
+		return nil, nil, false
+	}
+
+	return user, upload, true
+}
+
+func uploadNotOpen(upload *db.Upload) *PatchError {
+	perr := newPatchError(http.StatusConflict, UploadErrNotOpen, "Upload was already "+upload.Status)
+	perr.Details = map[string]interface{}{
+		"status":     upload.Status,
+		"version_id": upload.VersionID,
+	}
+	return perr
+}
+
+// missingChunks - Indexes of chunks not received yet, or received with the wrong size
+func missingChunks(upload *db.Upload, chunks []db.UploadChunk) []int {
+	received := make(map[int]bool, len(chunks))
+	for _, chunk := range chunks {
+		if chunk.Index < upload.ChunkCount() && chunk.Size == upload.ChunkLength(chunk.Index) {
+			received[chunk.Index] = true
+		}
+	}
+
+	missing := []int{}
+	for i := 0; i < upload.ChunkCount(); i++ {
+		if !received[i] {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// CreateUpload - Starts a chunked upload of a large file
+func CreateUpload(w http.ResponseWriter, r *http.Request) {
+	var req UploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	if req.ProjectID == "" || req.FilePath == "" || req.TotalSize <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "project_id, file_path and a positive total_size are required",
+		})
+		return
+	}
+
+	projectUUID, err := uuid.Parse(req.ProjectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	user, _, ok := authorizeProject(w, r, projectUUID, PermCommit)
+	if !ok {
+		return
+	}
+
+	ref, ok := resolveBranch(w, projectUUID, req.Branch)
+	if !ok {
+		return
+	}
+
+	if req.ChunkSize == 0 {
+		req.ChunkSize = defaultChunkSize
+	}
+	if req.ChunkSize < minChunkSize || req.ChunkSize > maxChunkSize {
+		perr := newPatchError(http.StatusBadRequest, UploadErrChunkSize, "chunk_size must be between 256 KiB and 64 MiB")
+		perr.Details = map[string]interface{}{
+			"min_chunk_size": minChunkSize,
+			"max_chunk_size": maxChunkSize,
+		}
+		writePatchError(w, perr)
+		return
+	}
+
+	if req.FileHash != "" && !sha256Pattern.MatchString(req.FileHash) {
+		writePatchError(w, newPatchError(http.StatusBadRequest, PatchErrHashMismatch, "file_hash must be a hex SHA-256 digest"))
+		return
+	}
+
+	limit, perr := fileSizeLimit(projectUUID)
+	if perr == nil {
+		perr = checkFileSize(req.TotalSize, limit)
+	}
+	if perr != nil {
+		writePatchError(w, perr)
+		return
+	}
+
+	if req.FileName == "" {
+		req.FileName = path.Base(req.FilePath)
+	}
+
+	uploadModel := &db.UploadModel{DB: db.DB}
+	upload, err := uploadModel.CreateUpload(
+		projectUUID,
+		user.ID,
+		ref.Branch,
+		req.FilePath,
+		req.FileName,
+		req.FileType,
+		req.TotalSize,
+		req.ChunkSize,
+		strings.ToLower(req.FileHash),
+		req.BaseVersion,
+		time.Now().Add(uploadSessionTTL),
+	)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to start upload",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"upload":      upload,
+		"chunk_count": upload.ChunkCount(),
+	})
+}
+
+// GetUpload - Reports which chunks of an upload arrived, so an interrupted client can resume
+func GetUpload(w http.ResponseWriter, r *http.Request) {
+	_, upload, ok := loadUpload(w, r, r.URL.Query().Get("upload_id"))
+	if !ok {
+		return
+	}
+
+	uploadModel := &db.UploadModel{DB: db.DB}
+	chunks, err := uploadModel.GetChunks(upload.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch upload chunks",
+		})
+		return
+	}
+
+	var receivedBytes int64
+	received := make([]int, 0, len(chunks))
+	for _, chunk := range chunks {
+		received = append(received, chunk.Index)
+		receivedBytes += chunk.Size
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":         true,
+		"upload":          upload,
+		"chunk_count":     upload.ChunkCount(),
+		"received_chunks": received,
+		"missing_chunks":  missingChunks(upload, chunks),
+		"received_bytes":  receivedBytes,
+	})
+}
+
+// UploadChunk - Stores one chunk of an upload. The body is the raw chunk and X-Chunk-SHA256 its
+// hash; sending an index again replaces it.
+func UploadChunk(w http.ResponseWriter, r *http.Request) {
+	_, upload, ok := loadUpload(w, r, r.URL.Query().Get("upload_id"))
+	if !ok {
+		return
+	}
+
+	if upload.Status != db.UploadOpen {
+		writePatchError(w, uploadNotOpen(upload))
+		return
+	}
+
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil || index < 0 || index >= upload.ChunkCount() {
+		perr := newPatchError(http.StatusBadRequest, UploadErrChunkIndex, "index must be a chunk number of this upload")
+		perr.Details = map[string]interface{}{"chunk_count": upload.ChunkCount()}
+		writePatchError(w, perr)
+		return
+	}
+
+	chunkHash := r.Header.Get("X-Chunk-SHA256")
+	if !sha256Pattern.MatchString(chunkHash) {
+		writePatchError(w, newPatchError(http.StatusBadRequest, UploadErrChunkRequired, "X-Chunk-SHA256 must be the hex SHA-256 of the chunk"))
+		return
+	}
+
+	// Every chunk but the last is exactly chunk_size, so that is all the body may hold
+	expected := upload.ChunkLength(index)
+	sizeError := func(received int64) {
+		perr := newPatchError(http.StatusBadRequest, UploadErrChunkSize, "Chunk "+strconv.Itoa(index)+" must be "+strconv.FormatInt(expected, 10)+" bytes")
+		perr.Details = map[string]interface{}{
+			"index":         index,
+			"expected_size": expected,
+			"received_size": received,
+		}
+		if received > expected {
+			perr.Status = http.StatusRequestEntityTooLarge
+		}
+		writePatchError(w, perr)
+	}
+
+	if r.ContentLength > expected {
+		sizeError(r.ContentLength)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, expected))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		sizeError(expected + 1)
+		return
+	}
+	if err != nil {
+		// Most likely the connection dropped; the client resumes from GET /version/upload
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to read chunk",
+		})
+		return
+	}
+	if int64(len(data)) != expected {
+		sizeError(int64(len(data)))
+		return
+	}
+
+	if actual := db.HashContent(data); !strings.EqualFold(actual, chunkHash) {
+		perr := newPatchError(http.StatusUnprocessableEntity, UploadErrChunkHash, "Chunk does not match X-Chunk-SHA256")
+		perr.Details = map[string]interface{}{
+			"index":         index,
+			"expected_hash": chunkHash,
+			"actual_hash":   actual,
+		}
+		writePatchError(w, perr)
+		return
+	}
+
+	hash, err := db.Blobs.Put(data)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to store chunk",
+		})
+		return
+	}
+
+	uploadModel := &db.UploadModel{DB: db.DB}
+	chunk := db.UploadChunk{Index: index, Hash: hash, Size: int64(len(data))}
+	err = uploadModel.SaveChunk(upload.ID, chunk, time.Now().Add(uploadSessionTTL))
+	if err == db.ErrUploadNotOpen {
+		// Committed or aborted while this chunk was on its way
+		if upload, err = uploadModel.GetUpload(upload.ID); err == nil {
+			writePatchError(w, uploadNotOpen(upload))
+			return
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to record chunk",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"upload_id": upload.ID,
+		"index":     chunk.Index,
+		"hash":      chunk.Hash,
+		"size":      chunk.Size,
+	})
+}
+
+// CommitUpload - Assembles a complete upload and commits it as a binary version of the file
+func CommitUpload(w http.ResponseWriter, r *http.Request) {
+	var req UploadCommitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	user, upload, ok := loadUpload(w, r, req.UploadID)
+	if !ok {
+		return
+	}
+
+	if upload.Status != db.UploadOpen {
+		writePatchError(w, uploadNotOpen(upload))
+		return
+	}
+
+	uploadModel := &db.UploadModel{DB: db.DB}
+	chunks, err := uploadModel.GetChunks(upload.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch upload chunks",
+		})
+		return
+	}
+
+	if missing := missingChunks(upload, chunks); len(missing) > 0 {
+		perr := newPatchError(http.StatusConflict, UploadErrIncomplete, "Upload is missing "+strconv.Itoa(len(missing))+" chunks")
+		perr.Details = map[string]interface{}{"missing_chunks": missing}
+		writePatchError(w, perr)
+		return
+	}
+
+	// The limit may have been lowered since the upload started
+	limit, perr := fileSizeLimit(upload.ProjectID)
+	if perr == nil {
+		perr = checkFileSize(upload.TotalSize, limit)
+	}
+	if perr != nil {
+		writePatchError(w, perr)
+		return
+	}
+
+	ref, perr := resolvePatchBranch(upload.ProjectID, upload.Branch)
+	if perr != nil {
+		writePatchError(w, perr)
+		return
+	}
+
+	// Checked against the file's latest version when the version is written
+	baseVersion := upload.BaseVersion
+	if req.BaseVersion > 0 {
+		baseVersion = req.BaseVersion
+	}
+
+	hashes := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		hashes[i] = chunk.Hash
+	}
+	hash, size, err := db.Blobs.PutChunked(hashes)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to assemble upload",
+		})
+		return
+	}
+
+	if upload.FileHash != "" && upload.FileHash != hash {
+		perr := newPatchError(http.StatusUnprocessableEntity, PatchErrHashMismatch, "Uploaded file does not match file_hash")
+		perr.Details = map[string]interface{}{
+			"expected_hash": upload.FileHash,
+			"actual_hash":   hash,
+		}
+		writePatchError(w, perr)
+		return
+	}
+
+	version, err := uploadModel.CommitUpload(upload.ID, ref, baseVersion, hash, size, req.CommitMsg)
+	if err == db.ErrUploadNotOpen {
+		if upload, err = uploadModel.GetUpload(upload.ID); err == nil {
+			writePatchError(w, uploadNotOpen(upload))
+			return
+		}
+	}
+	if fileErr, ok := err.(*db.ChangesetFileError); ok {
+		perr := newPatchError(http.StatusConflict, PatchErrStaleBase, upload.FilePath+" changed since base_version; binary files can't be merged")
+		perr.Details = map[string]interface{}{
+			"base_version":   fileErr.BaseVersion,
+			"latest_version": fileErr.LatestVersion,
+			"latest_hash":    fileErr.LatestHash,
+		}
+		writePatchError(w, perr)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to create version: " + err.Error(),
+		})
+		return
+	}
+
+	LogActivity(
+		user.ID,
+		upload.ProjectID,
+		"file_commit",
+		"Committed "+upload.FilePath,
+		map[string]interface{}{
+			"file_path": upload.FilePath,
+			"version":   version.Version,
+			"file_hash": version.FileHash,
+			"file_size": version.FileSize,
+			"branch":    version.Branch,
+			"is_binary": true,
+		},
+		r,
+	)
+
+	NotifyProjectMembers(
+		upload.ProjectID,
+		user.ID,
+		"file_updated",
+		user.USERNAME+" committed "+upload.FilePath,
+		map[string]interface{}{
+			"project_id": upload.ProjectID,
+			"file_path":  upload.FilePath,
+			"version":    version.Version,
+			"branch":     version.Branch,
+			"is_binary":  true,
+			"user_email": user.EMAIL,
+		},
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"upload_id":  upload.ID,
+		"version_id": version.ID,
+		"version":    version.Version,
+		"file_path":  version.FilePath,
+		"branch":     version.Branch,
+		"file_hash":  version.FileHash,
+		"file_size":  version.FileSize,
+		"is_binary":  true,
+		"commit_msg": req.CommitMsg,
+	})
+}
+
+// AbortUpload - Abandons an upload
+func AbortUpload(w http.ResponseWriter, r *http.Request) {
+	_, upload, ok := loadUpload(w, r, r.URL.Query().Get("upload_id"))
+	if !ok {
+		return
+	}
+
+	uploadModel := &db.UploadModel{DB: db.DB}
+	err := uploadModel.AbortUpload(upload.ID)
+	if err == db.ErrUploadNotOpen {
+		writePatchError(w, uploadNotOpen(upload))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to abort upload",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"upload_id": upload.ID,
+		"status":    db.UploadAborted,
+	})
+}
+
+// GetFileContent - Downloads the raw content of a file, at a version or as seen through a branch or tag
+func GetFileContent(w http.ResponseWriter, r *http.Request) {
+	projectID := r.URL.Query().Get("project_id")
+	filePath := r.URL.Query().Get("file_path")
+	versionParam := r.URL.Query().Get("version")
+
+	if projectID == "" || filePath == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "project_id and file_path are required",
+		})
+		return
+	}
+
+	projectUUID, err := uuid.Parse(projectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return
+	}
+
+	versionModel := &db.VersionModel{DB: db.DB}
+	var fv *db.FileVersion
+	if versionParam != "" {
+		version, err := strconv.Atoi(versionParam)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Invalid version",
+			})
+			return
+		}
+		fv, err = versionModel.GetVersion(projectUUID, filePath, version)
+	} else {
+		ref, ok := resolveRef(w, projectUUID, r.URL.Query().Get("ref"))
+		if !ok {
+			return
+		}
+		fv, err = versionModel.GetLatestVersion(projectUUID, filePath, ref)
+	}
+	if err == nil && fv.IsDeleted {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "File not found",
+		})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch file",
+		})
+		return
+	}
+
+	contentType := "text/plain; charset=utf-8"
+	if fv.IsBinary {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fv.FileName}))
+	w.Header().Set("X-File-Version", strconv.Itoa(fv.Version))
+	w.Header().Set("X-File-Hash", fv.FileHash)
+
+	if !fv.IsBinary {
+		w.Header().Set("Content-Length", strconv.Itoa(len(fv.Content)))
+		io.WriteString(w, fv.Content)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(fv.FileSize, 10))
+	if _, err := db.Blobs.WriteTo(fv.FileHash, w); err != nil {
+		// Headers are gone; the short body tells the client the download failed
+		log.Printf("Failed to stream %s version %d: %v", fv.FilePath, fv.Version, err)
+	}
+}
+
+// GetFileSizeLimit - The largest file a project accepts
+func GetFileSizeLimit(w http.ResponseWriter, r *http.Request) {
+	projectUUID, err := uuid.Parse(r.URL.Query().Get("project_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return
+	}
+
+	projectModel := &db.ProjectModel{DB: db.DB}
+	limit, custom, err := projectModel.GetMaxFileSize(projectUUID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch file size limit",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"project_id":     projectUUID,
+		"max_file_size":  limit,
+		"is_default":     !custom,
+		"max_chunk_size": maxChunkSize,
+	})
+}
+
+// SetFileSizeLimit - Changes the largest file a project accepts
+func SetFileSizeLimit(w http.ResponseWriter, r *http.Request) {
+	var req FileSizeLimitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	projectUUID, err := uuid.Parse(req.ProjectID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid project ID",
+		})
+		return
+	}
+
+	if req.MaxFileSize != nil && *req.MaxFileSize <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "max_file_size must be positive, or null for the server default",
+		})
+		return
+	}
+
+	user, _, ok := authorizeProject(w, r, projectUUID, PermManageProject)
+	if !ok {
+		return
+	}
+
+	projectModel := &db.ProjectModel{DB: db.DB}
+	if err := projectModel.SetMaxFileSize(projectUUID, req.MaxFileSize); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to update file size limit",
+		})
+		return
+	}
+
+	limit, custom, err := projectModel.GetMaxFileSize(projectUUID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch file size limit",
+		})
+		return
+	}
+
+	LogActivity(
+		user.ID,
+		projectUUID,
+		"project_settings",
+		"Set the file size limit to "+strconv.FormatInt(limit, 10)+" bytes",
+		map[string]interface{}{
+			"max_file_size": limit,
+			"is_default":    !custom,
+		},
+		r,
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"project_id":    projectUUID,
+		"max_file_size": limit,
+		"is_default":    !custom,
+	})
+}
+
+// StartUploadCleanup - Periodically removes upload sessions that went quiet
+func StartUploadCleanup(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		uploadModel := &db.UploadModel{DB: db.DB}
+		for range ticker.C {
+			removed, err := uploadModel.DeleteExpiredUploads(time.Now())
+			if err != nil {
+				log.Printf("Upload cleanup failed: %v", err)
+				continue
+			}
+			if removed > 0 {
+				log.Printf("Upload cleanup removed %d uploads", removed)
+			}
+		}
+	}()
+}
@@ -2,28 +2,36 @@ package services
 
 import (
 	"app/urtc/db"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"path"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type FileVersion struct {
-	ID        uuid.UUID `json:"id"`
-	ProjectID uuid.UUID `json:"project_id"`
-	UserID    uuid.UUID `json:"user_id"`
-	FilePath  string    `json:"file_path"`
-	FileName  string    `json:"file_name"`
-	FileType  string    `json:"file_type"`
-	Version   int       `json:"version"`
-	FileHash  string    `json:"file_hash"`
-	FileSize  int64     `json:"file_size"`
-	Content   string    `json:"content,omitempty"` // Base64 or text content
-	CommitMsg string    `json:"commit_message"`
-	IsDeleted bool      `json:"is_deleted"`
-	CreatedAt time.Time `json:"created_at"`
-	Username  string    `json:"username,omitempty"`
+	ID          uuid.UUID  `json:"id"`
+	ProjectID   uuid.UUID  `json:"project_id"`
+	UserID      uuid.UUID  `json:"user_id"`
+	FilePath    string     `json:"file_path"`
+	FileName    string     `json:"file_name"`
+	FileType    string     `json:"file_type"`
+	Version     int        `json:"version"`
+	FileHash    string     `json:"file_hash"`
+	FileSize    int64      `json:"file_size"`
+	Content     string     `json:"content,omitempty"` // Base64 or text content
+	CommitMsg   string     `json:"commit_message"`
+	IsDeleted   bool       `json:"is_deleted"`
+	IsBinary    bool       `json:"is_binary"` // content is left out; download it from /version/content
+	ChangesetID *uuid.UUID `json:"changeset_id,omitempty"`
+	Branch      string     `json:"branch"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Username    string     `json:"username,omitempty"`
 }
 
 type VersionHistoryRequest struct {
@@ -33,31 +41,38 @@ type VersionHistoryRequest struct {
 }
 
 type FileConflict struct {
-	ID            uuid.UUID `json:"id"`
-	ProjectID     uuid.UUID `json:"project_id"`
-	FilePath      string    `json:"file_path"`
-	BaseVersion   int       `json:"base_version"`
-	LocalUserID   uuid.UUID `json:"local_user_id"`
-	RemoteUserID  uuid.UUID `json:"remote_user_id"`
-	LocalContent  string    `json:"local_content"`
-	RemoteContent string    `json:"remote_content"`
-	Status        string    `json:"status"` // "pending", "resolved", "ignored"
-	ResolvedBy    uuid.UUID `json:"resolved_by,omitempty"`
-	CreatedAt     time.Time `json:"created_at"`
-	ResolvedAt    time.Time `json:"resolved_at,omitempty"`
+	ID                uuid.UUID       `json:"id"`
+	ProjectID         uuid.UUID       `json:"project_id"`
+	FilePath          string          `json:"file_path"`
+	Branch            string          `json:"branch"`
+	BaseVersion       int             `json:"base_version"`
+	LatestVersion     int             `json:"latest_version,omitempty"`
+	LocalUserID       uuid.UUID       `json:"local_user_id"`
+	RemoteUserID      uuid.UUID       `json:"remote_user_id"`
+	LocalContent      string          `json:"local_content"`
+	RemoteContent     string          `json:"remote_content"`
+	BaseContent       string          `json:"base_content"`
+	MergedContent     string          `json:"merged_content"`
+	Hunks             json.RawMessage `json:"hunks"`
+	Status            string          `json:"status"` // "pending", "resolved", "ignored"
+	ResolvedBy        uuid.UUID       `json:"resolved_by,omitempty"`
+	ResolvedVersionID *uuid.UUID      `json:"resolved_version_id,omitempty"`
+	CreatedAt         time.Time       `json:"created_at"`
+	ResolvedAt        time.Time       `json:"resolved_at,omitempty"`
 }
 
 type CommitRequest struct {
-	ProjectID   string `json:"project_id"`
-	UserEmail   string `json:"user_email"`
-	FilePath    string `json:"file_path"`
-	FileName    string `json:"file_name"`
-	FileType    string `json:"file_type"`
-	Content     string `json:"content"`
-	FileHash    string `json:"file_hash"`
-	FileSize    int64  `json:"file_size"`
-	CommitMsg   string `json:"commit_message"`
-	BaseVersion int    `json:"base_version,omitempty"`
+	ProjectID   string          `json:"project_id"`
+	FilePath    string          `json:"file_path"`
+	FileName    string          `json:"file_name"`
+	FileType    string          `json:"file_type"`
+	Content     string          `json:"content"`
+	FileHash    string          `json:"file_hash"` // optional; checked against the server's own hash
+	CommitMsg   string          `json:"commit_message"`
+	BaseVersion int             `json:"base_version,omitempty"`
+	PatchType   string          `json:"patch_type,omitempty"` // "json_patch" or "text_diff"; sent instead of content
+	Patch       json.RawMessage `json:"patch,omitempty"`
+	Branch      string          `json:"branch,omitempty"` // the default branch if empty
 }
 
 // CommitFileVersion - Creates a new version of a file
@@ -72,7 +87,7 @@ func CommitFileVersion(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate required fields
-	if req.ProjectID == "" || req.UserEmail == "" || req.FilePath == "" || req.Content == "" {
+	if req.ProjectID == "" || req.FilePath == "" || (req.Content == "" && len(req.Patch) == 0) {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
 			"error": "Missing required fields",
@@ -89,50 +104,75 @@ func CommitFileVersion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get user
-	userModel := &db.UserModel{DB: db.DB}
-	user, err := userModel.GetUserByEmail(req.UserEmail)
+	user, _, ok := authorizeProject(w, r, projectUUID, PermCommit)
+	if !ok {
+		return
+	}
+
+	ref, ok := resolveBranch(w, projectUUID, req.Branch)
+	if !ok {
+		return
+	}
+
+	// A delta is rebuilt into the full file against the version it was made from
+	if len(req.Patch) > 0 {
+		content, base, perr := resolvePatch(projectUUID, ref, req.FilePath, req.BaseVersion, req.PatchType, req.Patch, req.FileHash)
+		if perr != nil {
+			writePatchError(w, perr)
+			return
+		}
+
+		req.Content = content
+		if req.FileName == "" {
+			req.FileName = base.FileName
+		}
+		if req.FileType == "" {
+			req.FileType = base.FileType
+		}
+	}
+
+	if perr := checkContentHash(req.Content, req.FileHash); perr != nil {
+		writePatchError(w, perr)
+		return
+	}
+
+	limit, perr := fileSizeLimit(projectUUID)
+	if perr == nil {
+		perr = checkFileSize(int64(len(req.Content)), limit)
+	}
+	if perr != nil {
+		writePatchError(w, perr)
+		return
+	}
+
+	base, err := loadBaseVersion(projectUUID, req.FilePath, req.BaseVersion)
+	var result *textCommit
+	if err == nil {
+		result, err = commitText(projectUUID, user.ID, ref, base, req.FilePath, req.FileName, req.FileType, req.FileHash, req.Content, req.CommitMsg)
+	}
+	if errors.As(err, &perr) {
+		writePatchError(w, perr)
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
+		log.Printf("Failed to commit %s: %v", req.FilePath, err)
+		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "User not found",
+			"error": "Failed to create version",
 		})
 		return
 	}
 
-	// Check for conflicts
-	versionModel := &db.VersionModel{DB: db.DB}
-	latestVersion, err := versionModel.GetLatestVersion(projectUUID, req.FilePath)
-
-	hasConflict := false
-	if err == nil && req.BaseVersion > 0 && latestVersion.Version > req.BaseVersion {
-		// Conflict detected - someone else committed while user was editing
-		hasConflict = true
-
-		// Create conflict record
-		conflictModel := &db.ConflictModel{DB: db.DB}
-		conflict, _ := conflictModel.CreateConflict(
-			projectUUID,
-			req.FilePath,
-			req.BaseVersion,
-			user.ID,
-			latestVersion.UserID,
-			req.Content,
-			latestVersion.Content,
-		)
-
-		// Notify remote user about conflict
-		SendNotificationToUser(
-			latestVersion.UserID.String(),
-			"file_conflict",
-			"File conflict detected",
-			map[string]interface{}{
-				"conflict_id": conflict.ID,
-				"project_id":  req.ProjectID,
-				"file_path":   req.FilePath,
-				"user_email":  req.UserEmail,
-			},
-		)
+	if result.Version == nil {
+		// The edits overlap - record the conflict for someone to resolve
+		conflict, err := recordConflict(projectUUID, ref.Branch, req.FilePath, user.ID, user.EMAIL, req.Content, result)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Failed to record conflict",
+			})
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusConflict)
@@ -142,30 +182,13 @@ func CommitFileVersion(w http.ResponseWriter, r *http.Request) {
 			"conflict_id":    conflict.ID,
 			"message":        "Conflict detected. Please resolve before committing.",
 			"base_version":   req.BaseVersion,
-			"latest_version": latestVersion.Version,
-		})
-		return
-	}
-
-	// Create new version
-	version, err := versionModel.CreateVersion(
-		projectUUID,
-		user.ID,
-		req.FilePath,
-		req.FileName,
-		req.FileType,
-		req.FileHash,
-		req.FileSize,
-		req.Content,
-		req.CommitMsg,
-	)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to create version: " + err.Error(),
+			"latest_version": result.Latest.Version,
+			"merged_content": result.Merged,
+			"hunks":          result.Hunks,
 		})
 		return
 	}
+	version := result.Version
 
 	// Log activity
 	LogActivity(
@@ -176,46 +199,213 @@ func CommitFileVersion(w http.ResponseWriter, r *http.Request) {
 		map[string]interface{}{
 			"file_path": req.FilePath,
 			"version":   version.Version,
-			"file_hash": req.FileHash,
+			"file_hash": version.FileHash,
+			"branch":    ref.Branch,
 		},
 		r,
 	)
 
-	// Notify collaborators
-	collabModel := &db.CollaboratorModel{DB: db.DB}
-	collaborators, _ := collabModel.GetProjectCollaborators(projectUUID)
-
-	for _, collab := range collaborators {
-		if collab.Status == "approved" && collab.UserID != user.ID {
-			SendNotificationToUser(
-				collab.UserID.String(),
-				"file_updated",
-				user.USERNAME+" committed "+req.FilePath,
-				map[string]interface{}{
-					"project_id": req.ProjectID,
-					"file_path":  req.FilePath,
-					"version":    version.Version,
-					"user_email": req.UserEmail,
-				},
-			)
-		}
-	}
+	// Notify the owner and collaborators
+	NotifyProjectMembers(
+		projectUUID,
+		user.ID,
+		"file_updated",
+		user.USERNAME+" committed "+req.FilePath,
+		map[string]interface{}{
+			"project_id": req.ProjectID,
+			"file_path":  req.FilePath,
+			"version":    version.Version,
+			"branch":     ref.Branch,
+			"user_email": user.EMAIL,
+		},
+	)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	response := map[string]interface{}{
 		"success":      true,
 		"version_id":   version.ID,
 		"version":      version.Version,
 		"file_path":    req.FilePath,
+		"branch":       ref.Branch,
+		"file_hash":    version.FileHash,
+		"file_size":    version.FileSize,
 		"commit_msg":   req.CommitMsg,
-		"has_conflict": hasConflict,
-	})
+		"has_conflict": false,
+	}
+	if result.MergedWith > 0 {
+		// The client's copy is stale; hand back what was actually stored
+		response["merged"] = true
+		response["merged_with_version"] = result.MergedWith
+		response["content"] = result.Content
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// commitAttempts - How often a text commit is merged again when other commits keep landing first
+const commitAttempts = 3
+
+// textCommit - Outcome of commitText: the new version, or the conflict that kept it from being committed
+type textCommit struct {
+	Version    *db.FileVersion
+	Content    string // what was committed; the merge result if the base was stale
+	MergedWith int    // latest version the edits were merged with, 0 if none
+
+	// Set instead of Version when the edits overlap with what was committed since the base
+	Base   *db.FileVersion
+	Latest *db.FileVersion
+	Merged string
+	Hunks  []MergeHunk
+}
+
+// mergeEdits - Three-way merge of text edited from base with the latest version of the file,
+// which may be a deletion
+func mergeEdits(base, latest *db.FileVersion, local string) (string, []MergeHunk) {
+	if latest.IsDeleted {
+		return mergeWithDeletion(base.Content, local)
+	}
+	return mergeText(base.Content, local, latest.Content)
 }
 
-// GetFileHistory - Retrieves version history for a file
+// loadBaseVersion - The version a client's edits started from, nil if it gave none
+func loadBaseVersion(projectID uuid.UUID, filePath string, baseVersion int) (*db.FileVersion, error) {
+	if baseVersion <= 0 {
+		return nil, nil
+	}
+
+	versionModel := &db.VersionModel{DB: db.DB}
+	base, err := versionModel.GetVersion(projectID, filePath, baseVersion)
+	if err == sql.ErrNoRows {
+		perr := newPatchError(http.StatusBadRequest, PatchErrBaseNotFound, fmt.Sprintf("%s has no version %d", filePath, baseVersion))
+		perr.Details = map[string]interface{}{"base_version": baseVersion}
+		return nil, perr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return base, nil
+}
+
+// commitText - Commits text edited from base, or over the latest version when base is nil.
+// CommitChange checks the base under the file's lock; if another commit got there first, the edits
+// are merged with it and committed again. Overlapping edits are not committed: the result then
+// describes the conflict instead. Client mistakes come back as a *PatchError.
+func commitText(projectID, userID uuid.UUID, ref *db.Ref, base *db.FileVersion, filePath, fileName, fileType, fileHash, content, commitMsg string) (*textCommit, error) {
+	versionModel := &db.VersionModel{DB: db.DB}
+
+	for attempt := 0; attempt < commitAttempts; attempt++ {
+		latest, err := versionModel.GetHeadVersion(projectID, filePath, ref)
+		if err == sql.ErrNoRows {
+			latest = nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		result := &textCommit{Content: content}
+		file := db.ChangesetFile{
+			Action:   db.ChangeAdd,
+			FilePath: filePath,
+			FileName: fileName,
+			FileType: fileType,
+			FileHash: fileHash,
+			Content:  content,
+		}
+
+		switch {
+		case latest == nil:
+			// First version of the file on this branch
+		case base == nil || base.Version >= latest.Version:
+			// Nothing new since the base
+			if !latest.IsDeleted {
+				file.Action, file.BaseVersion = db.ChangeEdit, latest.Version
+			}
+		case latest.IsBinary || base.IsBinary:
+			// A binary version has no text to merge with
+			perr := newPatchError(http.StatusConflict, PatchErrStaleBase, filePath+" changed since base_version; binary files can't be merged")
+			perr.Details = map[string]interface{}{
+				"base_version":   base.Version,
+				"latest_version": latest.Version,
+				"latest_hash":    latest.FileHash,
+			}
+			return nil, perr
+		default:
+			// Someone else committed while the user was editing: merge both edits against
+			// the version the user started from
+			merged, hunks := mergeEdits(base, latest, content)
+			if len(hunks) > 0 {
+				return &textCommit{Base: base, Latest: latest, Merged: merged, Hunks: hunks}, nil
+			}
+			file.Action, file.BaseVersion = db.ChangeEdit, latest.Version
+			file.Content, file.FileHash = merged, ""
+			result.Content, result.MergedWith = merged, latest.Version
+		}
+
+		version, err := versionModel.CommitChange(projectID, userID, ref, file, commitMsg)
+		var fileErr *db.ChangesetFileError
+		if errors.As(err, &fileErr) {
+			// Another commit landed in between; merge with that one instead
+			continue
+		}
+		if err == db.ErrHashMismatch {
+			return nil, newPatchError(http.StatusUnprocessableEntity, PatchErrHashMismatch, "Content does not match file_hash")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		result.Version = version
+		return result, nil
+	}
+
+	return nil, newPatchError(http.StatusConflict, PatchErrStaleBase, filePath+" keeps changing; fetch the latest version and retry")
+}
+
+// recordConflict - Stores edits that overlap with changes committed since their base, and tells
+// the author of the latest version
+func recordConflict(projectID uuid.UUID, branch, filePath string, userID uuid.UUID, userEmail, local string, result *textCommit) (*db.FileConflict, error) {
+	hunksJSON, _ := json.Marshal(result.Hunks)
+	conflictModel := &db.ConflictModel{DB: db.DB}
+	conflict, err := conflictModel.CreateConflict(
+		projectID,
+		branch,
+		filePath,
+		result.Base.Version,
+		result.Latest.Version,
+		userID,
+		result.Latest.UserID,
+		local,
+		result.Latest.Content,
+		result.Base.Content,
+		result.Merged,
+		hunksJSON,
+	)
+	if err != nil {
+		log.Printf("Failed to record conflict on %s: %v", filePath, err)
+		return nil, err
+	}
+
+	SendNotificationToUser(
+		result.Latest.UserID.String(),
+		"file_conflict",
+		"File conflict detected",
+		map[string]interface{}{
+			"conflict_id":    conflict.ID,
+			"project_id":     projectID,
+			"file_path":      filePath,
+			"branch":         branch,
+			"user_email":     userEmail,
+			"conflict_count": len(result.Hunks),
+		},
+	)
+
+	return conflict, nil
+}
+
+// GetFileHistory - Retrieves version history for a file on a branch or tag
 func GetFileHistory(w http.ResponseWriter, r *http.Request) {
 	projectID := r.URL.Query().Get("project_id")
 	filePath := r.URL.Query().Get("file_path")
+	refName := r.URL.Query().Get("ref")
 
 	if projectID == "" || filePath == "" {
 		w.WriteHeader(http.StatusBadRequest)
@@ -234,8 +424,17 @@ func GetFileHistory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return
+	}
+
+	ref, ok := resolveRef(w, projectUUID, refName)
+	if !ok {
+		return
+	}
+
 	versionModel := &db.VersionModel{DB: db.DB}
-	versions, err := versionModel.GetFileHistory(projectUUID, filePath, 50)
+	versions, err := versionModel.GetFileHistory(projectUUID, filePath, ref, 50)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -249,6 +448,7 @@ func GetFileHistory(w http.ResponseWriter, r *http.Request) {
 		"success":    true,
 		"project_id": projectID,
 		"file_path":  filePath,
+		"ref":        ref.Name,
 		"versions":   versions,
 		"total":      len(versions),
 	})
@@ -275,6 +475,10 @@ func GetProjectVersions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return
+	}
+
 	versionModel := &db.VersionModel{DB: db.DB}
 	versions, err := versionModel.GetProjectVersions(projectUUID, 100)
 	if err != nil {
@@ -315,6 +519,10 @@ func GetFileConflicts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+		return
+	}
+
 	conflictModel := &db.ConflictModel{DB: db.DB}
 	conflicts, err := conflictModel.GetProjectConflicts(projectUUID, "pending")
 	if err != nil {
@@ -334,13 +542,64 @@ func GetFileConflicts(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// ResolveConflict - Mark a conflict as resolved
+// GetConflict - Get one conflict with the base, both sides and the attempted merge
+func GetConflict(w http.ResponseWriter, r *http.Request) {
+	conflictUUID, err := uuid.Parse(r.URL.Query().Get("conflict_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid conflict ID",
+		})
+		return
+	}
+
+	conflictModel := &db.ConflictModel{DB: db.DB}
+	conflict, err := conflictModel.GetConflictByID(conflictUUID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Conflict not found",
+		})
+		return
+	}
+
+	if _, _, ok := authorizeProject(w, r, conflict.ProjectID, PermViewProject); !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"conflict": FileConflict{
+			ID:                conflict.ID,
+			ProjectID:         conflict.ProjectID,
+			FilePath:          conflict.FilePath,
+			Branch:            conflict.Branch,
+			BaseVersion:       conflict.BaseVersion,
+			LatestVersion:     conflict.LatestVersion,
+			LocalUserID:       conflict.LocalUserID,
+			RemoteUserID:      conflict.RemoteUserID,
+			LocalContent:      conflict.LocalContent,
+			RemoteContent:     conflict.RemoteContent,
+			BaseContent:       conflict.BaseContent,
+			MergedContent:     conflict.MergedContent,
+			Hunks:             json.RawMessage(conflict.Hunks),
+			Status:            conflict.Status,
+			ResolvedBy:        conflict.ResolvedBy,
+			ResolvedVersionID: conflict.ResolvedVersionID,
+			CreatedAt:         conflict.CreatedAt,
+			ResolvedAt:        conflict.ResolvedAt,
+		},
+	})
+}
+
+// ResolveConflict - Commit the resolved content as a new version and close the conflict
 func ResolveConflict(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		ConflictID      string `json:"conflict_id"`
-		ResolvedByEmail string `json:"resolved_by_email"`
-		ResolvedContent string `json:"resolved_content"`
-		CommitMsg       string `json:"commit_message"`
+		ConflictID      string  `json:"conflict_id"`
+		ResolvedContent *string `json:"resolved_content"`
+		CommitMsg       string  `json:"commit_message"`
+		BaseVersion     int     `json:"base_version"` // the version resolved against; defaults to the conflict's latest_version
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -351,39 +610,227 @@ func ResolveConflict(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conflictUUID, err := uuid.Parse(req.ConflictID)
-	if err != nil {
+	if req.ResolvedContent == nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Invalid conflict ID",
+			"error": "resolved_content is required",
 		})
 		return
 	}
 
-	userModel := &db.UserModel{DB: db.DB}
-	user, err := userModel.GetUserByEmail(req.ResolvedByEmail)
+	conflict, user, ok := loadPendingConflict(w, r, req.ConflictID)
+	if !ok {
+		return
+	}
+
+	ref, ok := resolveRef(w, conflict.ProjectID, conflict.Branch)
+	if !ok {
+		return
+	}
+
+	// The new version keeps the file's name and type
+	fileName, fileType := path.Base(conflict.FilePath), ""
+	versionModel := &db.VersionModel{DB: db.DB}
+	if latest, err := versionModel.GetLatestVersion(conflict.ProjectID, conflict.FilePath, ref); err == nil {
+		fileName, fileType = latest.FileName, latest.FileType
+	}
+
+	commitMsg := req.CommitMsg
+	if commitMsg == "" {
+		commitMsg = "Resolved conflict in " + conflict.FilePath
+	}
+
+	content := *req.ResolvedContent
+	conflictModel := &db.ConflictModel{DB: db.DB}
+	version, err := conflictModel.ResolveConflict(
+		conflict.ID,
+		user.ID,
+		ref,
+		req.BaseVersion,
+		fileName,
+		fileType,
+		content,
+		commitMsg,
+	)
+	if err == db.ErrConflictNotPending {
+		writeConflictNotPending(w)
+		return
+	}
+	if fileErr, ok := err.(*db.ChangesetFileError); ok {
+		// Someone committed to the file since; the conflict stays open to be resolved again
+		perr := newPatchError(http.StatusConflict, PatchErrStaleBase, conflict.FilePath+" changed since the conflict; resolve it again against the latest version")
+		perr.Details = map[string]interface{}{
+			"base_version":   fileErr.BaseVersion,
+			"latest_version": fileErr.LatestVersion,
+			"latest_hash":    fileErr.LatestHash,
+		}
+		writePatchError(w, perr)
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to resolve conflict",
+		})
+		return
+	}
+
+	LogActivity(
+		user.ID,
+		conflict.ProjectID,
+		"conflict_resolved",
+		"Resolved conflict in "+conflict.FilePath,
+		map[string]interface{}{
+			"conflict_id": conflict.ID,
+			"file_path":   conflict.FilePath,
+			"version":     version.Version,
+			"version_id":  version.ID,
+		},
+		r,
+	)
+
+	notifyConflictParties(conflict, "conflict_resolved", user.USERNAME+" resolved the conflict in "+conflict.FilePath, map[string]interface{}{
+		"conflict_id": conflict.ID,
+		"project_id":  conflict.ProjectID,
+		"file_path":   conflict.FilePath,
+		"version":     version.Version,
+		"version_id":  version.ID,
+		"resolved_by": user.USERNAME,
+	})
+
+	// The resolution is a new version like any other commit
+	NotifyProjectMembers(
+		conflict.ProjectID,
+		user.ID,
+		"file_updated",
+		user.USERNAME+" committed "+conflict.FilePath,
+		map[string]interface{}{
+			"project_id": conflict.ProjectID,
+			"file_path":  conflict.FilePath,
+			"version":    version.Version,
+			"user_email": user.EMAIL,
+		},
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"conflict_id": conflict.ID,
+		"version_id":  version.ID,
+		"version":     version.Version,
+		"file_hash":   version.FileHash,
+		"message":     "Conflict resolved successfully",
+	})
+}
+
+// IgnoreConflict - Close a conflict without committing, keeping the latest version as it is
+func IgnoreConflict(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ConflictID string `json:"conflict_id"`
+		Reason     string `json:"reason"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "User not found",
+			"error": "Invalid request body",
 		})
 		return
 	}
 
+	conflict, user, ok := loadPendingConflict(w, r, req.ConflictID)
+	if !ok {
+		return
+	}
+
 	conflictModel := &db.ConflictModel{DB: db.DB}
-	err = conflictModel.ResolveConflict(conflictUUID, user.ID)
+	err := conflictModel.IgnoreConflict(conflict.ID, user.ID)
+	if err == db.ErrConflictNotPending {
+		writeConflictNotPending(w)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to resolve conflict",
+			"error": "Failed to ignore conflict",
 		})
 		return
 	}
 
+	LogActivity(
+		user.ID,
+		conflict.ProjectID,
+		"conflict_ignored",
+		"Ignored conflict in "+conflict.FilePath,
+		map[string]interface{}{
+			"conflict_id": conflict.ID,
+			"file_path":   conflict.FilePath,
+			"reason":      req.Reason,
+		},
+		r,
+	)
+
+	notifyConflictParties(conflict, "conflict_ignored", user.USERNAME+" ignored the conflict in "+conflict.FilePath, map[string]interface{}{
+		"conflict_id": conflict.ID,
+		"project_id":  conflict.ProjectID,
+		"file_path":   conflict.FilePath,
+		"resolved_by": user.USERNAME,
+		"reason":      req.Reason,
+	})
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":     true,
-		"conflict_id": req.ConflictID,
-		"message":     "Conflict resolved successfully",
+		"conflict_id": conflict.ID,
+		"message":     "Conflict ignored",
+	})
+}
+
+// loadPendingConflict - Looks up a conflict the caller may resolve; writes the error response otherwise
+func loadPendingConflict(w http.ResponseWriter, r *http.Request, conflictID string) (*db.FileConflict, *db.User, bool) {
+	conflictUUID, err := uuid.Parse(conflictID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid conflict ID",
+		})
+		return nil, nil, false
+	}
+
+	conflictModel := &db.ConflictModel{DB: db.DB}
+	conflict, err := conflictModel.GetConflictByID(conflictUUID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Conflict not found",
+		})
+		return nil, nil, false
+	}
+
+	user, _, ok := authorizeProject(w, r, conflict.ProjectID, PermResolveConflicts)
+	if !ok {
+		return nil, nil, false
+	}
+
+	if conflict.Status != "pending" {
+		writeConflictNotPending(w)
+		return nil, nil, false
+	}
+
+	return conflict, user, true
+}
+
+func writeConflictNotPending(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": "Conflict has already been resolved or ignored",
 	})
 }
+
+// notifyConflictParties - Tells both sides of a conflict how it was closed
+func notifyConflictParties(conflict *db.FileConflict, msgType, message string, metadata map[string]interface{}) {
+	SendNotificationToUser(conflict.LocalUserID.String(), msgType, message, metadata)
+	if conflict.RemoteUserID != conflict.LocalUserID {
+		SendNotificationToUser(conflict.RemoteUserID.String(), msgType, message, metadata)
+	}
+}
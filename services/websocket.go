@@ -1,7 +1,9 @@
 package services
 
 import (
+	"app/urtc/db"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"sync"
@@ -11,103 +13,453 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+const (
+	clientSendBuffer     = 256     // messages a connection can fall behind by before it is dropped
+	maxClientMessageSize = 1 << 20 // largest frame a client may send; the connection is closed on a larger one
+)
+
+var (
+	errClientClosed  = errors.New("connection closed")
+	errClientTooSlow = errors.New("connection is not keeping up with its messages")
+)
+
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		// TODO: Configure properly in production with allowed origins
-		return true
-	},
+	CheckOrigin:     checkWebSocketOrigin,
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 }
 
+// Client - A single WebSocket connection. A user can hold several at once,
+// e.g. an editor plugin, a web dashboard and a second machine.
+type Client struct {
+	ID            string
+	UserID        string
+	SessionID     uuid.UUID
+	ClientType    string
+	EngineVersion string
+	ConnectedAt   time.Time
+	conn          *websocket.Conn
+	writeMu       sync.Mutex
+	outbox        chan Message    // written to the connection in order by writePump
+	replayed      map[string]bool // queued message IDs sent on connect, skipped if they also arrive live
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+// ClientInfo - Public description of a connected device
+type ClientInfo struct {
+	ConnectionID  string    `json:"connection_id"`
+	UserID        string    `json:"user_id"`
+	ClientType    string    `json:"client_type"`
+	EngineVersion string    `json:"engine_version,omitempty"`
+	ConnectedAt   time.Time `json:"connected_at"`
+}
+
+func newClient(userID string, sessionID uuid.UUID, conn *websocket.Conn, clientType, engineVersion string) *Client {
+	if clientType == "" {
+		clientType = "unknown"
+	}
+	return &Client{
+		ID:            uuid.New().String(),
+		UserID:        userID,
+		SessionID:     sessionID,
+		ClientType:    clientType,
+		EngineVersion: engineVersion,
+		ConnectedAt:   time.Now(),
+		conn:          conn,
+		outbox:        make(chan Message, clientSendBuffer),
+		replayed:      make(map[string]bool),
+		done:          make(chan struct{}),
+	}
+}
+
+func (c *Client) info() ClientInfo {
+	return ClientInfo{
+		ConnectionID:  c.ID,
+		UserID:        c.UserID,
+		ClientType:    c.ClientType,
+		EngineVersion: c.EngineVersion,
+		ConnectedAt:   c.ConnectedAt,
+	}
+}
+
+// send - Queues a message for the connection's writer without blocking the caller. Fails when
+// the connection is closed or so far behind that its queue is full.
+func (c *Client) send(msg Message) error {
+	select {
+	case <-c.done:
+		return errClientClosed
+	default:
+	}
+
+	select {
+	case c.outbox <- msg:
+		return nil
+	default:
+		return errClientTooSlow
+	}
+}
+
+// writeJSON - Gorilla connections allow one concurrent writer, so every write goes through the client lock
+func (c *Client) writeJSON(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	// Set write deadline to prevent hanging
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.conn.WriteJSON(v)
+}
+
+func (c *Client) writePing() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.conn.WriteMessage(websocket.PingMessage, nil)
+}
+
+func (c *Client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// sendError - Sends an error message back to this connection only
+func (c *Client) sendError(message string) {
+	c.send(Message{
+		Type:      "error",
+		Message:   message,
+		Timestamp: getCurrentTimestamp(),
+	})
+}
+
 // WebSocket connection manager
 type ConnectionManager struct {
-	connections map[string]*websocket.Conn // userID -> connection
+	connections map[string]map[string]*Client // userID -> connectionID -> client
+	rooms       map[string]map[string]*Client // projectID -> connectionID -> client in the project session
 	mutex       sync.RWMutex
 	broadcast   chan Message
+	persist     chan Message // durable messages waiting to be stored before delivery
 }
 
 var manager = &ConnectionManager{
-	connections: make(map[string]*websocket.Conn),
+	connections: make(map[string]map[string]*Client),
+	rooms:       make(map[string]map[string]*Client),
 	broadcast:   make(chan Message, 100), // Buffered channel
+	persist:     make(chan Message, 1000),
 }
 
 // Message types
 type Message struct {
-	Type           string                 `json:"type"` // "file_share", "code_share", "ping", "notification", "collaboration_request"
-	SenderID       string                 `json:"sender_id,omitempty"`
-	SenderEmail    string                 `json:"sender_email,omitempty"`
-	RecipientID    string                 `json:"recipient_id,omitempty"`
-	RecipientEmail string                 `json:"recipient_email,omitempty"`
-	ProjectID      string                 `json:"project_id,omitempty"`
-	ProjectName    string                 `json:"project_name,omitempty"`
-	FileName       string                 `json:"file_name,omitempty"`
-	FileContent    string                 `json:"file_content,omitempty"`
-	FileType       string                 `json:"file_type,omitempty"`
-	Message        string                 `json:"message,omitempty"`
-	Timestamp      string                 `json:"timestamp"`
-	Metadata       map[string]interface{} `json:"metadata,omitempty"`
+	Type               string                 `json:"type"`                 // "file_share", "code_share", "ping", "notification", "collaboration_request"
+	MessageID          string                 `json:"message_id,omitempty"` // set on queued messages; acknowledge with {"type": "ack", "message_id": ...}
+	Replayed           bool                   `json:"replayed,omitempty"`
+	SenderID           string                 `json:"sender_id,omitempty"`
+	SenderConnectionID string                 `json:"sender_connection_id,omitempty"`
+	SenderEmail        string                 `json:"sender_email,omitempty"`
+	RecipientID        string                 `json:"recipient_id,omitempty"`
+	RecipientEmail     string                 `json:"recipient_email,omitempty"`
+	Room               string                 `json:"room,omitempty"` // project ID to fan out to every member of the room
+	ProjectID          string                 `json:"project_id,omitempty"`
+	ProjectName        string                 `json:"project_name,omitempty"`
+	FileName           string                 `json:"file_name,omitempty"`
+	FileContent        string                 `json:"file_content,omitempty"`
+	FileType           string                 `json:"file_type,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+	Document           *DocumentPayload       `json:"document,omitempty"` // live co-editing of a script
+	Timestamp          string                 `json:"timestamp"`
+	Metadata           map[string]interface{} `json:"metadata,omitempty"`
 }
 
 // Initialize broadcast handler
 func init() {
 	go manager.handleBroadcast()
+	go manager.handlePersist()
 }
 
 // Handle broadcast messages
 func (cm *ConnectionManager) handleBroadcast() {
 	for msg := range cm.broadcast {
-		cm.mutex.RLock()
-		conn, exists := cm.connections[msg.RecipientID]
-		cm.mutex.RUnlock()
-
-		if exists {
-			// Set write deadline to prevent hanging
-			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			err := conn.WriteJSON(msg)
-			if err != nil {
-				log.Printf("Error sending message to %s: %v", msg.RecipientID, err)
-				cm.removeConnection(msg.RecipientID)
+		if msg.Room != "" {
+			// Fan out to every connection in the project room except the sending one
+			for _, client := range cm.getRoomClients(msg.Room) {
+				if client.ID == msg.SenderConnectionID {
+					continue
+				}
+				roomMsg := msg
+				roomMsg.RecipientID = client.UserID
+				cm.writeTo(client, roomMsg)
 			}
-		} else {
-			log.Printf("Recipient %s not connected, message queued or dropped", msg.RecipientID)
-			// TODO: Store message in database for offline delivery
+			continue
 		}
+
+		cm.deliver(msg)
 	}
 }
 
+// Queue a message without blocking; room events can be raised from the broadcast goroutine itself
+func (cm *ConnectionManager) enqueue(msg Message) {
+	select {
+	case cm.broadcast <- msg:
+	default:
+		go func() { cm.broadcast <- msg }()
+	}
+}
+
+// Deliver a message to every device of its recipient. Durable messages are stored first so
+// they survive the recipient being offline and are replayed until acknowledged; that happens
+// on the persist goroutine so the database never holds up the broadcast loop.
+func (cm *ConnectionManager) deliver(msg Message) {
+	if isDurableMessage(msg) && msg.MessageID == "" {
+		cm.persist <- msg
+		return
+	}
+	cm.deliverToClients(msg)
+}
+
+// Store durable messages in the order they were sent, then deliver them
+func (cm *ConnectionManager) handlePersist() {
+	for msg := range cm.persist {
+		persistMessage(&msg)
+		cm.deliverToClients(msg)
+	}
+}
+
+// Queue a message on every connection of its recipient, marking queued messages delivered
+func (cm *ConnectionManager) deliverToClients(msg Message) {
+	clients := cm.getUserClients(msg.RecipientID)
+	if len(clients) == 0 {
+		if msg.MessageID != "" {
+			log.Printf("Recipient %s not connected, %s message queued for delivery", msg.RecipientID, msg.Type)
+		}
+		return
+	}
+
+	delivered := false
+	for _, client := range clients {
+		if cm.writeTo(client, msg) {
+			delivered = true
+		}
+	}
+
+	if delivered && msg.MessageID != "" {
+		markMessageDelivered(msg.MessageID)
+	}
+}
+
+// Queue a message on one connection, dropping the connection if it is closed or can't keep up
+func (cm *ConnectionManager) writeTo(client *Client, msg Message) bool {
+	if err := client.send(msg); err != nil {
+		log.Printf("Error sending message to %s (connection %s): %v", client.UserID, client.ID, err)
+		cm.removeClient(client)
+		return false
+	}
+	return true
+}
+
 // Add connection
-func (cm *ConnectionManager) addConnection(userID string, conn *websocket.Conn) {
+func (cm *ConnectionManager) addClient(client *Client) {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
 
-	// Close existing connection if any
-	if existingConn, exists := cm.connections[userID]; exists {
-		existingConn.Close()
-		log.Printf("Closed existing connection for user %s", userID)
+	clients, exists := cm.connections[client.UserID]
+	if !exists {
+		clients = make(map[string]*Client)
+		cm.connections[client.UserID] = clients
 	}
+	clients[client.ID] = client
 
-	cm.connections[userID] = conn
-	log.Printf("User %s connected. Total connections: %d", userID, len(cm.connections))
+	log.Printf("User %s connected from %s (connection %s, %d devices). Online users: %d",
+		client.UserID, client.ClientType, client.ID, len(clients), len(cm.connections))
 }
 
 // Remove connection
-func (cm *ConnectionManager) removeConnection(userID string) {
+func (cm *ConnectionManager) removeClient(client *Client) {
 	cm.mutex.Lock()
-	defer cm.mutex.Unlock()
-	if conn, exists := cm.connections[userID]; exists {
-		conn.Close()
-		delete(cm.connections, userID)
-		log.Printf("User %s disconnected. Total connections: %d", userID, len(cm.connections))
+	clients := cm.connections[client.UserID]
+	_, exists := clients[client.ID]
+	if exists {
+		delete(clients, client.ID)
+		if len(clients) == 0 {
+			delete(cm.connections, client.UserID)
+		}
+		log.Printf("User %s disconnected connection %s. Online users: %d", client.UserID, client.ID, len(cm.connections))
+	}
+	cm.mutex.Unlock()
+
+	client.close()
+
+	if exists {
+		// A closed connection leaves every project session and document it joined
+		for _, projectID := range cm.getClientRooms(client) {
+			cm.leaveRoom(projectID, client)
+		}
+		closeClientDocuments(client)
+	}
+}
+
+// Join a project room
+func (cm *ConnectionManager) joinRoom(projectID string, client *Client) {
+	cm.mutex.Lock()
+	members, exists := cm.rooms[projectID]
+	if !exists {
+		members = make(map[string]*Client)
+		cm.rooms[projectID] = members
+	}
+	_, alreadyJoined := members[client.ID]
+	members[client.ID] = client
+	cm.mutex.Unlock()
+
+	if !alreadyJoined {
+		log.Printf("User %s joined project room %s from connection %s", client.UserID, projectID, client.ID)
+		cm.enqueue(Message{
+			Type:               "member_joined",
+			SenderID:           client.UserID,
+			SenderConnectionID: client.ID,
+			Room:               projectID,
+			ProjectID:          projectID,
+			Timestamp:          getCurrentTimestamp(),
+			Metadata: map[string]interface{}{
+				"client": client.info(),
+			},
+		})
+	}
+}
+
+// Leave a project room
+func (cm *ConnectionManager) leaveRoom(projectID string, client *Client) {
+	cm.mutex.Lock()
+	members, exists := cm.rooms[projectID]
+	_, joined := members[client.ID]
+	if exists && joined {
+		delete(members, client.ID)
+		if len(members) == 0 {
+			delete(cm.rooms, projectID)
+		}
+	}
+	cm.mutex.Unlock()
+
+	if joined {
+		log.Printf("User %s left project room %s from connection %s", client.UserID, projectID, client.ID)
+		cm.enqueue(Message{
+			Type:               "member_left",
+			SenderID:           client.UserID,
+			SenderConnectionID: client.ID,
+			Room:               projectID,
+			ProjectID:          projectID,
+			Timestamp:          getCurrentTimestamp(),
+			Metadata: map[string]interface{}{
+				"client": client.info(),
+			},
+		})
+	}
+}
+
+// Check if a connection is in a project room
+func (cm *ConnectionManager) isInRoom(projectID string, client *Client) bool {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	_, joined := cm.rooms[projectID][client.ID]
+	return joined
+}
+
+// Get the connections in a project room
+func (cm *ConnectionManager) getRoomClients(projectID string) []*Client {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	clients := make([]*Client, 0, len(cm.rooms[projectID]))
+	for _, client := range cm.rooms[projectID] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Get the distinct user IDs in a project room
+func (cm *ConnectionManager) getRoomMembers(projectID string) []string {
+	seen := make(map[string]bool)
+	members := make([]string, 0)
+	for _, client := range cm.getRoomClients(projectID) {
+		if !seen[client.UserID] {
+			seen[client.UserID] = true
+			members = append(members, client.UserID)
+		}
+	}
+	return members
+}
+
+// Get the project rooms a connection has joined
+func (cm *ConnectionManager) getClientRooms(client *Client) []string {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	var projectIDs []string
+	for projectID, members := range cm.rooms {
+		if _, joined := members[client.ID]; joined {
+			projectIDs = append(projectIDs, projectID)
+		}
+	}
+	return projectIDs
+}
+
+// Get a snapshot of every project room and the connections in it
+func (cm *ConnectionManager) getRooms() map[string][]ClientInfo {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	rooms := make(map[string][]ClientInfo, len(cm.rooms))
+	for projectID, members := range cm.rooms {
+		infos := make([]ClientInfo, 0, len(members))
+		for _, client := range members {
+			infos = append(infos, client.info())
+		}
+		rooms[projectID] = infos
+	}
+	return rooms
+}
+
+// Get every connection of a user
+func (cm *ConnectionManager) getUserClients(userID string) []*Client {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	clients := make([]*Client, 0, len(cm.connections[userID]))
+	for _, client := range cm.connections[userID] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Get every connection opened with a session
+func (cm *ConnectionManager) getSessionClients(sessionID uuid.UUID) []*Client {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	var clients []*Client
+	for _, userClients := range cm.connections {
+		for _, client := range userClients {
+			if client.SessionID == sessionID {
+				clients = append(clients, client)
+			}
+		}
+	}
+	return clients
+}
+
+// Get the devices a user is connected from
+func (cm *ConnectionManager) getUserDevices(userID string) []ClientInfo {
+	clients := cm.getUserClients(userID)
+	devices := make([]ClientInfo, 0, len(clients))
+	for _, client := range clients {
+		devices = append(devices, client.info())
 	}
+	return devices
 }
 
 // Check if user is online
 func (cm *ConnectionManager) isUserOnline(userID string) bool {
 	cm.mutex.RLock()
 	defer cm.mutex.RUnlock()
-	_, exists := cm.connections[userID]
-	return exists
+	return len(cm.connections[userID]) > 0
 }
 
 // Get all online user IDs
@@ -122,17 +474,28 @@ func (cm *ConnectionManager) getOnlineUserIDs() []string {
 	return userIDs
 }
 
-// WebSocket handler - establishes connection
-func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("user_id")
-	if userID == "" {
-		http.Error(w, "user_id is required", http.StatusBadRequest)
-		return
+// Count every open connection across users
+func (cm *ConnectionManager) connectionCount() int {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	total := 0
+	for _, clients := range cm.connections {
+		total += len(clients)
 	}
+	return total
+}
 
-	// Validate UUID
-	if _, err := uuid.Parse(userID); err != nil {
-		http.Error(w, "Invalid user_id format", http.StatusBadRequest)
+// WebSocket handler - establishes connection
+func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Identity comes from the session, never from the query string
+	session, user, err := authenticateWebSocket(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid or expired session",
+		})
 		return
 	}
 
@@ -142,56 +505,126 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	manager.addConnection(userID, conn)
+	// Client metadata lets collaborators see which tools a user is connected from
+	client := newClient(
+		user.ID.String(),
+		session.ID,
+		conn,
+		r.URL.Query().Get("client_type"),
+		r.URL.Query().Get("engine_version"),
+	)
 
 	// Send connection success message
 	successMsg := Message{
 		Type:      "connection_success",
 		Message:   "Connected to real-time collaboration server",
 		Timestamp: getCurrentTimestamp(),
+		Metadata: map[string]interface{}{
+			"connection_id": client.ID,
+		},
 	}
-	conn.WriteJSON(successMsg)
+	client.writeJSON(successMsg)
+
+	// Replay anything queued while the user was offline or not yet acknowledged before live
+	// messages: once before the connection is registered, then again for anything stored in
+	// between. Live messages wait in the outbox until the writer starts below.
+	replayQueuedMessages(client)
+	manager.addClient(client)
+	replayQueuedMessages(client)
 
 	// Configure ping/pong for connection health
+	conn.SetReadLimit(maxClientMessageSize)
 	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	conn.SetPongHandler(func(string) error {
 		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 		return nil
 	})
 
-	// Start ping ticker
-	go sendPing(userID, conn)
+	// Start the writer and drop the connection if the session ends
+	go writePump(client)
+	go watchSession(client)
 
 	// Listen for incoming messages
-	handleClientMessages(userID, conn)
+	handleClientMessages(client)
 }
 
-// Send periodic ping to keep connection alive
-func sendPing(userID string, conn *websocket.Conn) {
+// writePump - The connection's writer once the replay is done: sends queued messages in order
+// and pings periodically to keep the connection alive
+func writePump(client *Client) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		if !manager.isUserOnline(userID) {
+	for {
+		select {
+		case <-client.done:
 			return
+		case msg := <-client.outbox:
+			if msg.MessageID != "" && client.replayed[msg.MessageID] {
+				continue
+			}
+			if err := client.writeJSON(msg); err != nil {
+				log.Printf("Error sending message to %s (connection %s): %v", client.UserID, client.ID, err)
+				manager.removeClient(client)
+				return
+			}
+		case <-ticker.C:
+			if err := client.writePing(); err != nil {
+				log.Printf("Ping error for user %s (connection %s): %v", client.UserID, client.ID, err)
+				manager.removeClient(client)
+				return
+			}
 		}
+	}
+}
 
-		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-			log.Printf("Ping error for user %s: %v", userID, err)
-			manager.removeConnection(userID)
-			return
+// checkShare - Why a share sent over the WebSocket is refused, or "" if it may go out. As with
+// shares over HTTP, a share in a project needs the share permission and a recipient who can view
+// the project; without one, the two users must share a project.
+func checkShare(senderID string, msg Message) string {
+	sender, err := uuid.Parse(senderID)
+	if err != nil {
+		return "Invalid sender"
+	}
+	recipient, err := uuid.Parse(msg.RecipientID)
+	if err != nil {
+		return "Invalid recipient_id"
+	}
+
+	collabModel := &db.CollaboratorModel{DB: db.DB}
+	if msg.ProjectID == "" {
+		shared, err := collabModel.SharesProject(sender, recipient)
+		if err != nil {
+			log.Printf("Failed to check shared projects of %s and %s: %v", sender, recipient, err)
+			return "Failed to check the recipient"
+		}
+		if !shared {
+			return "You can only share with users you collaborate with"
 		}
+		return ""
+	}
+
+	projectID, err := uuid.Parse(msg.ProjectID)
+	if err != nil {
+		return "Invalid project ID"
+	}
+	if _, err := Authorize(sender, projectID, PermShareFiles); err != nil {
+		return "You don't have permission to share files in this project"
 	}
+	recipientRole, err := collabModel.GetUserRole(recipient, projectID)
+	if err != nil || !RoleAllows(recipientRole, PermViewProject) {
+		return "Recipient is not an approved collaborator"
+	}
+	return ""
 }
 
 // Handle incoming messages from client
-func handleClientMessages(userID string, conn *websocket.Conn) {
-	defer manager.removeConnection(userID)
+func handleClientMessages(client *Client) {
+	defer manager.removeClient(client)
 
+	userID := client.UserID
 	for {
 		var msg Message
-		err := conn.ReadJSON(&msg)
+		err := client.conn.ReadJSON(&msg)
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error for user %s: %v", userID, err)
@@ -201,6 +634,7 @@ func handleClientMessages(userID string, conn *websocket.Conn) {
 
 		// Set sender ID and timestamp
 		msg.SenderID = userID
+		msg.SenderConnectionID = client.ID
 		msg.Timestamp = getCurrentTimestamp()
 
 		// Validate message
@@ -216,6 +650,10 @@ func handleClientMessages(userID string, conn *websocket.Conn) {
 				log.Printf("Invalid %s message: missing recipient_id", msg.Type)
 				continue
 			}
+			if reason := checkShare(userID, msg); reason != "" {
+				client.sendError(reason)
+				continue
+			}
 			// Broadcast to recipient
 			manager.broadcast <- msg
 
@@ -226,20 +664,86 @@ func handleClientMessages(userID string, conn *websocket.Conn) {
 				Message:   "Server alive",
 				Timestamp: getCurrentTimestamp(),
 			}
-			conn.WriteJSON(pong)
+			client.send(pong)
 
 		case "typing":
-			// Forward typing indicator to recipient
+			// Forward typing indicator to recipient, or to the project room
 			if msg.RecipientID != "" {
 				manager.broadcast <- msg
+			} else if msg.ProjectID != "" && manager.isInRoom(msg.ProjectID, client) {
+				msg.Room = msg.ProjectID
+				manager.broadcast <- msg
 			}
 
+		case "ack":
+			// Delivery acknowledgement for a queued message
+			acknowledgeMessage(client, msg.MessageID)
+
+		case "join_project":
+			handleJoinProject(client, msg.ProjectID)
+
+		case "leave_project":
+			manager.leaveRoom(msg.ProjectID, client)
+			client.send(Message{
+				Type:      "left_project",
+				ProjectID: msg.ProjectID,
+				Timestamp: getCurrentTimestamp(),
+			})
+
+		case "project_message":
+			// Fan out to everyone in the project session
+			if !manager.isInRoom(msg.ProjectID, client) {
+				client.sendError("Join the project before sending project messages")
+				continue
+			}
+			msg.Room = msg.ProjectID
+			msg.RecipientID = ""
+			manager.broadcast <- msg
+
+		case "doc_open":
+			handleOpenDocument(client, msg.ProjectID, msg.Document)
+
+		case "doc_op":
+			handleDocumentOperation(client, msg.ProjectID, msg.Document)
+
+		case "doc_close":
+			handleCloseDocument(client, msg.ProjectID, msg.Document)
+
 		default:
 			log.Printf("Unknown message type from user %s: %s", userID, msg.Type)
 		}
 	}
 }
 
+// Join a project room after checking the user is the owner or an approved collaborator
+func handleJoinProject(client *Client, projectID string) {
+	projectUUID, err := uuid.Parse(projectID)
+	if err != nil {
+		client.sendError("Invalid project_id")
+		return
+	}
+	userUUID, err := uuid.Parse(client.UserID)
+	if err != nil {
+		client.sendError("Invalid user")
+		return
+	}
+
+	if _, err := Authorize(userUUID, projectUUID, PermViewProject); err != nil {
+		client.sendError("Not an approved collaborator on this project")
+		return
+	}
+
+	manager.joinRoom(projectID, client)
+	client.send(Message{
+		Type:      "joined_project",
+		ProjectID: projectID,
+		Timestamp: getCurrentTimestamp(),
+		Metadata: map[string]interface{}{
+			"members": manager.getRoomMembers(projectID),
+		},
+	})
+}
+
 // Send notification to user (can be called from other services)
 func SendNotificationToUser(recipientID, notificationType, message string, metadata map[string]interface{}) {
 	msg := Message{
@@ -266,36 +770,148 @@ func BroadcastToUsers(userIDs []string, msgType, message string, metadata map[st
 	}
 }
 
+// Broadcast message to every user in a project room
+func BroadcastToProject(projectID, senderID, msgType, message string, metadata map[string]interface{}) {
+	manager.broadcast <- Message{
+		Type:      msgType,
+		SenderID:  senderID,
+		Room:      projectID,
+		ProjectID: projectID,
+		Message:   message,
+		Timestamp: getCurrentTimestamp(),
+		Metadata:  metadata,
+	}
+}
+
+// Notify the owner and every approved collaborator of a project, except one user
+func NotifyProjectMembers(projectID, excludeUserID uuid.UUID, msgType, message string, metadata map[string]interface{}) {
+	collabModel := &db.CollaboratorModel{DB: db.DB}
+	memberIDs, err := collabModel.GetProjectMemberIDs(projectID)
+	if err != nil {
+		log.Printf("Failed to load members of project %s: %v", projectID, err)
+		return
+	}
+
+	for _, memberID := range memberIDs {
+		if memberID == excludeUserID {
+			continue
+		}
+		SendNotificationToUser(memberID.String(), msgType, message, metadata)
+	}
+}
+
 // Get online users
 func GetOnlineUsers(w http.ResponseWriter, r *http.Request) {
 	userIDs := manager.getOnlineUserIDs()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":      true,
-		"online_users": userIDs,
-		"total_online": len(userIDs),
+		"success":           true,
+		"online_users":      userIDs,
+		"total_online":      len(userIDs),
+		"total_connections": manager.connectionCount(),
+	})
+}
+
+// Get project rooms - lists who is in each project session the caller can view
+func GetProjectRooms(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	filter := r.URL.Query().Get("project_id")
+	if filter != "" {
+		projectUUID, err := uuid.Parse(filter)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Invalid project ID",
+			})
+			return
+		}
+		if _, _, ok := authorizeProject(w, r, projectUUID, PermViewProject); !ok {
+			return
+		}
+	}
+
+	rooms := make([]map[string]interface{}, 0)
+	for projectID, connections := range manager.getRooms() {
+		if filter != "" && projectID != filter {
+			continue
+		}
+		projectUUID, err := uuid.Parse(projectID)
+		if err != nil {
+			continue
+		}
+		if _, err := Authorize(user.ID, projectUUID, PermViewProject); err != nil {
+			continue
+		}
+		members := manager.getRoomMembers(projectID)
+		rooms = append(rooms, map[string]interface{}{
+			"project_id":   projectID,
+			"members":      members,
+			"connections":  connections,
+			"total_online": len(members),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"rooms":       rooms,
+		"total_rooms": len(rooms),
 	})
 }
 
-// Check user online status
+// Check user online status - devices are only listed for the caller and users who share a project with them
 func CheckUserOnlineStatus(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("user_id")
-	if userID == "" {
+	caller, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	userUUID, err := uuid.Parse(r.URL.Query().Get("user_id"))
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "user_id is required",
+			"error": "A valid user_id is required",
 		})
 		return
 	}
 
-	isOnline := manager.isUserOnline(userID)
+	// Which devices someone uses is only shown to themselves and the people they work with
+	shared := userUUID == caller.ID
+	if !shared {
+		collabModel := &db.CollaboratorModel{DB: db.DB}
+		shared, err = collabModel.SharesProject(caller.ID, userUUID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Failed to check project membership",
+			})
+			return
+		}
+	}
 
+	userID := userUUID.String()
 	w.Header().Set("Content-Type", "application/json")
+	if !shared {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":   true,
+			"user_id":   userID,
+			"is_online": manager.isUserOnline(userID),
+		})
+		return
+	}
+
+	devices := manager.getUserDevices(userID)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":   true,
-		"user_id":   userID,
-		"is_online": isOnline,
+		"success":      true,
+		"user_id":      userID,
+		"is_online":    len(devices) > 0,
+		"devices":      devices,
+		"device_count": len(devices),
 	})
 }
 
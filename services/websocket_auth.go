@@ -0,0 +1,220 @@
+package services
+
+import (
+	"app/urtc/db"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	wsTicketTTL            = 30 * time.Second
+	wsSessionCheckInterval = 2 * time.Minute
+)
+
+var errWebSocketUnauthenticated = errors.New("session token or ticket required")
+
+// wsTicket - A single-use credential for clients that cannot set headers on the
+// WebSocket handshake (browsers). Tickets live in memory for a few seconds.
+type wsTicket struct {
+	session   *db.Session
+	user      *db.User
+	expiresAt time.Time
+}
+
+type ticketStore struct {
+	tickets map[string]wsTicket // hashed ticket -> ticket
+	mutex   sync.Mutex
+}
+
+var wsTickets = &ticketStore{
+	tickets: make(map[string]wsTicket),
+}
+
+func (ts *ticketStore) issue(session *db.Session, user *db.User) (string, time.Time, error) {
+	raw, err := generateToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := time.Now().Add(wsTicketTTL)
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	// Drop expired tickets while we hold the lock
+	for key, ticket := range ts.tickets {
+		if time.Now().After(ticket.expiresAt) {
+			delete(ts.tickets, key)
+		}
+	}
+	ts.tickets[hashToken(raw)] = wsTicket{session: session, user: user, expiresAt: expiresAt}
+
+	return raw, expiresAt, nil
+}
+
+// redeem - Consumes a ticket; each ticket opens at most one connection
+func (ts *ticketStore) redeem(raw string) (wsTicket, bool) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	key := hashToken(raw)
+	ticket, exists := ts.tickets[key]
+	if !exists {
+		return wsTicket{}, false
+	}
+	delete(ts.tickets, key)
+
+	if time.Now().After(ticket.expiresAt) {
+		return wsTicket{}, false
+	}
+	return ticket, true
+}
+
+// authenticateWebSocket - Resolves the handshake credentials: an "Authorization: Bearer <session>"
+// header for native clients, or a "ticket" query parameter obtained from /ws/ticket
+func authenticateWebSocket(r *http.Request) (*db.Session, *db.User, error) {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		parts := strings.Split(authHeader, " ")
+		if len(parts) != 2 || parts[0] != "Bearer" || parts[1] == "" {
+			return nil, nil, errWebSocketUnauthenticated
+		}
+		return ResolveSession(parts[1])
+	}
+
+	if raw := r.URL.Query().Get("ticket"); raw != "" {
+		ticket, ok := wsTickets.redeem(raw)
+		if !ok {
+			return nil, nil, errWebSocketUnauthenticated
+		}
+
+		// The session may have been revoked since the ticket was issued
+		sessionModel := &db.SessionModel{DB: db.DB}
+		active, err := sessionModel.IsSessionActive(ticket.session.ID)
+		if err != nil || !active {
+			return nil, nil, errWebSocketUnauthenticated
+		}
+		return ticket.session, ticket.user, nil
+	}
+
+	return nil, nil, errWebSocketUnauthenticated
+}
+
+// allowedWebSocketOrigins - Origin allowlist from WS_ALLOWED_ORIGINS, falling back to ALLOWED_ORIGINS
+func allowedWebSocketOrigins() []string {
+	raw := os.Getenv("WS_ALLOWED_ORIGINS")
+	if raw == "" {
+		raw = os.Getenv("ALLOWED_ORIGINS")
+	}
+
+	var origins []string
+	for _, origin := range strings.Split(raw, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// checkWebSocketOrigin - Native clients such as engine plugins send no Origin header and are
+// authenticated by token alone. Browser origins must be on the allowlist; without one, only
+// same-origin pages may connect.
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	allowed := allowedWebSocketOrigins()
+	if len(allowed) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+
+	for _, candidate := range allowed {
+		if candidate == "*" || strings.EqualFold(candidate, strings.TrimRight(origin, "/")) {
+			return true
+		}
+	}
+
+	log.Printf("Rejected WebSocket connection from origin %s", origin)
+	return false
+}
+
+// watchSession - Closes the connection once its session expires or is revoked
+func watchSession(client *Client) {
+	ticker := time.NewTicker(wsSessionCheckInterval)
+	defer ticker.Stop()
+
+	sessionModel := &db.SessionModel{DB: db.DB}
+	for {
+		select {
+		case <-client.done:
+			return
+		case <-ticker.C:
+			active, err := sessionModel.IsSessionActive(client.SessionID)
+			if err != nil {
+				log.Printf("Session check failed for connection %s: %v", client.ID, err)
+				continue
+			}
+			if !active {
+				closeRevokedClient(client)
+				return
+			}
+		}
+	}
+}
+
+// closeRevokedClient - Tells the client why and drops the connection
+func closeRevokedClient(client *Client) {
+	log.Printf("Closing connection %s of user %s: session no longer valid", client.ID, client.UserID)
+	client.writeJSON(Message{
+		Type:      "session_revoked",
+		Message:   "Your session has ended. Please sign in again.",
+		Timestamp: getCurrentTimestamp(),
+	})
+	manager.removeClient(client)
+}
+
+// DisconnectSession - Closes every connection opened with a session (called on logout)
+func DisconnectSession(sessionID uuid.UUID) {
+	for _, client := range manager.getSessionClients(sessionID) {
+		closeRevokedClient(client)
+	}
+}
+
+// IssueWebSocketTicket - Exchanges the session for a short-lived, single-use WebSocket ticket
+func IssueWebSocketTicket(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	session, _ := CurrentSession(r)
+
+	ticket, expiresAt, err := wsTickets.issue(session, user)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to issue WebSocket ticket",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"ticket":     ticket,
+		"expires_at": expiresAt,
+		"expires_in": int(wsTicketTTL.Seconds()),
+	})
+}